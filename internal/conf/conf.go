@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"os"
 	"reflect"
 	"strings"
@@ -169,6 +170,7 @@ func loadFromFile(fpath string, conf *Conf) (bool, error) {
 type Conf struct {
 	// general
 	LogLevel                  LogLevel        `json:"logLevel"`
+	LogFormat                 LogFormat       `json:"logFormat"`
 	LogDestinations           LogDestinations `json:"logDestinations"`
 	LogFile                   string          `json:"logFile"`
 	ReadTimeout               StringDuration  `json:"readTimeout"`
@@ -183,6 +185,7 @@ type Conf struct {
 	PPROFAddress              string          `json:"pprofAddress"`
 	RunOnConnect              string          `json:"runOnConnect"`
 	RunOnConnectRestart       bool            `json:"runOnConnectRestart"`
+	RunOnConnectCleanEnv      bool            `json:"runOnConnectCleanEnv"`
 
 	// RTSP
 	RTSPDisable       bool        `json:"rtspDisable"`
@@ -200,8 +203,33 @@ type Conf struct {
 	AuthMethods       AuthMethods `json:"authMethods"`
 
 	// RTMP
-	RTMPDisable bool   `json:"rtmpDisable"`
-	RTMPAddress string `json:"rtmpAddress"`
+	RTMPDisable                 bool           `json:"rtmpDisable"`
+	RTMPAddress                 string         `json:"rtmpAddress"`
+	RTMPServerKey               string         `json:"rtmpServerKey"`
+	RTMPServerCert              string         `json:"rtmpServerCert"`
+	RTMPPingPeriod              StringDuration `json:"rtmpPingPeriod"`
+	RTMPDrainTimeout            StringDuration `json:"rtmpDrainTimeout"`
+	RTMPAuthMaxBackoff          StringDuration `json:"rtmpAuthMaxBackoff"`
+	RTMPAuthBackoffWindow       StringDuration `json:"rtmpAuthBackoffWindow"`
+	RTMPAuthTrustedIPs          IPsOrNets      `json:"rtmpAuthTrustedIPs"`
+	RTMPRedirectURL             string         `json:"rtmpRedirectURL"`
+	RTMPTCPKeepAlivePeriod      StringDuration `json:"rtmpTCPKeepAlivePeriod"`
+	RTMPTCPDisableNoDelay       bool           `json:"rtmpTCPDisableNoDelay"`
+	RTMPTCPReceiveBufferSize    StringSize     `json:"rtmpTCPReceiveBufferSize"`
+	RTMPTCPSendBufferSize       StringSize     `json:"rtmpTCPSendBufferSize"`
+	RTMPSlowReaderTimeout       StringDuration `json:"rtmpSlowReaderTimeout"`
+	RTMPStalledPublisherTimeout StringDuration `json:"rtmpStalledPublisherTimeout"`
+	RTMPMinWriteTimeout         StringDuration `json:"rtmpMinWriteTimeout"`
+	RTMPMaxReaderWriteTimeout   StringDuration `json:"rtmpMaxReaderWriteTimeout"`
+	RTMPMaxPacketSize           StringSize     `json:"rtmpMaxPacketSize"`
+	RTMPMaxConns                int            `json:"rtmpMaxConns"`
+	RTMPHandshakeTimeout        StringDuration `json:"rtmpHandshakeTimeout"`
+	RTMPReplyBandwidthCheck     bool           `json:"rtmpReplyBandwidthCheck"`
+	RTMPRequireStreamKey        bool           `json:"rtmpRequireStreamKey"`
+	RTMPRequireAdobeAuth        bool           `json:"rtmpRequireAdobeAuth"`
+	RTMPStateWebhookURL         string         `json:"rtmpStateWebhookURL"`
+	RTMPVariants                RTMPVariants   `json:"rtmpVariants"`
+	RTMPSelfTestPath            string         `json:"rtmpSelfTestPath"`
 
 	// HLS
 	HLSDisable         bool           `json:"hlsDisable"`
@@ -345,6 +373,104 @@ func (conf *Conf) CheckAndFillMissing() error {
 		conf.RTMPAddress = ":1935"
 	}
 
+	if (conf.RTMPServerKey != "" && conf.RTMPServerCert == "") ||
+		(conf.RTMPServerKey == "" && conf.RTMPServerCert != "") {
+		return fmt.Errorf("RTMP server key and certificate must be both filled")
+	}
+
+	if conf.RTMPPingPeriod < 0 {
+		return fmt.Errorf("'rtmpPingPeriod' can't be negative")
+	}
+
+	if conf.RTMPDrainTimeout < 0 {
+		return fmt.Errorf("'rtmpDrainTimeout' can't be negative")
+	}
+
+	if conf.RTMPAuthMaxBackoff < 0 {
+		return fmt.Errorf("'rtmpAuthMaxBackoff' can't be negative")
+	}
+
+	if conf.RTMPAuthBackoffWindow == 0 {
+		conf.RTMPAuthBackoffWindow = 10 * StringDuration(time.Minute)
+	}
+
+	if conf.RTMPTCPKeepAlivePeriod < 0 {
+		return fmt.Errorf("'rtmpTCPKeepAlivePeriod' can't be negative")
+	}
+
+	if conf.RTMPTCPReceiveBufferSize > math.MaxInt32 {
+		return fmt.Errorf("'rtmpTCPReceiveBufferSize' is too big")
+	}
+
+	if conf.RTMPTCPSendBufferSize > math.MaxInt32 {
+		return fmt.Errorf("'rtmpTCPSendBufferSize' is too big")
+	}
+
+	if conf.RTMPSlowReaderTimeout < 0 {
+		return fmt.Errorf("'rtmpSlowReaderTimeout' can't be negative")
+	}
+
+	if conf.RTMPStalledPublisherTimeout < 0 {
+		return fmt.Errorf("'rtmpStalledPublisherTimeout' can't be negative")
+	}
+
+	if conf.RTMPMinWriteTimeout < 0 {
+		return fmt.Errorf("'rtmpMinWriteTimeout' can't be negative")
+	}
+
+	if conf.RTMPMinWriteTimeout > conf.WriteTimeout {
+		return fmt.Errorf("'rtmpMinWriteTimeout' can't be greater than 'writeTimeout'")
+	}
+
+	if conf.RTMPMaxReaderWriteTimeout < 0 {
+		return fmt.Errorf("'rtmpMaxReaderWriteTimeout' can't be negative")
+	}
+
+	if conf.RTMPMaxReaderWriteTimeout != 0 && conf.RTMPMaxReaderWriteTimeout < conf.WriteTimeout {
+		return fmt.Errorf("'rtmpMaxReaderWriteTimeout' can't be lower than 'writeTimeout'")
+	}
+
+	if conf.RTMPMaxPacketSize == 0 {
+		conf.RTMPMaxPacketSize = 4 * 1024 * 1024
+	}
+	// bigger messages are refused by the RTMP library.
+	if conf.RTMPMaxPacketSize > 4*1024*1024 {
+		return fmt.Errorf("'rtmpMaxPacketSize' can't be greater than 4M")
+	}
+
+	if conf.RTMPMaxConns < 0 {
+		return fmt.Errorf("'rtmpMaxConns' can't be negative")
+	}
+
+	if conf.RTMPHandshakeTimeout < 0 {
+		return fmt.Errorf("'rtmpHandshakeTimeout' can't be negative")
+	}
+
+	if conf.RTMPHandshakeTimeout == 0 {
+		conf.RTMPHandshakeTimeout = 5 * StringDuration(time.Second)
+	}
+
+	if conf.RTMPRedirectURL != "" {
+		if !strings.HasPrefix(conf.RTMPRedirectURL, "http://") &&
+			!strings.HasPrefix(conf.RTMPRedirectURL, "https://") {
+			return fmt.Errorf("'rtmpRedirectURL' must be a HTTP URL")
+		}
+	}
+
+	if conf.RTMPStateWebhookURL != "" {
+		if !strings.HasPrefix(conf.RTMPStateWebhookURL, "http://") &&
+			!strings.HasPrefix(conf.RTMPStateWebhookURL, "https://") {
+			return fmt.Errorf("'rtmpStateWebhookURL' must be a HTTP URL")
+		}
+	}
+
+	if conf.RTMPSelfTestPath != "" {
+		err := IsValidPathName(conf.RTMPSelfTestPath)
+		if err != nil {
+			return fmt.Errorf("invalid 'rtmpSelfTestPath': %s", err)
+		}
+	}
+
 	if conf.HLSAddress == "" {
 		conf.HLSAddress = ":8888"
 	}
@@ -52,6 +52,12 @@ func TestConfFromFile(t *testing.T) {
 			Source:                     "publisher",
 			SourceOnDemandStartTimeout: 10 * StringDuration(time.Second),
 			SourceOnDemandCloseAfter:   10 * StringDuration(time.Second),
+			RTMPAACFormat:              "raw",
+			RTMPReadBufferPolicy:       "drop-oldest",
+			RTMPReadBufferBlockTimeout: StringDuration(time.Second),
+			MinFramerateGracePeriod:    10 * StringDuration(time.Second),
+			RTMPDiscontinuityThreshold: 10 * StringDuration(time.Second),
+			RTMPOnDemandKeepalive:      2 * StringDuration(time.Second),
 			RunOnDemandStartTimeout:    5 * StringDuration(time.Second),
 			RunOnDemandCloseAfter:      10 * StringDuration(time.Second),
 		}, pa)
@@ -110,6 +116,12 @@ func TestConfFromFileAndEnv(t *testing.T) {
 		Source:                     "rtsp://testing",
 		SourceOnDemandStartTimeout: 10 * StringDuration(time.Second),
 		SourceOnDemandCloseAfter:   10 * StringDuration(time.Second),
+		RTMPAACFormat:              "raw",
+		RTMPReadBufferPolicy:       "drop-oldest",
+		RTMPReadBufferBlockTimeout: StringDuration(time.Second),
+		MinFramerateGracePeriod:    10 * StringDuration(time.Second),
+		RTMPDiscontinuityThreshold: 10 * StringDuration(time.Second),
+		RTMPOnDemandKeepalive:      2 * StringDuration(time.Second),
 		RunOnDemandStartTimeout:    10 * StringDuration(time.Second),
 		RunOnDemandCloseAfter:      10 * StringDuration(time.Second),
 	}, pa)
@@ -129,6 +141,12 @@ func TestConfFromEnvOnly(t *testing.T) {
 		Source:                     "rtsp://testing",
 		SourceOnDemandStartTimeout: 10 * StringDuration(time.Second),
 		SourceOnDemandCloseAfter:   10 * StringDuration(time.Second),
+		RTMPAACFormat:              "raw",
+		RTMPReadBufferPolicy:       "drop-oldest",
+		RTMPReadBufferBlockTimeout: StringDuration(time.Second),
+		MinFramerateGracePeriod:    10 * StringDuration(time.Second),
+		RTMPDiscontinuityThreshold: 10 * StringDuration(time.Second),
+		RTMPOnDemandKeepalive:      2 * StringDuration(time.Second),
 		RunOnDemandStartTimeout:    10 * StringDuration(time.Second),
 		RunOnDemandCloseAfter:      10 * StringDuration(time.Second),
 	}, pa)
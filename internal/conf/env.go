@@ -52,6 +52,16 @@ func loadEnvInternal(env map[string]string, prefix string, rv reflect.Value) err
 		}
 		return nil
 
+	case reflect.TypeOf(float64(0)):
+		if ev, ok := env[prefix]; ok {
+			fv, err := strconv.ParseFloat(ev, 64)
+			if err != nil {
+				return fmt.Errorf("%s: %s", prefix, err)
+			}
+			rv.SetFloat(fv)
+		}
+		return nil
+
 	case reflect.TypeOf(bool(false)):
 		if ev, ok := env[prefix]; ok {
 			switch strings.ToLower(ev) {
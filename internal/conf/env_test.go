@@ -19,6 +19,9 @@ type testStruct struct {
 	// int
 	MyInt int
 
+	// float
+	MyFloat float64
+
 	// bool
 	MyBool bool
 
@@ -36,6 +39,9 @@ func TestEnvironment(t *testing.T) {
 	os.Setenv("MYPREFIX_MYINT", "123")
 	defer os.Unsetenv("MYPREFIX_MYINT")
 
+	os.Setenv("MYPREFIX_MYFLOAT", "0.5")
+	defer os.Unsetenv("MYPREFIX_MYFLOAT")
+
 	os.Setenv("MYPREFIX_MYBOOL", "yes")
 	defer os.Unsetenv("MYPREFIX_MYBOOL")
 
@@ -54,6 +60,7 @@ func TestEnvironment(t *testing.T) {
 
 	require.Equal(t, "testcontent", s.MyString)
 	require.Equal(t, 123, s.MyInt)
+	require.Equal(t, 0.5, s.MyFloat)
 	require.Equal(t, true, s.MyBool)
 	require.Equal(t, 22*StringDuration(time.Second), s.MyDuration)
 
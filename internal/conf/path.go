@@ -39,24 +39,51 @@ type PathConf struct {
 	Regexp *regexp.Regexp `json:"-"`
 
 	// source
-	Source                     string         `json:"source"`
-	SourceProtocol             SourceProtocol `json:"sourceProtocol"`
-	SourceAnyPortEnable        bool           `json:"sourceAnyPortEnable"`
-	SourceFingerprint          string         `json:"sourceFingerprint"`
-	SourceOnDemand             bool           `json:"sourceOnDemand"`
-	SourceOnDemandStartTimeout StringDuration `json:"sourceOnDemandStartTimeout"`
-	SourceOnDemandCloseAfter   StringDuration `json:"sourceOnDemandCloseAfter"`
-	SourceRedirect             string         `json:"sourceRedirect"`
-	DisablePublisherOverride   bool           `json:"disablePublisherOverride"`
-	Fallback                   string         `json:"fallback"`
+	Source                        string         `json:"source"`
+	SourceProtocol                SourceProtocol `json:"sourceProtocol"`
+	SourceAnyPortEnable           bool           `json:"sourceAnyPortEnable"`
+	SourceFingerprint             string         `json:"sourceFingerprint"`
+	SourceOnDemand                bool           `json:"sourceOnDemand"`
+	SourceOnDemandStartTimeout    StringDuration `json:"sourceOnDemandStartTimeout"`
+	SourceOnDemandCloseAfter      StringDuration `json:"sourceOnDemandCloseAfter"`
+	SourceRedirect                string         `json:"sourceRedirect"`
+	DisablePublisherOverride      bool           `json:"disablePublisherOverride"`
+	PublisherReconnectGracePeriod StringDuration `json:"publisherReconnectGracePeriod"`
+	Fallback                      string         `json:"fallback"`
 
 	// authentication
-	PublishUser Credential `json:"publishUser"`
-	PublishPass Credential `json:"publishPass"`
-	PublishIPs  IPsOrNets  `json:"publishIPs"`
-	ReadUser    Credential `json:"readUser"`
-	ReadPass    Credential `json:"readPass"`
-	ReadIPs     IPsOrNets  `json:"readIPs"`
+	PublishUser               Credential `json:"publishUser"`
+	PublishPass               Credential `json:"publishPass"`
+	PublishIPs                IPsOrNets  `json:"publishIPs"`
+	PublishRevalidateOnReload bool       `json:"publishRevalidateOnReload"`
+	ReadUser                  Credential `json:"readUser"`
+	ReadPass                  Credential `json:"readPass"`
+	ReadIPs                   IPsOrNets  `json:"readIPs"`
+
+	// readers
+	MaxReaders                 int            `json:"maxReaders"`
+	ReadBufferCount            int            `json:"readBufferCount"`
+	RTMPReadBufferPolicy       string         `json:"rtmpReadBufferPolicy"`
+	RTMPReadBufferBlockTimeout StringDuration `json:"rtmpReadBufferBlockTimeout"`
+	RTMPDTSPassthrough         bool           `json:"rtmpDTSPassthrough"`
+	RTMPClampCTime             bool           `json:"rtmpClampCTime"`
+	RTMPAACSamplesPerFrame     int            `json:"rtmpAACSamplesPerFrame"`
+	RTMPAACFormat              string         `json:"rtmpAACFormat"`
+	RTMPRejectNonBaseline      bool           `json:"rtmpRejectNonBaseline"`
+	RTMPMaxReadBitrate         int            `json:"rtmpMaxReadBitrate"`
+	RTMPMaxPublishBitrate      int            `json:"rtmpMaxPublishBitrate"`
+	MinFramerate               float64        `json:"minFramerate"`
+	MinFramerateGracePeriod    StringDuration `json:"minFramerateGracePeriod"`
+	MaxWidth                   int            `json:"maxWidth"`
+	MaxHeight                  int            `json:"maxHeight"`
+	RTMPAbsoluteTimestamps     bool           `json:"rtmpAbsoluteTimestamps"`
+	RTMPEarlyAudioBufferSize   int            `json:"rtmpEarlyAudioBufferSize"`
+	RTMPDiscontinuityThreshold StringDuration `json:"rtmpDiscontinuityThreshold"`
+	RTMPAudioJitterBuffer      StringDuration `json:"rtmpAudioJitterBuffer"`
+	MaxLatency                 StringDuration `json:"maxLatency"`
+	GOPCacheSize               int            `json:"gopCacheSize"`
+	RTMPRequestKeyFrame        bool           `json:"rtmpRequestKeyFrame"`
+	RTMPOnDemandKeepalive      StringDuration `json:"rtmpOnDemandKeepalive"`
 
 	// external commands
 	RunOnInit               string         `json:"runOnInit"`
@@ -69,6 +96,7 @@ type PathConf struct {
 	RunOnReadyRestart       bool           `json:"runOnReadyRestart"`
 	RunOnRead               string         `json:"runOnRead"`
 	RunOnReadRestart        bool           `json:"runOnReadRestart"`
+	RunOnReadCleanEnv       bool           `json:"runOnReadCleanEnv"`
 }
 
 func (pconf *PathConf) checkAndFillMissing(conf *Conf, name string) error {
@@ -233,6 +261,116 @@ func (pconf *PathConf) checkAndFillMissing(conf *Conf, name string) error {
 		return fmt.Errorf("'readIPs' can't be used with 'externalAuthenticationURL'")
 	}
 
+	if pconf.MaxReaders < 0 {
+		return fmt.Errorf("'maxReaders' can't be negative")
+	}
+
+	if pconf.ReadBufferCount < 0 {
+		return fmt.Errorf("'readBufferCount' can't be negative")
+	}
+
+	switch pconf.RTMPReadBufferPolicy {
+	case "":
+		pconf.RTMPReadBufferPolicy = "drop-oldest"
+
+	case "drop-oldest", "block":
+
+	default:
+		return fmt.Errorf("invalid 'rtmpReadBufferPolicy': '%s'", pconf.RTMPReadBufferPolicy)
+	}
+
+	// readers that don't catch up must be closed at some point, since their
+	// buffer can't grow indefinitely.
+	if pconf.RTMPReadBufferBlockTimeout < 0 {
+		return fmt.Errorf("'rtmpReadBufferBlockTimeout' can't be negative")
+	}
+	if pconf.RTMPReadBufferBlockTimeout == 0 {
+		pconf.RTMPReadBufferBlockTimeout = StringDuration(time.Second)
+	}
+
+	if pconf.RTMPAACSamplesPerFrame < 0 {
+		return fmt.Errorf("'rtmpAACSamplesPerFrame' can't be negative")
+	}
+
+	switch pconf.RTMPAACFormat {
+	case "":
+		pconf.RTMPAACFormat = "raw"
+
+	case "raw", "adts":
+
+	default:
+		return fmt.Errorf("invalid 'rtmpAACFormat': '%s'", pconf.RTMPAACFormat)
+	}
+
+	if pconf.RTMPMaxReadBitrate < 0 {
+		return fmt.Errorf("'rtmpMaxReadBitrate' can't be negative")
+	}
+
+	if pconf.RTMPMaxPublishBitrate < 0 {
+		return fmt.Errorf("'rtmpMaxPublishBitrate' can't be negative")
+	}
+
+	if pconf.MinFramerate < 0 {
+		return fmt.Errorf("'minFramerate' can't be negative")
+	}
+
+	if pconf.MinFramerateGracePeriod < 0 {
+		return fmt.Errorf("'minFramerateGracePeriod' can't be negative")
+	}
+
+	if pconf.MinFramerateGracePeriod == 0 {
+		pconf.MinFramerateGracePeriod = 10 * StringDuration(time.Second)
+	}
+
+	if pconf.MaxWidth < 0 {
+		return fmt.Errorf("'maxWidth' can't be negative")
+	}
+
+	if pconf.MaxHeight < 0 {
+		return fmt.Errorf("'maxHeight' can't be negative")
+	}
+
+	if pconf.RTMPOnDemandKeepalive < 0 {
+		return fmt.Errorf("'rtmpOnDemandKeepalive' can't be negative")
+	}
+	if pconf.RTMPOnDemandKeepalive == 0 {
+		pconf.RTMPOnDemandKeepalive = 2 * StringDuration(time.Second)
+	}
+
+	if pconf.RTMPEarlyAudioBufferSize < 0 {
+		return fmt.Errorf("'rtmpEarlyAudioBufferSize' can't be negative")
+	}
+
+	if pconf.RTMPDiscontinuityThreshold < 0 {
+		return fmt.Errorf("'rtmpDiscontinuityThreshold' can't be negative")
+	}
+
+	if pconf.RTMPDiscontinuityThreshold == 0 {
+		pconf.RTMPDiscontinuityThreshold = 10 * StringDuration(time.Second)
+	}
+
+	if pconf.RTMPAudioJitterBuffer < 0 {
+		return fmt.Errorf("'rtmpAudioJitterBuffer' can't be negative")
+	}
+
+	if pconf.MaxLatency < 0 {
+		return fmt.Errorf("'maxLatency' can't be negative")
+	}
+
+	if pconf.GOPCacheSize < 0 {
+		return fmt.Errorf("'gopCacheSize' can't be negative")
+	}
+
+	// otherwise the cached IDR is dropped from the read buffer
+	// before the reader starts.
+	readBufferCount := conf.ReadBufferCount
+	if pconf.ReadBufferCount != 0 {
+		readBufferCount = pconf.ReadBufferCount
+	}
+	if pconf.GOPCacheSize != 0 && pconf.GOPCacheSize >= readBufferCount {
+		return fmt.Errorf("'gopCacheSize' must be lower than 'readBufferCount'")
+	}
+
 	if pconf.RunOnInit != "" && pconf.Regexp != nil {
 		return fmt.Errorf("a path with a regular expression does not support option 'runOnInit'; use another path")
 	}
@@ -258,3 +396,20 @@ func (pconf *PathConf) Equal(other *PathConf) bool {
 	b, _ := json.Marshal(other)
 	return string(a) == string(b)
 }
+
+// EqualExceptAuthentication checks whether two PathConfs are equal,
+// ignoring the authentication parameters.
+func (pconf *PathConf) EqualExceptAuthentication(other *PathConf) bool {
+	withoutAuth := func(pconf PathConf) *PathConf {
+		pconf.PublishUser = ""
+		pconf.PublishPass = ""
+		pconf.PublishIPs = nil
+		pconf.PublishRevalidateOnReload = false
+		pconf.ReadUser = ""
+		pconf.ReadPass = ""
+		pconf.ReadIPs = nil
+		return &pconf
+	}
+
+	return withoutAuth(*pconf).Equal(withoutAuth(*other))
+}
@@ -0,0 +1,76 @@
+package conf
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// RTMPVariants is the rtmpVariants parameter.
+// It maps a name requested by RTMP readers and the value of the quality
+// query parameter to the path that is actually read.
+type RTMPVariants map[string]map[string]string
+
+// UnmarshalJSON unmarshals a RTMPVariants from JSON.
+func (d *RTMPVariants) UnmarshalJSON(b []byte) error {
+	var in map[string]map[string]string
+	if err := json.Unmarshal(b, &in); err != nil {
+		return err
+	}
+
+	for name, variants := range in {
+		if err := IsValidPathName(name); err != nil {
+			return fmt.Errorf("invalid variant name: %s (%s)", err, name)
+		}
+
+		if len(variants) == 0 {
+			return fmt.Errorf("variant '%s' doesn't contain any quality", name)
+		}
+
+		for quality, pathName := range variants {
+			if quality == "" {
+				return fmt.Errorf("variant '%s' contains an empty quality", name)
+			}
+
+			if err := IsValidPathName(pathName); err != nil {
+				return fmt.Errorf("invalid path of quality '%s' of variant '%s': %s", quality, name, err)
+			}
+		}
+	}
+
+	*d = in
+
+	return nil
+}
+
+// the environment variable is in the format
+// name:quality=path,quality=path;name:quality=path
+func (d *RTMPVariants) unmarshalEnv(s string) error {
+	if s == "" {
+		*d = nil
+		return nil
+	}
+
+	in := make(map[string]map[string]string)
+
+	for _, entry := range strings.Split(s, ";") {
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid variant: '%s'", entry)
+		}
+
+		variants := make(map[string]string)
+		for _, kv := range strings.Split(parts[1], ",") {
+			kvParts := strings.SplitN(kv, "=", 2)
+			if len(kvParts) != 2 {
+				return fmt.Errorf("invalid quality: '%s'", kv)
+			}
+			variants[kvParts[0]] = kvParts[1]
+		}
+
+		in[parts[0]] = variants
+	}
+
+	byts, _ := json.Marshal(in)
+	return d.UnmarshalJSON(byts)
+}
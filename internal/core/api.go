@@ -45,6 +45,7 @@ func loadConfData(ctx *gin.Context) (interface{}, error) {
 	var in struct {
 		// general
 		LogLevel                  *conf.LogLevel        `json:"logLevel"`
+		LogFormat                 *conf.LogFormat       `json:"logFormat"`
 		LogDestinations           *conf.LogDestinations `json:"logDestinations"`
 		LogFile                   *string               `json:"logFile"`
 		ReadTimeout               *conf.StringDuration  `json:"readTimeout"`
@@ -59,6 +60,7 @@ func loadConfData(ctx *gin.Context) (interface{}, error) {
 		PPROFAddress              *string               `json:"pprofAddress"`
 		RunOnConnect              *string               `json:"runOnConnect"`
 		RunOnConnectRestart       *bool                 `json:"runOnConnectRestart"`
+		RunOnConnectCleanEnv      *bool                 `json:"runOnConnectCleanEnv"`
 
 		// RTSP
 		RTSPDisable       *bool             `json:"rtspDisable"`
@@ -76,8 +78,33 @@ func loadConfData(ctx *gin.Context) (interface{}, error) {
 		AuthMethods       *conf.AuthMethods `json:"authMethods"`
 
 		// RTMP
-		RTMPDisable *bool   `json:"rtmpDisable"`
-		RTMPAddress *string `json:"rtmpAddress"`
+		RTMPDisable                 *bool                `json:"rtmpDisable"`
+		RTMPAddress                 *string              `json:"rtmpAddress"`
+		RTMPServerKey               *string              `json:"rtmpServerKey"`
+		RTMPServerCert              *string              `json:"rtmpServerCert"`
+		RTMPPingPeriod              *conf.StringDuration `json:"rtmpPingPeriod"`
+		RTMPDrainTimeout            *conf.StringDuration `json:"rtmpDrainTimeout"`
+		RTMPAuthMaxBackoff          *conf.StringDuration `json:"rtmpAuthMaxBackoff"`
+		RTMPAuthBackoffWindow       *conf.StringDuration `json:"rtmpAuthBackoffWindow"`
+		RTMPAuthTrustedIPs          *conf.IPsOrNets      `json:"rtmpAuthTrustedIPs"`
+		RTMPRedirectURL             *string              `json:"rtmpRedirectURL"`
+		RTMPTCPKeepAlivePeriod      *conf.StringDuration `json:"rtmpTCPKeepAlivePeriod"`
+		RTMPTCPDisableNoDelay       *bool                `json:"rtmpTCPDisableNoDelay"`
+		RTMPTCPReceiveBufferSize    *conf.StringSize     `json:"rtmpTCPReceiveBufferSize"`
+		RTMPTCPSendBufferSize       *conf.StringSize     `json:"rtmpTCPSendBufferSize"`
+		RTMPSlowReaderTimeout       *conf.StringDuration `json:"rtmpSlowReaderTimeout"`
+		RTMPStalledPublisherTimeout *conf.StringDuration `json:"rtmpStalledPublisherTimeout"`
+		RTMPMinWriteTimeout         *conf.StringDuration `json:"rtmpMinWriteTimeout"`
+		RTMPMaxReaderWriteTimeout   *conf.StringDuration `json:"rtmpMaxReaderWriteTimeout"`
+		RTMPMaxPacketSize           *conf.StringSize     `json:"rtmpMaxPacketSize"`
+		RTMPMaxConns                *int                 `json:"rtmpMaxConns"`
+		RTMPHandshakeTimeout        *conf.StringDuration `json:"rtmpHandshakeTimeout"`
+		RTMPReplyBandwidthCheck     *bool                `json:"rtmpReplyBandwidthCheck"`
+		RTMPRequireStreamKey        *bool                `json:"rtmpRequireStreamKey"`
+		RTMPRequireAdobeAuth        *bool                `json:"rtmpRequireAdobeAuth"`
+		RTMPStateWebhookURL         *string              `json:"rtmpStateWebhookURL"`
+		RTMPVariants                *conf.RTMPVariants   `json:"rtmpVariants"`
+		RTMPSelfTestPath            *string              `json:"rtmpSelfTestPath"`
 
 		// HLS
 		HLSDisable         *bool                `json:"hlsDisable"`
@@ -99,24 +126,51 @@ func loadConfData(ctx *gin.Context) (interface{}, error) {
 func loadConfPathData(ctx *gin.Context) (interface{}, error) {
 	var in struct {
 		// source
-		Source                     *string              `json:"source"`
-		SourceProtocol             *conf.SourceProtocol `json:"sourceProtocol"`
-		SourceAnyPortEnable        *bool                `json:"sourceAnyPortEnable"`
-		SourceFingerprint          *string              `json:"sourceFingerprint"`
-		SourceOnDemand             *bool                `json:"sourceOnDemand"`
-		SourceOnDemandStartTimeout *conf.StringDuration `json:"sourceOnDemandStartTimeout"`
-		SourceOnDemandCloseAfter   *conf.StringDuration `json:"sourceOnDemandCloseAfter"`
-		SourceRedirect             *string              `json:"sourceRedirect"`
-		DisablePublisherOverride   *bool                `json:"disablePublisherOverride"`
-		Fallback                   *string              `json:"fallback"`
+		Source                        *string              `json:"source"`
+		SourceProtocol                *conf.SourceProtocol `json:"sourceProtocol"`
+		SourceAnyPortEnable           *bool                `json:"sourceAnyPortEnable"`
+		SourceFingerprint             *string              `json:"sourceFingerprint"`
+		SourceOnDemand                *bool                `json:"sourceOnDemand"`
+		SourceOnDemandStartTimeout    *conf.StringDuration `json:"sourceOnDemandStartTimeout"`
+		SourceOnDemandCloseAfter      *conf.StringDuration `json:"sourceOnDemandCloseAfter"`
+		SourceRedirect                *string              `json:"sourceRedirect"`
+		DisablePublisherOverride      *bool                `json:"disablePublisherOverride"`
+		PublisherReconnectGracePeriod *conf.StringDuration `json:"publisherReconnectGracePeriod"`
+		Fallback                      *string              `json:"fallback"`
 
 		// authentication
-		PublishUser *conf.Credential `json:"publishUser"`
-		PublishPass *conf.Credential `json:"publishPass"`
-		PublishIPs  *conf.IPsOrNets  `json:"publishIPs"`
-		ReadUser    *conf.Credential `json:"readUser"`
-		ReadPass    *conf.Credential `json:"readPass"`
-		ReadIPs     *conf.IPsOrNets  `json:"readIPs"`
+		PublishUser               *conf.Credential `json:"publishUser"`
+		PublishPass               *conf.Credential `json:"publishPass"`
+		PublishIPs                *conf.IPsOrNets  `json:"publishIPs"`
+		PublishRevalidateOnReload *bool            `json:"publishRevalidateOnReload"`
+		ReadUser                  *conf.Credential `json:"readUser"`
+		ReadPass                  *conf.Credential `json:"readPass"`
+		ReadIPs                   *conf.IPsOrNets  `json:"readIPs"`
+
+		// readers
+		MaxReaders                 *int                 `json:"maxReaders"`
+		ReadBufferCount            *int                 `json:"readBufferCount"`
+		RTMPReadBufferPolicy       *string              `json:"rtmpReadBufferPolicy"`
+		RTMPReadBufferBlockTimeout *conf.StringDuration `json:"rtmpReadBufferBlockTimeout"`
+		RTMPDTSPassthrough         *bool                `json:"rtmpDTSPassthrough"`
+		RTMPClampCTime             *bool                `json:"rtmpClampCTime"`
+		RTMPAACSamplesPerFrame     *int                 `json:"rtmpAACSamplesPerFrame"`
+		RTMPAACFormat              *string              `json:"rtmpAACFormat"`
+		RTMPRejectNonBaseline      *bool                `json:"rtmpRejectNonBaseline"`
+		RTMPMaxReadBitrate         *int                 `json:"rtmpMaxReadBitrate"`
+		RTMPMaxPublishBitrate      *int                 `json:"rtmpMaxPublishBitrate"`
+		MinFramerate               *float64             `json:"minFramerate"`
+		MinFramerateGracePeriod    *conf.StringDuration `json:"minFramerateGracePeriod"`
+		MaxWidth                   *int                 `json:"maxWidth"`
+		MaxHeight                  *int                 `json:"maxHeight"`
+		RTMPAbsoluteTimestamps     *bool                `json:"rtmpAbsoluteTimestamps"`
+		RTMPEarlyAudioBufferSize   *int                 `json:"rtmpEarlyAudioBufferSize"`
+		RTMPDiscontinuityThreshold *conf.StringDuration `json:"rtmpDiscontinuityThreshold"`
+		RTMPAudioJitterBuffer      *conf.StringDuration `json:"rtmpAudioJitterBuffer"`
+		MaxLatency                 *conf.StringDuration `json:"maxLatency"`
+		GOPCacheSize               *int                 `json:"gopCacheSize"`
+		RTMPRequestKeyFrame        *bool                `json:"rtmpRequestKeyFrame"`
+		RTMPOnDemandKeepalive      *conf.StringDuration `json:"rtmpOnDemandKeepalive"`
 
 		// external commands
 		RunOnInit               *string              `json:"runOnInit"`
@@ -129,6 +183,7 @@ func loadConfPathData(ctx *gin.Context) (interface{}, error) {
 		RunOnReadyRestart       *bool                `json:"runOnReadyRestart"`
 		RunOnRead               *string              `json:"runOnRead"`
 		RunOnReadRestart        *bool                `json:"runOnReadRestart"`
+		RunOnReadCleanEnv       *bool                `json:"runOnReadCleanEnv"`
 	}
 	err := json.NewDecoder(ctx.Request.Body).Decode(&in)
 	if err != nil {
@@ -150,6 +205,7 @@ type apiRTSPServer interface {
 type apiRTMPServer interface {
 	onAPIConnsList(req rtmpServerAPIConnsListReq) rtmpServerAPIConnsListRes
 	onAPIConnsKick(req rtmpServerAPIConnsKickReq) rtmpServerAPIConnsKickRes
+	onAPISelfTest() rtmpServerAPISelfTestRes
 }
 
 type apiHLSServer interface {
@@ -224,6 +280,7 @@ func newAPI(
 	if !interfaceIsEmpty(a.rtmpServer) {
 		group.GET("/v1/rtmpconns/list", a.onRTMPConnsList)
 		group.POST("/v1/rtmpconns/kick/:id", a.onRTMPConnsKick)
+		group.POST("/v1/rtmpconns/selftest", a.onRTMPConnsSelfTest)
 	}
 
 	if !interfaceIsEmpty(a.hlsServer) {
@@ -501,6 +558,16 @@ func (a *api) onRTMPConnsKick(ctx *gin.Context) {
 	ctx.Status(http.StatusOK)
 }
 
+func (a *api) onRTMPConnsSelfTest(ctx *gin.Context) {
+	res := a.rtmpServer.onAPISelfTest()
+	if res.err != nil {
+		ctx.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, res.data)
+}
+
 func (a *api) onHLSMuxersList(ctx *gin.Context) {
 	res := a.hlsServer.onAPIHLSMuxersList(hlsServerAPIMuxersListReq{})
 	if res.err != nil {
@@ -117,6 +117,11 @@ func (p *Core) Log(level logger.Level, format string, args ...interface{}) {
 	p.logger.Log(level, format, args...)
 }
 
+// LogFields is the main logging function, with additional fields.
+func (p *Core) LogFields(level logger.Level, fields logger.Fields, format string, args ...interface{}) {
+	p.logger.LogFields(level, fields, format, args...)
+}
+
 func (p *Core) run() {
 	defer close(p.done)
 
@@ -177,6 +182,7 @@ func (p *Core) createResources(initial bool) error {
 	if p.logger == nil {
 		p.logger, err = logger.New(
 			logger.Level(p.conf.LogLevel),
+			logger.Format(p.conf.LogFormat),
 			p.conf.LogDestinations,
 			p.conf.LogFile)
 		if err != nil {
@@ -224,6 +230,7 @@ func (p *Core) createResources(initial bool) error {
 			p.conf.ReadTimeout,
 			p.conf.WriteTimeout,
 			p.conf.ReadBufferCount,
+			p.conf.RTMPMaxPacketSize,
 			p.conf.Paths,
 			p.externalCmdPool,
 			p.metrics,
@@ -258,6 +265,7 @@ func (p *Core) createResources(initial bool) error {
 				p.conf.Protocols,
 				p.conf.RunOnConnect,
 				p.conf.RunOnConnectRestart,
+				p.conf.RunOnConnectCleanEnv,
 				p.externalCmdPool,
 				p.metrics,
 				p.pathManager,
@@ -294,6 +302,7 @@ func (p *Core) createResources(initial bool) error {
 				p.conf.Protocols,
 				p.conf.RunOnConnect,
 				p.conf.RunOnConnectRestart,
+				p.conf.RunOnConnectCleanEnv,
 				p.externalCmdPool,
 				p.metrics,
 				p.pathManager,
@@ -308,14 +317,45 @@ func (p *Core) createResources(initial bool) error {
 		if p.rtmpServer == nil {
 			p.rtmpServer, err = newRTMPServer(
 				p.ctx,
-				p.conf.ExternalAuthenticationURL,
-				p.conf.RTMPAddress,
-				p.conf.ReadTimeout,
-				p.conf.WriteTimeout,
-				p.conf.ReadBufferCount,
-				p.conf.RTSPAddress,
-				p.conf.RunOnConnect,
-				p.conf.RunOnConnectRestart,
+				rtmpServerConf{
+					rtmpConnConf: rtmpConnConf{
+						externalAuthenticationURL: p.conf.ExternalAuthenticationURL,
+						rtspAddress:               p.conf.RTSPAddress,
+						pingPeriod:                p.conf.RTMPPingPeriod,
+						drainTimeout:              p.conf.RTMPDrainTimeout,
+						authTrustedIPs:            p.conf.RTMPAuthTrustedIPs,
+						redirectURL:               p.conf.RTMPRedirectURL,
+						tcpKeepAlivePeriod:        p.conf.RTMPTCPKeepAlivePeriod,
+						tcpDisableNoDelay:         p.conf.RTMPTCPDisableNoDelay,
+						tcpReceiveBufferSize:      p.conf.RTMPTCPReceiveBufferSize,
+						tcpSendBufferSize:         p.conf.RTMPTCPSendBufferSize,
+						slowReaderTimeout:         p.conf.RTMPSlowReaderTimeout,
+						stalledPublisherTimeout:   p.conf.RTMPStalledPublisherTimeout,
+						minWriteTimeout:           p.conf.RTMPMinWriteTimeout,
+						maxReaderWriteTimeout:     p.conf.RTMPMaxReaderWriteTimeout,
+						maxPacketSize:             p.conf.RTMPMaxPacketSize,
+						handshakeTimeout:          p.conf.RTMPHandshakeTimeout,
+						replyBandwidthCheck:       p.conf.RTMPReplyBandwidthCheck,
+						requireStreamKey:          p.conf.RTMPRequireStreamKey,
+						adobeAuthRequired:         p.conf.RTMPRequireAdobeAuth,
+						variants:                  p.conf.RTMPVariants,
+						logLevel:                  p.conf.LogLevel,
+						readTimeout:               p.conf.ReadTimeout,
+						writeTimeout:              p.conf.WriteTimeout,
+						readBufferCount:           p.conf.ReadBufferCount,
+						runOnConnect:              p.conf.RunOnConnect,
+						runOnConnectRestart:       p.conf.RunOnConnectRestart,
+						runOnConnectCleanEnv:      p.conf.RunOnConnectCleanEnv,
+					},
+					address:           p.conf.RTMPAddress,
+					serverCert:        p.conf.RTMPServerCert,
+					serverKey:         p.conf.RTMPServerKey,
+					authMaxBackoff:    p.conf.RTMPAuthMaxBackoff,
+					authBackoffWindow: p.conf.RTMPAuthBackoffWindow,
+					maxConns:          p.conf.RTMPMaxConns,
+					stateWebhookURL:   p.conf.RTMPStateWebhookURL,
+					selfTestPath:      p.conf.RTMPSelfTestPath,
+				},
 				p.externalCmdPool,
 				p.metrics,
 				p.pathManager,
@@ -377,6 +417,7 @@ func (p *Core) createResources(initial bool) error {
 func (p *Core) closeResources(newConf *conf.Conf, calledByAPI bool) {
 	closeLogger := false
 	if newConf == nil ||
+		newConf.LogFormat != p.conf.LogFormat ||
 		!reflect.DeepEqual(newConf.LogDestinations, p.conf.LogDestinations) ||
 		newConf.LogFile != p.conf.LogFile {
 		closeLogger = true
@@ -402,6 +443,7 @@ func (p *Core) closeResources(newConf *conf.Conf, calledByAPI bool) {
 		newConf.ReadTimeout != p.conf.ReadTimeout ||
 		newConf.WriteTimeout != p.conf.WriteTimeout ||
 		newConf.ReadBufferCount != p.conf.ReadBufferCount ||
+		newConf.RTMPMaxPacketSize != p.conf.RTMPMaxPacketSize ||
 		closeMetrics {
 		closePathManager = true
 	} else if !reflect.DeepEqual(newConf.Paths, p.conf.Paths) {
@@ -428,6 +470,7 @@ func (p *Core) closeResources(newConf *conf.Conf, calledByAPI bool) {
 		!reflect.DeepEqual(newConf.Protocols, p.conf.Protocols) ||
 		newConf.RunOnConnect != p.conf.RunOnConnect ||
 		newConf.RunOnConnectRestart != p.conf.RunOnConnectRestart ||
+		newConf.RunOnConnectCleanEnv != p.conf.RunOnConnectCleanEnv ||
 		closeMetrics ||
 		closePathManager {
 		closeRTSPServer = true
@@ -449,6 +492,7 @@ func (p *Core) closeResources(newConf *conf.Conf, calledByAPI bool) {
 		!reflect.DeepEqual(newConf.Protocols, p.conf.Protocols) ||
 		newConf.RunOnConnect != p.conf.RunOnConnect ||
 		newConf.RunOnConnectRestart != p.conf.RunOnConnectRestart ||
+		newConf.RunOnConnectCleanEnv != p.conf.RunOnConnectCleanEnv ||
 		closeMetrics ||
 		closePathManager {
 		closeRTSPSServer = true
@@ -458,6 +502,32 @@ func (p *Core) closeResources(newConf *conf.Conf, calledByAPI bool) {
 	if newConf == nil ||
 		newConf.RTMPDisable != p.conf.RTMPDisable ||
 		newConf.RTMPAddress != p.conf.RTMPAddress ||
+		newConf.RTMPServerCert != p.conf.RTMPServerCert ||
+		newConf.RTMPServerKey != p.conf.RTMPServerKey ||
+		newConf.RTMPPingPeriod != p.conf.RTMPPingPeriod ||
+		newConf.RTMPDrainTimeout != p.conf.RTMPDrainTimeout ||
+		newConf.RTMPAuthMaxBackoff != p.conf.RTMPAuthMaxBackoff ||
+		newConf.RTMPAuthBackoffWindow != p.conf.RTMPAuthBackoffWindow ||
+		!reflect.DeepEqual(newConf.RTMPAuthTrustedIPs, p.conf.RTMPAuthTrustedIPs) ||
+		newConf.RTMPRedirectURL != p.conf.RTMPRedirectURL ||
+		newConf.RTMPTCPKeepAlivePeriod != p.conf.RTMPTCPKeepAlivePeriod ||
+		newConf.RTMPTCPDisableNoDelay != p.conf.RTMPTCPDisableNoDelay ||
+		newConf.RTMPTCPReceiveBufferSize != p.conf.RTMPTCPReceiveBufferSize ||
+		newConf.RTMPTCPSendBufferSize != p.conf.RTMPTCPSendBufferSize ||
+		newConf.RTMPSlowReaderTimeout != p.conf.RTMPSlowReaderTimeout ||
+		newConf.RTMPStalledPublisherTimeout != p.conf.RTMPStalledPublisherTimeout ||
+		newConf.RTMPMinWriteTimeout != p.conf.RTMPMinWriteTimeout ||
+		newConf.RTMPMaxReaderWriteTimeout != p.conf.RTMPMaxReaderWriteTimeout ||
+		newConf.RTMPMaxPacketSize != p.conf.RTMPMaxPacketSize ||
+		newConf.RTMPMaxConns != p.conf.RTMPMaxConns ||
+		newConf.RTMPHandshakeTimeout != p.conf.RTMPHandshakeTimeout ||
+		newConf.RTMPReplyBandwidthCheck != p.conf.RTMPReplyBandwidthCheck ||
+		newConf.RTMPRequireStreamKey != p.conf.RTMPRequireStreamKey ||
+		newConf.RTMPRequireAdobeAuth != p.conf.RTMPRequireAdobeAuth ||
+		newConf.RTMPStateWebhookURL != p.conf.RTMPStateWebhookURL ||
+		!reflect.DeepEqual(newConf.RTMPVariants, p.conf.RTMPVariants) ||
+		newConf.RTMPSelfTestPath != p.conf.RTMPSelfTestPath ||
+		newConf.LogLevel != p.conf.LogLevel ||
 		newConf.ExternalAuthenticationURL != p.conf.ExternalAuthenticationURL ||
 		newConf.ReadTimeout != p.conf.ReadTimeout ||
 		newConf.WriteTimeout != p.conf.WriteTimeout ||
@@ -465,6 +535,7 @@ func (p *Core) closeResources(newConf *conf.Conf, calledByAPI bool) {
 		newConf.RTSPAddress != p.conf.RTSPAddress ||
 		newConf.RunOnConnect != p.conf.RunOnConnect ||
 		newConf.RunOnConnectRestart != p.conf.RunOnConnectRestart ||
+		newConf.RunOnConnectCleanEnv != p.conf.RunOnConnectCleanEnv ||
 		closeMetrics ||
 		closePathManager {
 		closeRTMPServer = true
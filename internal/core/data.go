@@ -12,4 +12,21 @@ type data struct {
 	ptsEqualsDTS bool
 	h264NALUs    [][]byte
 	h264PTS      time.Duration
+
+	// DTS provided by the publisher, if available.
+	h264DTS *time.Duration
+
+	// closed captions (CEA-608/708 cc_data) contained in the SEI NALUs
+	// of the access unit, that are also left inside h264NALUs.
+	h264Captions [][]byte
+
+	// AMF data message (onCuePoint, onTextData) sent by a RTMP publisher,
+	// that is not associated with any track.
+	amfData []byte
+
+	// time at which the data has been received by the server.
+	received time.Time
+
+	// whether the data comes from the GOP cache.
+	replayed bool
 }
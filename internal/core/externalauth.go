@@ -4,9 +4,24 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
 )
 
+// externalAuthIP returns the canonical form of an IP and its family,
+// that allow backends to tell IPv6 addresses apart from host:port pairs.
+func externalAuthIP(ip string) (string, string) {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ip, ""
+	}
+
+	if parsed.To4() != nil {
+		return parsed.String(), "ipv4"
+	}
+	return parsed.String(), "ipv6"
+}
+
 func externalAuth(
 	ur string,
 	ip string,
@@ -16,8 +31,11 @@ func externalAuth(
 	action string,
 	query string,
 ) error {
+	ip, ipFamily := externalAuthIP(ip)
+
 	enc, _ := json.Marshal(struct {
 		IP       string `json:"ip"`
+		IPFamily string `json:"ipFamily"`
 		User     string `json:"user"`
 		Password string `json:"password"`
 		Path     string `json:"path"`
@@ -25,6 +43,7 @@ func externalAuth(
 		Query    string `json:"query"`
 	}{
 		IP:       ip,
+		IPFamily: ipFamily,
 		User:     user,
 		Password: password,
 		Path:     path,
@@ -0,0 +1,25 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestExternalAuthIP(t *testing.T) {
+	for _, ca := range []struct {
+		in     string
+		ip     string
+		family string
+	}{
+		{"192.168.1.1", "192.168.1.1", "ipv4"},
+		{"::ffff:192.168.1.1", "192.168.1.1", "ipv4"},
+		{"fe80::1", "fe80::1", "ipv6"},
+		{"FE80:0:0:0:0:0:0:1", "fe80::1", "ipv6"},
+		{"invalid", "invalid", ""},
+	} {
+		ip, family := externalAuthIP(ca.in)
+		require.Equal(t, ca.ip, ip)
+		require.Equal(t, ca.family, family)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"sort"
 	"strconv"
 	"sync"
 
@@ -27,6 +28,12 @@ type metricsRTSPServer interface {
 
 type metricsRTMPServer interface {
 	onAPIConnsList(req rtmpServerAPIConnsListReq) rtmpServerAPIConnsListRes
+	onMetricsConnErrors() map[rtmpServerConnErrorKey]uint64
+	onMetricsConnCloses() map[rtmpConnCloseCause]uint64
+	onMetricsFramesDropped() uint64
+	onMetricsReadBufferOverflows() map[rtmpReadBufferPolicy]uint64
+	onMetricsAudioJitterBufferFill() int64
+	onMetricsSelfTest() *rtmpServerAPISelfTestData
 }
 
 type metricsHLSServer interface {
@@ -185,6 +192,59 @@ func (m *metrics) onMetrics(ctx *gin.Context) {
 			out += metric("rtmp_conns{state=\"publish\"}",
 				publishCount)
 		}
+
+		connErrors := m.rtmpServer.onMetricsConnErrors()
+		keys := make([]rtmpServerConnErrorKey, 0, len(connErrors))
+		for k := range connErrors {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			if keys[i].direction != keys[j].direction {
+				return keys[i].direction < keys[j].direction
+			}
+			return keys[i].kind < keys[j].kind
+		})
+
+		for _, k := range keys {
+			out += metric("rtmp_conn_errors{direction=\""+k.direction+"\",type=\""+k.kind+"\"}",
+				int64(connErrors[k]))
+		}
+
+		connCloses := m.rtmpServer.onMetricsConnCloses()
+		causes := make([]rtmpConnCloseCause, 0, len(connCloses))
+		for k := range connCloses {
+			causes = append(causes, k)
+		}
+		sort.Slice(causes, func(i, j int) bool {
+			return causes[i] < causes[j]
+		})
+
+		for _, k := range causes {
+			out += metric("rtmp_conns_closed{cause=\""+k.String()+"\"}",
+				int64(connCloses[k]))
+		}
+
+		out += metric("rtmp_frames_dropped{reason=\"latency\"}",
+			int64(m.rtmpServer.onMetricsFramesDropped()))
+
+		readBufferOverflows := m.rtmpServer.onMetricsReadBufferOverflows()
+		for _, k := range []rtmpReadBufferPolicy{rtmpReadBufferDropOldest, rtmpReadBufferBlock} {
+			out += metric("rtmp_read_buffer_overflows{policy=\""+k.String()+"\"}",
+				int64(readBufferOverflows[k]))
+		}
+
+		out += metric("rtmp_audio_jitter_buffer_frames",
+			m.rtmpServer.onMetricsAudioJitterBufferFill())
+
+		// the result of the last self test
+		if res := m.rtmpServer.onMetricsSelfTest(); res != nil {
+			if res.OK {
+				out += metric("rtmp_self_test_ok", 1)
+				out += metric("rtmp_self_test_latency_ms", res.latency.Milliseconds())
+			} else {
+				out += metric("rtmp_self_test_ok", 0)
+			}
+		}
 	}
 
 	if !interfaceIsEmpty(m.hlsServer) {
@@ -58,6 +58,36 @@ func (pathErrAuthCritical) Error() string {
 	return "critical authentication error"
 }
 
+type pathErrTooManyReaders struct {
+	pathName   string
+	maxReaders int
+}
+
+// Error implements the error interface.
+func (e pathErrTooManyReaders) Error() string {
+	return fmt.Sprintf("path '%s' has reached the maximum number of RTMP readers (%d)",
+		e.pathName, e.maxReaders)
+}
+
+type pathErrInvalidName struct {
+	pathName string
+	err      error
+}
+
+// Error implements the error interface.
+func (e pathErrInvalidName) Error() string {
+	return fmt.Sprintf("invalid path name: %s (%s)", e.err, e.pathName)
+}
+
+type pathErrPublisherConflict struct {
+	pathName string
+}
+
+// Error implements the error interface.
+func (e pathErrPublisherConflict) Error() string {
+	return fmt.Sprintf("another publisher is already publishing to path '%s'", e.pathName)
+}
+
 type pathParent interface {
 	log(logger.Level, string, ...interface{})
 	onPathSourceReady(*path)
@@ -155,12 +185,14 @@ type pathPublisherAnnounceReq struct {
 	author       publisher
 	pathName     string
 	authenticate authenticateFunc
+	identity     string // optional, allows to recognize reconnecting publishers
 	res          chan pathPublisherAnnounceRes
 }
 
 type pathReaderPlayReq struct {
-	author reader
-	res    chan struct{}
+	author          reader
+	requestKeyFrame bool
+	res             chan struct{}
 }
 
 type pathPublisherRecordRes struct {
@@ -212,21 +244,24 @@ type pathAPIPathsListSubReq struct {
 }
 
 type path struct {
-	rtspAddress     string
-	readTimeout     conf.StringDuration
-	writeTimeout    conf.StringDuration
-	readBufferCount int
-	confName        string
-	conf            *conf.PathConf
-	name            string
-	matches         []string
-	wg              *sync.WaitGroup
-	externalCmdPool *externalcmd.Pool
-	parent          pathParent
+	rtspAddress       string
+	readTimeout       conf.StringDuration
+	writeTimeout      conf.StringDuration
+	readBufferCount   int
+	rtmpMaxPacketSize conf.StringSize
+	confName          string
+	conf              *conf.PathConf // written by the path routine only
+	confMutex         sync.RWMutex
+	name              string
+	matches           []string
+	wg                *sync.WaitGroup
+	externalCmdPool   *externalcmd.Pool
+	parent            pathParent
 
 	ctx                context.Context
 	ctxCancel          func()
 	source             source
+	sourceIdentity     string
 	sourceReady        bool
 	sourceStaticWg     sync.WaitGroup
 	readers            map[reader]pathReaderState
@@ -240,6 +275,7 @@ type path struct {
 	onDemandState      pathOnDemandState
 
 	// in
+	confReload              chan *conf.PathConf
 	sourceStaticSetReady    chan pathSourceStaticSetReadyReq
 	sourceStaticSetNotReady chan pathSourceStaticSetNotReadyReq
 	describe                chan pathDescribeReq
@@ -260,8 +296,9 @@ func newPath(
 	readTimeout conf.StringDuration,
 	writeTimeout conf.StringDuration,
 	readBufferCount int,
+	rtmpMaxPacketSize conf.StringSize,
 	confName string,
-	conf *conf.PathConf,
+	pathConf *conf.PathConf,
 	name string,
 	matches []string,
 	wg *sync.WaitGroup,
@@ -275,8 +312,9 @@ func newPath(
 		readTimeout:             readTimeout,
 		writeTimeout:            writeTimeout,
 		readBufferCount:         readBufferCount,
+		rtmpMaxPacketSize:       rtmpMaxPacketSize,
 		confName:                confName,
-		conf:                    conf,
+		conf:                    pathConf,
 		name:                    name,
 		matches:                 matches,
 		wg:                      wg,
@@ -287,6 +325,7 @@ func newPath(
 		readers:                 make(map[reader]pathReaderState),
 		onDemandReadyTimer:      newEmptyTimer(),
 		onDemandCloseTimer:      newEmptyTimer(),
+		confReload:              make(chan *conf.PathConf, 1),
 		sourceStaticSetReady:    make(chan pathSourceStaticSetReadyReq),
 		sourceStaticSetNotReady: make(chan pathSourceStaticSetNotReadyReq),
 		describe:                make(chan pathDescribeReq),
@@ -325,6 +364,8 @@ func (pa *path) ConfName() string {
 
 // Conf returns the configuration of this path.
 func (pa *path) Conf() *conf.PathConf {
+	pa.confMutex.RLock()
+	defer pa.confMutex.RUnlock()
 	return pa.conf
 }
 
@@ -349,6 +390,7 @@ func (pa *path) run() {
 			pa.externalCmdPool,
 			pa.conf.RunOnInit,
 			pa.conf.RunOnInitRestart,
+			false,
 			pa.externalCmdEnv(),
 			func(co int) {
 				pa.log(logger.Info, "runOnInit command exited with code %d", co)
@@ -382,6 +424,9 @@ func (pa *path) run() {
 					return fmt.Errorf("not in use")
 				}
 
+			case newConf := <-pa.confReload:
+				pa.handleConfReload(newConf)
+
 			case req := <-pa.sourceStaticSetReady:
 				if req.source == pa.source {
 					pa.sourceSetReady(req.tracks)
@@ -531,22 +576,32 @@ func (pa *path) externalCmdEnv() externalcmd.Environment {
 	return env
 }
 
+// onDemandStartTimeout returns the maximum time readers wait for
+// an on-demand source.
+func (pa *path) onDemandStartTimeout() time.Duration {
+	if pa.hasStaticSource() {
+		return time.Duration(pa.conf.SourceOnDemandStartTimeout)
+	}
+	return time.Duration(pa.conf.RunOnDemandStartTimeout)
+}
+
 func (pa *path) onDemandStartSource() {
 	pa.onDemandReadyTimer.Stop()
 	if pa.hasStaticSource() {
 		pa.staticSourceCreate()
-		pa.onDemandReadyTimer = time.NewTimer(time.Duration(pa.conf.SourceOnDemandStartTimeout))
+		pa.onDemandReadyTimer = time.NewTimer(pa.onDemandStartTimeout())
 	} else {
 		pa.log(logger.Info, "runOnDemand command started")
 		pa.onDemandCmd = externalcmd.NewCmd(
 			pa.externalCmdPool,
 			pa.conf.RunOnDemand,
 			pa.conf.RunOnDemandRestart,
+			false,
 			pa.externalCmdEnv(),
 			func(co int) {
 				pa.log(logger.Info, "runOnDemand command exited with code %d", co)
 			})
-		pa.onDemandReadyTimer = time.NewTimer(time.Duration(pa.conf.RunOnDemandStartTimeout))
+		pa.onDemandReadyTimer = time.NewTimer(pa.onDemandStartTimeout())
 	}
 
 	pa.onDemandState = pathOnDemandStateWaitingReady
@@ -594,7 +649,7 @@ func (pa *path) onDemandCloseSource() {
 
 func (pa *path) sourceSetReady(tracks gortsplib.Tracks) {
 	pa.sourceReady = true
-	pa.stream = newStream(tracks)
+	pa.stream = newStream(tracks, pa.conf.GOPCacheSize)
 
 	if pa.isOnDemand() {
 		pa.onDemandReadyTimer.Stop()
@@ -627,6 +682,7 @@ func (pa *path) sourceSetReady(tracks gortsplib.Tracks) {
 			pa.externalCmdPool,
 			pa.conf.RunOnReady,
 			pa.conf.RunOnReadyRestart,
+			false,
 			pa.externalCmdEnv(),
 			func(co int) {
 				pa.log(logger.Info, "runOnReady command exited with code %d", co)
@@ -675,6 +731,7 @@ func (pa *path) staticSourceCreate() {
 			pa.conf.Source,
 			pa.readTimeout,
 			pa.writeTimeout,
+			pa.rtmpMaxPacketSize,
 			&pa.sourceStaticWg,
 			pa)
 	case strings.HasPrefix(pa.conf.Source, "http://") ||
@@ -708,6 +765,7 @@ func (pa *path) doPublisherRemove() {
 	}
 
 	pa.source = nil
+	pa.sourceIdentity = ""
 }
 
 func (pa *path) handleDescribe(req pathDescribeReq) {
@@ -768,20 +826,45 @@ func (pa *path) handlePublisherAnnounce(req pathPublisherAnnounceReq) {
 		}
 
 		if pa.conf.DisablePublisherOverride {
-			req.res <- pathPublisherAnnounceRes{err: fmt.Errorf("another publisher is already publishing to path '%s'", pa.name)}
-			return
+			if !pa.isReconnectingPublisher(req) {
+				req.res <- pathPublisherAnnounceRes{err: pathErrPublisherConflict{pathName: pa.name}}
+				return
+			}
+
+			pa.log(logger.Info, "closing stale publisher with the same credentials")
+		} else {
+			pa.log(logger.Info, "closing existing publisher")
 		}
 
-		pa.log(logger.Info, "closing existing publisher")
 		pa.source.(publisher).close()
 		pa.doPublisherRemove()
 	}
 
 	pa.source = req.author
+	pa.sourceIdentity = req.identity
 
 	req.res <- pathPublisherAnnounceRes{path: pa}
 }
 
+// isReconnectingPublisher returns whether a publisher has the same identity
+// of the current one, and the current one is stale, that is, it didn't send
+// any data within the grace period. Publishers that are still sending data are
+// never replaced, otherwise two encoders with the same credentials would keep
+// replacing each other.
+func (pa *path) isReconnectingPublisher(req pathPublisherAnnounceReq) bool {
+	if pa.conf.PublisherReconnectGracePeriod == 0 ||
+		req.identity == "" || req.identity != pa.sourceIdentity {
+		return false
+	}
+
+	cur, ok := pa.source.(publisherWithActivity)
+	if !ok {
+		return false
+	}
+
+	return time.Since(cur.lastActivity()) >= time.Duration(pa.conf.PublisherReconnectGracePeriod)
+}
+
 func (pa *path) handlePublisherRecord(req pathPublisherRecordReq) {
 	if pa.source != req.author {
 		req.res <- pathPublisherRecordRes{err: fmt.Errorf("publisher is not assigned to this path anymore")}
@@ -795,6 +878,22 @@ func (pa *path) handlePublisherRecord(req pathPublisherRecordReq) {
 	req.res <- pathPublisherRecordRes{stream: pa.stream}
 }
 
+func (pa *path) handleConfReload(newConf *conf.PathConf) {
+	pa.confMutex.Lock()
+	pa.conf = newConf
+	pa.confMutex.Unlock()
+
+	pa.log(logger.Debug, "authentication parameters updated")
+
+	if !pa.conf.PublishRevalidateOnReload {
+		return
+	}
+
+	if source, ok := pa.source.(publisherWithRevalidation); ok {
+		source.onPublisherRevalidate(pa.conf.PublishIPs, pa.conf.PublishUser, pa.conf.PublishPass)
+	}
+}
+
 func (pa *path) handlePublisherPause(req pathPublisherPauseReq) {
 	if req.author == pa.source && pa.sourceReady {
 		if pa.isOnDemand() && pa.onDemandState != pathOnDemandStateInitial {
@@ -830,13 +929,41 @@ func (pa *path) handleReaderSetupPlay(req pathReaderSetupPlayReq) {
 			pa.onDemandStartSource()
 		}
 		pa.setupPlayRequests = append(pa.setupPlayRequests, req)
+
+		if w, ok := req.author.(readerOnDemandWaiter); ok {
+			w.onReaderOnDemandWait(pa.conf, pa.onDemandStartTimeout())
+		}
 		return
 	}
 
 	req.res <- pathReaderSetupPlayRes{err: pathErrNoOnePublishing{pathName: pa.name}}
 }
 
+// rtmpReaderCount returns the number of RTMP readers, that are the only ones
+// limited by maxReaders, since they allocate a large read buffer each.
+func (pa *path) rtmpReaderCount() int {
+	n := 0
+	for r := range pa.readers {
+		if _, ok := r.(*rtmpConn); ok {
+			n++
+		}
+	}
+	return n
+}
+
 func (pa *path) handleReaderSetupPlayPost(req pathReaderSetupPlayReq) {
+	_, isRTMP := req.author.(*rtmpConn)
+	if _, ok := pa.readers[req.author]; !ok &&
+		isRTMP &&
+		pa.conf.MaxReaders != 0 &&
+		pa.rtmpReaderCount() >= pa.conf.MaxReaders {
+		req.res <- pathReaderSetupPlayRes{err: pathErrTooManyReaders{
+			pathName:   pa.name,
+			maxReaders: pa.conf.MaxReaders,
+		}}
+		return
+	}
+
 	pa.readers[req.author] = pathReaderStatePrePlay
 
 	if pa.isOnDemand() && pa.onDemandState == pathOnDemandStateClosing {
@@ -856,6 +983,12 @@ func (pa *path) handleReaderPlay(req pathReaderPlayReq) {
 
 	pa.stream.readerAdd(req.author)
 
+	if req.requestKeyFrame {
+		if source, ok := pa.source.(sourceKeyFrameRequester); ok {
+			source.onSourceRequestKeyFrame()
+		}
+	}
+
 	req.author.onReaderAccepted()
 
 	close(req.res)
@@ -953,6 +1086,18 @@ func (pa *path) onPublisherRecord(req pathPublisherRecordReq) pathPublisherRecor
 	}
 }
 
+// onConfReload is called by pathManager when only the authentication
+// parameters of the configuration have changed. It doesn't block,
+// since the path may be waiting for the path manager.
+func (pa *path) onConfReload(newConf *conf.PathConf) {
+	// discard a configuration that has not been applied yet
+	select {
+	case <-pa.confReload:
+	default:
+	}
+	pa.confReload <- newConf
+}
+
 // onPublisherPause is called by a publisher.
 func (pa *path) onPublisherPause(req pathPublisherPauseReq) {
 	req.res = make(chan struct{})
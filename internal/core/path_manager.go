@@ -19,14 +19,15 @@ type pathManagerParent interface {
 }
 
 type pathManager struct {
-	rtspAddress     string
-	readTimeout     conf.StringDuration
-	writeTimeout    conf.StringDuration
-	readBufferCount int
-	pathConfs       map[string]*conf.PathConf
-	externalCmdPool *externalcmd.Pool
-	metrics         *metrics
-	parent          pathManagerParent
+	rtspAddress       string
+	readTimeout       conf.StringDuration
+	writeTimeout      conf.StringDuration
+	readBufferCount   int
+	rtmpMaxPacketSize conf.StringSize
+	pathConfs         map[string]*conf.PathConf
+	externalCmdPool   *externalcmd.Pool
+	metrics           *metrics
+	parent            pathManagerParent
 
 	ctx       context.Context
 	ctxCancel func()
@@ -51,6 +52,7 @@ func newPathManager(
 	readTimeout conf.StringDuration,
 	writeTimeout conf.StringDuration,
 	readBufferCount int,
+	rtmpMaxPacketSize conf.StringSize,
 	pathConfs map[string]*conf.PathConf,
 	externalCmdPool *externalcmd.Pool,
 	metrics *metrics,
@@ -63,6 +65,7 @@ func newPathManager(
 		readTimeout:       readTimeout,
 		writeTimeout:      writeTimeout,
 		readBufferCount:   readBufferCount,
+		rtmpMaxPacketSize: rtmpMaxPacketSize,
 		pathConfs:         pathConfs,
 		externalCmdPool:   externalCmdPool,
 		metrics:           metrics,
@@ -138,9 +141,18 @@ outer:
 			}
 
 			// remove paths associated with a conf which doesn't exist anymore
-			// or has changed
+			// or has changed. When only the authentication parameters
+			// have changed, paths are updated without closing them,
+			// in order not to disconnect publishers and readers.
 			for _, pa := range pm.paths {
-				if pathConf, ok := pm.pathConfs[pa.ConfName()]; !ok || pathConf != pa.Conf() {
+				pathConf, ok := pm.pathConfs[pa.ConfName()]
+				switch {
+				case ok && pathConf == pa.Conf():
+
+				case ok && pathConf.EqualExceptAuthentication(pa.Conf()):
+					pa.onConfReload(pathConf)
+
+				default:
 					delete(pm.paths, pa.Name())
 					pa.close()
 				}
@@ -274,6 +286,7 @@ func (pm *pathManager) createPath(
 		pm.readTimeout,
 		pm.writeTimeout,
 		pm.readBufferCount,
+		pm.rtmpMaxPacketSize,
 		pathConfName,
 		pathConf,
 		name,
@@ -286,7 +299,7 @@ func (pm *pathManager) createPath(
 func (pm *pathManager) findPathConf(name string) (string, *conf.PathConf, []string, error) {
 	err := conf.IsValidPathName(name)
 	if err != nil {
-		return "", nil, nil, fmt.Errorf("invalid path name: %s (%s)", err, name)
+		return "", nil, nil, pathErrInvalidName{pathName: name, err: err}
 	}
 
 	// normal path
@@ -0,0 +1,219 @@
+package core
+
+import (
+	"bufio"
+	"io"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	nrtmp "github.com/notedit/rtmp/format/rtmp"
+	"github.com/stretchr/testify/require"
+
+	"github.com/aler9/rtsp-simple-server/internal/conf"
+)
+
+// testPathPublisher is a publisher that doesn't send any data,
+// whose last activity can be set.
+type testPathPublisher struct {
+	activity time.Time
+	closed   bool
+}
+
+func (p *testPathPublisher) onSourceAPIDescribe() interface{} { return nil }
+
+func (p *testPathPublisher) close() { p.closed = true }
+
+func (p *testPathPublisher) onPublisherAccepted(int) {}
+
+func (p *testPathPublisher) lastActivity() time.Time { return p.activity }
+
+// testPathReader is a reader that uses a protocol different than RTMP.
+type testPathReader struct{}
+
+func (testPathReader) close() {}
+
+func (testPathReader) onReaderAccepted() {}
+
+func (testPathReader) onReaderData(*data) {}
+
+func (testPathReader) onReaderAPIDescribe() interface{} { return nil }
+
+// testPathOnDemandWaiter is a reader that records the calls
+// to onReaderOnDemandWait.
+type testPathOnDemandWaiter struct {
+	testPathReader
+	timeouts chan time.Duration
+}
+
+func (r *testPathOnDemandWaiter) onReaderOnDemandWait(_ *conf.PathConf, timeout time.Duration) {
+	r.timeouts <- timeout
+}
+
+func TestPathPublisherReconnectGracePeriod(t *testing.T) {
+	pm := newTestRTMPConnPathManager(t, &conf.PathConf{
+		DisablePublisherOverride:      true,
+		PublisherReconnectGracePeriod: conf.StringDuration(2 * time.Second),
+	})
+	defer pm.close()
+
+	identity := rtmpConnPublisherIdentity(url.Values{"key": []string{"mykey"}})
+
+	announce := func(p publisher, identity string) error {
+		res := pm.onPublisherAnnounce(pathPublisherAnnounceReq{
+			author:   p,
+			pathName: "mystream",
+			authenticate: func([]interface{}, conf.Credential, conf.Credential) error {
+				return nil
+			},
+			identity: identity,
+		})
+		return res.err
+	}
+
+	p1 := &testPathPublisher{activity: time.Now()}
+	require.NoError(t, announce(p1, identity))
+
+	// the current publisher is still sending data
+	p1.activity = time.Now().Add(-500 * time.Millisecond)
+	err := announce(&testPathPublisher{activity: time.Now()}, identity)
+	require.Equal(t, pathErrPublisherConflict{pathName: "mystream"}, err)
+	require.Equal(t, false, p1.closed)
+
+	// the current publisher is stale, publishers without identity
+	// or with another one are rejected
+	p1.activity = time.Now().Add(-5 * time.Second)
+
+	err = announce(&testPathPublisher{}, "")
+	require.Equal(t, pathErrPublisherConflict{pathName: "mystream"}, err)
+
+	err = announce(&testPathPublisher{}, rtmpConnPublisherIdentity(url.Values{"key": []string{"otherkey"}}))
+	require.Equal(t, pathErrPublisherConflict{pathName: "mystream"}, err)
+	require.Equal(t, false, p1.closed)
+
+	// the same publisher reconnects
+	p2 := &testPathPublisher{activity: time.Now()}
+	require.NoError(t, announce(p2, identity))
+	require.Equal(t, true, p1.closed)
+}
+
+func TestPathPublisherReconnectGracePeriodDisabled(t *testing.T) {
+	pm := newTestRTMPConnPathManager(t, &conf.PathConf{
+		DisablePublisherOverride: true,
+	})
+	defer pm.close()
+
+	identity := rtmpConnPublisherIdentity(url.Values{"key": []string{"mykey"}})
+
+	announce := func(p publisher) error {
+		res := pm.onPublisherAnnounce(pathPublisherAnnounceReq{
+			author:   p,
+			pathName: "mystream",
+			authenticate: func([]interface{}, conf.Credential, conf.Credential) error {
+				return nil
+			},
+			identity: identity,
+		})
+		return res.err
+	}
+
+	p1 := &testPathPublisher{activity: time.Now().Add(-time.Hour)}
+	require.NoError(t, announce(p1))
+
+	err := announce(&testPathPublisher{})
+	require.Equal(t, pathErrPublisherConflict{pathName: "mystream"}, err)
+	require.Equal(t, false, p1.closed)
+}
+
+func TestPathMaxReaders(t *testing.T) {
+	pm := newTestRTMPConnPathManager(t, &conf.PathConf{
+		MaxReaders: 1,
+	})
+	defer pm.close()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	stream := testRTMPConnPublishPCMA(t, pm)
+
+	setupPlay := func(r reader) error {
+		res := pm.onReaderSetupPlay(pathReaderSetupPlayReq{
+			author:   r,
+			pathName: "teststream",
+			authenticate: func([]interface{}, conf.Credential, conf.Credential) error {
+				return nil
+			},
+		})
+		return res.err
+	}
+
+	// readers that use other protocols are not counted
+	require.NoError(t, setupPlay(&testPathReader{}))
+
+	rc1, rnconn1 := newTestRTMPConn(&wg, pm, testRTMPConnParent{})
+	defer rc1.close()
+	defer rnconn1.Close()
+
+	reader := testRTMPConnClient(t, rnconn1, "rtmp://127.0.0.1/teststream", nrtmp.PrepareReading)
+	testRTMPConnReadFirstAudio(t, reader, stream)
+	go io.Copy(io.Discard, rnconn1)
+
+	// RTMP readers above the limit are rejected
+	require.Equal(t, pathErrTooManyReaders{pathName: "teststream", maxReaders: 1}, setupPlay(&rtmpConn{}))
+
+	parent := newTestRTMPConnRecordingParent()
+	rc2, rnconn2 := newTestRTMPConn(&wg, pm, parent)
+	defer rc2.close()
+	defer rnconn2.Close()
+
+	go func() {
+		reader := nrtmp.NewConn(&bufio.ReadWriter{
+			Reader: bufio.NewReader(rnconn2),
+			Writer: bufio.NewWriter(rnconn2),
+		})
+		reader.URL, _ = url.Parse("rtmp://127.0.0.1/teststream")
+		reader.Prepare(nrtmp.StageGotPublishOrPlayCommand, nrtmp.PrepareReading)
+		io.Copy(io.Discard, rnconn2)
+	}()
+
+	require.Equal(t, rc2, <-parent.closed)
+	require.Equal(t, rtmpConnCloseCauseError, parent.cause)
+
+	// readers that use other protocols are not limited
+	require.NoError(t, setupPlay(&testPathReader{}))
+}
+
+func TestPathReaderOnDemandWait(t *testing.T) {
+	for _, ca := range []string{"on demand", "not on demand"} {
+		t.Run(ca, func(t *testing.T) {
+			pathConf := &conf.PathConf{}
+			pm := newTestRTMPConnPathManager(t, pathConf)
+			defer pm.close()
+
+			// static sources can't be set on path 'all', set them after the check
+			if ca == "on demand" {
+				pathConf.Source = "rtsp://127.0.0.1:1/teststream"
+				pathConf.SourceOnDemand = true
+				pathConf.SourceOnDemandStartTimeout = conf.StringDuration(300 * time.Millisecond)
+			}
+
+			r := &testPathOnDemandWaiter{timeouts: make(chan time.Duration, 1)}
+
+			res := pm.onReaderSetupPlay(pathReaderSetupPlayReq{
+				author:   r,
+				pathName: "teststream",
+				authenticate: func([]interface{}, conf.Credential, conf.Credential) error {
+					return nil
+				},
+			})
+			require.Error(t, res.err)
+
+			if ca == "on demand" {
+				require.Equal(t, 300*time.Millisecond, <-r.timeouts)
+			} else {
+				require.Equal(t, 0, len(r.timeouts))
+			}
+		})
+	}
+}
@@ -1,8 +1,28 @@
 package core
 
+import (
+	"time"
+
+	"github.com/aler9/rtsp-simple-server/internal/conf"
+)
+
 // publisher is an entity that can publish a stream.
 type publisher interface {
 	source
 	close()
 	onPublisherAccepted(tracksLen int)
 }
+
+// publisherWithRevalidation is a publisher that can be authenticated again
+// when the credentials of the path change.
+type publisherWithRevalidation interface {
+	publisher
+	onPublisherRevalidate(pathIPs []interface{}, pathUser conf.Credential, pathPass conf.Credential)
+}
+
+// publisherWithActivity is a publisher that keeps track of the last time
+// it received data, allowing to detect stale publishers.
+type publisherWithActivity interface {
+	publisher
+	lastActivity() time.Time
+}
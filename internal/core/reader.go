@@ -1,5 +1,11 @@
 package core
 
+import (
+	"time"
+
+	"github.com/aler9/rtsp-simple-server/internal/conf"
+)
+
 // reader is an entity that can read a stream.
 type reader interface {
 	close()
@@ -7,3 +13,10 @@ type reader interface {
 	onReaderData(*data)
 	onReaderAPIDescribe() interface{}
 }
+
+// readerOnDemandWaiter is a reader that is notified when it's put on hold
+// until an on-demand source is ready, allowing to keep its connection alive.
+type readerOnDemandWaiter interface {
+	reader
+	onReaderOnDemandWait(pathConf *conf.PathConf, timeout time.Duration)
+}
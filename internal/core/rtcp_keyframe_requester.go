@@ -0,0 +1,114 @@
+package core
+
+import (
+	"sync/atomic"
+
+	"github.com/aler9/gortsplib"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+)
+
+type rtcpKeyFrameRequesterTrack struct {
+	// accessed atomically
+	ssrc    uint32
+	pending int32
+}
+
+// rtcpKeyFrameRequester asks a RTSP publisher to send a keyframe of its H264 tracks,
+// by sending RTCP Picture Loss Indication (PLI) packets.
+// The SSRC of each track, that is needed by PLI packets, is taken from incoming packets.
+// A single PLI packet is sent per group of pictures: after a request, further
+// requests are ignored until a keyframe is received, in order not to force
+// the publisher to send a keyframe for every reader that connects.
+type rtcpKeyFrameRequester struct {
+	// nil for tracks that are not H264.
+	tracks []*rtcpKeyFrameRequesterTrack
+
+	write func(int, rtcp.Packet)
+}
+
+func newRTCPKeyFrameRequester(tracks gortsplib.Tracks, write func(int, rtcp.Packet)) *rtcpKeyFrameRequester {
+	r := &rtcpKeyFrameRequester{
+		tracks: make([]*rtcpKeyFrameRequesterTrack, len(tracks)),
+		write:  write,
+	}
+
+	for i, track := range tracks {
+		if _, ok := track.(*gortsplib.TrackH264); ok {
+			r.tracks[i] = &rtcpKeyFrameRequesterTrack{}
+		}
+	}
+
+	return r
+}
+
+// onPacketRTP must be called for every incoming RTP packet.
+func (r *rtcpKeyFrameRequester) onPacketRTP(trackID int, pkt *rtp.Packet) {
+	if trackID >= len(r.tracks) || r.tracks[trackID] == nil {
+		return
+	}
+	t := r.tracks[trackID]
+
+	atomic.StoreUint32(&t.ssrc, pkt.SSRC)
+
+	if atomic.LoadInt32(&t.pending) != 0 && rtpH264ContainsIDR(pkt.Payload) {
+		atomic.StoreInt32(&t.pending, 0)
+	}
+}
+
+// request sends a PLI packet to every H264 track whose SSRC is known,
+// and that is not waiting for a previously requested keyframe.
+// It can be called by any routine.
+func (r *rtcpKeyFrameRequester) request() {
+	for trackID, t := range r.tracks {
+		if t == nil {
+			continue
+		}
+
+		// no packets have been received yet, therefore the SSRC is unknown
+		// and the first keyframe has still to come.
+		v := atomic.LoadUint32(&t.ssrc)
+		if v == 0 {
+			continue
+		}
+
+		if !atomic.CompareAndSwapInt32(&t.pending, 0, 1) {
+			continue
+		}
+
+		r.write(trackID, &rtcp.PictureLossIndication{MediaSSRC: v})
+	}
+}
+
+// rtpH264ContainsIDR checks whether the payload of a H264 RTP packet
+// contains an IDR NALU, or the beginning of one.
+func rtpH264ContainsIDR(payload []byte) bool {
+	if len(payload) == 0 {
+		return false
+	}
+
+	switch payload[0] & 0x1F {
+	case 5: // IDR
+		return true
+
+	case 24: // STAP-A
+		payload = payload[1:]
+		for len(payload) >= 3 {
+			size := int(payload[0])<<8 | int(payload[1])
+			payload = payload[2:]
+			if size == 0 || size > len(payload) {
+				return false
+			}
+			if payload[0]&0x1F == 5 {
+				return true
+			}
+			payload = payload[size:]
+		}
+		return false
+
+	case 28: // FU-A
+		return len(payload) >= 2 && payload[1]&0x80 != 0 && payload[1]&0x1F == 5
+	}
+
+	return false
+}
@@ -0,0 +1,87 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/aler9/gortsplib"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRTCPKeyFrameRequester(t *testing.T) {
+	videoTrack, err := gortsplib.NewTrackH264(96,
+		[]byte{
+			0x67, 0x64, 0x00, 0x0c, 0xac, 0x3b, 0x50, 0xb0,
+			0x4b, 0x42, 0x00, 0x00, 0x03, 0x00, 0x02, 0x00,
+			0x00, 0x03, 0x00, 0x3d, 0x08,
+		},
+		[]byte{0x68, 0xee, 0x3c, 0x80},
+		nil)
+	require.NoError(t, err)
+
+	audioTrack, err := gortsplib.NewTrackAAC(97, 2, 44100, 2, nil)
+	require.NoError(t, err)
+
+	type written struct {
+		trackID int
+		pkt     rtcp.Packet
+	}
+	var writes []written
+
+	r := newRTCPKeyFrameRequester(gortsplib.Tracks{audioTrack, videoTrack}, func(trackID int, pkt rtcp.Packet) {
+		writes = append(writes, written{trackID, pkt})
+	})
+
+	// SSRC is not known yet
+	r.request()
+	require.Empty(t, writes)
+
+	r.onPacketRTP(0, &rtp.Packet{Header: rtp.Header{SSRC: 0x1111}})
+	r.onPacketRTP(1, &rtp.Packet{Header: rtp.Header{SSRC: 0x2222}})
+
+	r.request()
+	require.Equal(t, []written{{1, &rtcp.PictureLossIndication{MediaSSRC: 0x2222}}}, writes)
+
+	// the keyframe has not been received yet
+	r.onPacketRTP(1, &rtp.Packet{Header: rtp.Header{SSRC: 0x2222}, Payload: []byte{0x01}})
+	r.request()
+	require.Equal(t, 1, len(writes))
+
+	// FU-A start of an IDR
+	r.onPacketRTP(1, &rtp.Packet{Header: rtp.Header{SSRC: 0x2222}, Payload: []byte{0x1C, 0x85}})
+	r.request()
+	require.Equal(t, 2, len(writes))
+
+	// STAP-A with SPS, PPS and IDR
+	r.onPacketRTP(1, &rtp.Packet{Header: rtp.Header{SSRC: 0x2222}, Payload: []byte{
+		0x18,
+		0x00, 0x01, 0x67,
+		0x00, 0x01, 0x68,
+		0x00, 0x02, 0x65, 0x88,
+	}})
+	r.request()
+	require.Equal(t, 3, len(writes))
+}
+
+func TestRTPH264ContainsIDR(t *testing.T) {
+	for _, ca := range []struct {
+		name    string
+		payload []byte
+		idr     bool
+	}{
+		{"empty", nil, false},
+		{"single non-IDR", []byte{0x41, 0x9a}, false},
+		{"single IDR", []byte{0x65, 0x88}, true},
+		{"STAP-A without IDR", []byte{0x18, 0x00, 0x01, 0x67, 0x00, 0x01, 0x68}, false},
+		{"STAP-A with IDR", []byte{0x18, 0x00, 0x01, 0x67, 0x00, 0x01, 0x65}, true},
+		{"STAP-A truncated", []byte{0x18, 0x00, 0x05, 0x67}, false},
+		{"FU-A IDR start", []byte{0x7C, 0x85, 0x88}, true},
+		{"FU-A IDR middle", []byte{0x7C, 0x05, 0x88}, false},
+		{"FU-A non-IDR start", []byte{0x7C, 0x81, 0x88}, false},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			require.Equal(t, ca.idr, rtpH264ContainsIDR(ca.payload))
+		})
+	}
+}
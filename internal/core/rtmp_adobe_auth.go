@@ -0,0 +1,188 @@
+package core
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// descriptions of the connect rejections that start the authentication.
+	rtmpAdobeAuthNeedAuth  = "[ AccessManager.Reject ] : [ code=403 need auth; authmod=adobe ] : "
+	rtmpAdobeAuthChallenge = "[ AccessManager.Reject ] : [ authmod=adobe ] : " +
+		"?reason=needauth&user=%s&salt=%s&challenge=%s&opaque=%s"
+
+	// time available to clients to reconnect with the response to a challenge.
+	rtmpAdobeAuthChallengeTimeout = 1 * time.Minute
+)
+
+// rtmpAdobeAuthParams parses the parameters of the Adobe authentication.
+// Values are not unescaped, since clients insert base64 values as they are.
+func rtmpAdobeAuthParams(rawQuery string) map[string]string {
+	ret := make(map[string]string)
+	for _, kv := range strings.Split(rawQuery, "&") {
+		tmp := strings.SplitN(kv, "=", 2)
+		if len(tmp) != 2 {
+			continue
+		}
+		if _, ok := ret[tmp[0]]; !ok {
+			ret[tmp[0]] = tmp[1]
+		}
+	}
+	return ret
+}
+
+// rtmpAdobeAuthResponse computes the response that a client must send
+// in order to prove the knowledge of the password.
+func rtmpAdobeAuthResponse(user string, salt string, pass string, opaque string, challenge string) string {
+	h := md5.Sum([]byte(user + salt + pass))
+	h = md5.Sum([]byte(base64.StdEncoding.EncodeToString(h[:]) + opaque + challenge))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// rtmpAdobeAuth implements the server side of the Adobe challenge-response
+// authentication (authmod=adobe), used by FMLE, Wirecast and some CDNs.
+// Since clients answer to challenges with a new connection, salts and
+// challenges are derived from a secret, in order to be able to check them
+// without storing them. Only challenges that have been used are stored,
+// until they expire, in order to prevent responses from being replayed.
+type rtmpAdobeAuth struct {
+	secret []byte
+
+	mutex sync.Mutex
+	used  map[string]time.Time // opaque -> expiration
+}
+
+func newRTMPAdobeAuth() (*rtmpAdobeAuth, error) {
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rtmpAdobeAuth{
+		secret: secret,
+		used:   make(map[string]time.Time),
+	}, nil
+}
+
+func (a *rtmpAdobeAuth) mac(v []byte) []byte {
+	h := hmac.New(sha256.New, a.secret)
+	h.Write(v)
+	return h.Sum(nil)[:16]
+}
+
+// salt returns the salt of a user, that doesn't change between connections.
+func (a *rtmpAdobeAuth) salt(user string) string {
+	return hex.EncodeToString(a.mac([]byte("salt:" + user))[:8])
+}
+
+// challenge returns a new challenge, that is also used as opaque value.
+// It contains the time of its creation, in order to allow to check whether
+// it's expired.
+func (a *rtmpAdobeAuth) challenge(now time.Time) (string, error) {
+	buf := make([]byte, 16)
+	_, err := rand.Read(buf[:8])
+	if err != nil {
+		return "", err
+	}
+	binary.BigEndian.PutUint64(buf[8:], uint64(now.Unix()))
+
+	return hex.EncodeToString(append(buf, a.mac(buf)...)), nil
+}
+
+func (a *rtmpAdobeAuth) checkChallenge(challenge string, now time.Time) error {
+	buf, err := hex.DecodeString(challenge)
+	if err != nil || len(buf) != 32 || !hmac.Equal(buf[16:], a.mac(buf[:16])) {
+		return fmt.Errorf("invalid challenge")
+	}
+
+	created := time.Unix(int64(binary.BigEndian.Uint64(buf[8:16])), 0)
+	if now.Sub(created) > rtmpAdobeAuthChallengeTimeout {
+		return fmt.Errorf("challenge is expired")
+	}
+
+	return nil
+}
+
+// connectRejection returns the description that has to be used to reject
+// a connect command of a client that has not completed the authentication yet,
+// or an empty string if the client has sent a response.
+func (a *rtmpAdobeAuth) connectRejection(params map[string]string, now time.Time) (string, error) {
+	if params["authmod"] != "adobe" || params["user"] == "" {
+		return rtmpAdobeAuthNeedAuth, nil
+	}
+
+	if params["response"] == "" {
+		challenge, err := a.challenge(now)
+		if err != nil {
+			return "", err
+		}
+
+		return fmt.Sprintf(rtmpAdobeAuthChallenge,
+			params["user"], a.salt(params["user"]), challenge, challenge), nil
+	}
+
+	return "", nil
+}
+
+// check checks the response sent by a client.
+// A challenge can be used by a single connection.
+func (a *rtmpAdobeAuth) check(params map[string]string, user string, pass string, now time.Time) error {
+	err := a.checkChallenge(params["opaque"], now)
+	if err != nil {
+		return err
+	}
+
+	err = a.checkResponse(params, user, pass)
+	if err != nil {
+		return err
+	}
+
+	return a.markUsed(params["opaque"], now)
+}
+
+func (a *rtmpAdobeAuth) markUsed(opaque string, now time.Time) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	for k, expiration := range a.used {
+		if now.After(expiration) {
+			delete(a.used, k)
+		}
+	}
+
+	if _, ok := a.used[opaque]; ok {
+		return fmt.Errorf("challenge has already been used")
+	}
+
+	a.used[opaque] = now.Add(rtmpAdobeAuthChallengeTimeout)
+	return nil
+}
+
+// checkResponse checks the response sent by a client, without checking
+// the challenge, that may have expired or may have been already used.
+// Therefore it must be used only to check again clients that are already
+// authenticated, for instance after a configuration reload.
+func (a *rtmpAdobeAuth) checkResponse(params map[string]string, user string, pass string) error {
+	if params["user"] != user {
+		return fmt.Errorf("invalid credentials")
+	}
+
+	// clients use the opaque value when available, the challenge otherwise.
+	opaque := params["opaque"]
+	expected := rtmpAdobeAuthResponse(user, a.salt(user), pass, opaque, params["challenge"])
+	if !hmac.Equal([]byte(params["response"]), []byte(expected)) {
+		return fmt.Errorf("invalid credentials")
+	}
+
+	return nil
+}
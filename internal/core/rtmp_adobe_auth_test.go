@@ -0,0 +1,76 @@
+package core
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRTMPAdobeAuth(t *testing.T) {
+	a, err := newRTMPAdobeAuth()
+	require.NoError(t, err)
+
+	now := time.Now()
+
+	// first attempt, without user
+	desc, err := a.connectRejection(rtmpAdobeAuthParams(""), now)
+	require.NoError(t, err)
+	require.Equal(t, rtmpAdobeAuthNeedAuth, desc)
+
+	// second attempt, with user
+	desc, err = a.connectRejection(rtmpAdobeAuthParams("authmod=adobe&user=myuser"), now)
+	require.NoError(t, err)
+	i := strings.Index(desc, "?")
+	require.NotEqual(t, -1, i)
+	params := rtmpAdobeAuthParams(desc[i+1:])
+	require.Equal(t, "needauth", params["reason"])
+	require.Equal(t, "myuser", params["user"])
+
+	response := func(pass string) map[string]string {
+		return rtmpAdobeAuthParams("authmod=adobe&user=myuser&challenge=abcd1234&opaque=" + params["opaque"] +
+			"&response=" + rtmpAdobeAuthResponse("myuser", params["salt"], pass, params["opaque"], "abcd1234"))
+	}
+
+	// third attempt, with response
+	desc, err = a.connectRejection(response("mypass"), now)
+	require.NoError(t, err)
+	require.Equal(t, "", desc)
+
+	err = a.check(response("wrongpass"), "myuser", "mypass", now)
+	require.EqualError(t, err, "invalid credentials")
+
+	err = a.check(response("mypass"), "otheruser", "mypass", now)
+	require.EqualError(t, err, "invalid credentials")
+
+	err = a.check(response("mypass"), "myuser", "mypass", now.Add(2*time.Minute))
+	require.EqualError(t, err, "challenge is expired")
+
+	err = a.check(response("mypass"), "myuser", "mypass", now)
+	require.NoError(t, err)
+
+	// responses can't be replayed
+	err = a.check(response("mypass"), "myuser", "mypass", now.Add(30*time.Second))
+	require.EqualError(t, err, "challenge has already been used")
+
+	// used challenges are forgotten after they expire
+	err = a.check(response("mypass"), "myuser", "mypass", now.Add(2*time.Minute))
+	require.EqualError(t, err, "challenge is expired")
+	require.NoError(t, a.markUsed("other", now.Add(2*time.Minute)))
+	require.Equal(t, 1, len(a.used))
+
+	// authenticated clients can be checked again after the challenge has been used
+	// and after it has expired, since checkResponse doesn't check the challenge
+	err = a.checkResponse(response("mypass"), "myuser", "mypass")
+	require.NoError(t, err)
+
+	err = a.checkResponse(response("mypass"), "myuser", "newpass")
+	require.EqualError(t, err, "invalid credentials")
+
+	// challenges created by another server are rejected
+	b, err := newRTMPAdobeAuth()
+	require.NoError(t, err)
+	err = b.check(response("mypass"), "myuser", "mypass", now)
+	require.EqualError(t, err, "invalid challenge")
+}
@@ -0,0 +1,120 @@
+package core
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/notedit/rtmp/av"
+)
+
+type rtmpAudioJitterBufferEntry struct {
+	pkt     av.Packet
+	release time.Time
+}
+
+// rtmpAudioJitterBuffer stores the audio frames sent to a reader, and releases
+// them spaced by their PTS, in order to smooth bursts caused by the network.
+// Frames are released in PTS order, and are never delayed more than maxDelay.
+type rtmpAudioJitterBuffer struct {
+	// accessed atomically, must be at the beginning of the struct
+	count uint64
+
+	maxDelay     time.Duration
+	onFillChange func(delta int64)
+	entries      []rtmpAudioJitterBufferEntry
+
+	// wall clock time and PTS that are used to compute release times
+	baseSet  bool
+	baseTime time.Time
+	basePTS  time.Duration
+}
+
+func newRTMPAudioJitterBuffer(
+	maxDelay time.Duration,
+	onFillChange func(delta int64),
+) *rtmpAudioJitterBuffer {
+	return &rtmpAudioJitterBuffer{
+		maxDelay:     maxDelay,
+		onFillChange: onFillChange,
+	}
+}
+
+// push stores a frame received at the given time.
+func (b *rtmpAudioJitterBuffer) push(pkt av.Packet, now time.Time) {
+	// the buffer has drained or the first frame has been received:
+	// start again by delaying the frame as much as possible.
+	if !b.baseSet || (len(b.entries) == 0 && b.releaseTime(pkt.Time).Before(now)) {
+		b.setBase(pkt.Time, now.Add(b.maxDelay))
+	}
+
+	// PTS are ahead of the wall clock: move the base,
+	// in order not to exceed the maximum delay.
+	release := b.releaseTime(pkt.Time)
+	if release.After(now.Add(b.maxDelay)) {
+		b.setBase(pkt.Time, now.Add(b.maxDelay))
+		release = now.Add(b.maxDelay)
+	}
+
+	i := sort.Search(len(b.entries), func(i int) bool {
+		return b.entries[i].pkt.Time > pkt.Time
+	})
+	b.entries = append(b.entries, rtmpAudioJitterBufferEntry{})
+	copy(b.entries[i+1:], b.entries[i:])
+	b.entries[i] = rtmpAudioJitterBufferEntry{
+		pkt:     pkt,
+		release: release,
+	}
+
+	b.setFill(uint64(len(b.entries)))
+}
+
+// pull returns the frames that have to be released at the given time.
+func (b *rtmpAudioJitterBuffer) pull(now time.Time) []av.Packet {
+	n := 0
+	for n < len(b.entries) && !b.entries[n].release.After(now) {
+		n++
+	}
+
+	if n == 0 {
+		return nil
+	}
+
+	ret := make([]av.Packet, n)
+	for i := 0; i < n; i++ {
+		ret[i] = b.entries[i].pkt
+	}
+	b.entries = b.entries[n:]
+
+	b.setFill(uint64(len(b.entries)))
+	return ret
+}
+
+// reset discards the stored frames.
+func (b *rtmpAudioJitterBuffer) reset() {
+	b.entries = nil
+	b.baseSet = false
+	b.setFill(0)
+}
+
+// fill returns the number of frames that have not been released yet.
+func (b *rtmpAudioJitterBuffer) fill() uint64 {
+	return atomic.LoadUint64(&b.count)
+}
+
+func (b *rtmpAudioJitterBuffer) setFill(n uint64) {
+	prev := atomic.SwapUint64(&b.count, n)
+	if n != prev {
+		b.onFillChange(int64(n) - int64(prev))
+	}
+}
+
+func (b *rtmpAudioJitterBuffer) setBase(pts time.Duration, t time.Time) {
+	b.baseSet = true
+	b.basePTS = pts
+	b.baseTime = t
+}
+
+func (b *rtmpAudioJitterBuffer) releaseTime(pts time.Duration) time.Time {
+	return b.baseTime.Add(pts - b.basePTS)
+}
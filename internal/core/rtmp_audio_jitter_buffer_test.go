@@ -0,0 +1,51 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/notedit/rtmp/av"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRTMPAudioJitterBuffer(t *testing.T) {
+	var total int64
+	b := newRTMPAudioJitterBuffer(100*time.Millisecond, func(delta int64) {
+		total += delta
+	})
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	pull := func(d time.Duration) []time.Duration {
+		var ret []time.Duration
+		for _, pkt := range b.pull(now.Add(d)) {
+			ret = append(ret, pkt.Time)
+		}
+		return ret
+	}
+
+	// frames received in a burst are spaced by their PTS
+	b.push(av.Packet{Time: 0}, now)
+	b.push(av.Packet{Time: 20 * time.Millisecond}, now.Add(60*time.Millisecond))
+	b.push(av.Packet{Time: 40 * time.Millisecond}, now.Add(60*time.Millisecond))
+	require.Equal(t, uint64(3), b.fill())
+	require.Equal(t, int64(3), total)
+	require.Equal(t, []time.Duration(nil), pull(60*time.Millisecond))
+	require.Equal(t, []time.Duration{0}, pull(100*time.Millisecond))
+	require.Equal(t, []time.Duration{20 * time.Millisecond}, pull(120*time.Millisecond))
+	require.Equal(t, []time.Duration{40 * time.Millisecond}, pull(140*time.Millisecond))
+
+	// frames are reordered
+	b.push(av.Packet{Time: 80 * time.Millisecond}, now.Add(150*time.Millisecond))
+	b.push(av.Packet{Time: 60 * time.Millisecond}, now.Add(150*time.Millisecond))
+	require.Equal(t, []time.Duration{60 * time.Millisecond, 80 * time.Millisecond}, pull(200*time.Millisecond))
+
+	// the maximum delay is never exceeded
+	b.push(av.Packet{Time: time.Second}, now.Add(200*time.Millisecond))
+	require.Equal(t, []time.Duration(nil), pull(250*time.Millisecond))
+	require.Equal(t, []time.Duration{time.Second}, pull(300*time.Millisecond))
+
+	b.push(av.Packet{Time: 1020 * time.Millisecond}, now.Add(300*time.Millisecond))
+	b.reset()
+	require.Equal(t, uint64(0), b.fill())
+	require.Equal(t, int64(0), total)
+}
@@ -0,0 +1,113 @@
+package core
+
+import (
+	"sync"
+	"time"
+)
+
+type rtmpAuthBackoffEntry struct {
+	failures    int
+	lastFailure time.Time
+}
+
+// rtmpAuthBackoff keeps track of authentication failures of each IP,
+// in order to increase exponentially the delay imposed to IPs that
+// fail repeatedly, even when they use multiple connections.
+type rtmpAuthBackoff struct {
+	maxDelay time.Duration
+	window   time.Duration
+
+	mutex   sync.Mutex
+	entries map[string]*rtmpAuthBackoffEntry
+}
+
+func newRTMPAuthBackoff(maxDelay time.Duration, window time.Duration) *rtmpAuthBackoff {
+	return &rtmpAuthBackoff{
+		maxDelay: maxDelay,
+		window:   window,
+		entries:  make(map[string]*rtmpAuthBackoffEntry),
+	}
+}
+
+func (b *rtmpAuthBackoff) delayOf(failures int) time.Duration {
+	d := rtmpConnPauseAfterAuthError
+	for i := 1; i < failures && d < b.maxDelay; i++ {
+		d *= 2
+	}
+	if d > b.maxDelay {
+		d = b.maxDelay
+	}
+	return d
+}
+
+// blocked returns whether the IP has to wait before attempting again.
+func (b *rtmpAuthBackoff) blocked(ip string) bool {
+	if b.maxDelay == 0 {
+		return false
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	e, ok := b.entries[ip]
+	if !ok {
+		return false
+	}
+
+	return time.Since(e.lastFailure) < b.delayOf(e.failures)
+}
+
+// delay returns the delay to impose to the IP after an authentication failure.
+func (b *rtmpAuthBackoff) delay(ip string) time.Duration {
+	if b.maxDelay == 0 {
+		return rtmpConnPauseAfterAuthError
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	e, ok := b.entries[ip]
+	if !ok {
+		return rtmpConnPauseAfterAuthError
+	}
+
+	return b.delayOf(e.failures)
+}
+
+func (b *rtmpAuthBackoff) onFailure(ip string) {
+	if b.maxDelay == 0 {
+		return
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	now := time.Now()
+
+	// remove stale IPs
+	for key, e := range b.entries {
+		if now.Sub(e.lastFailure) >= b.window {
+			delete(b.entries, key)
+		}
+	}
+
+	e, ok := b.entries[ip]
+	if !ok {
+		e = &rtmpAuthBackoffEntry{}
+		b.entries[ip] = e
+	}
+
+	e.failures++
+	e.lastFailure = now
+}
+
+func (b *rtmpAuthBackoff) onSuccess(ip string) {
+	if b.maxDelay == 0 {
+		return
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	delete(b.entries, ip)
+}
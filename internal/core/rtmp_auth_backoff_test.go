@@ -0,0 +1,41 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRTMPAuthBackoff(t *testing.T) {
+	b := newRTMPAuthBackoff(10*time.Second, 10*time.Minute)
+
+	require.Equal(t, false, b.blocked("127.0.0.1"))
+	require.Equal(t, 2*time.Second, b.delay("127.0.0.1"))
+
+	b.onFailure("127.0.0.1")
+	require.Equal(t, true, b.blocked("127.0.0.1"))
+	require.Equal(t, false, b.blocked("127.0.0.2"))
+	require.Equal(t, 2*time.Second, b.delay("127.0.0.1"))
+
+	b.onFailure("127.0.0.1")
+	require.Equal(t, 4*time.Second, b.delay("127.0.0.1"))
+
+	b.onFailure("127.0.0.1")
+	require.Equal(t, 8*time.Second, b.delay("127.0.0.1"))
+
+	b.onFailure("127.0.0.1")
+	require.Equal(t, 10*time.Second, b.delay("127.0.0.1"))
+
+	b.onSuccess("127.0.0.1")
+	require.Equal(t, false, b.blocked("127.0.0.1"))
+	require.Equal(t, 2*time.Second, b.delay("127.0.0.1"))
+}
+
+func TestRTMPAuthBackoffDisabled(t *testing.T) {
+	b := newRTMPAuthBackoff(0, 10*time.Minute)
+
+	b.onFailure("127.0.0.1")
+	require.Equal(t, false, b.blocked("127.0.0.1"))
+	require.Equal(t, 2*time.Second, b.delay("127.0.0.1"))
+}
@@ -0,0 +1,36 @@
+package core
+
+import (
+	"sync/atomic"
+)
+
+// rtmpBitrateMeter measures the bitrate of a publisher over a sliding window.
+// Bytes are accumulated into a running counter, that is sampled periodically.
+type rtmpBitrateMeter struct {
+	// accessed atomically, must be at the beginning of the struct
+	bytes uint64
+
+	samples []uint64
+}
+
+// newRTMPBitrateMeter allocates a meter whose window is made of windowLen samples.
+func newRTMPBitrateMeter(windowLen int) *rtmpBitrateMeter {
+	return &rtmpBitrateMeter{
+		samples: make([]uint64, 0, windowLen+1),
+	}
+}
+
+func (m *rtmpBitrateMeter) add(n int) {
+	atomic.AddUint64(&m.bytes, uint64(n))
+}
+
+// sample samples the counter and returns the number of bytes received
+// during the window, and whether the window has been entirely filled.
+func (m *rtmpBitrateMeter) sample() (uint64, bool) {
+	if len(m.samples) == cap(m.samples) {
+		m.samples = append(m.samples[:0], m.samples[1:]...)
+	}
+	m.samples = append(m.samples, atomic.LoadUint64(&m.bytes))
+
+	return m.samples[len(m.samples)-1] - m.samples[0], len(m.samples) == cap(m.samples)
+}
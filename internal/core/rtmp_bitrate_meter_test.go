@@ -0,0 +1,31 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRTMPBitrateMeter(t *testing.T) {
+	m := newRTMPBitrateMeter(2)
+
+	n, full := m.sample()
+	require.Equal(t, uint64(0), n)
+	require.Equal(t, false, full)
+
+	m.add(1000)
+	n, full = m.sample()
+	require.Equal(t, uint64(1000), n)
+	require.Equal(t, false, full)
+
+	m.add(500)
+	n, full = m.sample()
+	require.Equal(t, uint64(1500), n)
+	require.Equal(t, true, full)
+
+	// the first sample leaves the window
+	m.add(200)
+	n, full = m.sample()
+	require.Equal(t, uint64(700), n)
+	require.Equal(t, true, full)
+}
@@ -1,343 +1,1936 @@
 package core
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"math"
 	"net"
 	"net/url"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/aler9/gortsplib"
+	"github.com/aler9/gortsplib/pkg/aac"
 	"github.com/aler9/gortsplib/pkg/h264"
-	"github.com/aler9/gortsplib/pkg/ringbuffer"
 	"github.com/aler9/gortsplib/pkg/rtpaac"
 	"github.com/aler9/gortsplib/pkg/rtph264"
+	"github.com/aler9/gortsplib/pkg/rtptimedec"
 	"github.com/notedit/rtmp/av"
 	nh264 "github.com/notedit/rtmp/codec/h264"
+	"github.com/notedit/rtmp/codec/opus"
 
 	"github.com/aler9/rtsp-simple-server/internal/conf"
 	"github.com/aler9/rtsp-simple-server/internal/externalcmd"
 	"github.com/aler9/rtsp-simple-server/internal/logger"
 	"github.com/aler9/rtsp-simple-server/internal/rtmp"
+	"github.com/aler9/rtsp-simple-server/internal/rtpopus"
 )
 
 const (
 	rtmpConnPauseAfterAuthError = 2 * time.Second
+	rtmpConnMaxThrottleDelay    = 1 * time.Second
+
+	// the bitrate of publishers is sampled every period and computed on a window
+	// made of multiple samples, in order to tolerate short bursts.
+	rtmpConnBitrateSamplePeriod = 1 * time.Second
+	rtmpConnBitrateWindowLen    = 5
+
+	// maximum time that readers wait for the SPS and PPS, when they are
+	// not available in the track and must be received in-band.
+	rtmpConnH264ParamsTimeout = 10 * time.Second
+
+	// PTS are shifted by this amount before being converted into RTP timestamps,
+	// since they are negative when a frame that precedes the first one
+	// in display order has a negative composition time.
+	rtmpConnRTPPTSOffset = 10 * time.Second
+
+	// maximum bitrate and rate of the AMF data messages forwarded from a publisher
+	// to readers, in order to prevent a publisher from flooding the read buffers
+	// with either big or small messages. Messages that exceed them are discarded.
+	rtmpConnAMFDataMaxBitrate = 64 // kbps
+	rtmpConnAMFDataMaxRate    = 50 // messages per second
 )
 
+// rtmpConnCloseReason returns a human-friendly description of the error
+// that caused a connection to be closed.
+func rtmpConnCloseReason(err error) string {
+	switch rtmpServerConnErrorKind(err) {
+	case "timeout":
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Op == "write" {
+			return "write timeout"
+		}
+		return "read timeout"
+
+	case "reset":
+		return "connection reset"
+
+	case "eof":
+		return "client disconnected"
+
+	default:
+		return fmt.Sprintf("%v", err)
+	}
+}
+
+// rtmpConnCloseCause is the cause of the closure of a connection.
+type rtmpConnCloseCause int
+
+const (
+	rtmpConnCloseCauseClient rtmpConnCloseCause = iota
+	rtmpConnCloseCauseTimeout
+	rtmpConnCloseCauseAuth
+	rtmpConnCloseCauseKicked
+	rtmpConnCloseCauseShutdown
+	rtmpConnCloseCauseTerminated
+	rtmpConnCloseCauseCapacity
+	rtmpConnCloseCauseError
+)
+
+func (c rtmpConnCloseCause) String() string {
+	switch c {
+	case rtmpConnCloseCauseClient:
+		return "client"
+
+	case rtmpConnCloseCauseTimeout:
+		return "timeout"
+
+	case rtmpConnCloseCauseAuth:
+		return "auth"
+
+	case rtmpConnCloseCauseKicked:
+		return "kicked"
+
+	case rtmpConnCloseCauseShutdown:
+		return "shutdown"
+
+	case rtmpConnCloseCauseTerminated:
+		return "terminated"
+
+	case rtmpConnCloseCauseCapacity:
+		return "capacity"
+	}
+	return "error"
+}
+
+// rtmpConnErrAuth is returned when a client fails to authenticate,
+// or when its credentials are not valid anymore.
+type rtmpConnErrAuth struct {
+	message string
+}
+
+// Error implements the error interface.
+func (e rtmpConnErrAuth) Error() string {
+	return e.message
+}
+
+// rtmpConnCloseCauseFromError classifies the error that caused a connection
+// to be closed, when the closure has not been requested by the server.
+func rtmpConnCloseCauseFromError(err error) rtmpConnCloseCause {
+	var authErr rtmpConnErrAuth
+	if errors.As(err, &authErr) {
+		return rtmpConnCloseCauseAuth
+	}
+
+	if errors.Is(err, rtmp.ErrUnpublished) {
+		return rtmpConnCloseCauseClient
+	}
+
+	switch rtmpServerConnErrorKind(err) {
+	case "timeout":
+		return rtmpConnCloseCauseTimeout
+
+	case "reset", "eof":
+		return rtmpConnCloseCauseClient
+	}
+
+	return rtmpConnCloseCauseError
+}
+
 func pathNameAndQuery(inURL *url.URL) (string, url.Values, string) {
 	// remove leading and trailing slashes inserted by OBS and some other clients
 	tmp := strings.TrimRight(inURL.String(), "/")
 	ur, _ := url.Parse(tmp)
 	pathName := strings.TrimLeft(ur.Path, "/")
+
+	// the URL is built by joining the app and the stream key with a slash;
+	// remove empty segments produced when they begin or end with a slash,
+	// in order to obtain the path name that RTSP clients would use.
+	var segs []string
+	for _, seg := range strings.Split(pathName, "/") {
+		if seg != "" {
+			segs = append(segs, seg)
+		}
+	}
+	pathName = strings.Join(segs, "/")
+
 	return pathName, ur.Query(), ur.RawQuery
 }
 
-type rtmpConnState int
+// rtmpConnStreamKeyEmpty returns whether the client left the stream key empty.
+// Since the URL is built by joining the app and the stream key with a slash,
+// the path ends with a slash in this case.
+func rtmpConnStreamKeyEmpty(u *url.URL) bool {
+	return strings.HasSuffix(u.Path, "/")
+}
 
-const (
-	rtmpConnStateIdle rtmpConnState = iota //nolint:deadcode,varcheck
-	rtmpConnStateRead
-	rtmpConnStatePublish
-)
+// rtmpConnQueryWithoutPass returns the encoded query,
+// without the password that may be used to authenticate.
+func rtmpConnQueryWithoutPass(query url.Values) string {
+	tmp := make(url.Values, len(query))
+	for k, v := range query {
+		if k != "pass" {
+			tmp[k] = v
+		}
+	}
+	return tmp.Encode()
+}
 
-type rtmpConnPathManager interface {
-	onReaderSetupPlay(req pathReaderSetupPlayReq) pathReaderSetupPlayRes
-	onPublisherAnnounce(req pathPublisherAnnounceReq) pathPublisherAnnounceRes
+// rtmpConnWithoutPass removes the password from the query of a string
+// sent by a client, like the app, the tcUrl or the stream name.
+func rtmpConnWithoutPass(s string) string {
+	i := strings.Index(s, "?")
+	if i < 0 {
+		return s
+	}
+
+	// the query is removed entirely when it can't be parsed
+	query, err := url.ParseQuery(s[i+1:])
+	if err != nil {
+		return s[:i]
+	}
+
+	if _, ok := query["pass"]; !ok {
+		return s
+	}
+
+	return s[:i+1] + rtmpConnQueryWithoutPass(query)
 }
 
-type rtmpConnParent interface {
-	log(logger.Level, string, ...interface{})
-	onConnClose(*rtmpConn)
+// rtmpConnSupportedTracks returns the IDs of the video and audio tracks
+// that can be sent with RTMP, and the IDs of the other tracks,
+// like metadata or ONVIF data tracks, that are skipped.
+func rtmpConnSupportedTracks(tracks gortsplib.Tracks) ([]int, []int, []int) {
+	var videoTrackIDs []int
+	var audioTrackIDs []int
+	var skippedTrackIDs []int
+
+	for i, track := range tracks {
+		switch track.(type) {
+		case *gortsplib.TrackH264:
+			videoTrackIDs = append(videoTrackIDs, i)
+
+		case *gortsplib.TrackAAC, *gortsplib.TrackOpus, *gortsplib.TrackPCMU:
+			audioTrackIDs = append(audioTrackIDs, i)
+
+		default:
+			if rtmp.TrackIsPCMA(track) {
+				audioTrackIDs = append(audioTrackIDs, i)
+			} else {
+				skippedTrackIDs = append(skippedTrackIDs, i)
+			}
+		}
+	}
+
+	return videoTrackIDs, audioTrackIDs, skippedTrackIDs
 }
 
-type rtmpConn struct {
-	id                        string
-	externalAuthenticationURL string
-	rtspAddress               string
-	readTimeout               conf.StringDuration
-	writeTimeout              conf.StringDuration
-	readBufferCount           int
-	runOnConnect              string
-	runOnConnectRestart       bool
-	wg                        *sync.WaitGroup
-	conn                      *rtmp.Conn
-	externalCmdPool           *externalcmd.Pool
-	pathManager               rtmpConnPathManager
-	parent                    rtmpConnParent
+// rtmpConnReaderWriteTimeout returns the write timeout of a reader, that can be
+// increased with the writeTimeout query parameter, up to max.
+// The parameter can't decrease it, in order to prevent readers from being
+// closed because of short timeouts. When max is zero, the parameter is ignored.
+func rtmpConnReaderWriteTimeout(query url.Values, def time.Duration, max time.Duration) (time.Duration, error) {
+	v := query.Get("writeTimeout")
+	if v == "" || max == 0 {
+		return def, nil
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid write timeout: '%s'", v)
+	}
 
-	ctx        context.Context
-	ctxCancel  func()
-	path       *path
-	ringBuffer *ringbuffer.RingBuffer // read
-	state      rtmpConnState
-	stateMutex sync.Mutex
+	if d > max {
+		d = max
+	}
+	if d < def {
+		d = def
+	}
+	return d, nil
 }
 
-func newRTMPConn(
-	parentCtx context.Context,
-	id string,
-	externalAuthenticationURL string,
-	rtspAddress string,
-	readTimeout conf.StringDuration,
-	writeTimeout conf.StringDuration,
-	readBufferCount int,
-	runOnConnect string,
-	runOnConnectRestart bool,
-	wg *sync.WaitGroup,
-	nconn net.Conn,
-	externalCmdPool *externalcmd.Pool,
-	pathManager rtmpConnPathManager,
-	parent rtmpConnParent,
-) *rtmpConn {
-	ctx, ctxCancel := context.WithCancel(parentCtx)
+// rtmpConnSelectTrack returns the ID of the track selected by the query
+// parameter named key, which is a 1-based index among the given tracks.
+// When the parameter is missing, the first track is selected.
+// When the parameter is zero, no track is selected.
+func rtmpConnSelectTrack(query url.Values, key string, trackIDs []int) (int, error) {
+	v := query.Get(key)
+	if v == "" {
+		if len(trackIDs) == 0 {
+			return -1, nil
+		}
+		return trackIDs[0], nil
+	}
 
-	c := &rtmpConn{
-		id:                        id,
-		externalAuthenticationURL: externalAuthenticationURL,
-		rtspAddress:               rtspAddress,
-		readTimeout:               readTimeout,
-		writeTimeout:              writeTimeout,
-		readBufferCount:           readBufferCount,
-		runOnConnect:              runOnConnect,
-		runOnConnectRestart:       runOnConnectRestart,
-		wg:                        wg,
-		conn:                      rtmp.NewServerConn(nconn),
-		externalCmdPool:           externalCmdPool,
-		pathManager:               pathManager,
-		parent:                    parent,
-		ctx:                       ctx,
-		ctxCancel:                 ctxCancel,
+	n, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		return -1, fmt.Errorf("invalid %s track index: '%s'", key, v)
 	}
 
-	c.log(logger.Info, "opened")
+	if n == 0 {
+		return -1, nil
+	}
 
-	c.wg.Add(1)
-	go c.run()
+	if n > uint64(len(trackIDs)) {
+		return -1, fmt.Errorf("%s track %d not found, the stream contains %d %s tracks",
+			key, n, len(trackIDs), key)
+	}
 
-	return c
+	return trackIDs[n-1], nil
 }
 
-// Close closes a Conn.
-func (c *rtmpConn) close() {
-	c.ctxCancel()
-}
+// rtmpConnSelectVariant returns the path that has to be read, given the requested
+// name and the quality query parameter. When the name doesn't have variants
+// or the quality is not specified, the requested name is returned.
+func rtmpConnSelectVariant(variants conf.RTMPVariants, pathName string, query url.Values) (string, error) {
+	qualities, ok := variants[pathName]
+	if !ok {
+		return pathName, nil
+	}
 
-// ID returns the ID of the Conn.
-func (c *rtmpConn) ID() string {
-	return c.id
+	quality := query.Get("quality")
+	if quality == "" {
+		return pathName, nil
+	}
+
+	actual, ok := qualities[quality]
+	if !ok {
+		available := make([]string, 0, len(qualities))
+		for q := range qualities {
+			available = append(available, q)
+		}
+		sort.Strings(available)
+
+		return "", fmt.Errorf("invalid quality '%s' for '%s', available qualities are: %s",
+			quality, pathName, strings.Join(available, ", "))
+	}
+
+	return actual, nil
 }
 
-// RemoteAddr returns the remote address of the Conn.
-func (c *rtmpConn) RemoteAddr() net.Addr {
-	return c.conn.RemoteAddr()
+// rtmpConnCountedConn is a net.Conn that counts transferred bytes.
+type rtmpConnCountedConn struct {
+	net.Conn
+	bytesReceived *uint64
+	bytesSent     *uint64
 }
 
-func (c *rtmpConn) log(level logger.Level, format string, args ...interface{}) {
-	c.parent.log(level, "[conn %v] "+format, append([]interface{}{c.conn.RemoteAddr()}, args...)...)
+func (cc *rtmpConnCountedConn) Read(p []byte) (int, error) {
+	n, err := cc.Conn.Read(p)
+	atomic.AddUint64(cc.bytesReceived, uint64(n))
+	return n, err
 }
 
-func (c *rtmpConn) ip() net.IP {
-	return c.conn.RemoteAddr().(*net.TCPAddr).IP
+func (cc *rtmpConnCountedConn) Write(p []byte) (int, error) {
+	n, err := cc.Conn.Write(p)
+	atomic.AddUint64(cc.bytesSent, uint64(n))
+	return n, err
 }
 
-func (c *rtmpConn) safeState() rtmpConnState {
-	c.stateMutex.Lock()
-	defer c.stateMutex.Unlock()
-	return c.state
+type rtmpConnState int
+
+const (
+	rtmpConnStateIdle rtmpConnState = iota
+	rtmpConnStateRead
+	rtmpConnStatePublish
+
+	// the connection is closing. It is only notified to the parent.
+	rtmpConnStateClosed
+)
+
+func (s rtmpConnState) String() string {
+	switch s {
+	case rtmpConnStateRead:
+		return "read"
+
+	case rtmpConnStatePublish:
+		return "publish"
+
+	case rtmpConnStateClosed:
+		return "closed"
+	}
+	return "idle"
 }
 
-func (c *rtmpConn) run() {
-	defer c.wg.Done()
+type rtmpConnPathManager interface {
+	onReaderSetupPlay(req pathReaderSetupPlayReq) pathReaderSetupPlayRes
+	onPublisherAnnounce(req pathPublisherAnnounceReq) pathPublisherAnnounceRes
+}
 
-	err := func() error {
-		if c.runOnConnect != "" {
-			c.log(logger.Info, "runOnConnect command started")
-			_, port, _ := net.SplitHostPort(c.rtspAddress)
-			onConnectCmd := externalcmd.NewCmd(
-				c.externalCmdPool,
-				c.runOnConnect,
-				c.runOnConnectRestart,
-				externalcmd.Environment{
-					"RTSP_PATH": "",
-					"RTSP_PORT": port,
-				},
-				func(co int) {
-					c.log(logger.Info, "runOnConnect command exited with code %d", co)
-				})
+// low delay AAC object types.
+const (
+	rtmpConnAACTypeLD  = 23
+	rtmpConnAACTypeELD = 39
+)
 
-			defer func() {
-				onConnectCmd.Close()
-				c.log(logger.Info, "runOnConnect command stopped")
-			}()
+// rtmpConnAACSamplesPerFrame returns the number of samples of each
+// access unit of an AAC track, that depends on the object type and
+// on the frame length flag of the GASpecificConfig (or ELDSpecificConfig).
+func rtmpConnAACSamplesPerFrame(track *gortsplib.TrackAAC) int {
+	conf := track.AOTSpecificConfig()
+	frameLengthFlag := len(conf) > 0 && (conf[0]>>7) != 0
+
+	switch track.Type() {
+	case rtmpConnAACTypeLD, rtmpConnAACTypeELD:
+		if frameLengthFlag {
+			return 480
 		}
+		return 512
+	}
 
-		ctx, cancel := context.WithCancel(c.ctx)
-		runErr := make(chan error)
-		go func() {
-			runErr <- c.runInner(ctx)
-		}()
+	if frameLengthFlag {
+		return 960
+	}
+	return 1024
+}
 
-		select {
-		case err := <-runErr:
-			cancel()
-			return err
+// rtmpConnCheckAAC checks whether an AAC configuration can be muxed into RTMP.
+// Only AAC-LC is supported, since it's the only object type that
+// is understood by the AAC decoder and by most RTMP players.
+func rtmpConnCheckAAC(typ int, channelCount int) error {
+	if aac.MPEG4AudioType(typ) != aac.MPEG4AudioTypeAACLC {
+		return fmt.Errorf("unsupported AAC object type: %d (only AAC-LC (%d) is supported)",
+			typ, aac.MPEG4AudioTypeAACLC)
+	}
 
-		case <-c.ctx.Done():
-			cancel()
-			<-runErr
-			return errors.New("terminated")
+	if channelCount < 1 || channelCount > 8 {
+		return fmt.Errorf("unsupported AAC channel count: %d", channelCount)
+	}
+
+	return nil
+}
+
+// rtmpConnCheckPCMA checks whether a G.711 A-law track can be muxed into RTMP.
+// FLV audio tags of G.711 frames are always 8kHz mono, while the static payload
+// type of these tracks can be associated with other parameters by the rtpmap.
+// G.711 mu-law tracks are always 8kHz mono, since they are checked by gortsplib.
+func rtmpConnCheckPCMA(track gortsplib.Track) error {
+	for _, attr := range track.MediaDescription().Attributes {
+		if attr.Key != "rtpmap" {
+			continue
 		}
-	}()
 
-	c.ctxCancel()
+		// <payload type> <encoding name>/<clock rate>[/<channels>]
+		parts := strings.SplitN(attr.Value, " ", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("invalid rtpmap: '%s'", attr.Value)
+		}
 
-	c.parent.onConnClose(c)
+		params := strings.Split(parts[1], "/")
+		if len(params) < 2 || params[1] != "8000" || (len(params) >= 3 && params[2] != "1") {
+			return fmt.Errorf("unsupported G.711 parameters: '%s' (only 8kHz mono is supported)", parts[1])
+		}
+	}
 
-	c.log(logger.Info, "closed (%v)", err)
+	return nil
 }
 
-func (c *rtmpConn) runInner(ctx context.Context) error {
-	go func() {
-		<-ctx.Done()
-		c.conn.Close()
-	}()
+// sample rates that can be encoded into the sampling frequency index of ADTS headers.
+var rtmpConnADTSSampleRates = []int{
+	96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350,
+}
 
-	c.conn.SetReadDeadline(time.Now().Add(time.Duration(c.readTimeout)))
-	c.conn.SetWriteDeadline(time.Now().Add(time.Duration(c.writeTimeout)))
-	err := c.conn.ServerHandshake()
-	if err != nil {
-		return err
+// rtmpConnADTSHeader returns the ADTS header of an AAC configuration,
+// in which the frame length has to be filled with rtmpConnADTSWrap().
+func rtmpConnADTSHeader(typ int, sampleRate int, channelCount int) ([]byte, error) {
+	// the object type is encoded with 2 bits
+	if typ < 1 || typ > 4 {
+		return nil, fmt.Errorf("AAC object type %d can't be encoded into ADTS", typ)
 	}
 
-	if c.conn.IsPublishing() {
-		return c.runPublish(ctx)
+	sampleRateIndex := -1
+	for i, sr := range rtmpConnADTSSampleRates {
+		if sr == sampleRate {
+			sampleRateIndex = i
+			break
+		}
 	}
-	return c.runRead(ctx)
+	if sampleRateIndex < 0 {
+		return nil, fmt.Errorf("AAC sample rate %d can't be encoded into ADTS", sampleRate)
+	}
+
+	var channelConfig int
+	switch {
+	case channelCount >= 1 && channelCount <= 6:
+		channelConfig = channelCount
+	case channelCount == 8:
+		channelConfig = 7
+	default:
+		return nil, fmt.Errorf("AAC channel count %d can't be encoded into ADTS", channelCount)
+	}
+
+	// buffer fullness is set to 0x7FF (variable bitrate), like ffmpeg does
+	return []byte{
+		0xFF,
+		0xF1,
+		byte((typ-1)<<6 | sampleRateIndex<<2 | channelConfig>>2),
+		byte((channelConfig & 0x03) << 6),
+		0x00,
+		0x1F,
+		0xFC,
+	}, nil
 }
 
-func (c *rtmpConn) runRead(ctx context.Context) error {
-	pathName, query, rawQuery := pathNameAndQuery(c.conn.URL())
+// rtmpConnADTSWrap prepends an ADTS header to an AAC access unit.
+func rtmpConnADTSWrap(header []byte, au []byte) ([]byte, error) {
+	frameLen := len(header) + len(au)
+	if frameLen > 0x1FFF {
+		return nil, fmt.Errorf("AAC access unit is too big to be encoded into ADTS (%d bytes)", len(au))
+	}
 
-	res := c.pathManager.onReaderSetupPlay(pathReaderSetupPlayReq{
-		author:   c,
-		pathName: pathName,
-		authenticate: func(
-			pathIPs []interface{},
-			pathUser conf.Credential,
-			pathPass conf.Credential,
-		) error {
-			return c.authenticate(pathName, pathIPs, pathUser, pathPass, "read", query, rawQuery)
-		},
-	})
+	ret := make([]byte, frameLen)
+	copy(ret, header)
+	ret[3] |= byte(frameLen >> 11)
+	ret[4] = byte(frameLen >> 3)
+	ret[5] |= byte(frameLen << 5)
+	copy(ret[len(header):], au)
+	return ret, nil
+}
 
-	if res.err != nil {
-		if terr, ok := res.err.(pathErrAuthCritical); ok {
-			// wait some seconds to stop brute force attacks
-			<-time.After(rtmpConnPauseAfterAuthError)
-			return errors.New(terr.message)
-		}
-		return res.err
+// rtmpConnH264ProfileName returns the name of a H264 profile.
+func rtmpConnH264ProfileName(profileIdc byte) string {
+	switch profileIdc {
+	case 66:
+		return "Baseline"
+	case 77:
+		return "Main"
+	case 88:
+		return "Extended"
+	case 100:
+		return "High"
+	case 110:
+		return "High 10"
+	case 122:
+		return "High 4:2:2"
+	case 244:
+		return "High 4:4:4 Predictive"
 	}
+	return strconv.FormatUint(uint64(profileIdc), 10)
+}
 
-	c.path = res.path
+// rtmpConnCheckBaseline checks whether a H264 stream can be decoded
+// by readers that support only the Baseline profile.
+func rtmpConnCheckBaseline(sps []byte) error {
+	if len(sps) < 3 {
+		return fmt.Errorf("invalid SPS")
+	}
 
-	defer func() {
-		c.path.onReaderRemove(pathReaderRemoveReq{author: c})
-	}()
+	// streams of other profiles that comply with the Baseline profile
+	// have the constraint_set0_flag set.
+	if sps[1] == 66 || (sps[2]&0x80) != 0 {
+		return nil
+	}
 
-	c.stateMutex.Lock()
-	c.state = rtmpConnStateRead
-	c.stateMutex.Unlock()
+	return fmt.Errorf("the stream uses the H264 %s profile, while the reader supports only the Baseline profile",
+		rtmpConnH264ProfileName(sps[1]))
+}
 
-	var videoTrack *gortsplib.TrackH264
-	videoTrackID := -1
-	var audioTrack *gortsplib.TrackAAC
-	audioTrackID := -1
-	var aacDecoder *rtpaac.Decoder
+// rtmpConnCheckResolution checks whether a resolution is within the given limits.
+// Limits equal to 0 mean unrestricted.
+func rtmpConnCheckResolution(width int, height int, maxWidth int, maxHeight int) error {
+	if maxWidth != 0 && width > maxWidth {
+		return fmt.Errorf("width (%d) exceeds the maximum allowed (%d)", width, maxWidth)
+	}
 
-	for i, track := range res.stream.tracks() {
-		switch tt := track.(type) {
-		case *gortsplib.TrackH264:
-			if videoTrack != nil {
-				return fmt.Errorf("can't read track %d with RTMP: too many tracks", i+1)
-			}
+	if maxHeight != 0 && height > maxHeight {
+		return fmt.Errorf("height (%d) exceeds the maximum allowed (%d)", height, maxHeight)
+	}
+
+	return nil
+}
 
-			videoTrack = tt
-			videoTrackID = i
+// rtmpConnH264Params returns the SPS and PPS contained in an access unit, if any.
+func rtmpConnH264Params(nalus [][]byte) ([]byte, []byte) {
+	var sps []byte
+	var pps []byte
 
-		case *gortsplib.TrackAAC:
-			if audioTrack != nil {
-				return fmt.Errorf("can't read track %d with RTMP: too many tracks", i+1)
-			}
+	for _, nalu := range nalus {
+		if len(nalu) == 0 {
+			continue
+		}
 
-			audioTrack = tt
-			audioTrackID = i
-			aacDecoder = &rtpaac.Decoder{SampleRate: track.ClockRate()}
-			aacDecoder.Init()
+		switch h264.NALUType(nalu[0] & 0x1F) {
+		case h264.NALUTypeSPS:
+			sps = nalu
+
+		case h264.NALUTypePPS:
+			pps = nalu
 		}
 	}
 
-	if videoTrack == nil && audioTrack == nil {
-		return fmt.Errorf("the stream doesn't contain an H264 track or an AAC track")
+	return sps, pps
+}
+
+// rtmpConnHandshakeTimeout returns the timeout of the handshake, that
+// can't be longer than the timeout used after the handshake.
+func rtmpConnHandshakeTimeout(handshakeTimeout conf.StringDuration, timeout conf.StringDuration) time.Duration {
+	if handshakeTimeout == 0 || handshakeTimeout > timeout {
+		return time.Duration(timeout)
 	}
+	return time.Duration(handshakeTimeout)
+}
 
-	c.conn.SetWriteDeadline(time.Now().Add(time.Duration(c.writeTimeout)))
-	err := c.conn.WriteTracks(videoTrack, audioTrack)
-	if err != nil {
-		return err
+// rtmpConnH264DecoderConfig returns a H264 decoder configuration
+// that contains the given SPS and PPS.
+func rtmpConnH264DecoderConfig(sps []byte, pps []byte) []byte {
+	codec := nh264.Codec{
+		SPS: map[int][]byte{
+			0: sps,
+		},
+		PPS: map[int][]byte{
+			0: pps,
+		},
 	}
 
-	c.ringBuffer = ringbuffer.New(uint64(c.readBufferCount))
+	b := make([]byte, 11+len(sps)+len(pps))
+	var n int
+	codec.ToConfig(b, &n)
+	return b[:n]
+}
+
+// rtmpConnAACOffset returns the PTS offset of the i-th access unit
+// of a group. It is computed in a single step in order to avoid
+// accumulating rounding errors.
+func rtmpConnAACOffset(i int, samplesPerFrame int, clockRate int) time.Duration {
+	return time.Duration(i) * time.Duration(samplesPerFrame) * time.Second / time.Duration(clockRate)
+}
+
+// rtmpConnPacketType returns the name of a packet type.
+func rtmpConnPacketType(typ int) string {
+	if s, ok := av.PacketTypeString[typ]; ok {
+		return s
+	}
+	return fmt.Sprintf("unknown type %d", typ)
+}
+
+// rtmpConnIsAnnexB returns whether a H264 packet is in Annex-B format
+// instead of AVCC, as sent by some encoders that don't follow the FLV specification.
+// Since a 3-byte start code is also the beginning of the length of a NALU
+// between 256 and 511 bytes, packets that start with it are considered
+// in Annex-B format only when they can't be decoded as AVCC.
+func rtmpConnIsAnnexB(byts []byte) bool {
+	if bytes.HasPrefix(byts, []byte{0x00, 0x00, 0x00, 0x01}) {
+		return true
+	}
+
+	if bytes.HasPrefix(byts, []byte{0x00, 0x00, 0x01}) {
+		_, err := h264.DecodeAVCC(byts)
+		return err != nil
+	}
+
+	return false
+}
+
+// rtmpConnCaptions returns the closed captions (CEA-608/708 cc_data)
+// contained in the SEI NALUs of an access unit.
+func rtmpConnCaptions(nalus [][]byte) [][]byte {
+	var ret [][]byte
+
+	for _, nalu := range nalus {
+		if len(nalu) == 0 || h264.NALUType(nalu[0]&0x1F) != h264.NALUTypeSEI {
+			continue
+		}
+
+		rbsp := h264.AntiCompetitionRemove(nalu[1:])
+
+		for len(rbsp) > 0 && rbsp[0] != 0x80 {
+			payloadType := 0
+			for len(rbsp) > 0 {
+				b := rbsp[0]
+				rbsp = rbsp[1:]
+				payloadType += int(b)
+				if b != 0xFF {
+					break
+				}
+			}
+
+			payloadSize := 0
+			for len(rbsp) > 0 {
+				b := rbsp[0]
+				rbsp = rbsp[1:]
+				payloadSize += int(b)
+				if b != 0xFF {
+					break
+				}
+			}
+
+			if payloadSize > len(rbsp) {
+				break
+			}
+
+			payload := rbsp[:payloadSize]
+			rbsp = rbsp[payloadSize:]
+
+			// user_data_registered_itu_t_t35, ATSC A/53 captions
+			if payloadType == 4 && len(payload) > 8 &&
+				payload[0] == 0xB5 && // country code (US)
+				payload[1] == 0x00 && payload[2] == 0x31 && // provider code (ATSC)
+				bytes.Equal(payload[3:7], []byte("GA94")) &&
+				payload[7] == 0x03 { // cc_data
+				ret = append(ret, payload[8:])
+			}
+		}
+	}
+
+	return ret
+}
+
+// rtmpConnPublisherIdentity returns the identity of a publisher,
+// that is used to recognize publishers that are reconnecting.
+// Publishers without credentials and stream key have no identity,
+// since they can't be told apart.
+func rtmpConnPublisherIdentity(query url.Values) string {
+	if query.Get("user") == "" && query.Get("pass") == "" && query.Get("key") == "" {
+		return ""
+	}
+
+	return "rtmp:" + url.Values{
+		"user": []string{query.Get("user")},
+		"pass": []string{query.Get("pass")},
+		"key":  []string{query.Get("key")},
+	}.Encode()
+}
+
+// rtmpConnAACTimestamps returns the timestamps of a group of AAC access units.
+// The first one is the PTS provided by the RTP decoder, while the following
+// ones are derived from it and from the duration of access units.
+func rtmpConnAACTimestamps(
+	pts time.Duration,
+	count int,
+	samplesPerFrame int,
+	clockRate int,
+) []time.Duration {
+	ret := make([]time.Duration, count)
+
+	for i := range ret {
+		ret[i] = pts + rtmpConnAACOffset(i, samplesPerFrame, clockRate)
+	}
+
+	return ret
+}
+
+// rtmpConnPing is pushed into the ring buffer of readers as a control item,
+// in order to write a ping without evicting frames.
+type rtmpConnPing struct{}
+
+// period of the checks of the audio jitter buffer of readers.
+const rtmpConnAudioJitterBufferPeriod = 10 * time.Millisecond
+
+// rtmpConnAudioTick is pushed into the ring buffer of readers as a control item,
+// in order to release the frames of the audio jitter buffer
+// when no other data is received.
+type rtmpConnAudioTick struct{}
+
+type rtmpConnParent interface {
+	log(logger.Level, string, ...interface{})
+	logFields(logger.Level, logger.Fields, string, ...interface{})
+	onConnClose(*rtmpConn, rtmpConnCloseCause)
+	onConnError(direction string, err error)
+	onConnStateChange(c *rtmpConn, oldState rtmpConnState, newState rtmpConnState)
+	onFramesDropped(n uint64)
+	onReadBufferOverflow(policy rtmpReadBufferPolicy)
+	onAudioJitterBufferFill(delta int64)
+}
+
+// rtmpConnConf contains the configuration of a rtmpConn,
+// that is shared by all the connections of a rtmpServer.
+type rtmpConnConf struct {
+	externalAuthenticationURL string
+	rtspAddress               string
+	pingPeriod                conf.StringDuration
+	drainTimeout              conf.StringDuration
+	authTrustedIPs            conf.IPsOrNets
+	redirectURL               string
+	tcpKeepAlivePeriod        conf.StringDuration
+	tcpDisableNoDelay         bool
+	tcpReceiveBufferSize      conf.StringSize
+	tcpSendBufferSize         conf.StringSize
+	slowReaderTimeout         conf.StringDuration
+	stalledPublisherTimeout   conf.StringDuration
+	minWriteTimeout           conf.StringDuration
+	maxReaderWriteTimeout     conf.StringDuration
+	maxPacketSize             conf.StringSize
+	handshakeTimeout          conf.StringDuration
+	replyBandwidthCheck       bool
+	requireStreamKey          bool
+	adobeAuthRequired         bool
+	variants                  conf.RTMPVariants
+	logLevel                  conf.LogLevel
+	readTimeout               conf.StringDuration
+	writeTimeout              conf.StringDuration
+	readBufferCount           int
+	runOnConnect              string
+	runOnConnectRestart       bool
+	runOnConnectCleanEnv      bool
+}
+
+type rtmpConn struct {
+	rtmpConnConf
+	id              string
+	authBackoff     *rtmpAuthBackoff
+	adobeAuth       *rtmpAdobeAuth
+	overCapacity    bool
+	wg              *sync.WaitGroup
+	tlsConn         *tls.Conn
+	conn            *rtmp.Conn
+	externalCmdPool *externalcmd.Pool
+	pathManager     rtmpConnPathManager
+	parent          rtmpConnParent
+
+	parentCtx     context.Context
+	ctx           context.Context
+	ctxCancel     func()
+	path          *path
+	ringBuffer    *rtmpReadBuffer        // read
+	audioJitter   *rtmpAudioJitterBuffer // read
+	tsUnwrapper   rtmpTimestampUnwrapper // publish
+	created       time.Time
+	kicked        bool
+	state         rtmpConnState
+	stateStart    time.Time
+	stateMutex    sync.Mutex
+	app           string
+	stopKeepalive func() // read
+	connectInfo   rtmp.ConnectInfo
+	encoderInfo   *rtmp.EncoderInfo // publish
+	tracks        gortsplib.Tracks  // publish
+	chunkSize     *int64
+	lastPacket    *int64  // publish
+	revoked       *uint32 // publish
+	videoFrames   *uint64 // publish
+	idrFrames     *uint64 // publish
+	lastIDR       *int64  // publish
+	bytesReceived *uint64
+	bytesSent     *uint64
+}
+
+// newRTMPConn allocates a rtmpConn. Clients of connections that are
+// over capacity are rejected as soon as they send the connect command.
+func newRTMPConn(
+	parentCtx context.Context,
+	id string,
+	cnf rtmpConnConf,
+	authBackoff *rtmpAuthBackoff,
+	adobeAuth *rtmpAdobeAuth,
+	overCapacity bool,
+	wg *sync.WaitGroup,
+	nconn net.Conn,
+	tlsConfig *tls.Config,
+	externalCmdPool *externalcmd.Pool,
+	pathManager rtmpConnPathManager,
+	parent rtmpConnParent,
+) *rtmpConn {
+	ctx, ctxCancel := context.WithCancel(parentCtx)
+	now := time.Now()
+
+	c := &rtmpConn{
+		rtmpConnConf:    cnf,
+		id:              id,
+		authBackoff:     authBackoff,
+		adobeAuth:       adobeAuth,
+		overCapacity:    overCapacity,
+		wg:              wg,
+		externalCmdPool: externalCmdPool,
+		pathManager:     pathManager,
+		parent:          parent,
+		parentCtx:       parentCtx,
+		ctx:             ctx,
+		ctxCancel:       ctxCancel,
+		created:         now,
+		stateStart:      now, // the idle state starts when the connection is created
+		chunkSize:       new(int64),
+		lastPacket:      new(int64),
+		revoked:         new(uint32),
+		videoFrames:     new(uint64),
+		idrFrames:       new(uint64),
+		lastIDR:         new(int64),
+		bytesReceived:   new(uint64),
+		bytesSent:       new(uint64),
+	}
+
+	rawConn := nconn
+
+	nconn = &rtmpConnCountedConn{
+		Conn:          nconn,
+		bytesReceived: c.bytesReceived,
+		bytesSent:     c.bytesSent,
+	}
+
+	if tlsConfig != nil {
+		c.tlsConn = tls.Server(nconn, tlsConfig)
+		nconn = c.tlsConn
+	}
+
+	c.conn = rtmp.NewServerConn(nconn)
+	c.conn.SetMaxMessageSize(uint32(c.maxPacketSize))
+
+	c.log(logger.Info, "opened")
+
+	c.setTCPOptions(rawConn)
+
+	c.wg.Add(1)
+	go c.run()
+
+	return c
+}
+
+// setTCPOptions sets the options of the underlying TCP connection.
+func (c *rtmpConn) setTCPOptions(nconn net.Conn) {
+	tcpConn, ok := nconn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+
+	if c.tcpKeepAlivePeriod != 0 {
+		err := tcpConn.SetKeepAlive(true)
+		if err == nil {
+			err = tcpConn.SetKeepAlivePeriod(time.Duration(c.tcpKeepAlivePeriod))
+		}
+		if err != nil {
+			c.log(logger.Warn, "unable to set TCP keepalive: %v", err)
+		}
+	}
+
+	if c.tcpDisableNoDelay {
+		err := tcpConn.SetNoDelay(false)
+		if err != nil {
+			c.log(logger.Warn, "unable to disable TCP no-delay: %v", err)
+		}
+	}
+
+	if c.tcpReceiveBufferSize == 0 && c.tcpSendBufferSize == 0 {
+		return
+	}
+
+	if c.tcpReceiveBufferSize != 0 {
+		err := tcpConn.SetReadBuffer(int(c.tcpReceiveBufferSize))
+		if err != nil {
+			c.log(logger.Warn, "unable to set the socket receive buffer size: %v", err)
+		}
+	}
+
+	if c.tcpSendBufferSize != 0 {
+		err := tcpConn.SetWriteBuffer(int(c.tcpSendBufferSize))
+		if err != nil {
+			c.log(logger.Warn, "unable to set the socket send buffer size: %v", err)
+		}
+	}
+
+	// the system may limit the sizes.
+	rcvBuf, sndBuf, err := rtmpConnSocketBufferSizes(tcpConn)
+	if err != nil {
+		c.log(logger.Debug, "unable to get the socket buffer sizes: %v", err)
+		return
+	}
+
+	c.log(logger.Debug, "socket buffer sizes: %d (receive), %d (send)", rcvBuf, sndBuf)
+
+	if rcvBuf < int(c.tcpReceiveBufferSize) {
+		c.log(logger.Warn, "socket receive buffer size has been limited by the system to %d", rcvBuf)
+	}
+
+	if sndBuf < int(c.tcpSendBufferSize) {
+		c.log(logger.Warn, "socket send buffer size has been limited by the system to %d", sndBuf)
+	}
+}
+
+// Close closes a Conn.
+func (c *rtmpConn) close() {
+	c.ctxCancel()
+}
+
+// kick closes the connection on behalf of the API.
+func (c *rtmpConn) kick() {
+	c.stateMutex.Lock()
+	c.kicked = true
+	c.stateMutex.Unlock()
+
+	c.close()
+}
+
+// ID returns the ID of the Conn.
+func (c *rtmpConn) ID() string {
+	return c.id
+}
+
+// RemoteAddr returns the remote address of the Conn.
+func (c *rtmpConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *rtmpConn) log(level logger.Level, format string, args ...interface{}) {
+	c.logFields(level, nil, format, args...)
+}
+
+// logFields writes a log entry with additional fields.
+func (c *rtmpConn) logFields(level logger.Level, extra logger.Fields, format string, args ...interface{}) {
+	c.stateMutex.Lock()
+	fields := logger.Fields{
+		"conn_id":     c.id,
+		"remote_addr": c.conn.RemoteAddr().String(),
+		"path":        c.app,
+		"state":       c.state.String(),
+	}
+	c.stateMutex.Unlock()
+
+	for k, v := range extra {
+		fields[k] = v
+	}
+
+	// the ID allows to match log lines with the entries returned by the API.
+	c.parent.logFields(level, fields, "[conn %v] [%s] "+format,
+		append([]interface{}{c.conn.RemoteAddr(), c.id}, args...)...)
+}
+
+// ip returns the IP of the client, or nil if the connection is not a TCP one.
+func (c *rtmpConn) ip() net.IP {
+	addr, ok := c.conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		c.log(logger.Warn, "unable to get the IP of the remote address (%T)", c.conn.RemoteAddr())
+		return nil
+	}
+	return addr.IP
+}
+
+// rtmpConnIPString returns the string representation of an IP,
+// or an empty string if the IP is unknown.
+func rtmpConnIPString(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	return ip.String()
+}
+
+// waitAfterAuthError waits some seconds to stop brute force attacks.
+// Clients whose IP is unknown always wait the same time,
+// since the backoff is computed per IP.
+func (c *rtmpConn) waitAfterAuthError() {
+	if c.isTrusted() {
+		return
+	}
+
+	ip := c.ip()
+	if ip == nil {
+		<-time.After(rtmpConnPauseAfterAuthError)
+		return
+	}
+
+	<-time.After(c.authBackoff.delay(ip.String()))
+}
+
+// isTrusted returns whether the client is exempted from anti brute force measures.
+func (c *rtmpConn) isTrusted() bool {
+	return ipEqualOrInRange(c.ip(), c.authTrustedIPs)
+}
+
+func (c *rtmpConn) safeState() rtmpConnState {
+	c.stateMutex.Lock()
+	defer c.stateMutex.Unlock()
+	return c.state
+}
+
+// setState changes the state of the connection and notifies the parent.
+func (c *rtmpConn) setState(state rtmpConnState) {
+	c.stateMutex.Lock()
+	oldState := c.state
+	c.state = state
+	c.stateStart = time.Now()
+	c.stateMutex.Unlock()
+
+	c.parent.onConnStateChange(c, oldState, state)
+}
+
+func (c *rtmpConn) run() {
+	defer c.wg.Done()
+
+	err := func() error {
+		if c.runOnConnect != "" && !c.overCapacity {
+			c.log(logger.Info, "runOnConnect command started")
+			_, port, _ := net.SplitHostPort(c.rtspAddress)
+			env := externalcmd.Environment{
+				"RTSP_PATH":    "",
+				"RTSP_PORT":    port,
+				"RTSP_CONN_ID": c.id,
+			}
+			if ip := c.ip(); ip != nil {
+				env["RTSP_CONN_IP"] = ip.String()
+			}
+
+			onConnectCmd := externalcmd.NewCmd(
+				c.externalCmdPool,
+				c.runOnConnect,
+				c.runOnConnectRestart,
+				c.runOnConnectCleanEnv,
+				env,
+				func(co int) {
+					c.log(logger.Info, "runOnConnect command exited with code %d", co)
+				})
+
+			defer func() {
+				onConnectCmd.Close()
+				c.log(logger.Info, "runOnConnect command stopped")
+			}()
+		}
+
+		ctx, cancel := context.WithCancel(c.ctx)
+		runErr := make(chan error)
+		go func() {
+			runErr <- c.runInner(ctx)
+		}()
+
+		select {
+		case err := <-runErr:
+			cancel()
+			return err
+
+		case <-c.ctx.Done():
+			cancel()
+			<-runErr
+			return errors.New("terminated")
+		}
+	}()
+
+	// the connection has been closed by the server when the context
+	// has been canceled before the end of the connection.
+	var cause rtmpConnCloseCause
+	switch {
+	case c.ctx.Err() == nil && c.overCapacity:
+		cause = rtmpConnCloseCauseCapacity
+
+	case c.ctx.Err() == nil:
+		cause = rtmpConnCloseCauseFromError(err)
+
+	case c.parentCtx.Err() != nil:
+		cause = rtmpConnCloseCauseShutdown
+
+	default:
+		cause = rtmpConnCloseCauseTerminated
+	}
+
+	c.ctxCancel()
+
+	c.stateMutex.Lock()
+	if c.kicked {
+		err = errors.New("kicked via API")
+		cause = rtmpConnCloseCauseKicked
+	}
+	c.stateMutex.Unlock()
+
+	// the end of reading or publishing is notified too, in order to allow
+	// the parent to keep track of the state of the connection.
+	if state := c.safeState(); state != rtmpConnStateIdle {
+		c.parent.onConnStateChange(c, state, rtmpConnStateClosed)
+	}
+
+	c.parent.onConnClose(c, cause)
+
+	c.logFields(logger.Info, logger.Fields{"close_cause": cause.String()},
+		"closed (%s: %s)", cause, rtmpConnCloseReason(err))
+}
+
+func (c *rtmpConn) runInner(ctx context.Context) error {
+	innerDone := make(chan struct{})
+	defer close(innerDone)
+
+	go func() {
+		<-ctx.Done()
+
+		// allow runRead() and runPublish() to terminate gracefully
+		if c.drainTimeout != 0 {
+			select {
+			case <-innerDone:
+			case <-time.After(time.Duration(c.drainTimeout)):
+			}
+		}
+
+		c.conn.Close()
+	}()
+
+	// tracing is enabled only when needed, since it requires to parse
+	// every received and sent message.
+	if logger.Level(c.logLevel) <= logger.Trace {
+		c.conn.Trace(func(received bool, description string) {
+			if received {
+				c.log(logger.Trace, "[c->s] %s", description)
+			} else {
+				c.log(logger.Trace, "[s->c] %s", description)
+			}
+		})
+	}
+
+	// the handshake must be completed within a shorter timeout, in order
+	// to limit the resources used by clients that keep it partially alive.
+	c.conn.SetReadDeadline(time.Now().Add(rtmpConnHandshakeTimeout(c.handshakeTimeout, c.readTimeout)))
+	c.conn.SetWriteDeadline(time.Now().Add(rtmpConnHandshakeTimeout(c.handshakeTimeout, c.writeTimeout)))
+
+	if c.tlsConn != nil {
+		err := c.tlsConn.Handshake()
+		if err != nil {
+			return err
+		}
+	}
+
+	// clients are rejected immediately, without the delay used against
+	// brute force attacks, since they are not at fault.
+	if c.overCapacity {
+		_, err := c.conn.ReadConnect()
+		if err != nil {
+			return err
+		}
+
+		c.conn.WriteConnectError("server at capacity")
+		return errors.New("server at capacity")
+	}
+
+	app, err := c.conn.ReadConnect()
+	if err != nil {
+		return err
+	}
+
+	err = c.authenticateConnect(app)
+	if err != nil {
+		return err
+	}
+
+	// clients are redirected before the connect command is accepted,
+	// since they connect to the target URL with the same stream name.
+	if c.redirectURL != "" {
+		redirected, err := c.redirect(app)
+		if redirected {
+			return err
+		}
+	}
+
+	if c.replyBandwidthCheck {
+		c.conn.ReplyBandwidthChecks()
+	}
+
+	err = c.conn.ServerHandshake()
+	if err != nil {
+		return err
+	}
+
+	c.conn.SetReadDeadline(time.Now().Add(time.Duration(c.readTimeout)))
+	c.conn.SetWriteDeadline(time.Now().Add(time.Duration(c.writeTimeout)))
+
+	// the parameters used by the client to connect are kept, in order to allow
+	// to connect to another server in the same way.
+	c.stateMutex.Lock()
+	c.connectInfo = c.conn.ConnectInfo()
+	c.stateMutex.Unlock()
+
+	atomic.StoreInt64(c.chunkSize, int64(c.conn.ReadChunkSize()))
+	c.log(logger.Debug, "chunk size: %d (sent), %d (received)",
+		c.conn.WriteChunkSize(), c.conn.ReadChunkSize())
+	c.log(logger.Debug, "acknowledgement window size: %d", c.conn.AckWindowSize())
+
+	u := *c.conn.URL()
+	u.RawQuery = rtmpConnQueryWithoutPass(u.Query())
+	c.log(logger.Debug, "requested URL: %s", u.String())
+
+	if c.requireStreamKey && rtmpConnStreamKeyEmpty(c.conn.URL()) {
+		err := errors.New("stream key is required")
+		c.writeError(err)
+		return err
+	}
+
+	if c.conn.IsPublishing() {
+		return c.runPublish(ctx)
+	}
+	return c.runRead(ctx)
+}
+
+// redirect asks the redirect service whether the client has to be handled by
+// another server and, in this case, rejects the connect command with a redirect.
+func (c *rtmpConn) redirect(app string) (bool, error) {
+	appPath, rawQuery := app, ""
+	if i := strings.Index(app, "?"); i >= 0 {
+		appPath, rawQuery = app[:i], app[i+1:]
+	}
+
+	target, err := rtmpRedirect(c.redirectURL, rtmpConnIPString(c.ip()), strings.Trim(appPath, "/"), rawQuery)
+	if err != nil {
+		c.log(logger.Warn, "unable to query the redirect service: %v", err)
+		return false, nil
+	}
+
+	if target == "" {
+		return false, nil
+	}
+
+	c.conn.SetWriteDeadline(time.Now().Add(time.Duration(c.writeTimeout)))
+	err = c.conn.WriteConnectRedirect(target)
+	if err != nil {
+		return true, err
+	}
+
+	return true, fmt.Errorf("redirected to %s", target)
+}
+
+func (c *rtmpConn) runRead(ctx context.Context) error {
+	pathName, query, rawQuery := pathNameAndQuery(c.conn.URL())
+
+	variantPathName, err := rtmpConnSelectVariant(c.variants, pathName, query)
+	if err != nil {
+		c.writeError(err)
+		return err
+	}
+	if variantPathName != pathName {
+		c.log(logger.Debug, "quality '%s' of '%s' is read from path '%s'",
+			query.Get("quality"), pathName, variantPathName)
+		pathName = variantPathName
+	}
+
+	c.stateMutex.Lock()
+	c.app = pathName
+	c.stateMutex.Unlock()
+
+	// the path may have to wait for an on-demand source:
+	// disable read deadline. The client is kept alive in the meanwhile
+	// by onReaderOnDemandWait().
+	c.conn.SetReadDeadline(time.Time{})
+
+	res := c.pathManager.onReaderSetupPlay(pathReaderSetupPlayReq{
+		author:   c,
+		pathName: pathName,
+		authenticate: func(
+			pathIPs []interface{},
+			pathUser conf.Credential,
+			pathPass conf.Credential,
+		) error {
+			return c.authenticate(pathName, pathIPs, pathUser, pathPass, "read", query, rawQuery)
+		},
+	})
+
+	c.stateMutex.Lock()
+	stopKeepalive := c.stopKeepalive
+	c.stopKeepalive = nil
+	c.stateMutex.Unlock()
+
+	if stopKeepalive != nil {
+		stopKeepalive()
+	}
+
+	if res.err != nil {
+		if terr, ok := res.err.(pathErrAuthCritical); ok {
+			err := rtmpConnErrAuth{message: terr.message}
+			c.writeError(err)
+
+			c.waitAfterAuthError()
+			return err
+		}
+
+		if _, ok := res.err.(pathErrTooManyReaders); ok {
+			c.log(logger.Warn, "%v", res.err)
+		}
+
+		c.writeError(res.err)
+		return res.err
+	}
+
+	c.path = res.path
+
+	defer func() {
+		c.path.onReaderRemove(pathReaderRemoveReq{author: c})
+	}()
+
+	c.setState(rtmpConnStateRead)
+
+	writeTimeout, err := rtmpConnReaderWriteTimeout(query, time.Duration(c.writeTimeout),
+		time.Duration(c.maxReaderWriteTimeout))
+	if err != nil {
+		c.writeError(err)
+		return err
+	}
+	if writeTimeout != time.Duration(c.writeTimeout) {
+		c.log(logger.Debug, "write timeout: %v", writeTimeout)
+	}
+
+	videoTrackIDs, audioTrackIDs, skippedTrackIDs := rtmpConnSupportedTracks(res.stream.tracks())
+
+	for _, id := range skippedTrackIDs {
+		c.log(logger.Debug, "skipping track %d (%s), since it can't be sent with RTMP",
+			id+1, res.stream.tracks()[id].MediaDescription().MediaName.Media)
+	}
+
+	if videoTrackIDs == nil && audioTrackIDs == nil {
+		return fmt.Errorf("the stream doesn't contain an H264 track, an AAC track, an Opus track or a G.711 track")
+	}
+
+	videoTrackID, err := rtmpConnSelectTrack(query, "video", videoTrackIDs)
+	if err != nil {
+		return err
+	}
+
+	audioTrackID, err := rtmpConnSelectTrack(query, "audio", audioTrackIDs)
+	if err != nil {
+		return err
+	}
+
+	// tracks can be omitted in order to save bandwidth, but not all of them.
+	// When the video track is omitted, audio is sent without waiting for an IDR.
+	if videoTrackID < 0 && audioTrackID < 0 {
+		err := fmt.Errorf("at least one track must be enabled")
+		c.writeError(err)
+		return err
+	}
+
+	var videoTrack *gortsplib.TrackH264
+	if videoTrackID >= 0 {
+		videoTrack = res.stream.tracks()[videoTrackID].(*gortsplib.TrackH264)
+
+		// readers that support only the Baseline profile show corrupted frames
+		// when they receive other profiles. The check is skipped when the SPS
+		// is not available yet.
+		if c.path.Conf().RTMPRejectNonBaseline && query.Get("profile") == "baseline" &&
+			videoTrack.SPS() != nil {
+			err := rtmpConnCheckBaseline(videoTrack.SPS())
+			if err != nil {
+				c.writeError(err)
+				return err
+			}
+		}
+	}
+
+	var audioTrack gortsplib.Track
+	var aacDecoder *rtpaac.Decoder
+	var aacSamplesPerFrame int
+	var aacADTSHeader []byte
+	var opusDecoder *rtpopus.Decoder
+	var opusCodec *opus.Codec
+	var g711TimeDecoder *rtptimedec.Decoder
+	var g711PacketType int
+	if audioTrackID >= 0 {
+		audioTrack = res.stream.tracks()[audioTrackID]
+
+		switch tt := audioTrack.(type) {
+		case *gortsplib.TrackAAC:
+			// the AAC sequence header is sent by WriteTracks(). It doesn't have to
+			// be sent again, since the configuration of a track can't change,
+			// and readers are closed when the publisher changes.
+			c.log(logger.Debug, "AAC object type: %d, channels: %d", tt.Type(), tt.ChannelCount())
+
+			err := rtmpConnCheckAAC(tt.Type(), tt.ChannelCount())
+			if err != nil {
+				return err
+			}
+
+			aacDecoder = &rtpaac.Decoder{SampleRate: tt.ClockRate()}
+			aacDecoder.Init()
+
+			aacSamplesPerFrame = c.path.Conf().RTMPAACSamplesPerFrame
+			if aacSamplesPerFrame == 0 {
+				aacSamplesPerFrame = rtmpConnAACSamplesPerFrame(tt)
+			}
+
+			aacFormat := c.path.Conf().RTMPAACFormat
+			if v := query.Get("aacFormat"); v != "" {
+				aacFormat = v
+			}
+
+			switch aacFormat {
+			case "raw":
+
+			case "adts":
+				aacADTSHeader, err = rtmpConnADTSHeader(tt.Type(), tt.ClockRate(), tt.ChannelCount())
+				if err != nil {
+					c.writeError(err)
+					return err
+				}
+
+			default:
+				err := fmt.Errorf("invalid AAC format: '%s'", aacFormat)
+				c.writeError(err)
+				return err
+			}
+
+		case *gortsplib.TrackOpus:
+			opusDecoder = &rtpopus.Decoder{SampleRate: tt.ClockRate()}
+			opusDecoder.Init()
+			opusCodec = &opus.Codec{
+				SampleRate: tt.ClockRate(),
+				Channels:   tt.ChannelCount(),
+			}
+
+		case *gortsplib.TrackPCMU:
+			g711TimeDecoder = rtptimedec.New(tt.ClockRate())
+			g711PacketType = rtmp.PacketPCMU
+
+		default:
+			err := rtmpConnCheckPCMA(tt)
+			if err != nil {
+				return err
+			}
+
+			g711TimeDecoder = rtptimedec.New(tt.ClockRate())
+			g711PacketType = rtmp.PacketPCMA
+		}
+
+		if g711TimeDecoder != nil {
+			c.log(logger.Warn, "the stream contains a G.711 track, that is not supported by Flash-based players")
+		}
+	}
+
+	// streams are always live: the requested position is ignored and the
+	// NetStream.Play.Reset status sent by WriteTracks() tells the player to flush
+	// its buffer, in order not to wait for data that will never be sent.
+	if playReq := c.conn.PlayRequest(); playReq.SeekRequested() {
+		c.log(logger.Info, "seeking is not supported with live streams (requested start: %vs, duration: %vs), "+
+			"playing from the live edge", playReq.Start, playReq.Duration)
+	}
+
+	// audio-only streams, like webradios, don't wait for any video frame:
+	// the AAC sequence header is sent by WriteTracks(), and audio frames
+	// are written as soon as they are received.
+	if videoTrack == nil && audioTrack != nil {
+		c.log(logger.Debug, "audio-only stream, audio starts immediately")
+	}
+
+	// the reader is removed from the path by the deferred onReaderRemove(),
+	// since it has not been added to the stream yet.
+	c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	err = c.conn.WriteTracks(videoTrack, audioTrack)
+	if err != nil {
+		if c.ctx.Err() == nil {
+			c.parent.onConnError("write", err)
+			c.log(logger.Info, "failed to send tracks to reader: %v", err)
+		}
+		return err
+	}
+
+	readBufferCount := c.readBufferCount
+	if c.path.Conf().ReadBufferCount != 0 {
+		readBufferCount = c.path.Conf().ReadBufferCount
+	}
+
+	readBufferPolicy := rtmpReadBufferPolicyFromConf(c.path.Conf().RTMPReadBufferPolicy)
+	c.log(logger.Debug, "read buffer: %d frames, policy: %s", readBufferCount, readBufferPolicy)
+
+	c.stateMutex.Lock()
+	c.ringBuffer = newRTMPReadBuffer(uint64(readBufferCount), readBufferPolicy,
+		time.Duration(c.path.Conf().RTMPReadBufferBlockTimeout))
+	c.stateMutex.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		c.ringBuffer.close()
+	}()
+
+	// the keyframe is requested after the reader has been added to the stream,
+	// in order not to lose it.
+	c.path.onReaderPlay(pathReaderPlayReq{
+		author:          c,
+		requestKeyFrame: c.path.Conf().RTMPRequestKeyFrame && videoTrack != nil,
+	})
+
+	if c.path.Conf().RunOnRead != "" {
+		c.log(logger.Info, "runOnRead command started")
+		env := c.path.externalCmdEnv()
+		env["RTSP_QUERY"] = rtmpConnQueryWithoutPass(query)
+		onReadCmd := externalcmd.NewCmd(
+			c.externalCmdPool,
+			c.path.Conf().RunOnRead,
+			c.path.Conf().RunOnReadRestart,
+			c.path.Conf().RunOnReadCleanEnv,
+			env,
+			func(co int) {
+				c.log(logger.Info, "runOnRead command exited with code %d", co)
+			})
+		defer func() {
+			onReadCmd.Close()
+			c.log(logger.Info, "runOnRead command stopped")
+		}()
+	}
+
+	// since the read deadline is disabled, dead readers are detected
+	// by periodically writing a ping.
+	if c.pingPeriod != 0 {
+		go func() {
+			t := time.NewTicker(time.Duration(c.pingPeriod))
+			defer t.Stop()
+
+			for {
+				select {
+				case <-t.C:
+					c.ringBuffer.pushControl(rtmpConnPing{})
+
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	// audio frames are spaced by their PTS before being written,
+	// in order to smooth bursts caused by the network.
+	var audioJitter *rtmpAudioJitterBuffer
+	if audioTrack != nil && c.path.Conf().RTMPAudioJitterBuffer != 0 {
+		audioJitter = newRTMPAudioJitterBuffer(time.Duration(c.path.Conf().RTMPAudioJitterBuffer),
+			c.parent.onAudioJitterBufferFill)
+		defer audioJitter.reset()
+
+		c.stateMutex.Lock()
+		c.audioJitter = audioJitter
+		c.stateMutex.Unlock()
+
+		// frames are released when data is pulled from the ring buffer;
+		// when no data is received, wake up the reader periodically.
+		go func() {
+			t := time.NewTicker(rtmpConnAudioJitterBufferPeriod)
+			defer t.Stop()
+
+			for {
+				select {
+				case <-t.C:
+					if audioJitter.fill() != 0 && c.ringBuffer.fill() == 0 {
+						c.ringBuffer.pushControl(rtmpConnAudioTick{})
+					}
+
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	// read pause requests of the client
+	pauseReq := make(chan bool)
+	go func() {
+		for {
+			paused, err := c.conn.ReadPause()
+			if err != nil {
+				return
+			}
+
+			select {
+			case pauseReq <- paused:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var limiter *rtmpRateLimiter
+	if c.path.Conf().RTMPMaxReadBitrate != 0 {
+		limiter = newRTMPRateLimiter(c.path.Conf().RTMPMaxReadBitrate)
+	}
+
+	// throttle waits until n bytes can be written without exceeding the bitrate,
+	// and returns false if the wait would be too long.
+	throttle := func(n int) bool {
+		if limiter == nil {
+			return true
+		}
+
+		wait, ok := limiter.take(n, time.Now(), rtmpConnMaxThrottleDelay)
+		if !ok {
+			return false
+		}
+
+		if wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+			}
+		}
+		return true
+	}
+
+	// SPS and PPS used to build the decoder configuration. When the publisher
+	// sends them only in-band, they are extracted from the access units.
+	var videoSPS []byte
+	var videoPPS []byte
+	var videoSentSPS []byte
+	var videoParamsDeadline time.Time
+	if videoTrack != nil {
+		videoSPS = videoTrack.SPS()
+		videoPPS = videoTrack.PPS()
+		if videoSPS == nil || videoPPS == nil {
+			c.log(logger.Debug, "SPS or PPS not available yet, waiting for them in-band")
+			videoParamsDeadline = time.Now().Add(rtmpConnH264ParamsTimeout)
+		}
+	}
+
+	var videoInitialPTS *time.Duration
+	videoFirstIDRFound := false
+	var videoFirstIDRPTS time.Duration
+	var videoDTSEst *h264.DTSEstimator
+	videoCTimeClamped := false
+	videoWaitIDR := false
+	audioDropping := false
+	absoluteTimestamps := c.path.Conf().RTMPAbsoluteTimestamps
+	discontinuityThreshold := time.Duration(c.path.Conf().RTMPDiscontinuityThreshold)
+	var videoLastPTS *time.Duration
+	var videoMaxSentPTS time.Duration
+	maxLatency := time.Duration(c.path.Conf().MaxLatency)
+	videoLate := false
+
+	// offset added to timestamps after a discontinuity,
+	// in order to keep them monotonic.
+	var timeOffset time.Duration
+
+	// offset subtracted from the PTS of audio frames after a discontinuity,
+	// in order to align them with the new video base.
+	var audioBasePTS time.Duration
+	audioRebase := false
+
+	// audioPTS converts the PTS of an audio frame into the one sent to the reader,
+	// and returns false if the frame precedes the first video IDR.
+	audioPTS := func(pts time.Duration) (time.Duration, bool) {
+		// the first audio frame received after the IDR that follows
+		// a discontinuity is aligned with the IDR.
+		if audioRebase {
+			audioRebase = false
+			audioBasePTS = pts - videoFirstIDRPTS
+		}
+		pts -= audioBasePTS
+
+		if absoluteTimestamps {
+			if videoInitialPTS != nil {
+				pts += *videoInitialPTS
+			}
+			return pts + timeOffset, true
+		}
+
+		pts -= videoFirstIDRPTS
+		return pts + timeOffset, pts >= 0
+	}
+
+	writeDeadline := newRTMPWriteDeadline(time.Duration(c.minWriteTimeout), writeTimeout)
+
+	// timestamp of the most recent frame that has been written.
+	var lastWrittenTime time.Duration
+
+	// writeMedia writes a frame within the adaptive write deadline.
+	// timestamps are 64-bit and are wrapped around to 32 bits when they are
+	// written, as expected by RTMP readers.
+	writeMedia := func(pkt av.Packet) error {
+		start := time.Now()
+		c.conn.SetWriteDeadline(start.Add(writeDeadline.timeout()))
+		err := c.writePacket(pkt)
+		if err != nil {
+			return err
+		}
+
+		if pkt.Time > lastWrittenTime {
+			lastWrittenTime = pkt.Time
+		}
+
+		writeDeadline.onWrite(time.Since(start))
+		return nil
+	}
+
+	writeAudio := func(pkt av.Packet) error {
+		if aacADTSHeader != nil && pkt.Type == av.AAC {
+			var err error
+			pkt.Data, err = rtmpConnADTSWrap(aacADTSHeader, pkt.Data)
+			if err != nil {
+				c.log(logger.Warn, "%v", err)
+				return nil
+			}
+		}
+
+		if !throttle(len(pkt.Data)) {
+			if !audioDropping {
+				audioDropping = true
+				c.log(logger.Warn, "reader is too slow for the maximum bitrate, dropping audio frames")
+			}
+			return nil
+		}
+		audioDropping = false
+
+		return writeMedia(pkt)
+	}
+
+	// enqueueAudio writes an audio frame, or stores it into the jitter buffer.
+	enqueueAudio := func(pkt av.Packet) error {
+		if audioJitter == nil {
+			return writeAudio(pkt)
+		}
+
+		audioJitter.push(pkt, time.Now())
+		return nil
+	}
+
+	// audio frames received before the first video IDR, with their original PTS.
+	earlyAudioMaxSize := c.path.Conf().RTMPEarlyAudioBufferSize
+	var earlyAudio []av.Packet
+
+	bufferEarlyAudio := func(pkt av.Packet) {
+		if len(earlyAudio) >= earlyAudioMaxSize {
+			earlyAudio = earlyAudio[1:]
+		}
+		earlyAudio = append(earlyAudio, pkt)
+	}
+
+	for {
+		select {
+		case paused := <-pauseReq:
+			if !paused {
+				break
+			}
+
+			c.log(logger.Debug, "paused")
+			c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			err := c.conn.WriteStatus("NetStream.Pause.Notify", "paused")
+			if err != nil {
+				return err
+			}
+
+			// stop consuming data until the client resumes,
+			// without slowing down the source or detecting a slow reader.
+			c.ringBuffer.setPaused(true)
+
+			err = c.waitResume(ctx, pauseReq, writeTimeout)
+			if err != nil {
+				return err
+			}
+
+			c.ringBuffer.setPaused(false)
+
+			c.log(logger.Debug, "resumed")
+			c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			err = c.conn.WriteStatus("NetStream.Unpause.Notify", "unpaused")
+			if err != nil {
+				return err
+			}
+
+			// avoid flooding the client with data received during the pause
+			videoWaitIDR = true
+
+			// timestamps received after the pause are not a discontinuity
+			videoLastPTS = nil
+
+			if audioJitter != nil {
+				audioJitter.reset()
+			}
+
+		default:
+		}
+
+		item, dropped, ok := c.ringBuffer.pull()
+		if !ok {
+			if c.drainTimeout != 0 {
+				// remaining data has been written, notify the client
+				c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+				c.conn.WriteStatus("NetStream.Play.Stop", "play stop")
+			}
+			return fmt.Errorf("terminated")
+		}
+
+		if audioJitter != nil {
+			for _, pkt := range audioJitter.pull(time.Now()) {
+				err := writeAudio(pkt)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		if dropped {
+			c.log(logger.Warn, "reader is too slow, the read buffer overflowed and frames have been dropped")
 
-	go func() {
-		<-ctx.Done()
-		c.ringBuffer.Close()
-	}()
+			// frames that depend on the dropped ones can't be decoded
+			videoWaitIDR = true
+		}
 
-	c.path.onReaderPlay(pathReaderPlayReq{
-		author: c,
-	})
+		if _, ok := item.(rtmpConnAudioTick); ok {
+			continue
+		}
 
-	if c.path.Conf().RunOnRead != "" {
-		c.log(logger.Info, "runOnRead command started")
-		onReadCmd := externalcmd.NewCmd(
-			c.externalCmdPool,
-			c.path.Conf().RunOnRead,
-			c.path.Conf().RunOnReadRestart,
-			c.path.externalCmdEnv(),
-			func(co int) {
-				c.log(logger.Info, "runOnRead command exited with code %d", co)
-			})
-		defer func() {
-			onReadCmd.Close()
-			c.log(logger.Info, "runOnRead command stopped")
-		}()
-	}
+		if _, ok := item.(rtmpConnPing); ok {
+			c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			err := c.conn.WritePing()
+			if err != nil {
+				return err
+			}
+			continue
+		}
 
-	// disable read deadline
-	c.conn.SetReadDeadline(time.Time{})
+		data := item.(*data)
 
-	var videoInitialPTS *time.Duration
-	videoFirstIDRFound := false
-	var videoFirstIDRPTS time.Duration
-	var videoDTSEst *h264.DTSEstimator
+		if data.amfData != nil {
+			// the reader starts from the first IDR.
+			if videoTrack != nil && !videoFirstIDRFound {
+				continue
+			}
 
-	for {
-		item, ok := c.ringBuffer.Pull()
-		if !ok {
-			return fmt.Errorf("terminated")
+			// the timestamps of the publisher can't be mapped to the ones
+			// of the reader, therefore data messages are written with
+			// the timestamp of the last frame, that they were received with.
+			err := writeMedia(av.Packet{
+				Type: rtmp.PacketData,
+				Data: data.amfData,
+				Time: lastWrittenTime,
+			})
+			if err != nil {
+				return err
+			}
+			continue
 		}
-		data := item.(*data)
+
+		// the frame exceeds the latency budget. Frames of the GOP cache are old
+		// by design and are never late.
+		late := maxLatency != 0 && !data.replayed && time.Since(data.received) > maxLatency
 
 		if videoTrack != nil && data.trackID == videoTrackID {
 			if data.h264NALUs == nil {
 				continue
 			}
 
+			sps, pps := rtmpConnH264Params(data.h264NALUs)
+			if sps != nil {
+				videoSPS = sps
+			}
+			if pps != nil {
+				videoPPS = pps
+			}
+
+			// frames can't be decoded without SPS and PPS.
+			if videoSPS == nil || videoPPS == nil {
+				if time.Now().After(videoParamsDeadline) {
+					return fmt.Errorf("SPS and PPS have not been received within %v", rtmpConnH264ParamsTimeout)
+				}
+				continue
+			}
+
+			// the publisher reset its timestamps: start again from the next IDR,
+			// with timestamps that follow the ones already sent.
+			if videoLastPTS != nil {
+				jump := data.h264PTS - *videoLastPTS
+				if jump > discontinuityThreshold || jump < -discontinuityThreshold {
+					c.log(logger.Warn, "PTS discontinuity detected (%v), resetting timestamps", jump)
+					videoInitialPTS = nil
+					videoFirstIDRFound = false
+					videoFirstIDRPTS = 0
+					timeOffset = videoMaxSentPTS + time.Millisecond
+
+					// audio timestamps jumped too, but not necessarily at the same time:
+					// audio is discarded until the next IDR, then re-based.
+					audioRebase = true
+					earlyAudio = nil
+				}
+			}
+			v := data.h264PTS
+			videoLastPTS = &v
+
 			// video is decoded in another routine,
 			// while audio is decoded in this routine:
 			// we have to sync their PTS.
@@ -347,6 +1940,27 @@ func (c *rtmpConn) runRead(ctx context.Context) error {
 			}
 			pts := data.h264PTS - *videoInitialPTS
 
+			// skip late frames; since the following ones can't be decoded
+			// without them, skip everything until the next IDR.
+			if late && videoFirstIDRFound && !videoWaitIDR && !h264.IDRPresent(data.h264NALUs) {
+				c.log(logger.Warn, "frames are exceeding the maximum latency, "+
+					"skipping to the next keyframe")
+				videoWaitIDR = true
+				videoLate = true
+			}
+
+			// after a resume, wait until we receive an IDR
+			if videoWaitIDR {
+				if !h264.IDRPresent(data.h264NALUs) {
+					if videoLate {
+						c.parent.onFramesDropped(1)
+					}
+					continue
+				}
+				videoWaitIDR = false
+				videoLate = false
+			}
+
 			// wait until we receive an IDR
 			if !videoFirstIDRFound {
 				if !h264.IDRPresent(data.h264NALUs) {
@@ -356,25 +1970,76 @@ func (c *rtmpConn) runRead(ctx context.Context) error {
 				videoFirstIDRFound = true
 				videoFirstIDRPTS = pts
 				videoDTSEst = h264.NewDTSEstimator()
+
+				// start timestamps from the first buffered audio frame
+				if earlyAudio != nil && earlyAudio[0].Time < videoFirstIDRPTS {
+					videoFirstIDRPTS = earlyAudio[0].Time
+				}
+
+				// when the stream contains B-frames, the DTS of the first IDR
+				// precedes its PTS: all timestamps are shifted, in order not to write
+				// a negative DTS and to preserve the composition times of the publisher.
+				if c.path.Conf().RTMPDTSPassthrough && data.h264DTS != nil && !absoluteTimestamps {
+					dts := *data.h264DTS - *videoInitialPTS - videoFirstIDRPTS + timeOffset
+					if dts < 0 {
+						timeOffset -= dts
+					}
+				}
+
+				if earlyAudio != nil {
+					for _, pkt := range earlyAudio {
+						var ok bool
+						pkt.Time, ok = audioPTS(pkt.Time)
+						if !ok {
+							continue
+						}
+
+						err := enqueueAudio(pkt)
+						if err != nil {
+							return err
+						}
+					}
+					earlyAudio = nil
+				}
+			}
+
+			size := 0
+			for _, nalu := range data.h264NALUs {
+				size += 4 + len(nalu)
+			}
+
+			if !throttle(size) {
+				c.log(logger.Warn, "reader is too slow for the maximum bitrate, "+
+					"dropping frames until the next keyframe")
+				videoWaitIDR = true
+				continue
 			}
 
 			if h264.IDRPresent(data.h264NALUs) {
-				codec := nh264.Codec{
-					SPS: map[int][]byte{
-						0: videoTrack.SPS(),
-					},
-					PPS: map[int][]byte{
-						0: videoTrack.PPS(),
-					},
-				}
-				b := make([]byte, 128)
-				var n int
-				codec.ToConfig(b, &n)
-				b = b[:n]
-
-				err = c.conn.WritePacket(av.Packet{
+				// the publisher may have changed resolution: prefer the parameters
+				// sent together with the IDR, then the ones of the track.
+				if sps == nil {
+					sps = videoTrack.SPS()
+				}
+				if pps == nil {
+					pps = videoTrack.PPS()
+				}
+				if sps == nil || pps == nil {
+					sps, pps = videoSPS, videoPPS
+				}
+
+				if videoSentSPS != nil && !bytes.Equal(sps, videoSentSPS) {
+					if parsed, err := nh264.ParseSPS(sps); err == nil {
+						c.log(logger.Info, "H264 parameters changed, resolution: %dx%d", parsed.Width, parsed.Height)
+					} else {
+						c.log(logger.Info, "H264 parameters changed")
+					}
+				}
+				videoSentSPS = sps
+
+				err = writeMedia(av.Packet{
 					Type: av.H264DecoderConfig,
-					Data: b,
+					Data: rtmpConnH264DecoderConfig(sps, pps),
 				})
 				if err != nil {
 					return err
@@ -386,20 +2051,127 @@ func (c *rtmpConn) runRead(ctx context.Context) error {
 				return err
 			}
 
-			pts -= videoFirstIDRPTS
-			dts := videoDTSEst.Feed(pts)
+			var dts time.Duration
+			if absoluteTimestamps {
+				pts = data.h264PTS
+			} else {
+				pts -= videoFirstIDRPTS
+			}
+
+			if c.path.Conf().RTMPDTSPassthrough && data.h264DTS != nil {
+				if absoluteTimestamps {
+					dts = *data.h264DTS
+				} else {
+					dts = *data.h264DTS - *videoInitialPTS - videoFirstIDRPTS
+				}
+			} else {
+				dts = videoDTSEst.Feed(pts)
+			}
+
+			pts += timeOffset
+			dts += timeOffset
+			if pts > videoMaxSentPTS {
+				videoMaxSentPTS = pts
+			}
 
-			c.conn.SetWriteDeadline(time.Now().Add(time.Duration(c.writeTimeout)))
-			err = c.conn.WritePacket(av.Packet{
+			ctime := pts - dts
+			if ctime < 0 && c.path.Conf().RTMPClampCTime {
+				if !videoCTimeClamped {
+					videoCTimeClamped = true
+					c.log(logger.Warn, "negative composition time (%v), clamping to zero", ctime)
+				}
+				ctime = 0
+			}
+
+			err = writeMedia(av.Packet{
 				Type:  av.H264,
 				Data:  avcc,
 				Time:  dts,
-				CTime: pts - dts,
+				CTime: ctime,
+			})
+			if err != nil {
+				return err
+			}
+		} else if opusDecoder != nil && data.trackID == audioTrackID {
+			frame, pts, err := opusDecoder.Decode(data.rtp)
+			if err != nil {
+				c.log(logger.Warn, "unable to decode audio track: %v", err)
+				continue
+			}
+
+			if videoTrack != nil && !videoFirstIDRFound && earlyAudioMaxSize != 0 && !audioRebase {
+				bufferEarlyAudio(av.Packet{
+					Type: av.OPUS,
+					Data: frame,
+					Time: pts,
+					OPUS: opusCodec,
+				})
+				continue
+			}
+
+			if videoTrack != nil && (!videoFirstIDRFound || videoWaitIDR) {
+				continue
+			}
+
+			if late {
+				c.parent.onFramesDropped(1)
+				continue
+			}
+
+			pts, ok := audioPTS(pts)
+			if !ok {
+				continue
+			}
+
+			err = enqueueAudio(av.Packet{
+				Type: av.OPUS,
+				Data: frame,
+				Time: pts,
+				OPUS: opusCodec,
+			})
+			if err != nil {
+				return err
+			}
+		} else if g711TimeDecoder != nil && data.trackID == audioTrackID {
+			// G.711 RTP payloads contain raw samples, that can be sent as they are.
+			if len(data.rtp.Payload) == 0 {
+				continue
+			}
+			frame := data.rtp.Payload
+			pts := g711TimeDecoder.Decode(data.rtp.Timestamp)
+
+			if videoTrack != nil && !videoFirstIDRFound && earlyAudioMaxSize != 0 && !audioRebase {
+				bufferEarlyAudio(av.Packet{
+					Type: g711PacketType,
+					Data: frame,
+					Time: pts,
+				})
+				continue
+			}
+
+			if videoTrack != nil && (!videoFirstIDRFound || videoWaitIDR) {
+				continue
+			}
+
+			if late {
+				c.parent.onFramesDropped(1)
+				continue
+			}
+
+			pts, ok := audioPTS(pts)
+			if !ok {
+				continue
+			}
+
+			err := enqueueAudio(av.Packet{
+				Type: g711PacketType,
+				Data: frame,
+				Time: pts,
 			})
 			if err != nil {
 				return err
 			}
-		} else if audioTrack != nil && data.trackID == audioTrackID {
+		} else if aacDecoder != nil && data.trackID == audioTrackID {
 			aus, pts, err := aacDecoder.Decode(data.rtp)
 			if err != nil {
 				if err != rtpaac.ErrMorePacketsNeeded {
@@ -408,39 +2180,216 @@ func (c *rtmpConn) runRead(ctx context.Context) error {
 				continue
 			}
 
-			if videoTrack != nil && !videoFirstIDRFound {
+			if videoTrack != nil && !videoFirstIDRFound && earlyAudioMaxSize != 0 && !audioRebase {
+				for i, au := range aus {
+					bufferEarlyAudio(av.Packet{
+						Type: av.AAC,
+						Data: au,
+						Time: pts + rtmpConnAACOffset(i, aacSamplesPerFrame, audioTrack.ClockRate()),
+					})
+				}
 				continue
 			}
 
-			pts -= videoFirstIDRPTS
-			if pts < 0 {
+			if videoTrack != nil && (!videoFirstIDRFound || videoWaitIDR) {
 				continue
 			}
 
-			for _, au := range aus {
-				c.conn.SetWriteDeadline(time.Now().Add(time.Duration(c.writeTimeout)))
-				err := c.conn.WritePacket(av.Packet{
+			if late {
+				c.parent.onFramesDropped(uint64(len(aus)))
+				continue
+			}
+
+			pts, ok := audioPTS(pts)
+			if !ok {
+				continue
+			}
+
+			auPTSs := rtmpConnAACTimestamps(pts, len(aus), aacSamplesPerFrame, audioTrack.ClockRate())
+
+			for i, au := range aus {
+				err := enqueueAudio(av.Packet{
 					Type: av.AAC,
 					Data: au,
-					Time: pts,
+					Time: auPTSs[i],
 				})
 				if err != nil {
 					return err
 				}
+			}
+		}
+	}
+}
+
+func (c *rtmpConn) writePacket(pkt av.Packet) error {
+	err := c.conn.WritePacket(pkt)
+	if err != nil && c.ctx.Err() == nil {
+		c.parent.onConnError("write", err)
+	}
+	return err
+}
+
+func (c *rtmpConn) readPacket() (av.Packet, error) {
+	pkt, err := c.conn.ReadPacket()
+	if err != nil {
+		if c.ctx.Err() == nil && err != rtmp.ErrUnpublished {
+			c.parent.onConnError("read", err)
+		}
+		return pkt, err
+	}
+
+	atomic.StoreInt64(c.lastPacket, time.Now().UnixNano())
+
+	// packets are read by a single routine.
+	pkt.Time = c.tsUnwrapper.unwrap(pkt.Time)
+
+	return pkt, nil
+}
+
+// onReaderOnDemandWait implements readerOnDemandWaiter.
+func (c *rtmpConn) onReaderOnDemandWait(pathConf *conf.PathConf, timeout time.Duration) {
+	c.stateMutex.Lock()
+	defer c.stateMutex.Unlock()
+
+	if c.stopKeepalive == nil {
+		c.stopKeepalive = c.startKeepalive(time.Duration(pathConf.RTMPOnDemandKeepalive), timeout)
+	}
+}
+
+// startKeepalive writes pings periodically until the returned function is called
+// or timeout has passed.
+func (c *rtmpConn) startKeepalive(period time.Duration, timeout time.Duration) func() {
+	terminate := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		t := time.NewTicker(period)
+		defer t.Stop()
+
+		deadline := time.NewTimer(timeout)
+		defer deadline.Stop()
+
+		for {
+			select {
+			case <-t.C:
+				c.conn.SetWriteDeadline(time.Now().Add(time.Duration(c.writeTimeout)))
+				err := c.conn.WritePing()
+				if err != nil {
+					return
+				}
+
+			case <-deadline.C:
+				return
 
-				pts += 1000 * time.Second / time.Duration(audioTrack.ClockRate())
+			case <-terminate:
+				return
 			}
 		}
+	}()
+
+	return func() {
+		close(terminate)
+		<-done
 	}
 }
 
 func (c *rtmpConn) runPublish(ctx context.Context) error {
+	pathName, query, rawQuery := pathNameAndQuery(c.conn.URL())
+	c.stateMutex.Lock()
+	c.app = pathName
+	c.stateMutex.Unlock()
+
+	atomic.StoreInt64(c.lastPacket, time.Now().UnixNano())
+
+	res := c.pathManager.onPublisherAnnounce(pathPublisherAnnounceReq{
+		author:   c,
+		pathName: pathName,
+		authenticate: func(
+			pathIPs []interface{},
+			pathUser conf.Credential,
+			pathPass conf.Credential,
+		) error {
+			return c.authenticate(pathName, pathIPs, pathUser, pathPass, "publish", query, rawQuery)
+		},
+		identity: rtmpConnPublisherIdentity(query),
+	})
+
+	if res.err != nil {
+		if terr, ok := res.err.(pathErrAuthCritical); ok {
+			err := rtmpConnErrAuth{message: terr.message}
+			c.writeError(err)
+
+			c.waitAfterAuthError()
+			return err
+		}
+
+		switch res.err.(type) {
+		case pathErrPublisherConflict, pathErrInvalidName:
+			c.conn.SetWriteDeadline(time.Now().Add(time.Duration(c.writeTimeout)))
+			c.conn.WriteStatusError("NetStream.Publish.BadName", res.err.Error())
+			return res.err
+		}
+
+		c.writeError(res.err)
+		return res.err
+	}
+
+	c.path = res.path
+
+	defer func() {
+		c.path.onPublisherRemove(pathPublisherRemoveReq{author: c})
+	}()
+
+	c.setState(rtmpConnStatePublish)
+
 	c.conn.SetReadDeadline(time.Now().Add(time.Duration(c.readTimeout)))
 	videoTrack, audioTrack, err := c.conn.ReadTracks()
 	if err != nil {
 		return err
 	}
 
+	if info := c.conn.EncoderInfo(); info != nil {
+		c.setEncoderInfo(info)
+	}
+
+	// the SPS may be sent in-band, after the tracks: in this case,
+	// the resolution can't be checked.
+	if videoTrack != nil && videoTrack.SPS() != nil {
+		pathConf := c.path.Conf()
+
+		err := func() error {
+			sps, err := nh264.ParseSPS(videoTrack.SPS())
+			if err != nil {
+				if pathConf.MaxWidth == 0 && pathConf.MaxHeight == 0 {
+					c.log(logger.Warn, "unable to parse SPS: %v", err)
+					return nil
+				}
+				return fmt.Errorf("unable to parse SPS: %v", err)
+			}
+
+			c.log(logger.Info, "H264 resolution: %dx%d", sps.Width, sps.Height)
+
+			return rtmpConnCheckResolution(int(sps.Width), int(sps.Height),
+				pathConf.MaxWidth, pathConf.MaxHeight)
+		}()
+		if err != nil {
+			c.conn.SetWriteDeadline(time.Now().Add(time.Duration(c.writeTimeout)))
+			c.conn.WriteStatusError("NetStream.Publish.Rejected", err.Error())
+			return err
+		}
+	}
+
+	c.stateMutex.Lock()
+	if videoTrack != nil {
+		c.tracks = append(c.tracks, videoTrack)
+	}
+	if audioTrack != nil {
+		c.tracks = append(c.tracks, audioTrack)
+	}
+	c.stateMutex.Unlock()
+
 	var tracks gortsplib.Tracks
 	videoTrackID := -1
 	audioTrackID := -1
@@ -454,48 +2403,35 @@ func (c *rtmpConn) runPublish(ctx context.Context) error {
 	}
 
 	var aacEncoder *rtpaac.Encoder
-	if audioTrack != nil {
+	var opusEncoder *rtpopus.Encoder
+	switch audioTrack.(type) {
+	case *gortsplib.TrackAAC:
 		aacEncoder = &rtpaac.Encoder{
 			PayloadType: 97,
 			SampleRate:  audioTrack.ClockRate(),
-		}
-		aacEncoder.Init()
-		audioTrackID = len(tracks)
-		tracks = append(tracks, audioTrack)
-	}
-
-	pathName, query, rawQuery := pathNameAndQuery(c.conn.URL())
-
-	res := c.pathManager.onPublisherAnnounce(pathPublisherAnnounceReq{
-		author:   c,
-		pathName: pathName,
-		authenticate: func(
-			pathIPs []interface{},
-			pathUser conf.Credential,
-			pathPass conf.Credential,
-		) error {
-			return c.authenticate(pathName, pathIPs, pathUser, pathPass, "publish", query, rawQuery)
-		},
-	})
+		}
+		aacEncoder.Init()
+		audioTrackID = len(tracks)
+		tracks = append(tracks, audioTrack)
 
-	if res.err != nil {
-		if terr, ok := res.err.(pathErrAuthCritical); ok {
-			// wait some seconds to stop brute force attacks
-			<-time.After(rtmpConnPauseAfterAuthError)
-			return errors.New(terr.message)
+	case *gortsplib.TrackOpus:
+		opusEncoder = &rtpopus.Encoder{
+			PayloadType: 97,
+			SampleRate:  audioTrack.ClockRate(),
 		}
-		return res.err
+		opusEncoder.Init()
+		audioTrackID = len(tracks)
+		tracks = append(tracks, audioTrack)
 	}
 
-	c.path = res.path
-
-	defer func() {
-		c.path.onPublisherRemove(pathPublisherRemoveReq{author: c})
-	}()
-
-	c.stateMutex.Lock()
-	c.state = rtmpConnStatePublish
-	c.stateMutex.Unlock()
+	// a stream without tracks can't be read: reject the publisher
+	// instead of creating it.
+	if len(tracks) == 0 {
+		err := fmt.Errorf("publisher provided no tracks")
+		c.conn.SetWriteDeadline(time.Now().Add(time.Duration(c.writeTimeout)))
+		c.conn.WriteStatusError("NetStream.Publish.Rejected", err.Error())
+		return err
+	}
 
 	// disable write deadline
 	c.conn.SetWriteDeadline(time.Time{})
@@ -508,27 +2444,215 @@ func (c *rtmpConn) runPublish(ctx context.Context) error {
 		return rres.err
 	}
 
+	// SPS and PPS that are currently in use
+	var videoSPS []byte
+	var videoPPS []byte
+	if videoTrack != nil {
+		videoSPS = videoTrack.SPS()
+		videoPPS = videoTrack.PPS()
+	}
+
+	videoFormatLogged := false
+	captionsLogged := false
+	unsupportedLogged := make(map[int]struct{})
+	amfDataLimiter := newRTMPAMFDataLimiter()
+	amfDataDropping := false
+
+	maxBitrate := uint64(c.path.Conf().RTMPMaxPublishBitrate)
+	var bitrateMeter *rtmpBitrateMeter
+	var bitrateExceeded uint64
+
+	if maxBitrate != 0 {
+		bitrateMeter = newRTMPBitrateMeter(rtmpConnBitrateWindowLen)
+		terminate := make(chan struct{})
+		defer close(terminate)
+
+		go func() {
+			t := time.NewTicker(rtmpConnBitrateSamplePeriod)
+			defer t.Stop()
+
+			for {
+				select {
+				case <-t.C:
+					n, full := bitrateMeter.sample()
+					if !full {
+						continue
+					}
+
+					bitrate := n * 8 / 1000 / uint64(rtmpConnBitrateWindowLen*rtmpConnBitrateSamplePeriod/time.Second)
+					if bitrate > maxBitrate {
+						atomic.StoreUint64(&bitrateExceeded, bitrate)
+						return
+					}
+
+				case <-terminate:
+					return
+				}
+			}
+		}()
+	}
+
+	minFramerate := c.path.Conf().MinFramerate
+	var framerateMeter *rtmpFramerateMeter
+	var framerateTooLow uint32
+	var framerate uint64
+
+	if minFramerate != 0 && videoTrack != nil {
+		framerateMeter = newRTMPFramerateMeter(rtmpConnBitrateSamplePeriod, rtmpConnBitrateWindowLen)
+		gracePeriod := time.Duration(c.path.Conf().MinFramerateGracePeriod)
+		terminate := make(chan struct{})
+		defer close(terminate)
+
+		go func() {
+			t := time.NewTicker(rtmpConnBitrateSamplePeriod)
+			defer t.Stop()
+
+			var belowSince time.Time
+
+			for {
+				select {
+				case <-t.C:
+					fps, full := framerateMeter.sample()
+					if !full {
+						continue
+					}
+
+					if fps >= minFramerate {
+						belowSince = time.Time{}
+						continue
+					}
+
+					if belowSince.IsZero() {
+						belowSince = time.Now()
+					}
+
+					if time.Since(belowSince) >= gracePeriod {
+						atomic.StoreUint64(&framerate, math.Float64bits(fps))
+						atomic.StoreUint32(&framerateTooLow, 1)
+						return
+					}
+
+				case <-terminate:
+					return
+				}
+			}
+		}()
+	}
+
+	// the read timeout is reset by any message, while the stall timeout
+	// is reset only by media frames.
+	lastMedia := time.Now()
+
 	for {
-		c.conn.SetReadDeadline(time.Now().Add(time.Duration(c.readTimeout)))
-		pkt, err := c.conn.ReadPacket()
+		deadline := time.Now().Add(time.Duration(c.readTimeout))
+		stallDeadline := false
+		if c.stalledPublisherTimeout != 0 {
+			if d := lastMedia.Add(time.Duration(c.stalledPublisherTimeout)); d.Before(deadline) {
+				deadline = d
+				stallDeadline = true
+			}
+		}
+
+		c.conn.SetReadDeadline(deadline)
+		pkt, err := c.readPacket()
 		if err != nil {
+			if err == rtmp.ErrUnpublished {
+				c.log(logger.Info, "publisher unpublished")
+			}
+			if stallDeadline && rtmpServerConnErrorKind(err) == "timeout" {
+				return fmt.Errorf("publisher stalled (no media received for %v)",
+					time.Duration(c.stalledPublisherTimeout))
+			}
+			return err
+		}
+
+		if pkt.Type == av.H264 || pkt.Type == av.AAC || pkt.Type == av.OPUS {
+			lastMedia = time.Now()
+		}
+
+		if bitrateMeter != nil {
+			if bitrate := atomic.LoadUint64(&bitrateExceeded); bitrate != 0 {
+				err := fmt.Errorf("bitrate (%d kbit/s) exceeds the maximum allowed (%d kbit/s)", bitrate, maxBitrate)
+				c.conn.SetWriteDeadline(time.Now().Add(time.Duration(c.writeTimeout)))
+				c.conn.WriteStatusError("NetStream.Publish.Rejected", err.Error())
+				return err
+			}
+
+			if pkt.Type == av.H264 || pkt.Type == av.AAC {
+				bitrateMeter.add(len(pkt.Data))
+			}
+		}
+
+		if framerateMeter != nil {
+			if atomic.LoadUint32(&framerateTooLow) != 0 {
+				err := fmt.Errorf("framerate too low (%.2f fps, minimum is %.2f fps)",
+					math.Float64frombits(atomic.LoadUint64(&framerate)), minFramerate)
+				c.conn.SetWriteDeadline(time.Now().Add(time.Duration(c.writeTimeout)))
+				c.conn.WriteStatusError("NetStream.Publish.Rejected", err.Error())
+				return err
+			}
+
+			if pkt.Type == av.H264 {
+				framerateMeter.add(pkt.Time)
+			}
+		}
+
+		if atomic.LoadUint32(c.revoked) != 0 {
+			err := rtmpConnErrAuth{message: "credentials have been revoked"}
+			c.conn.SetWriteDeadline(time.Now().Add(time.Duration(c.writeTimeout)))
+			c.conn.WriteStatusError("NetStream.Publish.Rejected", err.Error())
 			return err
 		}
 
+		atomic.StoreInt64(c.chunkSize, int64(c.conn.ReadChunkSize()))
+
+		// the connection is being closed: stop after the current packet
+		// and notify the client.
+		if c.drainTimeout != 0 && ctx.Err() != nil {
+			c.conn.SetWriteDeadline(time.Now().Add(time.Duration(c.writeTimeout)))
+			c.conn.WriteStatus("NetStream.Unpublish.Success", "unpublish success")
+			return fmt.Errorf("terminated")
+		}
+
 		switch pkt.Type {
+		case av.Metadata:
+			// some encoders send metadata again when settings change.
+			info, err := rtmp.ParseEncoderInfo(pkt.Data)
+			if err != nil {
+				c.log(logger.Debug, "unable to parse metadata: %v", err)
+				continue
+			}
+			c.setEncoderInfo(info)
+
 		case av.H264DecoderConfig:
+			if videoTrack == nil {
+				return fmt.Errorf("received an H264 decoder config, but track is not set up")
+			}
+
 			codec, err := nh264.FromDecoderConfig(pkt.Data)
 			if err != nil {
 				return err
 			}
 
-			pts := pkt.Time + pkt.CTime
+			// some encoders send the decoder config before every IDR,
+			// even if it didn't change.
+			if bytes.Equal(codec.SPS[0], videoSPS) && bytes.Equal(codec.PPS[0], videoPPS) {
+				continue
+			}
+
+			c.log(logger.Warn, "the publisher changed the H264 parameters mid-stream; "+
+				"readers that don't support parameter changes may be unable to decode the stream")
+			videoSPS = codec.SPS[0]
+			videoPPS = codec.PPS[0]
+
+			dts := pkt.Time
+			pts := dts + pkt.CTime
 			nalus := [][]byte{
 				codec.SPS[0],
 				codec.PPS[0],
 			}
 
-			pkts, err := h264Encoder.Encode(nalus, pts)
+			pkts, err := h264Encoder.Encode(nalus, pts+rtmpConnRTPPTSOffset)
 			if err != nil {
 				return fmt.Errorf("error while encoding H264: %v", err)
 			}
@@ -548,6 +2672,7 @@ func (c *rtmpConn) runPublish(ctx context.Context) error {
 						ptsEqualsDTS: h264.IDRPresent(nalus),
 						h264NALUs:    nalus,
 						h264PTS:      pts,
+						h264DTS:      &dts,
 					})
 				}
 			}
@@ -557,14 +2682,45 @@ func (c *rtmpConn) runPublish(ctx context.Context) error {
 				return fmt.Errorf("received an H264 packet, but track is not set up")
 			}
 
-			nalus, err := h264.DecodeAVCC(pkt.Data)
+			annexB := rtmpConnIsAnnexB(pkt.Data)
+
+			if !videoFormatLogged {
+				videoFormatLogged = true
+				if annexB {
+					c.log(logger.Info, "H264 packets are in Annex-B format")
+				} else {
+					c.log(logger.Debug, "H264 packets are in AVCC format")
+				}
+			}
+
+			var nalus [][]byte
+			if annexB {
+				nalus, err = h264.DecodeAnnexB(pkt.Data)
+			} else {
+				nalus, err = h264.DecodeAVCC(pkt.Data)
+			}
 			if err != nil {
 				return err
 			}
 
-			pts := pkt.Time + pkt.CTime
+			atomic.AddUint64(c.videoFrames, 1)
+			if h264.IDRPresent(nalus) {
+				atomic.AddUint64(c.idrFrames, 1)
+				atomic.StoreInt64(c.lastIDR, time.Now().UnixNano())
+			}
+
+			dts := pkt.Time
+			pts := dts + pkt.CTime
+
+			// captions are left inside the stream and are also
+			// forwarded to readers separately.
+			captions := rtmpConnCaptions(nalus)
+			if captions != nil && !captionsLogged {
+				captionsLogged = true
+				c.log(logger.Info, "the stream contains closed captions")
+			}
 
-			pkts, err := h264Encoder.Encode(nalus, pts)
+			pkts, err := h264Encoder.Encode(nalus, pts+rtmpConnRTPPTSOffset)
 			if err != nil {
 				return fmt.Errorf("error while encoding H264: %v", err)
 			}
@@ -584,12 +2740,14 @@ func (c *rtmpConn) runPublish(ctx context.Context) error {
 						ptsEqualsDTS: h264.IDRPresent(nalus),
 						h264NALUs:    nalus,
 						h264PTS:      pts,
+						h264DTS:      &dts,
+						h264Captions: captions,
 					})
 				}
 			}
 
 		case av.AAC:
-			if audioTrack == nil {
+			if aacEncoder == nil {
 				return fmt.Errorf("received an AAC packet, but track is not set up")
 			}
 
@@ -605,6 +2763,50 @@ func (c *rtmpConn) runPublish(ctx context.Context) error {
 					ptsEqualsDTS: true,
 				})
 			}
+
+		case av.OPUS:
+			if opusEncoder == nil {
+				return fmt.Errorf("received an Opus packet, but track is not set up")
+			}
+
+			pkt, err := opusEncoder.Encode(pkt.Data, pkt.Time)
+			if err != nil {
+				return fmt.Errorf("error while encoding Opus: %v", err)
+			}
+
+			rres.stream.writeData(&data{
+				trackID:      audioTrackID,
+				rtp:          pkt,
+				ptsEqualsDTS: true,
+			})
+
+		case av.AACDecoderConfig, rtmp.PacketOpusHead:
+			// some encoders send the audio configuration again, or after
+			// the video one. It is ignored, since the configuration
+			// of a track can't change.
+
+		case rtmp.PacketData:
+			if !amfDataLimiter.take(len(pkt.Data), time.Now()) {
+				if !amfDataDropping {
+					amfDataDropping = true
+					c.log(logger.Warn, "too many AMF data messages, discarding them")
+				}
+				continue
+			}
+			amfDataDropping = false
+
+			rres.stream.writeAMFData(&data{
+				amfData: pkt.Data,
+			})
+
+		default:
+			// packets of the same type are usually sent repeatedly:
+			// log only the first one.
+			if _, ok := unsupportedLogged[pkt.Type]; !ok {
+				unsupportedLogged[pkt.Type] = struct{}{}
+				c.log(logger.Warn, "received an unsupported packet (%s), "+
+					"packets of this type will be ignored", rtmpConnPacketType(pkt.Type))
+			}
 		}
 	}
 }
@@ -617,11 +2819,45 @@ func (c *rtmpConn) authenticate(
 	action string,
 	query url.Values,
 	rawQuery string,
+) error {
+	ip := c.ip()
+
+	// the backoff is computed per IP, therefore it can't be applied
+	// when the IP is unknown.
+	if ip == nil || c.isTrusted() {
+		return c.authenticateInner(ip, pathName, pathIPs, pathUser, pathPass, action, query, rawQuery)
+	}
+
+	if c.authBackoff.blocked(ip.String()) {
+		return pathErrAuthCritical{
+			message: "too many authentication failures",
+		}
+	}
+
+	err := c.authenticateInner(ip, pathName, pathIPs, pathUser, pathPass, action, query, rawQuery)
+	if err != nil {
+		c.authBackoff.onFailure(ip.String())
+		return err
+	}
+
+	c.authBackoff.onSuccess(ip.String())
+	return nil
+}
+
+func (c *rtmpConn) authenticateInner(
+	ip net.IP,
+	pathName string,
+	pathIPs []interface{},
+	pathUser conf.Credential,
+	pathPass conf.Credential,
+	action string,
+	query url.Values,
+	rawQuery string,
 ) error {
 	if c.externalAuthenticationURL != "" {
 		err := externalAuth(
 			c.externalAuthenticationURL,
-			c.ip().String(),
+			rtmpConnIPString(ip),
 			query.Get("user"),
 			query.Get("pass"),
 			pathName,
@@ -634,8 +2870,28 @@ func (c *rtmpConn) authenticate(
 		}
 	}
 
+	return c.checkCredentials(ip, pathIPs, pathUser, pathPass, query, rawQuery, false)
+}
+
+// checkCredentials checks the IP and the credentials of the client against
+// the ones required by the path. When revalidating, the challenge of the Adobe
+// authentication is not checked, since it may have expired in the meanwhile.
+func (c *rtmpConn) checkCredentials(
+	ip net.IP,
+	pathIPs []interface{},
+	pathUser conf.Credential,
+	pathPass conf.Credential,
+	query url.Values,
+	rawQuery string,
+	revalidate bool,
+) error {
 	if pathIPs != nil {
-		ip := c.ip()
+		if ip == nil {
+			return pathErrAuthCritical{
+				message: "IP of the client is unknown",
+			}
+		}
+
 		if !ipEqualOrInRange(ip, pathIPs) {
 			return pathErrAuthCritical{
 				message: fmt.Sprintf("IP '%s' not allowed", ip),
@@ -644,7 +2900,19 @@ func (c *rtmpConn) authenticate(
 	}
 
 	if pathUser != "" {
-		if query.Get("user") != string(pathUser) ||
+		if params := rtmpAdobeAuthParams(rawQuery); params["authmod"] == "adobe" {
+			var err error
+			if revalidate {
+				err = c.adobeAuth.checkResponse(params, string(pathUser), string(pathPass))
+			} else {
+				err = c.adobeAuth.check(params, string(pathUser), string(pathPass), time.Now())
+			}
+			if err != nil {
+				return pathErrAuthCritical{
+					message: err.Error(),
+				}
+			}
+		} else if query.Get("user") != string(pathUser) ||
 			query.Get("pass") != string(pathPass) {
 			return pathErrAuthCritical{
 				message: "invalid credentials",
@@ -655,6 +2923,88 @@ func (c *rtmpConn) authenticate(
 	return nil
 }
 
+// onPublisherRevalidate implements publisherWithRevalidation.
+// The publisher is disconnected when the next packet is received.
+func (c *rtmpConn) onPublisherRevalidate(
+	pathIPs []interface{},
+	pathUser conf.Credential,
+	pathPass conf.Credential,
+) {
+	_, query, rawQuery := pathNameAndQuery(c.conn.URL())
+	err := c.checkCredentials(c.ip(), pathIPs, pathUser, pathPass, query, rawQuery, true)
+	if err != nil {
+		c.log(logger.Info, "publisher is not authorized anymore: %s", err.(pathErrAuthCritical).message)
+		atomic.StoreUint32(c.revoked, 1)
+	}
+}
+
+// authenticateConnect performs the connect phase of the Adobe authentication.
+// Clients that have not sent a response yet are rejected with a description
+// that contains what they need to compute it, and then they connect again.
+// The response is checked when the requested path, and therefore
+// its credentials, are known.
+// Clients that don't use the Adobe authentication are let through,
+// unless it is required.
+func (c *rtmpConn) authenticateConnect(app string) error {
+	var params map[string]string
+	if i := strings.Index(app, "?"); i >= 0 {
+		params = rtmpAdobeAuthParams(app[i+1:])
+	}
+
+	if params["authmod"] != "adobe" && !c.adobeAuthRequired {
+		return nil
+	}
+
+	description, err := c.adobeAuth.connectRejection(params, time.Now())
+	if err != nil {
+		return err
+	}
+
+	if description == "" {
+		return nil
+	}
+
+	c.conn.SetWriteDeadline(time.Now().Add(time.Duration(c.writeTimeout)))
+	c.conn.WriteConnectError(description)
+	return rtmpConnErrAuth{message: "authentication required (authmod=adobe)"}
+}
+
+// waitResume waits until a paused reader resumes. Since the ring buffer
+// is not pulled in the meanwhile, pings are written here.
+func (c *rtmpConn) waitResume(ctx context.Context, pauseReq chan bool, writeTimeout time.Duration) error {
+	var pingC <-chan time.Time
+	if c.pingPeriod != 0 {
+		t := time.NewTicker(time.Duration(c.pingPeriod))
+		defer t.Stop()
+		pingC = t.C
+	}
+
+	for {
+		select {
+		case paused := <-pauseReq:
+			if !paused {
+				return nil
+			}
+
+		case <-pingC:
+			c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+			err := c.conn.WritePing()
+			if err != nil {
+				return err
+			}
+
+		case <-ctx.Done():
+			return fmt.Errorf("terminated")
+		}
+	}
+}
+
+// writeError sends an error to the client before the publish or play request is accepted.
+func (c *rtmpConn) writeError(err error) {
+	c.conn.SetWriteDeadline(time.Now().Add(time.Duration(c.writeTimeout)))
+	c.conn.WriteError(err)
+}
+
 // onReaderAccepted implements reader.
 func (c *rtmpConn) onReaderAccepted() {
 	c.log(logger.Info, "is reading from path '%s'", c.path.Name())
@@ -662,28 +3012,242 @@ func (c *rtmpConn) onReaderAccepted() {
 
 // onReaderData implements reader.
 func (c *rtmpConn) onReaderData(data *data) {
-	c.ringBuffer.Push(data)
+	c.handlePush(c.ringBuffer.push(data, time.Now()))
+}
+
+// onReaderReplayData implements streamReplayReader.
+func (c *rtmpConn) onReaderReplayData(data *data) {
+	c.handlePush(c.ringBuffer.pushNoWait(data, time.Now()))
+}
+
+func (c *rtmpConn) handlePush(fullFor time.Duration, overflowed bool, tooSlow bool) {
+	if overflowed {
+		c.parent.onReadBufferOverflow(c.ringBuffer.policy)
+	}
+
+	// the reader is closed instead of slowing down the source.
+	if tooSlow && c.ctx.Err() == nil {
+		c.log(logger.Warn, "reader is too slow: the read buffer is full and "+
+			"rtmpReadBufferBlockTimeout has passed, closing")
+		c.close()
+		return
+	}
+
+	if c.slowReaderTimeout != 0 && fullFor >= time.Duration(c.slowReaderTimeout) &&
+		c.ctx.Err() == nil {
+		c.log(logger.Warn, "reader is too slow: the read buffer has been full for %v, closing", fullFor)
+		c.close()
+	}
+}
+
+type rtmpConnAPIEncoderInfo struct {
+	Encoder       string  `json:"encoder"`
+	VideoDataRate float64 `json:"videoDataRate"`
+	AudioDataRate float64 `json:"audioDataRate"`
+	FrameRate     float64 `json:"frameRate"`
+	Width         float64 `json:"width"`
+	Height        float64 `json:"height"`
+}
+
+type rtmpConnAPIConnectInfo struct {
+	App        string `json:"app"`
+	TcURL      string `json:"tcUrl"`
+	PageURL    string `json:"pageUrl"`
+	FlashVer   string `json:"flashVer"`
+	StreamName string `json:"streamName"`
+}
+
+type rtmpConnAPITrack struct {
+	Codec     string `json:"codec"`
+	ClockRate int    `json:"clockRate"`
+	Width     int    `json:"width,omitempty"`
+	Height    int    `json:"height,omitempty"`
+}
+
+func rtmpConnAPITracks(tracks gortsplib.Tracks) []rtmpConnAPITrack {
+	ret := []rtmpConnAPITrack{}
+
+	for _, track := range tracks {
+		switch tt := track.(type) {
+		case *gortsplib.TrackH264:
+			t := rtmpConnAPITrack{
+				Codec:     "H264",
+				ClockRate: tt.ClockRate(),
+			}
+
+			sps, err := nh264.ParseSPS(tt.SPS())
+			if err == nil {
+				t.Width = int(sps.Width)
+				t.Height = int(sps.Height)
+			}
+
+			ret = append(ret, t)
+
+		case *gortsplib.TrackAAC:
+			ret = append(ret, rtmpConnAPITrack{
+				Codec:     "AAC",
+				ClockRate: tt.ClockRate(),
+			})
+
+		case *gortsplib.TrackOpus:
+			ret = append(ret, rtmpConnAPITrack{
+				Codec:     "Opus",
+				ClockRate: tt.ClockRate(),
+			})
+
+		case *gortsplib.TrackPCMU:
+			ret = append(ret, rtmpConnAPITrack{
+				Codec:     "PCMU",
+				ClockRate: tt.ClockRate(),
+			})
+
+		default:
+			if rtmp.TrackIsPCMA(track) {
+				ret = append(ret, rtmpConnAPITrack{
+					Codec:     "PCMA",
+					ClockRate: track.ClockRate(),
+				})
+			}
+		}
+	}
+
+	return ret
+}
+
+func (c *rtmpConn) setEncoderInfo(info *rtmp.EncoderInfo) {
+	c.log(logger.Debug, "encoder: '%s', video bitrate: %v kbps, audio bitrate: %v kbps, framerate: %v",
+		info.Encoder, info.VideoDataRate, info.AudioDataRate, info.FrameRate)
+
+	c.stateMutex.Lock()
+	c.encoderInfo = info
+	c.stateMutex.Unlock()
+}
+
+func (c *rtmpConn) apiDescribe() interface{} {
+	c.stateMutex.Lock()
+	stateStart := c.stateStart
+	app := c.app
+	connectInfo := c.connectInfo
+	info := c.encoderInfo
+	tracks := rtmpConnAPITracks(c.tracks)
+	ringBuffer := c.ringBuffer
+	audioJitter := c.audioJitter
+	c.stateMutex.Unlock()
+
+	var readBufferFill uint64
+	if ringBuffer != nil {
+		readBufferFill = ringBuffer.fill()
+	}
+
+	var audioJitterBufferFill uint64
+	if audioJitter != nil {
+		audioJitterBufferFill = audioJitter.fill()
+	}
+
+	videoFrames := atomic.LoadUint64(c.videoFrames)
+	idrFrames := atomic.LoadUint64(c.idrFrames)
+
+	var timeSinceLastIDR *string
+	if lastIDR := atomic.LoadInt64(c.lastIDR); lastIDR != 0 {
+		v := time.Since(time.Unix(0, lastIDR)).String()
+		timeSinceLastIDR = &v
+	}
+
+	var apiInfo *rtmpConnAPIEncoderInfo
+	if info != nil {
+		apiInfo = &rtmpConnAPIEncoderInfo{
+			Encoder:       info.Encoder,
+			VideoDataRate: info.VideoDataRate,
+			AudioDataRate: info.AudioDataRate,
+			FrameRate:     info.FrameRate,
+			Width:         info.Width,
+			Height:        info.Height,
+		}
+	}
+
+	return struct {
+		Type                  string                  `json:"type"`
+		ID                    string                  `json:"id"`
+		Created               string                  `json:"created"`
+		StateStart            string                  `json:"stateStart"`
+		App                   string                  `json:"app"`
+		Connect               rtmpConnAPIConnectInfo  `json:"connect"`
+		EncoderInfo           *rtmpConnAPIEncoderInfo `json:"encoderInfo"`
+		Tracks                []rtmpConnAPITrack      `json:"tracks"`
+		ChunkSize             int64                   `json:"chunkSize"`
+		BytesReceived         uint64                  `json:"bytesReceived"`
+		BytesSent             uint64                  `json:"bytesSent"`
+		ReadBufferFill        uint64                  `json:"readBufferFill"`
+		AudioJitterBufferFill uint64                  `json:"audioJitterBufferFill"`
+		VideoFrames           uint64                  `json:"videoFrames"`
+		IDRFrames             uint64                  `json:"idrFrames"`
+		GOPSize               float64                 `json:"gopSize"`
+		TimeSinceLastIDR      *string                 `json:"timeSinceLastIDR"`
+	}{
+		"rtmpConn",
+		c.id,
+		c.created.Format(time.RFC3339),
+		stateStart.Format(time.RFC3339),
+		app,
+		rtmpConnAPIConnectInfo{
+			App:        rtmpConnWithoutPass(connectInfo.App),
+			TcURL:      rtmpConnWithoutPass(connectInfo.TcURL),
+			PageURL:    connectInfo.PageURL,
+			FlashVer:   connectInfo.FlashVer,
+			StreamName: rtmpConnWithoutPass(connectInfo.StreamName),
+		},
+		apiInfo,
+		tracks,
+		atomic.LoadInt64(c.chunkSize),
+		atomic.LoadUint64(c.bytesReceived),
+		atomic.LoadUint64(c.bytesSent),
+		readBufferFill,
+		audioJitterBufferFill,
+		videoFrames,
+		idrFrames,
+		rtmpConnGOPSize(videoFrames, idrFrames),
+		timeSinceLastIDR,
+	}
+}
+
+// rtmpConnGOPSize estimates the GOP size of a published stream,
+// that is the average number of video frames between two IDR frames.
+// It returns zero when no IDR frame has been received.
+func rtmpConnGOPSize(videoFrames uint64, idrFrames uint64) float64 {
+	if idrFrames == 0 {
+		return 0
+	}
+	return float64(videoFrames) / float64(idrFrames)
 }
 
 // onReaderAPIDescribe implements reader.
 func (c *rtmpConn) onReaderAPIDescribe() interface{} {
-	return struct {
-		Type string `json:"type"`
-		ID   string `json:"id"`
-	}{"rtmpConn", c.id}
+	return c.apiDescribe()
 }
 
 // onSourceAPIDescribe implements source.
 func (c *rtmpConn) onSourceAPIDescribe() interface{} {
-	return struct {
-		Type string `json:"type"`
-		ID   string `json:"id"`
-	}{"rtmpConn", c.id}
+	return c.apiDescribe()
+}
+
+// lastActivity implements publisherWithActivity.
+func (c *rtmpConn) lastActivity() time.Time {
+	return time.Unix(0, atomic.LoadInt64(c.lastPacket))
 }
 
 // onPublisherAccepted implements publisher.
+// The encoder, that is the flashVer sent in the connect command, is logged too,
+// in order to allow to find publishers that use a given software.
 func (c *rtmpConn) onPublisherAccepted(tracksLen int) {
-	c.log(logger.Info, "is publishing to path '%s', %d %s",
+	c.stateMutex.Lock()
+	encoder := c.connectInfo.FlashVer
+	c.stateMutex.Unlock()
+
+	if encoder == "" {
+		encoder = "unknown"
+	}
+
+	c.log(logger.Info, "is publishing to path '%s', %d %s, encoder '%s'",
 		c.path.Name(),
 		tracksLen,
 		func() string {
@@ -691,5 +3255,6 @@ func (c *rtmpConn) onPublisherAccepted(tracksLen int) {
 				return "track"
 			}
 			return "tracks"
-		}())
+		}(),
+		encoder)
 }
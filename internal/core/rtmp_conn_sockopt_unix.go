@@ -0,0 +1,46 @@
+//go:build !windows
+// +build !windows
+
+package core
+
+import (
+	"net"
+	"runtime"
+	"syscall"
+)
+
+// rtmpConnSocketBufferSizes returns the actual sizes of the receive and send buffers
+// of a socket, that may differ from the requested ones.
+func rtmpConnSocketBufferSizes(tcpConn *net.TCPConn) (int, int, error) {
+	raw, err := tcpConn.SyscallConn()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var rcvBuf int
+	var sndBuf int
+	var sockErr error
+
+	err = raw.Control(func(fd uintptr) {
+		rcvBuf, sockErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+		if sockErr != nil {
+			return
+		}
+		sndBuf, sockErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF)
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	if sockErr != nil {
+		return 0, 0, sockErr
+	}
+
+	// Linux doubles the requested sizes, in order to make room for its bookkeeping
+	// overhead, and returns the doubled values.
+	if runtime.GOOS == "linux" {
+		rcvBuf /= 2
+		sndBuf /= 2
+	}
+
+	return rcvBuf, sndBuf, nil
+}
@@ -0,0 +1,49 @@
+//go:build !windows
+// +build !windows
+
+package core
+
+import (
+	"net"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRTMPConnSocketBufferSizes(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			conn.Close()
+		}
+	}()
+
+	nconn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer nconn.Close()
+
+	tcpConn := nconn.(*net.TCPConn)
+
+	err = tcpConn.SetReadBuffer(65536)
+	require.NoError(t, err)
+	err = tcpConn.SetWriteBuffer(65536)
+	require.NoError(t, err)
+
+	// the system may enlarge or clamp the sizes
+	rcvBuf, sndBuf, err := rtmpConnSocketBufferSizes(tcpConn)
+	require.NoError(t, err)
+	require.NotEqual(t, 0, rcvBuf)
+	require.NotEqual(t, 0, sndBuf)
+
+	// the requested sizes are below the default limits of Linux,
+	// therefore they are returned as they are.
+	if runtime.GOOS == "linux" {
+		require.Equal(t, 65536, rcvBuf)
+		require.Equal(t, 65536, sndBuf)
+	}
+}
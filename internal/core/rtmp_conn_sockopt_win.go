@@ -0,0 +1,13 @@
+//go:build windows
+// +build windows
+
+package core
+
+import (
+	"fmt"
+	"net"
+)
+
+func rtmpConnSocketBufferSizes(tcpConn *net.TCPConn) (int, int, error) {
+	return 0, 0, fmt.Errorf("not supported")
+}
@@ -0,0 +1,2642 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/aler9/gortsplib"
+	"github.com/aler9/gortsplib/pkg/aac"
+	"github.com/aler9/gortsplib/pkg/h264"
+	"github.com/notedit/rtmp/av"
+	nh264 "github.com/notedit/rtmp/codec/h264"
+	"github.com/notedit/rtmp/format/flv/flvio"
+	nrtmp "github.com/notedit/rtmp/format/rtmp"
+	"github.com/pion/rtp"
+	"github.com/stretchr/testify/require"
+
+	"github.com/aler9/rtsp-simple-server/internal/conf"
+	"github.com/aler9/rtsp-simple-server/internal/logger"
+	"github.com/aler9/rtsp-simple-server/internal/rtmp"
+)
+
+func TestRTMPConnAACSamplesPerFrame(t *testing.T) {
+	for _, ca := range []struct {
+		name              string
+		typ               int
+		aotSpecificConfig []byte
+		samplesPerFrame   int
+	}{
+		{
+			"lc 1024",
+			2,
+			nil,
+			1024,
+		},
+		{
+			"lc 960",
+			2,
+			[]byte{0x80},
+			960,
+		},
+		{
+			"ld 512",
+			23,
+			nil,
+			512,
+		},
+		{
+			"ld 480",
+			23,
+			[]byte{0x80},
+			480,
+		},
+		{
+			"eld 512",
+			39,
+			nil,
+			512,
+		},
+		{
+			"eld 480",
+			39,
+			[]byte{0x80},
+			480,
+		},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			track, err := gortsplib.NewTrackAAC(96, ca.typ, 48000, 2, ca.aotSpecificConfig)
+			require.NoError(t, err)
+			require.Equal(t, ca.samplesPerFrame, rtmpConnAACSamplesPerFrame(track))
+		})
+	}
+}
+
+func TestRTMPConnAACPacing(t *testing.T) {
+	// at 32khz, frames last exactly 32ms (1024 samples) and 30ms (960 samples)
+	for _, ca := range []struct {
+		name              string
+		aotSpecificConfig []byte
+		step              time.Duration
+	}{
+		{
+			"1024",
+			nil,
+			32 * time.Millisecond,
+		},
+		{
+			"960",
+			[]byte{0x80},
+			30 * time.Millisecond,
+		},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			track, err := gortsplib.NewTrackAAC(96, 2, 32000, 2, ca.aotSpecificConfig)
+			require.NoError(t, err)
+
+			ptss := rtmpConnAACTimestamps(0, 4, rtmpConnAACSamplesPerFrame(track), 32000)
+			for i, pts := range ptss {
+				require.Equal(t, time.Duration(i)*ca.step, pts)
+			}
+		})
+	}
+}
+
+func TestRTMPConnSelectVariant(t *testing.T) {
+	variants := conf.RTMPVariants{
+		"cam": {
+			"high": "cam_high",
+			"mid":  "cam_mid",
+			"low":  "cam_low",
+		},
+	}
+
+	for _, ca := range []struct {
+		name     string
+		pathName string
+		query    url.Values
+		actual   string
+	}{
+		{"quality", "cam", url.Values{"quality": []string{"mid"}}, "cam_mid"},
+		{"no quality", "cam", url.Values{}, "cam"},
+		{"no variants", "other", url.Values{"quality": []string{"mid"}}, "other"},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			actual, err := rtmpConnSelectVariant(variants, ca.pathName, ca.query)
+			require.NoError(t, err)
+			require.Equal(t, ca.actual, actual)
+		})
+	}
+
+	_, err := rtmpConnSelectVariant(variants, "cam", url.Values{"quality": []string{"ultra"}})
+	require.EqualError(t, err, "invalid quality 'ultra' for 'cam', available qualities are: high, low, mid")
+}
+
+func TestRTMPConnReaderWriteTimeout(t *testing.T) {
+	for _, ca := range []struct {
+		name    string
+		query   string
+		max     time.Duration
+		timeout time.Duration
+		err     string
+	}{
+		{"default", "", 30 * time.Second, 10 * time.Second, ""},
+		{"disabled", "writeTimeout=20s", 0, 10 * time.Second, ""},
+		{"override", "writeTimeout=20s", 30 * time.Second, 20 * time.Second, ""},
+		{"lower", "writeTimeout=2s", 30 * time.Second, 10 * time.Second, ""},
+		{"clamped", "writeTimeout=1m", 30 * time.Second, 30 * time.Second, ""},
+		{"invalid", "writeTimeout=abc", 30 * time.Second, 0, "invalid write timeout: 'abc'"},
+		{"negative", "writeTimeout=-5s", 30 * time.Second, 0, "invalid write timeout: '-5s'"},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			query, err := url.ParseQuery(ca.query)
+			require.NoError(t, err)
+
+			timeout, err := rtmpConnReaderWriteTimeout(query, 10*time.Second, ca.max)
+			if ca.err != "" {
+				require.EqualError(t, err, ca.err)
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, ca.timeout, timeout)
+			}
+		})
+	}
+}
+
+func TestRTMPConnCheckAAC(t *testing.T) {
+	require.NoError(t, rtmpConnCheckAAC(2, 2))
+
+	err := rtmpConnCheckAAC(1, 2)
+	require.EqualError(t, err, "unsupported AAC object type: 1 (only AAC-LC (2) is supported)")
+
+	err = rtmpConnCheckAAC(2, 0)
+	require.EqualError(t, err, "unsupported AAC channel count: 0")
+}
+
+func TestRTMPConnCheckPCMA(t *testing.T) {
+	for _, ca := range []struct {
+		name   string
+		rtpmap string
+		err    string
+	}{
+		{"no rtpmap", "", ""},
+		{"mono", "8 PCMA/8000", ""},
+		{"explicit mono", "8 PCMA/8000/1", ""},
+		{"stereo", "8 PCMA/8000/2", "unsupported G.711 parameters: 'PCMA/8000/2' (only 8kHz mono is supported)"},
+		{"16khz", "8 PCMA/16000", "unsupported G.711 parameters: 'PCMA/16000' (only 8kHz mono is supported)"},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			track, err := gortsplib.NewTrackGeneric("audio", []string{"8"}, ca.rtpmap, "")
+			require.NoError(t, err)
+
+			err = rtmpConnCheckPCMA(track)
+			if ca.err != "" {
+				require.EqualError(t, err, ca.err)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestRTMPConnADTS(t *testing.T) {
+	header, err := rtmpConnADTSHeader(2, 44100, 2)
+	require.NoError(t, err)
+
+	au := make([]byte, 1000)
+	au[0] = 0x21
+	byts, err := rtmpConnADTSWrap(header, au)
+	require.NoError(t, err)
+
+	pkts, err := aac.DecodeADTS(byts)
+	require.NoError(t, err)
+	require.Equal(t, []*aac.ADTSPacket{{
+		Type:         2,
+		SampleRate:   44100,
+		ChannelCount: 2,
+		AU:           au,
+	}}, pkts)
+
+	// the header can be reused
+	byts, err = rtmpConnADTSWrap(header, []byte{0x01, 0x02})
+	require.NoError(t, err)
+	pkts, err = aac.DecodeADTS(byts)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x01, 0x02}, pkts[0].AU)
+
+	_, err = rtmpConnADTSHeader(5, 44100, 2)
+	require.EqualError(t, err, "AAC object type 5 can't be encoded into ADTS")
+
+	_, err = rtmpConnADTSHeader(2, 44000, 2)
+	require.EqualError(t, err, "AAC sample rate 44000 can't be encoded into ADTS")
+
+	_, err = rtmpConnADTSHeader(2, 44100, 7)
+	require.EqualError(t, err, "AAC channel count 7 can't be encoded into ADTS")
+
+	_, err = rtmpConnADTSWrap(header, make([]byte, 8192))
+	require.EqualError(t, err, "AAC access unit is too big to be encoded into ADTS (8192 bytes)")
+}
+
+func TestRTMPConnCheckBaseline(t *testing.T) {
+	// Baseline
+	require.NoError(t, rtmpConnCheckBaseline([]byte{0x67, 66, 0x00, 0x1f}))
+
+	// Main, constrained to Baseline
+	require.NoError(t, rtmpConnCheckBaseline([]byte{0x67, 77, 0x80, 0x1f}))
+
+	err := rtmpConnCheckBaseline([]byte{0x67, 100, 0x00, 0x28})
+	require.EqualError(t, err,
+		"the stream uses the H264 High profile, while the reader supports only the Baseline profile")
+
+	err = rtmpConnCheckBaseline([]byte{0x67, 77, 0x40, 0x1f})
+	require.EqualError(t, err,
+		"the stream uses the H264 Main profile, while the reader supports only the Baseline profile")
+
+	err = rtmpConnCheckBaseline([]byte{0x67})
+	require.EqualError(t, err, "invalid SPS")
+}
+
+func TestRTMPConnCheckResolution(t *testing.T) {
+	require.NoError(t, rtmpConnCheckResolution(1920, 1080, 1920, 1080))
+	require.NoError(t, rtmpConnCheckResolution(3840, 2160, 0, 0))
+
+	err := rtmpConnCheckResolution(3840, 2160, 1920, 0)
+	require.EqualError(t, err, "width (3840) exceeds the maximum allowed (1920)")
+
+	err = rtmpConnCheckResolution(1080, 1920, 1920, 1080)
+	require.EqualError(t, err, "height (1920) exceeds the maximum allowed (1080)")
+}
+
+func TestRTMPConnGOPSize(t *testing.T) {
+	require.Equal(t, float64(0), rtmpConnGOPSize(100, 0))
+	require.Equal(t, float64(30), rtmpConnGOPSize(90, 3))
+	require.Equal(t, float64(1), rtmpConnGOPSize(10, 10))
+}
+
+func TestRTMPConnAPITracks(t *testing.T) {
+	videoTrack, err := gortsplib.NewTrackH264(96,
+		[]byte{
+			0x67, 0x64, 0x00, 0x0c, 0xac, 0x3b, 0x50, 0xb0,
+			0x4b, 0x42, 0x00, 0x00, 0x03, 0x00, 0x02, 0x00,
+			0x00, 0x03, 0x00, 0x3d, 0x08,
+		},
+		[]byte{0x68, 0xee, 0x3c, 0x80},
+		nil)
+	require.NoError(t, err)
+
+	audioTrack, err := gortsplib.NewTrackAAC(96, 2, 44100, 2, nil)
+	require.NoError(t, err)
+
+	pcmaTrack, err := gortsplib.NewTrackGeneric("audio", []string{"8"}, "8 PCMA/8000", "")
+	require.NoError(t, err)
+
+	require.Equal(t, []rtmpConnAPITrack{
+		{
+			Codec:     "H264",
+			ClockRate: 90000,
+			Width:     352,
+			Height:    288,
+		},
+		{
+			Codec:     "AAC",
+			ClockRate: 44100,
+		},
+		{
+			Codec:     "PCMU",
+			ClockRate: 8000,
+		},
+		{
+			Codec:     "PCMA",
+			ClockRate: 8000,
+		},
+	}, rtmpConnAPITracks(gortsplib.Tracks{videoTrack, audioTrack, gortsplib.NewTrackPCMU(), pcmaTrack}))
+}
+
+func TestRTMPConnSupportedTracks(t *testing.T) {
+	videoTrack, err := gortsplib.NewTrackH264(96,
+		[]byte{
+			0x67, 0x64, 0x00, 0x0c, 0xac, 0x3b, 0x50, 0xb0,
+			0x4b, 0x42, 0x00, 0x00, 0x03, 0x00, 0x02, 0x00,
+			0x00, 0x03, 0x00, 0x3d, 0x08,
+		},
+		[]byte{0x68, 0xee, 0x3c, 0x80},
+		nil)
+	require.NoError(t, err)
+
+	audioTrack, err := gortsplib.NewTrackAAC(97, 2, 44100, 2, nil)
+	require.NoError(t, err)
+
+	dataTrack, err := gortsplib.NewTrackGeneric("application", []string{"107"}, "107 vnd.onvif.metadata/90000", "")
+	require.NoError(t, err)
+
+	videoTrackIDs, audioTrackIDs, skippedTrackIDs := rtmpConnSupportedTracks(
+		gortsplib.Tracks{dataTrack, videoTrack, audioTrack, dataTrack})
+	require.Equal(t, []int{1}, videoTrackIDs)
+	require.Equal(t, []int{2}, audioTrackIDs)
+	require.Equal(t, []int{0, 3}, skippedTrackIDs)
+
+	// G.711 tracks
+	pcmaTrack, err := gortsplib.NewTrackGeneric("audio", []string{"8"}, "8 PCMA/8000", "")
+	require.NoError(t, err)
+
+	_, g711TrackIDs, _ := rtmpConnSupportedTracks(gortsplib.Tracks{gortsplib.NewTrackPCMU(), pcmaTrack})
+	require.Equal(t, []int{0, 1}, g711TrackIDs)
+
+	videoTrackID, err := rtmpConnSelectTrack(url.Values{}, "video", videoTrackIDs)
+	require.NoError(t, err)
+	require.Equal(t, 1, videoTrackID)
+
+	audioTrackID, err := rtmpConnSelectTrack(url.Values{}, "audio", audioTrackIDs)
+	require.NoError(t, err)
+	require.Equal(t, 2, audioTrackID)
+
+	// omitted track
+	videoTrackID, err = rtmpConnSelectTrack(url.Values{"video": []string{"0"}}, "video", videoTrackIDs)
+	require.NoError(t, err)
+	require.Equal(t, -1, videoTrackID)
+
+	_, err = rtmpConnSelectTrack(url.Values{"video": []string{"a"}}, "video", videoTrackIDs)
+	require.EqualError(t, err, "invalid video track index: 'a'")
+}
+
+func TestRTMPConnCaptions(t *testing.T) {
+	ccData := []byte{0xc1, 0xff, 0xfc, 0x94, 0x2c}
+
+	sei := []byte{
+		0x06,       // SEI
+		0x04,       // user_data_registered_itu_t_t35
+		0x0d,       // payload size
+		0xb5,       // country code
+		0x00, 0x31, // provider code
+		'G', 'A', '9', '4',
+		0x03, // cc_data
+	}
+	sei = append(sei, ccData...)
+	sei = append(sei, 0x80)
+
+	require.Equal(t, [][]byte{ccData}, rtmpConnCaptions([][]byte{
+		{0x09, 0xf0},
+		sei,
+		{0x65, 0x88, 0x84},
+	}))
+
+	// SEI without captions
+	require.Equal(t, [][]byte(nil), rtmpConnCaptions([][]byte{
+		{0x06, 0x05, 0x01, 0x00, 0x80},
+		{0x65, 0x88, 0x84},
+	}))
+}
+
+// testRTMPConnDataReader is a reader that sends received data to a channel.
+type testRTMPConnDataReader struct {
+	testPathReader
+	data chan *data
+}
+
+func (r *testRTMPConnDataReader) onReaderData(data *data) {
+	select {
+	case r.data <- data:
+	default:
+	}
+}
+
+func TestRTMPConnPublishCaptions(t *testing.T) {
+	pm := newTestRTMPConnPathManager(t, &conf.PathConf{})
+	defer pm.close()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	c, nconn := newTestRTMPConn(&wg, pm, testRTMPConnParent{})
+	defer nconn.Close()
+	defer c.close()
+
+	source := testRTMPConnClient(t, nconn, "rtmp://127.0.0.1/teststream", nrtmp.PrepareWriting)
+	testRTMPConnPublishTracks(t, source)
+	pa := <-pm.sourceReady
+
+	r := &testRTMPConnDataReader{data: make(chan *data, 100)}
+	res := pm.onReaderSetupPlay(pathReaderSetupPlayReq{
+		author:   r,
+		pathName: "teststream",
+		authenticate: func([]interface{}, conf.Credential, conf.Credential) error {
+			return nil
+		},
+	})
+	require.NoError(t, res.err)
+	pa.onReaderPlay(pathReaderPlayReq{author: r})
+
+	ccData := []byte{0xc1, 0xff, 0xfc, 0x94, 0x2c}
+	sei := append([]byte{
+		0x06, 0x04, 0x0d, 0xb5, 0x00, 0x31,
+		'G', 'A', '9', '4',
+		0x03,
+	}, ccData...)
+	sei = append(sei, 0x80)
+
+	avcc, err := h264.EncodeAVCC([][]byte{sei, {0x65, 0x88, 0x84, 0x00}})
+	require.NoError(t, err)
+	err = source.WritePacket(av.Packet{
+		Type: av.H264,
+		Data: avcc,
+	})
+	require.NoError(t, err)
+	err = source.FlushWrite()
+	require.NoError(t, err)
+
+	for {
+		select {
+		case d := <-r.data:
+			if d.h264NALUs == nil {
+				continue
+			}
+
+			// captions are forwarded and are left inside the stream
+			require.Equal(t, [][]byte{ccData}, d.h264Captions)
+			require.Equal(t, sei, d.h264NALUs[0])
+			return
+
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the access unit")
+		}
+	}
+}
+
+func TestRTMPConnPublishDecoderConfigChange(t *testing.T) {
+	pm := newTestRTMPConnPathManager(t, &conf.PathConf{})
+	defer pm.close()
+
+	parent := &testRTMPConnLogParent{lines: make(chan string, 100)}
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	c, nconn := newTestRTMPConn(&wg, pm, parent)
+	defer nconn.Close()
+	defer c.close()
+
+	source := testRTMPConnClient(t, nconn, "rtmp://127.0.0.1/teststream", nrtmp.PrepareWriting)
+	testRTMPConnPublishTracks(t, source)
+	pa := <-pm.sourceReady
+
+	r := &testRTMPConnDataReader{data: make(chan *data, 100)}
+	res := pm.onReaderSetupPlay(pathReaderSetupPlayReq{
+		author:   r,
+		pathName: "teststream",
+		authenticate: func([]interface{}, conf.Credential, conf.Credential) error {
+			return nil
+		},
+	})
+	require.NoError(t, res.err)
+	pa.onReaderPlay(pathReaderPlayReq{author: r})
+
+	writeConfig := func(sps []byte) {
+		err := source.WritePacket(av.Packet{
+			Type: av.H264DecoderConfig,
+			Data: rtmpConnH264DecoderConfig(sps, testRTMPConnPPS),
+		})
+		require.NoError(t, err)
+		err = source.FlushWrite()
+		require.NoError(t, err)
+	}
+
+	// returns the NALUs of the next access unit, and whether
+	// the warning has been logged in the meanwhile.
+	nextAU := func() ([][]byte, bool) {
+		for {
+			select {
+			case d := <-r.data:
+				if d.h264NALUs == nil {
+					continue
+				}
+
+				warned := false
+				for {
+					select {
+					case line := <-parent.lines:
+						if strings.Contains(line, "changed the H264 parameters mid-stream") {
+							warned = true
+						}
+						continue
+					default:
+					}
+					break
+				}
+
+				return d.h264NALUs, warned
+
+			case <-time.After(5 * time.Second):
+				t.Fatal("timed out waiting for an access unit")
+			}
+		}
+	}
+
+	// an unchanged config is ignored: the first access unit
+	// is the IDR, with the parameters that are inserted before it.
+	writeConfig(testRTMPConnSPS)
+	err := testRTMPConnWriteIDR(source, 0)
+	require.NoError(t, err)
+
+	nalus, warned := nextAU()
+	require.Equal(t, [][]byte{testRTMPConnSPS, testRTMPConnPPS, {0x65, 0x88, 0x84, 0x00}}, nalus)
+	require.Equal(t, false, warned)
+
+	// a changed config is logged and forwarded:
+	// the new parameters are inserted before the next IDR.
+	sps2 := []byte{
+		0x67, 0x64, 0x00, 0x32, 0xac, 0x2c, 0x6a, 0x80,
+		0xa8, 0x02, 0xfe, 0x9b, 0x82, 0x80, 0x82, 0xa0,
+		0x00, 0x00, 0x03, 0x00, 0x20, 0x00, 0x00, 0x06,
+		0x50, 0x80,
+	}
+	writeConfig(sps2)
+	err = testRTMPConnWriteIDR(source, 40*time.Millisecond)
+	require.NoError(t, err)
+
+	nalus, warned = nextAU()
+	require.Equal(t, [][]byte{sps2, testRTMPConnPPS, {0x65, 0x88, 0x84, 0x00}}, nalus)
+	require.Equal(t, true, warned)
+}
+
+func TestRTMPConnH264Params(t *testing.T) {
+	sps, pps := rtmpConnH264Params([][]byte{
+		{0x09, 0xf0},
+		{0x67, 0x42, 0xc0, 0x1f},
+		{0x68, 0xce, 0x3c, 0x80},
+		{0x65, 0x88, 0x84},
+	})
+	require.Equal(t, []byte{0x67, 0x42, 0xc0, 0x1f}, sps)
+	require.Equal(t, []byte{0x68, 0xce, 0x3c, 0x80}, pps)
+
+	// access unit without parameters
+	sps, pps = rtmpConnH264Params([][]byte{
+		nil,
+		{0x41, 0x9a, 0x24},
+	})
+	require.Equal(t, []byte(nil), sps)
+	require.Equal(t, []byte(nil), pps)
+}
+
+func TestRTMPConnHandshakeTimeout(t *testing.T) {
+	require.Equal(t, 5*time.Second, rtmpConnHandshakeTimeout(
+		conf.StringDuration(5*time.Second), conf.StringDuration(10*time.Second)))
+
+	// the handshake timeout can't exceed the timeout
+	require.Equal(t, 10*time.Second, rtmpConnHandshakeTimeout(
+		conf.StringDuration(20*time.Second), conf.StringDuration(10*time.Second)))
+
+	// disabled
+	require.Equal(t, 10*time.Second, rtmpConnHandshakeTimeout(
+		0, conf.StringDuration(10*time.Second)))
+}
+
+func TestRTMPConnH264DecoderConfig(t *testing.T) {
+	// SPS longer than 128 bytes
+	sps := append([]byte{0x67, 0x64, 0x00, 0x28}, bytes.Repeat([]byte{0xac}, 200)...)
+	pps := []byte{0x68, 0xee, 0x3c, 0x80}
+
+	codec, err := nh264.FromDecoderConfig(rtmpConnH264DecoderConfig(sps, pps))
+	require.NoError(t, err)
+	require.Equal(t, sps, codec.SPS[0])
+	require.Equal(t, pps, codec.PPS[0])
+}
+
+func TestRTMPConnPublisherIdentity(t *testing.T) {
+	id1 := rtmpConnPublisherIdentity(url.Values{"user": []string{"myuser"}, "pass": []string{"mypass"}})
+	id2 := rtmpConnPublisherIdentity(url.Values{"pass": []string{"mypass"}, "user": []string{"myuser"}, "other": []string{"1"}})
+	require.Equal(t, id1, id2)
+
+	id3 := rtmpConnPublisherIdentity(url.Values{"user": []string{"myuser"}, "pass": []string{"otherpass"}})
+	require.NotEqual(t, id1, id3)
+
+	id4 := rtmpConnPublisherIdentity(url.Values{"key": []string{"mykey"}})
+	require.NotEqual(t, "", id4)
+
+	// publishers without credentials have no identity
+	require.Equal(t, "", rtmpConnPublisherIdentity(url.Values{"other": []string{"1"}}))
+}
+
+func TestRTMPConnPacketType(t *testing.T) {
+	require.Equal(t, "H264SPSPPSNALU", rtmpConnPacketType(av.H264SPSPPSNALU))
+	require.Equal(t, "unknown type 0", rtmpConnPacketType(0))
+}
+
+func TestRTMPConnIsAnnexB(t *testing.T) {
+	require.Equal(t, true, rtmpConnIsAnnexB([]byte{0x00, 0x00, 0x00, 0x01, 0x65, 0x88}))
+	require.Equal(t, false, rtmpConnIsAnnexB([]byte{0x00, 0x00, 0x00, 0x02, 0x65, 0x88}))
+
+	// 3-byte start code
+	require.Equal(t, true, rtmpConnIsAnnexB([]byte{0x00, 0x00, 0x01, 0x65, 0x88}))
+	nalus, err := h264.DecodeAnnexB([]byte{0x00, 0x00, 0x01, 0x09, 0xf0, 0x00, 0x00, 0x01, 0x65, 0x88})
+	require.NoError(t, err)
+	require.Equal(t, [][]byte{{0x09, 0xf0}, {0x65, 0x88}}, nalus)
+
+	// AVCC with a NALU between 256 and 511 bytes
+	avcc, err := h264.EncodeAVCC([][]byte{append([]byte{0x65}, bytes.Repeat([]byte{0x88}, 299)...)})
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x00, 0x00, 0x01}, avcc[:3])
+	require.Equal(t, false, rtmpConnIsAnnexB(avcc))
+}
+
+func TestRTMPConnCloseReason(t *testing.T) {
+	require.Equal(t, "read timeout", rtmpConnCloseReason(
+		&net.OpError{Op: "read", Err: os.ErrDeadlineExceeded}))
+	require.Equal(t, "write timeout", rtmpConnCloseReason(
+		&net.OpError{Op: "write", Err: os.ErrDeadlineExceeded}))
+	require.Equal(t, "connection reset", rtmpConnCloseReason(
+		&net.OpError{Op: "read", Err: &os.SyscallError{Syscall: "read", Err: syscall.ECONNRESET}}))
+	require.Equal(t, "client disconnected", rtmpConnCloseReason(io.EOF))
+	require.Equal(t, "terminated", rtmpConnCloseReason(fmt.Errorf("terminated")))
+}
+
+func TestRTMPConnCloseCause(t *testing.T) {
+	for _, ca := range []struct {
+		err   error
+		cause rtmpConnCloseCause
+	}{
+		{io.EOF, rtmpConnCloseCauseClient},
+		{rtmp.ErrUnpublished, rtmpConnCloseCauseClient},
+		{
+			&net.OpError{Op: "read", Err: &os.SyscallError{Syscall: "read", Err: syscall.ECONNRESET}},
+			rtmpConnCloseCauseClient,
+		},
+		{&net.OpError{Op: "read", Err: os.ErrDeadlineExceeded}, rtmpConnCloseCauseTimeout},
+		{rtmpConnErrAuth{message: "credentials have been revoked"}, rtmpConnCloseCauseAuth},
+		{fmt.Errorf("at least one track must be enabled"), rtmpConnCloseCauseError},
+	} {
+		require.Equal(t, ca.cause, rtmpConnCloseCauseFromError(ca.err))
+	}
+
+	require.Equal(t, "auth", rtmpConnCloseCauseAuth.String())
+	require.Equal(t, "capacity", rtmpConnCloseCauseCapacity.String())
+	require.Equal(t, "error", rtmpConnCloseCauseError.String())
+}
+
+func TestRTMPConnStreamKeyEmpty(t *testing.T) {
+	for _, ca := range []struct {
+		app   string
+		key   string
+		empty bool
+	}{
+		{"live", "mystream", false},
+		{"live/", "mystream", false},
+		{"live", "mystream?user=myuser", false},
+		{"live", "", true},
+		{"live", "?user=myuser", true},
+		{"live/mystream", "", true},
+	} {
+		u, err := url.ParseRequestURI("/" + ca.app + "/" + ca.key)
+		require.NoError(t, err)
+		require.Equal(t, ca.empty, rtmpConnStreamKeyEmpty(u), ca.app+" "+ca.key)
+	}
+}
+
+func TestPathNameAndQuery(t *testing.T) {
+	for _, ca := range []struct {
+		name     string
+		app      string
+		key      string
+		pathName string
+		rawQuery string
+	}{
+		{
+			"standard",
+			"live",
+			"stream1",
+			"live/stream1",
+			"",
+		},
+		{
+			"nested app",
+			"live/region",
+			"cam1",
+			"live/region/cam1",
+			"",
+		},
+		{
+			"nested key",
+			"live",
+			"region/cam1",
+			"live/region/cam1",
+			"",
+		},
+		{
+			"app with trailing slash",
+			"live/region/",
+			"cam1",
+			"live/region/cam1",
+			"",
+		},
+		{
+			"key with leading slash",
+			"live/region",
+			"/cam1",
+			"live/region/cam1",
+			"",
+		},
+		{
+			"no key",
+			"live/region/cam1",
+			"",
+			"live/region/cam1",
+			"",
+		},
+		{
+			"query",
+			"live/region",
+			"cam1?user=myuser&pass=mypass",
+			"live/region/cam1",
+			"user=myuser&pass=mypass",
+		},
+		{
+			"track selection",
+			"live",
+			"cam1?video=1&audio=2",
+			"live/cam1",
+			"video=1&audio=2",
+		},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			// the URL is built in the same way of the server-side library
+			ur, err := url.ParseRequestURI("/" + ca.app + "/" + ca.key)
+			require.NoError(t, err)
+			ur.Scheme = "rtmp"
+			ur.Host = "localhost:1935"
+
+			pathName, _, rawQuery := pathNameAndQuery(ur)
+			require.Equal(t, ca.pathName, pathName)
+			require.Equal(t, ca.rawQuery, rawQuery)
+		})
+	}
+}
+
+func TestRTMPConnQueryWithoutPass(t *testing.T) {
+	query, err := url.ParseQuery("token=abc&user=myuser&pass=mypass&client=mobile")
+	require.NoError(t, err)
+	require.Equal(t, "client=mobile&token=abc&user=myuser", rtmpConnQueryWithoutPass(query))
+}
+
+func TestRTMPConnWithoutPass(t *testing.T) {
+	require.Equal(t, "live", rtmpConnWithoutPass("live"))
+	require.Equal(t, "rtmp://127.0.0.1/live?key=val", rtmpConnWithoutPass("rtmp://127.0.0.1/live?key=val"))
+	require.Equal(t, "mystream?user=myuser", rtmpConnWithoutPass("mystream?user=myuser&pass=mypass"))
+	require.Equal(t, "mystream", rtmpConnWithoutPass("mystream?pass=%zz"))
+}
+
+func TestRTMPConnAACTimestamps(t *testing.T) {
+	// timestamps of each group are derived from the PTS of the group,
+	// without depending on previous groups.
+	for _, pts := range []time.Duration{
+		0,
+		40 * time.Millisecond,
+		100 * time.Millisecond,
+	} {
+		ptss := rtmpConnAACTimestamps(pts, 3, 1024, 48000)
+		require.Equal(t, []time.Duration{
+			pts,
+			pts + 21333333*time.Nanosecond,
+			pts + 42666666*time.Nanosecond,
+		}, ptss)
+	}
+}
+
+type testRTMPConnParent struct{}
+
+func (testRTMPConnParent) log(logger.Level, string, ...interface{}) {}
+
+func (testRTMPConnParent) logFields(logger.Level, logger.Fields, string, ...interface{}) {}
+
+func (testRTMPConnParent) onConnClose(*rtmpConn, rtmpConnCloseCause) {}
+
+func (testRTMPConnParent) onConnError(string, error) {}
+
+func (testRTMPConnParent) onConnStateChange(*rtmpConn, rtmpConnState, rtmpConnState) {}
+
+func (testRTMPConnParent) onFramesDropped(uint64) {}
+
+func (testRTMPConnParent) onReadBufferOverflow(rtmpReadBufferPolicy) {}
+
+func (testRTMPConnParent) onAudioJitterBufferFill(int64) {}
+
+// testRTMPConnLogParent is a rtmpConnParent that stores log lines.
+type testRTMPConnLogParent struct {
+	testRTMPConnParent
+	lines chan string
+}
+
+func (p *testRTMPConnLogParent) logFields(_ logger.Level, _ logger.Fields, format string, args ...interface{}) {
+	select {
+	case p.lines <- fmt.Sprintf(format, args...):
+	default:
+	}
+}
+
+func TestRTMPConnLogPrefix(t *testing.T) {
+	pm := newTestRTMPConnPathManager(t, &conf.PathConf{})
+	defer pm.close()
+
+	parent := &testRTMPConnLogParent{lines: make(chan string, 10)}
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	c, nconn := newTestRTMPConn(&wg, pm, parent)
+	defer nconn.Close()
+	defer c.close()
+
+	c.log(logger.Info, "test message")
+
+	for {
+		select {
+		case line := <-parent.lines:
+			if strings.HasSuffix(line, "test message") {
+				require.Equal(t, "[conn pipe] [test] test message", line)
+				return
+			}
+
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the log line")
+		}
+	}
+}
+
+func TestRTMPConnNonTCP(t *testing.T) {
+	nconn, other := net.Pipe()
+	defer nconn.Close()
+	defer other.Close()
+
+	c := &rtmpConn{
+		conn:        rtmp.NewServerConn(nconn),
+		authBackoff: newRTMPAuthBackoff(time.Minute, time.Minute),
+		parent:      testRTMPConnParent{},
+	}
+
+	require.Equal(t, net.IP(nil), c.ip())
+	require.Equal(t, false, c.isTrusted())
+	require.Equal(t, "", rtmpConnIPString(c.ip()))
+
+	// IP-based rules fail
+	ips := []interface{}{&net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(0, 32)}}
+	err := c.authenticate("mypath", ips, "", "", "read", url.Values{}, "")
+	require.Equal(t, pathErrAuthCritical{message: "IP of the client is unknown"}, err)
+
+	// other rules still work
+	err = c.authenticate("mypath", nil, "", "", "read", url.Values{}, "")
+	require.NoError(t, err)
+
+	// the backoff is not applied, since it would be shared by all clients
+	// without an IP
+	for i := 0; i < 3; i++ {
+		err = c.authenticate("mypath", nil, "myuser", "mypass", "read", url.Values{}, "")
+		require.Equal(t, pathErrAuthCritical{message: "invalid credentials"}, err)
+	}
+	require.Equal(t, 0, len(c.authBackoff.entries))
+}
+
+// testRTMPConnPathManager is a rtmpConnPathManager that creates paths
+// with a fixed configuration, in order to test rtmpConn without a pathManager.
+// It is also the parent of the paths it creates.
+type testRTMPConnPathManager struct {
+	pathConf *conf.PathConf
+
+	ctx         context.Context
+	ctxCancel   func()
+	wg          sync.WaitGroup
+	mutex       sync.Mutex
+	paths       map[string]*path
+	sourceReady chan *path
+}
+
+func newTestRTMPConnPathManager(t *testing.T, pathConf *conf.PathConf) *testRTMPConnPathManager {
+	// fill the missing parameters of the configuration
+	cnf := &conf.Conf{
+		Paths: map[string]*conf.PathConf{
+			"all": pathConf,
+		},
+	}
+	err := cnf.CheckAndFillMissing()
+	require.NoError(t, err)
+
+	ctx, ctxCancel := context.WithCancel(context.Background())
+
+	return &testRTMPConnPathManager{
+		pathConf:    pathConf,
+		ctx:         ctx,
+		ctxCancel:   ctxCancel,
+		paths:       make(map[string]*path),
+		sourceReady: make(chan *path, 1),
+	}
+}
+
+func (pm *testRTMPConnPathManager) close() {
+	pm.ctxCancel()
+	pm.wg.Wait()
+}
+
+func (pm *testRTMPConnPathManager) path(name string) *path {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	pa, ok := pm.paths[name]
+	if !ok {
+		pa = newPath(
+			pm.ctx,
+			"",
+			conf.StringDuration(10*time.Second),
+			conf.StringDuration(10*time.Second),
+			512,
+			0,
+			"all",
+			pm.pathConf,
+			name,
+			nil,
+			&pm.wg,
+			nil,
+			pm)
+		pm.paths[name] = pa
+	}
+
+	return pa
+}
+
+func (pm *testRTMPConnPathManager) onReaderSetupPlay(req pathReaderSetupPlayReq) pathReaderSetupPlayRes {
+	err := req.authenticate(pm.pathConf.ReadIPs, pm.pathConf.ReadUser, pm.pathConf.ReadPass)
+	if err != nil {
+		return pathReaderSetupPlayRes{err: err}
+	}
+
+	req.res = make(chan pathReaderSetupPlayRes)
+	return pm.path(req.pathName).onReaderSetupPlay(req)
+}
+
+func (pm *testRTMPConnPathManager) onPublisherAnnounce(req pathPublisherAnnounceReq) pathPublisherAnnounceRes {
+	err := req.authenticate(pm.pathConf.PublishIPs, pm.pathConf.PublishUser, pm.pathConf.PublishPass)
+	if err != nil {
+		return pathPublisherAnnounceRes{err: err}
+	}
+
+	req.res = make(chan pathPublisherAnnounceRes)
+	return pm.path(req.pathName).onPublisherAnnounce(req)
+}
+
+func (pm *testRTMPConnPathManager) log(logger.Level, string, ...interface{}) {}
+
+func (pm *testRTMPConnPathManager) onPathSourceReady(pa *path) {
+	select {
+	case pm.sourceReady <- pa:
+	default:
+	}
+}
+
+func (pm *testRTMPConnPathManager) onPathClose(pa *path) {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+	delete(pm.paths, pa.Name())
+}
+
+// testRTMPConnRecordingParent is a rtmpConnParent that notifies
+// when connections are closed.
+type testRTMPConnRecordingParent struct {
+	testRTMPConnParent
+	closed chan *rtmpConn
+	cause  rtmpConnCloseCause // can be read after receiving from closed
+	states chan string
+}
+
+func newTestRTMPConnRecordingParent() *testRTMPConnRecordingParent {
+	return &testRTMPConnRecordingParent{
+		closed: make(chan *rtmpConn, 1),
+		states: make(chan string, 10),
+	}
+}
+
+func (p *testRTMPConnRecordingParent) onConnStateChange(c *rtmpConn, oldState rtmpConnState, newState rtmpConnState) {
+	select {
+	case p.states <- oldState.String() + " -> " + newState.String():
+	default:
+	}
+}
+
+func (p *testRTMPConnRecordingParent) onConnClose(c *rtmpConn, cause rtmpConnCloseCause) {
+	p.cause = cause
+	p.closed <- c
+}
+
+// newTestRTMPConn creates a rtmpConn with default parameters, attached to
+// one side of an in-memory connection, and returns the other side.
+func newTestRTMPConn(
+	wg *sync.WaitGroup,
+	pathManager rtmpConnPathManager,
+	parent rtmpConnParent,
+) (*rtmpConn, net.Conn) {
+	return newTestRTMPConnWithConf(wg, testRTMPConnConf(), pathManager, parent)
+}
+
+// testRTMPConnConf returns the default parameters of test connections.
+func testRTMPConnConf() rtmpConnConf {
+	return rtmpConnConf{
+		rtspAddress:      ":8554",
+		handshakeTimeout: conf.StringDuration(5 * time.Second),
+		logLevel:         conf.LogLevel(logger.Info),
+		readTimeout:      conf.StringDuration(10 * time.Second),
+		writeTimeout:     conf.StringDuration(10 * time.Second),
+		readBufferCount:  512,
+	}
+}
+
+// newTestRTMPConnWithConf is like newTestRTMPConn, but allows
+// to set the parameters of the connection.
+func newTestRTMPConnWithConf(
+	wg *sync.WaitGroup,
+	cnf rtmpConnConf,
+	pathManager rtmpConnPathManager,
+	parent rtmpConnParent,
+) (*rtmpConn, net.Conn) {
+	nconn, other := net.Pipe()
+
+	c := newRTMPConn(
+		context.Background(),
+		"test",
+		cnf,
+		newRTMPAuthBackoff(0, time.Minute),
+		nil,
+		false,
+		wg,
+		nconn,
+		nil,
+		nil,
+		pathManager,
+		parent)
+
+	return c, other
+}
+
+func testRTMPConnClient(t *testing.T, nconn net.Conn, u string, stage int) *nrtmp.Conn {
+	conn := nrtmp.NewConn(&bufio.ReadWriter{
+		Reader: bufio.NewReader(nconn),
+		Writer: bufio.NewWriter(nconn),
+	})
+
+	var err error
+	conn.URL, err = url.Parse(u)
+	require.NoError(t, err)
+
+	err = conn.Prepare(nrtmp.StageGotPublishOrPlayCommand, stage)
+	require.NoError(t, err)
+
+	return conn
+}
+
+var (
+	testRTMPConnSPS = []byte{
+		0x67, 0x64, 0x00, 0x0c, 0xac, 0x3b, 0x50, 0xb0,
+		0x4b, 0x42, 0x00, 0x00, 0x03, 0x00, 0x02, 0x00,
+		0x00, 0x03, 0x00, 0x3d, 0x08,
+	}
+	testRTMPConnPPS = []byte{0x68, 0xee, 0x3c, 0x80}
+)
+
+// testRTMPConnPublishTracks writes the metadata and the decoder
+// configurations of a H264 and an AAC track.
+func testRTMPConnPublishTracks(t *testing.T, conn *nrtmp.Conn) {
+	err := conn.WritePacket(av.Packet{
+		Type: av.Metadata,
+		Data: flvio.FillAMF0ValsMalloc([]interface{}{flvio.AMFMap{
+			{K: "videocodecid", V: float64(7)},
+			{K: "audiocodecid", V: float64(10)},
+		}}),
+	})
+	require.NoError(t, err)
+
+	err = conn.WritePacket(av.Packet{
+		Type: av.H264DecoderConfig,
+		Data: rtmpConnH264DecoderConfig(testRTMPConnSPS, testRTMPConnPPS),
+	})
+	require.NoError(t, err)
+
+	enc, err := aac.MPEG4AudioConfig{
+		Type:         2,
+		SampleRate:   44100,
+		ChannelCount: 2,
+	}.Encode()
+	require.NoError(t, err)
+
+	err = conn.WritePacket(av.Packet{
+		Type: av.AACDecoderConfig,
+		Data: enc,
+	})
+	require.NoError(t, err)
+
+	err = conn.FlushWrite()
+	require.NoError(t, err)
+}
+
+func testRTMPConnWriteIDR(conn *nrtmp.Conn, dts time.Duration) error {
+	avcc, err := h264.EncodeAVCC([][]byte{{0x65, 0x88, 0x84, 0x00}})
+	if err != nil {
+		return err
+	}
+
+	err = conn.WritePacket(av.Packet{
+		Type: av.H264,
+		Data: avcc,
+		Time: dts,
+	})
+	if err != nil {
+		return err
+	}
+
+	return conn.FlushWrite()
+}
+
+func TestRTMPConnStateStart(t *testing.T) {
+	pm := newTestRTMPConnPathManager(t, &conf.PathConf{})
+	defer pm.close()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	c, nconn := newTestRTMPConn(&wg, pm, testRTMPConnParent{})
+	defer nconn.Close()
+	defer c.close()
+
+	byts, err := json.Marshal(c.apiDescribe())
+	require.NoError(t, err)
+	var desc struct {
+		Created    string `json:"created"`
+		StateStart string `json:"stateStart"`
+	}
+	err = json.Unmarshal(byts, &desc)
+	require.NoError(t, err)
+
+	// the idle state starts when the connection is created
+	require.Equal(t, desc.Created, desc.StateStart)
+	require.NotEqual(t, time.Time{}.Format(time.RFC3339), desc.StateStart)
+}
+
+func TestRTMPConnBytesCounters(t *testing.T) {
+	pm := newTestRTMPConnPathManager(t, &conf.PathConf{})
+	defer pm.close()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	counters := func(desc interface{}) (uint64, uint64) {
+		byts, err := json.Marshal(desc)
+		require.NoError(t, err)
+		var out struct {
+			BytesReceived uint64 `json:"bytesReceived"`
+			BytesSent     uint64 `json:"bytesSent"`
+		}
+		err = json.Unmarshal(byts, &out)
+		require.NoError(t, err)
+		return out.BytesReceived, out.BytesSent
+	}
+
+	pc, pnconn := newTestRTMPConn(&wg, pm, testRTMPConnParent{})
+	defer pc.close()
+	defer pnconn.Close()
+
+	// bytes are counted on the client side too
+	clientReceived := new(uint64)
+	clientSent := new(uint64)
+	source := testRTMPConnClient(t, &rtmpConnCountedConn{
+		Conn:          pnconn,
+		bytesReceived: clientReceived,
+		bytesSent:     clientSent,
+	}, "rtmp://127.0.0.1/teststream", nrtmp.PrepareWriting)
+	testRTMPConnPublishTracks(t, source)
+	<-pm.sourceReady
+
+	err := testRTMPConnWriteIDR(source, 0)
+	require.NoError(t, err)
+
+	// the publisher receives all the bytes sent by the client and
+	// sends all the bytes received by the client.
+	require.Eventually(t, func() bool {
+		received, sent := counters(pc.onSourceAPIDescribe())
+		return received == atomic.LoadUint64(clientSent) &&
+			sent == atomic.LoadUint64(clientReceived)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	received, _ := counters(pc.onSourceAPIDescribe())
+	err = testRTMPConnWriteIDR(source, 40*time.Millisecond)
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		received2, _ := counters(pc.onSourceAPIDescribe())
+		return received2 > received
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the bytes sent to readers are counted
+	rc, rnconn := newTestRTMPConn(&wg, pm, testRTMPConnParent{})
+	defer rc.close()
+	defer rnconn.Close()
+
+	testRTMPConnClient(t, rnconn, "rtmp://127.0.0.1/teststream", nrtmp.PrepareReading)
+	go io.Copy(io.Discard, rnconn)
+
+	_, sentBefore := counters(rc.onReaderAPIDescribe())
+
+	for i := 2; i < 5; i++ {
+		err = testRTMPConnWriteIDR(source, time.Duration(i)*40*time.Millisecond)
+		require.NoError(t, err)
+	}
+
+	require.Eventually(t, func() bool {
+		received, sent := counters(rc.onReaderAPIDescribe())
+		return received > 0 && sent > sentBefore
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestRTMPConnPublish(t *testing.T) {
+	pm := newTestRTMPConnPathManager(t, &conf.PathConf{})
+	defer pm.close()
+
+	parent := newTestRTMPConnRecordingParent()
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	c, nconn := newTestRTMPConn(&wg, pm, parent)
+	defer c.close()
+
+	source := testRTMPConnClient(t, nconn, "rtmp://127.0.0.1/teststream", nrtmp.PrepareWriting)
+	testRTMPConnPublishTracks(t, source)
+
+	pa := <-pm.sourceReady
+	require.Equal(t, "teststream", pa.Name())
+	require.Equal(t, rtmpConnStatePublish, c.safeState())
+
+	// the encoder is the flashVer sent by the client in the connect command
+	byts, err := json.Marshal(c.onSourceAPIDescribe())
+	require.NoError(t, err)
+	var desc struct {
+		Connect struct {
+			FlashVer string `json:"flashVer"`
+		} `json:"connect"`
+	}
+	err = json.Unmarshal(byts, &desc)
+	require.NoError(t, err)
+	require.Equal(t, "LNX 9,0,124,2", desc.Connect.FlashVer)
+
+	err = testRTMPConnWriteIDR(source, 0)
+	require.NoError(t, err)
+
+	err = source.WritePacket(av.Packet{
+		Type: av.AAC,
+		Data: []byte{0x01, 0x02, 0x03, 0x04},
+	})
+	require.NoError(t, err)
+	err = source.FlushWrite()
+	require.NoError(t, err)
+
+	// the connection is closed after all packets have been processed
+	nconn.Close()
+	require.Equal(t, c, <-parent.closed)
+	require.Equal(t, rtmpConnCloseCauseClient, parent.cause)
+
+	require.Equal(t, "idle -> publish", <-parent.states)
+	require.Equal(t, "publish -> closed", <-parent.states)
+
+	require.Equal(t, 2, len(c.tracks))
+	require.Equal(t, uint64(1), atomic.LoadUint64(c.videoFrames))
+	require.Equal(t, uint64(1), atomic.LoadUint64(c.idrFrames))
+}
+
+func TestRTMPConnPublishNoTracks(t *testing.T) {
+	pm := newTestRTMPConnPathManager(t, &conf.PathConf{})
+	defer pm.close()
+
+	parent := newTestRTMPConnRecordingParent()
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	c, nconn := newTestRTMPConn(&wg, pm, parent)
+	defer c.close()
+	defer nconn.Close()
+
+	source := testRTMPConnClient(t, nconn, "rtmp://127.0.0.1/teststream", nrtmp.PrepareWriting)
+
+	// metadata without codecs, followed by a frame without decoder config
+	err := source.WritePacket(av.Packet{
+		Type: av.Metadata,
+		Data: flvio.FillAMF0ValsMalloc([]interface{}{flvio.AMFMap{}}),
+	})
+	require.NoError(t, err)
+	err = testRTMPConnWriteIDR(source, 0)
+	require.NoError(t, err)
+
+	go io.Copy(io.Discard, nconn)
+
+	require.Equal(t, c, <-parent.closed)
+	require.Equal(t, rtmpConnCloseCauseError, parent.cause)
+
+	select {
+	case <-pm.sourceReady:
+		t.Errorf("path is ready")
+	default:
+	}
+}
+
+func TestRTMPConnPublishUnsupportedVideo(t *testing.T) {
+	for _, ca := range []struct {
+		name   string
+		fourCC string
+		err    string
+	}{
+		{"h265", "hvc1", "H265 is not supported yet"},
+		{"av1", "av01", "AV1 is not supported yet"},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			pm := newTestRTMPConnPathManager(t, &conf.PathConf{})
+			defer pm.close()
+
+			parent := &testRTMPConnLogParent{lines: make(chan string, 100)}
+			var wg sync.WaitGroup
+			defer wg.Wait()
+
+			c, nconn := newTestRTMPConn(&wg, pm, parent)
+			defer c.close()
+			defer nconn.Close()
+
+			source := testRTMPConnClient(t, nconn, "rtmp://127.0.0.1/teststream", nrtmp.PrepareWriting)
+
+			// enhanced RTMP sequence start, without metadata
+			err := source.WriteTag(flvio.Tag{
+				Type:      flvio.TAG_VIDEO,
+				FrameType: 0x08 | flvio.FRAME_KEY, // ExVideoHeader
+				Data:      append([]byte(ca.fourCC), 0x01, 0x02, 0x03),
+			})
+			require.NoError(t, err)
+			err = source.FlushWrite()
+			require.NoError(t, err)
+
+			go io.Copy(io.Discard, nconn)
+
+			for closed := false; !closed; {
+				select {
+				case line := <-parent.lines:
+					closed = strings.Contains(line, "closed (error: "+ca.err)
+
+				case <-time.After(5 * time.Second):
+					t.Fatal("timed out waiting for the publisher to be closed")
+				}
+			}
+
+			select {
+			case <-pm.sourceReady:
+				t.Errorf("path is ready")
+			default:
+			}
+		})
+	}
+}
+
+func TestRTMPConnKickCause(t *testing.T) {
+	pm := newTestRTMPConnPathManager(t, &conf.PathConf{})
+	defer pm.close()
+
+	parent := newTestRTMPConnRecordingParent()
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	c, nconn := newTestRTMPConn(&wg, pm, parent)
+	defer nconn.Close()
+
+	c.kick()
+	require.Equal(t, c, <-parent.closed)
+	require.Equal(t, rtmpConnCloseCauseKicked, parent.cause)
+}
+
+func TestRTMPConnReadDecoderConfig(t *testing.T) {
+	pm := newTestRTMPConnPathManager(t, &conf.PathConf{})
+	defer pm.close()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	pc, pnconn := newTestRTMPConn(&wg, pm, testRTMPConnParent{})
+	defer pc.close()
+	defer pnconn.Close()
+
+	source := testRTMPConnClient(t, pnconn, "rtmp://127.0.0.1/teststream", nrtmp.PrepareWriting)
+	testRTMPConnPublishTracks(t, source)
+	<-pm.sourceReady
+
+	rc, rnconn := newTestRTMPConn(&wg, pm, testRTMPConnParent{})
+	defer rc.close()
+	defer rnconn.Close()
+
+	reader := testRTMPConnClient(t, rnconn, "rtmp://127.0.0.1/teststream", nrtmp.PrepareReading)
+
+	// IDRs are sent until the reader receives one, since the reader
+	// may not have been added to the path yet.
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			case <-time.After(50 * time.Millisecond):
+			}
+
+			err := testRTMPConnWriteIDR(source, time.Duration(i)*50*time.Millisecond)
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	var prev av.Packet
+	for {
+		pkt, err := reader.ReadPacket()
+		require.NoError(t, err)
+
+		if pkt.Type == av.H264 {
+			break
+		}
+		prev = pkt
+	}
+
+	require.Equal(t, av.H264DecoderConfig, prev.Type)
+	codec, err := nh264.FromDecoderConfig(prev.Data)
+	require.NoError(t, err)
+	require.Equal(t, testRTMPConnSPS, codec.SPS[0])
+	require.Equal(t, testRTMPConnPPS, codec.PPS[0])
+}
+
+func TestRTMPConnReadDTSPassthrough(t *testing.T) {
+	pm := newTestRTMPConnPathManager(t, &conf.PathConf{
+		RTMPDTSPassthrough: true,
+	})
+	defer pm.close()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	pc, pnconn := newTestRTMPConn(&wg, pm, testRTMPConnParent{})
+	defer pc.close()
+	defer pnconn.Close()
+
+	source := testRTMPConnClient(t, pnconn, "rtmp://127.0.0.1/teststream", nrtmp.PrepareWriting)
+	testRTMPConnPublishTracks(t, source)
+	<-pm.sourceReady
+
+	rc, rnconn := newTestRTMPConn(&wg, pm, testRTMPConnParent{})
+	defer rc.close()
+	defer rnconn.Close()
+
+	reader := testRTMPConnClient(t, rnconn, "rtmp://127.0.0.1/teststream", nrtmp.PrepareReading)
+
+	avcc, err := h264.EncodeAVCC([][]byte{{0x65, 0x88, 0x84, 0x00}})
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			case <-time.After(50 * time.Millisecond):
+			}
+
+			err := source.WritePacket(av.Packet{
+				Type:  av.H264,
+				Data:  avcc,
+				Time:  time.Duration(i) * 50 * time.Millisecond,
+				CTime: 120 * time.Millisecond,
+			})
+			if err != nil {
+				return
+			}
+
+			err = source.FlushWrite()
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	// the composition time of the publisher is preserved,
+	// instead of being estimated.
+	for i := 0; i < 2; {
+		pkt, err := reader.ReadPacket()
+		require.NoError(t, err)
+
+		if pkt.Type == av.H264 {
+			require.Equal(t, 120*time.Millisecond, pkt.CTime)
+			i++
+		}
+	}
+}
+
+func TestRTMPConnReadBFrames(t *testing.T) {
+	for _, ca := range []struct {
+		name   string
+		ctimes []time.Duration
+	}{
+		{
+			// IDR, P, B, B in decoding order
+			"b-frames",
+			[]time.Duration{
+				66 * time.Millisecond,
+				133 * time.Millisecond,
+				33 * time.Millisecond,
+				33 * time.Millisecond,
+			},
+		},
+		{
+			"negative composition time",
+			[]time.Duration{
+				-33 * time.Millisecond,
+				66 * time.Millisecond,
+				-33 * time.Millisecond,
+				-33 * time.Millisecond,
+			},
+		},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			pm := newTestRTMPConnPathManager(t, &conf.PathConf{
+				RTMPDTSPassthrough: true,
+			})
+			defer pm.close()
+
+			var wg sync.WaitGroup
+			defer wg.Wait()
+
+			pc, pnconn := newTestRTMPConn(&wg, pm, testRTMPConnParent{})
+			defer pc.close()
+			defer pnconn.Close()
+
+			source := testRTMPConnClient(t, pnconn, "rtmp://127.0.0.1/teststream", nrtmp.PrepareWriting)
+			testRTMPConnPublishTracks(t, source)
+			<-pm.sourceReady
+
+			rc, rnconn := newTestRTMPConn(&wg, pm, testRTMPConnParent{})
+			defer rc.close()
+			defer rnconn.Close()
+
+			reader := testRTMPConnClient(t, rnconn, "rtmp://127.0.0.1/teststream", nrtmp.PrepareReading)
+
+			done := make(chan struct{})
+			defer close(done)
+
+			// groups of frames are sent until the reader receives one,
+			// since the reader may not have been added to the path yet.
+			go func() {
+				for i := 0; ; i++ {
+					select {
+					case <-done:
+						return
+					case <-time.After(50 * time.Millisecond):
+					}
+
+					for j, ctime := range ca.ctimes {
+						nalu := []byte{0x41, 0x9a, 0x00}
+						if j == 0 {
+							nalu = []byte{0x65, 0x88, 0x84, 0x00}
+						}
+
+						avcc, err := h264.EncodeAVCC([][]byte{nalu})
+						if err != nil {
+							return
+						}
+
+						err = source.WritePacket(av.Packet{
+							Type:  av.H264,
+							Data:  avcc,
+							Time:  time.Duration(i*len(ca.ctimes)+j) * 33 * time.Millisecond,
+							CTime: ctime,
+						})
+						if err != nil {
+							return
+						}
+					}
+
+					err := source.FlushWrite()
+					if err != nil {
+						return
+					}
+				}
+			}()
+
+			// the decoding order and the composition times are preserved,
+			// and the DTS is never negative.
+			var pkts []av.Packet
+			for len(pkts) < len(ca.ctimes) {
+				pkt, err := reader.ReadPacket()
+				require.NoError(t, err)
+
+				if pkt.Type == av.H264 {
+					pkts = append(pkts, pkt)
+				}
+			}
+
+			nalus, err := h264.DecodeAVCC(pkts[0].Data)
+			require.NoError(t, err)
+			require.Equal(t, h264.NALUTypeIDR, h264.NALUType(nalus[len(nalus)-1][0]&0x1F))
+			require.Less(t, pkts[0].Time, time.Second)
+
+			for i, pkt := range pkts {
+				require.Equal(t, ca.ctimes[i], pkt.CTime)
+				require.Equal(t, pkts[0].Time+time.Duration(i)*33*time.Millisecond, pkt.Time)
+			}
+		})
+	}
+}
+
+func TestRTMPConnReadDiscontinuity(t *testing.T) {
+	pm := newTestRTMPConnPathManager(t, &conf.PathConf{})
+	defer pm.close()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	pc, pnconn := newTestRTMPConn(&wg, pm, testRTMPConnParent{})
+	defer pc.close()
+	defer pnconn.Close()
+
+	source := testRTMPConnClient(t, pnconn, "rtmp://127.0.0.1/teststream", nrtmp.PrepareWriting)
+	testRTMPConnPublishTracks(t, source)
+	<-pm.sourceReady
+
+	rc, rnconn := newTestRTMPConn(&wg, pm, testRTMPConnParent{})
+	defer rc.close()
+	defer rnconn.Close()
+
+	reader := testRTMPConnClient(t, rnconn, "rtmp://127.0.0.1/teststream", nrtmp.PrepareReading)
+
+	done := make(chan struct{})
+	defer close(done)
+	jump := make(chan struct{})
+
+	// IDRs and audio frames with the same timestamp are sent until the test ends;
+	// timestamps jump forward by a minute when requested.
+	go func() {
+		jumpReq := jump
+		var offset time.Duration
+
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			case <-jumpReq:
+				jumpReq = nil
+				offset = time.Minute
+			case <-time.After(50 * time.Millisecond):
+			}
+
+			ts := time.Duration(i)*50*time.Millisecond + offset
+
+			err := testRTMPConnWriteIDR(source, ts)
+			if err == nil {
+				err = source.WritePacket(av.Packet{
+					Type: av.AAC,
+					Data: []byte{0x01, 0x02, 0x03, 0x04},
+					Time: ts,
+				})
+			}
+			if err == nil {
+				err = source.FlushWrite()
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	var videoPTS time.Duration
+	videoCount := 0
+	audioCount := 0
+
+	for audioCount < 5 {
+		pkt, err := reader.ReadPacket()
+		require.NoError(t, err)
+
+		switch pkt.Type {
+		case av.H264:
+			videoPTS = pkt.Time + pkt.CTime
+			videoCount++
+			if videoCount == 3 {
+				close(jump)
+			}
+
+		case av.AAC:
+			// audio and video are still aligned after the discontinuity
+			if videoCount >= 8 {
+				require.InDelta(t, float64(videoPTS), float64(pkt.Time), float64(200*time.Millisecond))
+				audioCount++
+			}
+		}
+	}
+}
+
+func TestRTMPConnReadAMFData(t *testing.T) {
+	pm := newTestRTMPConnPathManager(t, &conf.PathConf{})
+	defer pm.close()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	pc, pnconn := newTestRTMPConn(&wg, pm, testRTMPConnParent{})
+	defer pc.close()
+	defer pnconn.Close()
+
+	source := testRTMPConnClient(t, pnconn, "rtmp://127.0.0.1/teststream", nrtmp.PrepareWriting)
+	testRTMPConnPublishTracks(t, source)
+	<-pm.sourceReady
+
+	rc, rnconn := newTestRTMPConn(&wg, pm, testRTMPConnParent{})
+	defer rc.close()
+	defer rnconn.Close()
+
+	reader := testRTMPConnClient(t, rnconn, "rtmp://127.0.0.1/teststream", nrtmp.PrepareReading)
+
+	cuePoint := flvio.FillAMF0ValsMalloc([]interface{}{"onCuePoint", flvio.AMFMap{
+		{K: "name", V: "ad"},
+		{K: "type", V: "event"},
+	}})
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			case <-time.After(50 * time.Millisecond):
+			}
+
+			err := testRTMPConnWriteIDR(source, time.Duration(i)*50*time.Millisecond)
+			if err != nil {
+				return
+			}
+
+			err = source.WriteTag(flvio.Tag{
+				Type: flvio.TAG_AMF0,
+				Data: cuePoint,
+				Time: uint32(i * 50),
+			})
+			if err != nil {
+				return
+			}
+
+			err = source.FlushWrite()
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	// the data message is forwarded to the reader, after the first IDR.
+	idrReceived := false
+	for {
+		tag, err := reader.ReadTag()
+		require.NoError(t, err)
+
+		if tag.Type == flvio.TAG_VIDEO && tag.AVCPacketType == flvio.AVC_NALU {
+			idrReceived = true
+		}
+
+		if tag.Type == flvio.TAG_AMF0 && bytes.Equal(tag.Data, cuePoint) {
+			require.Equal(t, true, idrReceived)
+			break
+		}
+	}
+}
+
+func TestRTMPConnReadAudioOnly(t *testing.T) {
+	pm := newTestRTMPConnPathManager(t, &conf.PathConf{})
+	defer pm.close()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	pc, pnconn := newTestRTMPConn(&wg, pm, testRTMPConnParent{})
+	defer pc.close()
+	defer pnconn.Close()
+
+	source := testRTMPConnClient(t, pnconn, "rtmp://127.0.0.1/teststream", nrtmp.PrepareWriting)
+	testRTMPConnPublishTracks(t, source)
+	<-pm.sourceReady
+
+	rc, rnconn := newTestRTMPConn(&wg, pm, testRTMPConnParent{})
+	defer rc.close()
+	defer rnconn.Close()
+
+	reader := testRTMPConnClient(t, rnconn, "rtmp://127.0.0.1/teststream?video=0", nrtmp.PrepareReading)
+
+	// audio is received even if the publisher doesn't send any IDR
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			case <-time.After(50 * time.Millisecond):
+			}
+
+			err := source.WritePacket(av.Packet{
+				Type: av.AAC,
+				Data: []byte{0x01, 0x02, 0x03, 0x04},
+				Time: time.Duration(i) * 50 * time.Millisecond,
+			})
+			if err == nil {
+				err = source.FlushWrite()
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		pkt, err := reader.ReadPacket()
+		require.NoError(t, err)
+		require.NotEqual(t, av.H264DecoderConfig, pkt.Type)
+		require.NotEqual(t, av.H264, pkt.Type)
+
+		if pkt.Type == av.AAC {
+			require.Equal(t, []byte{0x01, 0x02, 0x03, 0x04}, pkt.Data)
+			break
+		}
+	}
+}
+
+func TestRTMPConnReadAudioOnlyPath(t *testing.T) {
+	pm := newTestRTMPConnPathManager(t, &conf.PathConf{})
+	defer pm.close()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	pc, pnconn := newTestRTMPConn(&wg, pm, testRTMPConnParent{})
+	defer pc.close()
+	defer pnconn.Close()
+
+	source := testRTMPConnClient(t, pnconn, "rtmp://127.0.0.1/teststream", nrtmp.PrepareWriting)
+
+	err := source.WritePacket(av.Packet{
+		Type: av.Metadata,
+		Data: flvio.FillAMF0ValsMalloc([]interface{}{flvio.AMFMap{
+			{K: "audiocodecid", V: float64(10)},
+		}}),
+	})
+	require.NoError(t, err)
+
+	enc, err := aac.MPEG4AudioConfig{
+		Type:         2,
+		SampleRate:   44100,
+		ChannelCount: 2,
+	}.Encode()
+	require.NoError(t, err)
+
+	err = source.WritePacket(av.Packet{
+		Type: av.AACDecoderConfig,
+		Data: enc,
+	})
+	require.NoError(t, err)
+	err = source.FlushWrite()
+	require.NoError(t, err)
+
+	<-pm.sourceReady
+
+	parent := &testRTMPConnLogParent{lines: make(chan string, 100)}
+	rc, rnconn := newTestRTMPConn(&wg, pm, parent)
+	defer rc.close()
+	defer rnconn.Close()
+
+	reader := testRTMPConnClient(t, rnconn, "rtmp://127.0.0.1/teststream", nrtmp.PrepareReading)
+
+	// the AAC sequence header is sent immediately
+	for {
+		pkt, err := reader.ReadPacket()
+		require.NoError(t, err)
+		require.NotEqual(t, av.H264DecoderConfig, pkt.Type)
+
+		if pkt.Type == av.AACDecoderConfig {
+			require.Equal(t, enc, pkt.Data)
+			break
+		}
+	}
+
+	fastPath := false
+	for accepted := false; !accepted; {
+		select {
+		case line := <-parent.lines:
+			switch {
+			case strings.HasSuffix(line, "audio-only stream, audio starts immediately"):
+				fastPath = true
+			case strings.HasSuffix(line, "is reading from path 'teststream'"):
+				accepted = true
+			}
+
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for the reader to be accepted")
+		}
+	}
+	require.Equal(t, true, fastPath)
+
+	// the first audio frame is written without waiting for any video frame
+	err = source.WritePacket(av.Packet{
+		Type: av.AAC,
+		Data: []byte{0x01, 0x02, 0x03, 0x04},
+	})
+	require.NoError(t, err)
+	err = source.FlushWrite()
+	require.NoError(t, err)
+
+	for {
+		pkt, err := reader.ReadPacket()
+		require.NoError(t, err)
+		require.NotEqual(t, av.H264, pkt.Type)
+
+		if pkt.Type == av.AAC {
+			require.Equal(t, []byte{0x01, 0x02, 0x03, 0x04}, pkt.Data)
+			require.Equal(t, time.Duration(0), pkt.Time)
+			break
+		}
+	}
+}
+
+// testRTMPConnExAudioTag returns an enhanced RTMP audio tag with an Opus payload.
+func testRTMPConnExAudioTag(packetType uint8, payload []byte, dts time.Duration) flvio.Tag {
+	return flvio.Tag{
+		Type:        flvio.TAG_AUDIO,
+		SoundFormat: 9,
+		SoundRate:   packetType >> 2,
+		SoundSize:   (packetType >> 1) & 0x01,
+		SoundType:   packetType & 0x01,
+		Time:        uint32(flvio.TimeToTs(dts)),
+		Data:        append([]byte("Opus"), payload...),
+	}
+}
+
+func TestRTMPConnPublishReadOpus(t *testing.T) {
+	for _, ca := range []string{"metadata", "no metadata"} {
+		t.Run(ca, func(t *testing.T) {
+			pm := newTestRTMPConnPathManager(t, &conf.PathConf{})
+			defer pm.close()
+
+			var wg sync.WaitGroup
+			defer wg.Wait()
+
+			pc, pnconn := newTestRTMPConn(&wg, pm, testRTMPConnParent{})
+			defer pc.close()
+			defer pnconn.Close()
+
+			source := testRTMPConnClient(t, pnconn, "rtmp://127.0.0.1/teststream", nrtmp.PrepareWriting)
+
+			if ca == "metadata" {
+				// the codec is signaled with the numeric value of the FourCC
+				err := source.WritePacket(av.Packet{
+					Type: av.Metadata,
+					Data: flvio.FillAMF0ValsMalloc([]interface{}{flvio.AMFMap{
+						{K: "audiocodecid", V: float64(0x4F707573)},
+					}}),
+				})
+				require.NoError(t, err)
+			}
+
+			// mono OpusHead
+			err := source.WriteTag(testRTMPConnExAudioTag(0, []byte{
+				'O', 'p', 'u', 's', 'H', 'e', 'a', 'd',
+				0x01, 0x01, 0x38, 0x01, 0x80, 0xbb, 0x00, 0x00,
+				0x00, 0x00, 0x00,
+			}, 0))
+			require.NoError(t, err)
+			err = source.FlushWrite()
+			require.NoError(t, err)
+
+			<-pm.sourceReady
+
+			parent := &testRTMPConnLogParent{lines: make(chan string, 100)}
+			rc, rnconn := newTestRTMPConn(&wg, pm, parent)
+			defer rc.close()
+			defer rnconn.Close()
+
+			reader := testRTMPConnClient(t, rnconn, "rtmp://127.0.0.1/teststream", nrtmp.PrepareReading)
+
+			// the track is announced to readers
+			for {
+				tag, err := reader.ReadTag()
+				require.NoError(t, err)
+
+				if tag.Type != flvio.TAG_AMF0 {
+					continue
+				}
+
+				vals, err := flvio.ParseAMFVals(tag.Data, false)
+				require.NoError(t, err)
+				md := vals[len(vals)-1].(flvio.AMFMap)
+
+				codec, _ := md.GetFloat64("audiocodecid")
+				require.Equal(t, float64(13), codec)
+				channels, _ := md.GetFloat64("audiochannels")
+				require.Equal(t, float64(1), channels)
+				break
+			}
+
+			for accepted := false; !accepted; {
+				select {
+				case line := <-parent.lines:
+					accepted = strings.HasSuffix(line, "is reading from path 'teststream'")
+
+				case <-time.After(5 * time.Second):
+					t.Fatal("timed out waiting for the reader to be accepted")
+				}
+			}
+
+			// frames are routed to readers
+			frame := []byte{0xf8, 0x01, 0x02, 0x03}
+			err = source.WriteTag(testRTMPConnExAudioTag(1, frame, 0))
+			require.NoError(t, err)
+			err = source.FlushWrite()
+			require.NoError(t, err)
+
+			for {
+				tag, err := reader.ReadTag()
+				require.NoError(t, err)
+
+				if tag.Type == flvio.TAG_AUDIO {
+					require.Equal(t, uint8(flvio.SOUND_OPUS), tag.SoundFormat)
+					require.Equal(t, uint8(flvio.SOUND_MONO), tag.SoundType)
+					require.Equal(t, frame, tag.Data)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestRTMPConnReadNoTracks(t *testing.T) {
+	pm := newTestRTMPConnPathManager(t, &conf.PathConf{})
+	defer pm.close()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	pc, pnconn := newTestRTMPConn(&wg, pm, testRTMPConnParent{})
+	defer pc.close()
+	defer pnconn.Close()
+
+	source := testRTMPConnClient(t, pnconn, "rtmp://127.0.0.1/teststream", nrtmp.PrepareWriting)
+	testRTMPConnPublishTracks(t, source)
+	<-pm.sourceReady
+
+	parent := newTestRTMPConnRecordingParent()
+	rc, rnconn := newTestRTMPConn(&wg, pm, parent)
+	defer rc.close()
+	defer rnconn.Close()
+
+	reader := nrtmp.NewConn(&bufio.ReadWriter{
+		Reader: bufio.NewReader(rnconn),
+		Writer: bufio.NewWriter(rnconn),
+	})
+	var err error
+	reader.URL, err = url.Parse("rtmp://127.0.0.1/teststream?video=0&audio=0")
+	require.NoError(t, err)
+	reader.Prepare(nrtmp.StageGotPublishOrPlayCommand, nrtmp.PrepareReading)
+
+	go io.Copy(io.Discard, rnconn)
+
+	require.Equal(t, rc, <-parent.closed)
+	require.Equal(t, rtmpConnCloseCauseError, parent.cause)
+}
+
+func TestRTMPConnReadPCMA(t *testing.T) {
+	for _, ca := range []string{"mono", "stereo"} {
+		t.Run(ca, func(t *testing.T) {
+			pm := newTestRTMPConnPathManager(t, &conf.PathConf{})
+			defer pm.close()
+
+			var wg sync.WaitGroup
+			defer wg.Wait()
+
+			rtpmap := "8 PCMA/8000"
+			if ca == "stereo" {
+				rtpmap = "8 PCMA/8000/2"
+			}
+			track, err := gortsplib.NewTrackGeneric("audio", []string{"8"}, rtpmap, "")
+			require.NoError(t, err)
+
+			publisher := &testPathPublisher{}
+			ares := pm.onPublisherAnnounce(pathPublisherAnnounceReq{
+				author:   publisher,
+				pathName: "teststream",
+				authenticate: func([]interface{}, conf.Credential, conf.Credential) error {
+					return nil
+				},
+			})
+			require.NoError(t, ares.err)
+
+			rres := ares.path.onPublisherRecord(pathPublisherRecordReq{
+				author: publisher,
+				tracks: gortsplib.Tracks{track},
+			})
+			require.NoError(t, rres.err)
+
+			done := make(chan struct{})
+			defer close(done)
+
+			go func() {
+				for i := 0; ; i++ {
+					select {
+					case <-done:
+						return
+					case <-time.After(20 * time.Millisecond):
+					}
+
+					rres.stream.writeData(&data{
+						trackID: 0,
+						rtp: &rtp.Packet{
+							Header: rtp.Header{
+								Version:        2,
+								PayloadType:    8,
+								SequenceNumber: uint16(i),
+								Timestamp:      uint32(i * 160),
+								SSRC:           0x1234,
+							},
+							Payload: bytes.Repeat([]byte{0xd5}, 160),
+						},
+						ptsEqualsDTS: true,
+					})
+				}
+			}()
+
+			parent := newTestRTMPConnRecordingParent()
+			rc, rnconn := newTestRTMPConn(&wg, pm, parent)
+			defer rc.close()
+			defer rnconn.Close()
+
+			if ca == "stereo" {
+				reader := nrtmp.NewConn(&bufio.ReadWriter{
+					Reader: bufio.NewReader(rnconn),
+					Writer: bufio.NewWriter(rnconn),
+				})
+				reader.URL, err = url.Parse("rtmp://127.0.0.1/teststream")
+				require.NoError(t, err)
+				reader.Prepare(nrtmp.StageGotPublishOrPlayCommand, nrtmp.PrepareReading)
+
+				go io.Copy(io.Discard, rnconn)
+
+				require.Equal(t, rc, <-parent.closed)
+				require.Equal(t, rtmpConnCloseCauseError, parent.cause)
+				return
+			}
+
+			reader := testRTMPConnClient(t, rnconn, "rtmp://127.0.0.1/teststream", nrtmp.PrepareReading)
+
+			for {
+				tag, err := reader.ReadTag()
+				require.NoError(t, err)
+
+				if tag.Type != flvio.TAG_AUDIO {
+					continue
+				}
+
+				require.Equal(t, uint8(flvio.SOUND_ALAW), tag.SoundFormat)
+				require.Equal(t, uint8(flvio.SOUND_5_5Khz), tag.SoundRate)
+				require.Equal(t, uint8(flvio.SOUND_16BIT), tag.SoundSize)
+				require.Equal(t, uint8(flvio.SOUND_MONO), tag.SoundType)
+				require.Equal(t, bytes.Repeat([]byte{0xd5}, 160), tag.Data)
+				break
+			}
+		})
+	}
+}
+
+func TestRTMPConnReadSelectTrack(t *testing.T) {
+	for _, ca := range []struct {
+		query       string
+		soundFormat uint8
+	}{
+		{"", flvio.SOUND_ALAW},
+		{"?audio=1", flvio.SOUND_ALAW},
+		{"?audio=2", flvio.SOUND_MULAW},
+		{"?audio=3", 0},
+		{"?audio=a", 0},
+	} {
+		t.Run(ca.query, func(t *testing.T) {
+			pm := newTestRTMPConnPathManager(t, &conf.PathConf{})
+			defer pm.close()
+
+			var wg sync.WaitGroup
+			defer wg.Wait()
+
+			pcmaTrack, err := gortsplib.NewTrackGeneric("audio", []string{"8"}, "8 PCMA/8000", "")
+			require.NoError(t, err)
+
+			publisher := &testPathPublisher{}
+			ares := pm.onPublisherAnnounce(pathPublisherAnnounceReq{
+				author:   publisher,
+				pathName: "teststream",
+				authenticate: func([]interface{}, conf.Credential, conf.Credential) error {
+					return nil
+				},
+			})
+			require.NoError(t, ares.err)
+
+			rres := ares.path.onPublisherRecord(pathPublisherRecordReq{
+				author: publisher,
+				tracks: gortsplib.Tracks{pcmaTrack, gortsplib.NewTrackPCMU()},
+			})
+			require.NoError(t, rres.err)
+
+			done := make(chan struct{})
+			defer close(done)
+
+			go func() {
+				for i := 0; ; i++ {
+					select {
+					case <-done:
+						return
+					case <-time.After(20 * time.Millisecond):
+					}
+
+					for trackID, payloadType := range []uint8{8, 0} {
+						rres.stream.writeData(&data{
+							trackID: trackID,
+							rtp: &rtp.Packet{
+								Header: rtp.Header{
+									Version:        2,
+									PayloadType:    payloadType,
+									SequenceNumber: uint16(i),
+									Timestamp:      uint32(i * 160),
+									SSRC:           0x1234,
+								},
+								Payload: bytes.Repeat([]byte{0xd5}, 160),
+							},
+							ptsEqualsDTS: true,
+						})
+					}
+				}
+			}()
+
+			parent := newTestRTMPConnRecordingParent()
+			rc, rnconn := newTestRTMPConn(&wg, pm, parent)
+			defer rc.close()
+			defer rnconn.Close()
+
+			// tracks that don't exist are rejected
+			if ca.soundFormat == 0 {
+				reader := nrtmp.NewConn(&bufio.ReadWriter{
+					Reader: bufio.NewReader(rnconn),
+					Writer: bufio.NewWriter(rnconn),
+				})
+				reader.URL, err = url.Parse("rtmp://127.0.0.1/teststream" + ca.query)
+				require.NoError(t, err)
+				reader.Prepare(nrtmp.StageGotPublishOrPlayCommand, nrtmp.PrepareReading)
+
+				go io.Copy(io.Discard, rnconn)
+
+				require.Equal(t, rc, <-parent.closed)
+				require.Equal(t, rtmpConnCloseCauseError, parent.cause)
+				return
+			}
+
+			reader := testRTMPConnClient(t, rnconn, "rtmp://127.0.0.1/teststream"+ca.query, nrtmp.PrepareReading)
+
+			for {
+				tag, err := reader.ReadTag()
+				require.NoError(t, err)
+
+				if tag.Type == flvio.TAG_AUDIO {
+					require.Equal(t, ca.soundFormat, tag.SoundFormat)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestRTMPConnReadAACTimestamps(t *testing.T) {
+	for _, ca := range []struct {
+		name            string
+		samplesPerFrame int
+	}{
+		{"lc", 0},
+		{"he-aac", 2048},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			pm := newTestRTMPConnPathManager(t, &conf.PathConf{
+				RTMPAACSamplesPerFrame: ca.samplesPerFrame,
+			})
+			defer pm.close()
+
+			var wg sync.WaitGroup
+			defer wg.Wait()
+
+			samplesPerFrame := ca.samplesPerFrame
+			if samplesPerFrame == 0 {
+				samplesPerFrame = 1024
+			}
+
+			track, err := gortsplib.NewTrackAAC(96, 2, 44100, 2, nil)
+			require.NoError(t, err)
+
+			publisher := &testPathPublisher{}
+			ares := pm.onPublisherAnnounce(pathPublisherAnnounceReq{
+				author:   publisher,
+				pathName: "teststream",
+				authenticate: func([]interface{}, conf.Credential, conf.Credential) error {
+					return nil
+				},
+			})
+			require.NoError(t, ares.err)
+
+			rres := ares.path.onPublisherRecord(pathPublisherRecordReq{
+				author: publisher,
+				tracks: gortsplib.Tracks{track},
+			})
+			require.NoError(t, rres.err)
+
+			// each RTP packet contains 4 access units.
+			payload := []byte{0x00, 0x40}
+			for i := 0; i < 4; i++ {
+				payload = append(payload, 0x00, 0x10) // size 2, index 0
+			}
+			for i := 0; i < 4; i++ {
+				payload = append(payload, 0x01, byte(i))
+			}
+
+			done := make(chan struct{})
+			defer close(done)
+
+			go func() {
+				for i := 0; ; i++ {
+					select {
+					case <-done:
+						return
+					case <-time.After(5 * time.Millisecond):
+					}
+
+					rres.stream.writeData(&data{
+						trackID: 0,
+						rtp: &rtp.Packet{
+							Header: rtp.Header{
+								Version:        2,
+								Marker:         true,
+								PayloadType:    96,
+								SequenceNumber: uint16(i),
+								Timestamp:      uint32(i * 4 * samplesPerFrame),
+								SSRC:           0x1234,
+							},
+							Payload: payload,
+						},
+						ptsEqualsDTS: true,
+					})
+				}
+			}()
+
+			rc, rnconn := newTestRTMPConn(&wg, pm, testRTMPConnParent{})
+			defer rc.close()
+			defer rnconn.Close()
+
+			reader := testRTMPConnClient(t, rnconn, "rtmp://127.0.0.1/teststream", nrtmp.PrepareReading)
+
+			// timestamps of frames are computed from the number of samples
+			// that precede them, starting from the first frame received by the reader,
+			// without accumulating rounding errors.
+			for i := 0; i < 40; {
+				pkt, err := reader.ReadPacket()
+				require.NoError(t, err)
+
+				if pkt.Type != av.AAC {
+					continue
+				}
+
+				expected := time.Duration(i*samplesPerFrame) * time.Second / 44100
+				require.Equal(t, expected.Truncate(time.Millisecond), pkt.Time)
+				i++
+			}
+		})
+	}
+}
+
+func TestRTMPConnPublishAuthFailPause(t *testing.T) {
+	pm := newTestRTMPConnPathManager(t, &conf.PathConf{
+		PublishUser: "myuser",
+		PublishPass: "mypass",
+	})
+	defer pm.close()
+
+	parent := newTestRTMPConnRecordingParent()
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	c, nconn := newTestRTMPConn(&wg, pm, parent)
+	defer c.close()
+	defer nconn.Close()
+
+	start := time.Now()
+
+	// the client receives the error; then, the connection is kept open
+	// for some seconds to stop brute force attacks.
+	source := nrtmp.NewConn(&bufio.ReadWriter{
+		Reader: bufio.NewReader(nconn),
+		Writer: bufio.NewWriter(nconn),
+	})
+	var err error
+	source.URL, err = url.Parse("rtmp://127.0.0.1/teststream?user=myuser&pass=wrong")
+	require.NoError(t, err)
+	source.Prepare(nrtmp.StageGotPublishOrPlayCommand, nrtmp.PrepareWriting)
+
+	go io.Copy(io.Discard, nconn)
+
+	require.Equal(t, c, <-parent.closed)
+	require.Equal(t, rtmpConnCloseCauseAuth, parent.cause)
+	require.GreaterOrEqual(t, time.Since(start), rtmpConnPauseAfterAuthError)
+}
+
+// testRTMPConnPublishPCMA publishes a PCMA track with a fake publisher
+// and returns the stream.
+func testRTMPConnPublishPCMA(t *testing.T, pm *testRTMPConnPathManager) *stream {
+	track, err := gortsplib.NewTrackGeneric("audio", []string{"8"}, "8 PCMA/8000", "")
+	require.NoError(t, err)
+
+	publisher := &testPathPublisher{}
+	ares := pm.onPublisherAnnounce(pathPublisherAnnounceReq{
+		author:   publisher,
+		pathName: "teststream",
+		authenticate: func([]interface{}, conf.Credential, conf.Credential) error {
+			return nil
+		},
+	})
+	require.NoError(t, ares.err)
+
+	rres := ares.path.onPublisherRecord(pathPublisherRecordReq{
+		author: publisher,
+		tracks: gortsplib.Tracks{track},
+	})
+	require.NoError(t, rres.err)
+
+	return rres.stream
+}
+
+func testRTMPConnPCMAData(i int) *data {
+	return &data{
+		trackID: 0,
+		rtp: &rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				PayloadType:    8,
+				SequenceNumber: uint16(i),
+				Timestamp:      uint32(i * 160),
+				SSRC:           0x1234,
+			},
+			Payload: bytes.Repeat([]byte{0xd5}, 160),
+		},
+		ptsEqualsDTS: true,
+	}
+}
+
+// testRTMPConnReadFirstAudio reads tags until the first audio frame,
+// in order to make sure that the reader has been added to the stream.
+func testRTMPConnReadFirstAudio(t *testing.T, reader *nrtmp.Conn, stream *stream) {
+	received := make(chan struct{})
+	go func() {
+		for {
+			tag, err := reader.ReadTag()
+			if err != nil || tag.Type == flvio.TAG_AUDIO {
+				close(received)
+				return
+			}
+		}
+	}()
+
+	for i := 0; ; i++ {
+		select {
+		case <-received:
+			return
+		case <-time.After(20 * time.Millisecond):
+			stream.writeData(testRTMPConnPCMAData(i))
+		}
+	}
+}
+
+func TestRTMPConnReadBufferBlockSlowReader(t *testing.T) {
+	pm := newTestRTMPConnPathManager(t, &conf.PathConf{
+		ReadBufferCount:            8,
+		RTMPReadBufferPolicy:       "block",
+		RTMPReadBufferBlockTimeout: conf.StringDuration(time.Minute),
+	})
+	defer pm.close()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	stream := testRTMPConnPublishPCMA(t, pm)
+
+	parent := newTestRTMPConnRecordingParent()
+	rc, rnconn := newTestRTMPConn(&wg, pm, parent)
+	defer rc.close()
+	defer rnconn.Close()
+
+	reader := testRTMPConnClient(t, rnconn, "rtmp://127.0.0.1/teststream", nrtmp.PrepareReading)
+	testRTMPConnReadFirstAudio(t, reader, stream)
+
+	// the reader stops reading; the source is not slowed down,
+	// and the reader is closed when its buffer can't hold more frames.
+	start := time.Now()
+	for i := 0; i < 100; i++ {
+		stream.writeData(testRTMPConnPCMAData(i))
+	}
+	require.Less(t, time.Since(start), time.Second)
+
+	select {
+	case c := <-parent.closed:
+		require.Equal(t, rc, c)
+	case <-time.After(5 * time.Second):
+		t.Errorf("reader was not closed")
+	}
+}
+
+// testRTMPConnWritePause sends a pause command, since it's not supported
+// by the client library.
+func testRTMPConnWritePause(t *testing.T, nconn net.Conn, paused bool) {
+	payload := flvio.FillAMF0ValsMalloc([]interface{}{"pause", float64(0), nil, paused, float64(0)})
+
+	msg := []byte{
+		0x08,
+		0x00, 0x00, 0x00,
+		byte(len(payload) >> 16), byte(len(payload) >> 8), byte(len(payload)),
+		0x14,
+		0x01, 0x00, 0x00, 0x00,
+	}
+	msg = append(msg, payload...)
+
+	_, err := nconn.Write(msg)
+	require.NoError(t, err)
+}
+
+func TestRTMPConnReadPausedSlowReader(t *testing.T) {
+	pm := newTestRTMPConnPathManager(t, &conf.PathConf{
+		ReadBufferCount: 8,
+	})
+	defer pm.close()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	stream := testRTMPConnPublishPCMA(t, pm)
+
+	cnf := testRTMPConnConf()
+	cnf.slowReaderTimeout = conf.StringDuration(100 * time.Millisecond)
+
+	parent := newTestRTMPConnRecordingParent()
+	rc, rnconn := newTestRTMPConnWithConf(&wg, cnf, pm, parent)
+	defer rc.close()
+	defer rnconn.Close()
+
+	reader := testRTMPConnClient(t, rnconn, "rtmp://127.0.0.1/teststream", nrtmp.PrepareReading)
+	testRTMPConnReadFirstAudio(t, reader, stream)
+
+	// the status message is consumed by the reading routine
+	go io.Copy(io.Discard, rnconn)
+	testRTMPConnWritePause(t, rnconn, true)
+
+	for i := 0; ; i++ {
+		rc.ringBuffer.mutex.Lock()
+		paused := rc.ringBuffer.paused
+		rc.ringBuffer.mutex.Unlock()
+		if paused {
+			break
+		}
+
+		require.Less(t, i, 100, "reader was not paused")
+		stream.writeData(testRTMPConnPCMAData(i))
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// the pause lasts longer than slowReaderTimeout, and more frames
+	// than the read buffer size are received in the meanwhile.
+	for i := 0; i < 30; i++ {
+		stream.writeData(testRTMPConnPCMAData(i))
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	select {
+	case <-parent.closed:
+		t.Errorf("paused reader was closed")
+	default:
+	}
+	require.Equal(t, uint64(0), rc.ringBuffer.fill())
+}
@@ -0,0 +1,56 @@
+package core
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// rtmpFramerateMeter measures the framerate of a publisher over a sliding window.
+// Frames are accumulated into a running counter, that is sampled periodically.
+// Frames with the same timestamp of the previous one are not counted,
+// since they don't advance the video.
+type rtmpFramerateMeter struct {
+	// accessed atomically, must be at the beginning of the struct
+	frames uint64
+
+	samplePeriod time.Duration
+	lastTime     *time.Duration
+	samples      []uint64
+}
+
+// newRTMPFramerateMeter allocates a meter whose window is made of windowLen samples,
+// taken every samplePeriod.
+func newRTMPFramerateMeter(samplePeriod time.Duration, windowLen int) *rtmpFramerateMeter {
+	return &rtmpFramerateMeter{
+		samplePeriod: samplePeriod,
+		samples:      make([]uint64, 0, windowLen+1),
+	}
+}
+
+// add adds a frame with the given timestamp.
+// It must always be called by the same routine.
+func (m *rtmpFramerateMeter) add(ts time.Duration) {
+	if m.lastTime != nil && *m.lastTime == ts {
+		return
+	}
+	m.lastTime = &ts
+
+	atomic.AddUint64(&m.frames, 1)
+}
+
+// sample samples the counter and returns the framerate of the window,
+// and whether the window has been entirely filled.
+func (m *rtmpFramerateMeter) sample() (float64, bool) {
+	if len(m.samples) == cap(m.samples) {
+		m.samples = append(m.samples[:0], m.samples[1:]...)
+	}
+	m.samples = append(m.samples, atomic.LoadUint64(&m.frames))
+
+	n := m.samples[len(m.samples)-1] - m.samples[0]
+	window := time.Duration(len(m.samples)-1) * m.samplePeriod
+	if window == 0 {
+		return 0, false
+	}
+
+	return float64(n) / window.Seconds(), len(m.samples) == cap(m.samples)
+}
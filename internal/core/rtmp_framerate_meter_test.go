@@ -0,0 +1,35 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRTMPFramerateMeter(t *testing.T) {
+	m := newRTMPFramerateMeter(time.Second, 2)
+
+	_, full := m.sample()
+	require.Equal(t, false, full)
+
+	for i := 0; i < 10; i++ {
+		m.add(time.Duration(i) * 100 * time.Millisecond)
+	}
+	fps, full := m.sample()
+	require.Equal(t, float64(10), fps)
+	require.Equal(t, false, full)
+
+	// duplicate timestamps are not counted
+	m.add(2 * time.Second)
+	m.add(2 * time.Second)
+	m.add(2 * time.Second)
+	fps, full = m.sample()
+	require.Equal(t, float64(5.5), fps)
+	require.Equal(t, true, full)
+
+	// the first sample leaves the window
+	fps, full = m.sample()
+	require.Equal(t, float64(0.5), fps)
+	require.Equal(t, true, full)
+}
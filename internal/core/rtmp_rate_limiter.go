@@ -0,0 +1,83 @@
+package core
+
+import (
+	"time"
+)
+
+// rtmpRateLimiter is a token bucket that limits the bitrate of a reader.
+// The bucket can contain up to one second of data.
+type rtmpRateLimiter struct {
+	rate   float64 // bytes per second
+	tokens float64
+	last   time.Time
+}
+
+func newRTMPRateLimiter(kbps int) *rtmpRateLimiter {
+	rate := float64(kbps) * 1000 / 8
+	return &rtmpRateLimiter{
+		rate:   rate,
+		tokens: rate,
+	}
+}
+
+// take removes n bytes from the bucket and returns how long the caller has to
+// wait before writing them. If the wait would be longer than maxWait,
+// the bucket is left untouched and false is returned.
+// Frames bigger than the bucket are written when the bucket is full,
+// and the following frames wait until the debt has been paid off.
+func (l *rtmpRateLimiter) take(n int, now time.Time, maxWait time.Duration) (time.Duration, bool) {
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.rate {
+			l.tokens = l.rate
+		}
+	}
+	l.last = now
+
+	missing := float64(n) - l.tokens
+	if missing <= 0 {
+		l.tokens -= float64(n)
+		return 0, true
+	}
+
+	if float64(n) > l.rate && l.tokens >= l.rate {
+		l.tokens -= float64(n)
+		return 0, true
+	}
+
+	wait := time.Duration(missing / l.rate * float64(time.Second))
+	if wait > maxWait {
+		return 0, false
+	}
+
+	l.tokens -= float64(n)
+	return wait, true
+}
+
+// rtmpAMFDataLimiter limits both the bitrate and the rate of the AMF data
+// messages of a publisher.
+type rtmpAMFDataLimiter struct {
+	bytes    *rtmpRateLimiter
+	messages *rtmpRateLimiter
+}
+
+func newRTMPAMFDataLimiter() *rtmpAMFDataLimiter {
+	return &rtmpAMFDataLimiter{
+		bytes: newRTMPRateLimiter(rtmpConnAMFDataMaxBitrate),
+		messages: &rtmpRateLimiter{
+			rate:   rtmpConnAMFDataMaxRate,
+			tokens: rtmpConnAMFDataMaxRate,
+		},
+	}
+}
+
+// take checks whether a message of n bytes can be forwarded immediately.
+func (l *rtmpAMFDataLimiter) take(n int, now time.Time) bool {
+	_, ok := l.messages.take(1, now, 0)
+	if !ok {
+		return false
+	}
+
+	_, ok = l.bytes.take(n, now, 0)
+	return ok
+}
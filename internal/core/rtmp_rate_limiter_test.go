@@ -0,0 +1,72 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRTMPRateLimiter(t *testing.T) {
+	// 8 kbit/s = 1000 bytes/s
+	l := newRTMPRateLimiter(8)
+	now := time.Now()
+
+	wait, ok := l.take(1000, now, time.Second)
+	require.Equal(t, true, ok)
+	require.Equal(t, time.Duration(0), wait)
+
+	wait, ok = l.take(500, now, time.Second)
+	require.Equal(t, true, ok)
+	require.Equal(t, 500*time.Millisecond, wait)
+
+	// the data would be written after 2 seconds
+	_, ok = l.take(1500, now, time.Second)
+	require.Equal(t, false, ok)
+
+	wait, ok = l.take(500, now.Add(1500*time.Millisecond), time.Second)
+	require.Equal(t, true, ok)
+	require.Equal(t, time.Duration(0), wait)
+
+	// a frame bigger than the bucket is written when the bucket is full
+	l = newRTMPRateLimiter(8)
+
+	wait, ok = l.take(500, now, time.Second)
+	require.Equal(t, true, ok)
+	require.Equal(t, time.Duration(0), wait)
+
+	_, ok = l.take(3000, now, time.Second)
+	require.Equal(t, false, ok)
+
+	now = now.Add(500 * time.Millisecond)
+
+	wait, ok = l.take(3000, now, time.Second)
+	require.Equal(t, true, ok)
+	require.Equal(t, time.Duration(0), wait)
+
+	// the following frames wait until the debt has been paid off
+	_, ok = l.take(100, now.Add(time.Second), time.Second)
+	require.Equal(t, false, ok)
+
+	wait, ok = l.take(100, now.Add(2*time.Second), time.Second)
+	require.Equal(t, true, ok)
+	require.Equal(t, 100*time.Millisecond, wait)
+}
+
+func TestRTMPAMFDataLimiter(t *testing.T) {
+	now := time.Now()
+
+	// messages
+	l := newRTMPAMFDataLimiter()
+	for i := 0; i < rtmpConnAMFDataMaxRate; i++ {
+		require.Equal(t, true, l.take(10, now))
+	}
+	require.Equal(t, false, l.take(10, now))
+	require.Equal(t, true, l.take(10, now.Add(100*time.Millisecond)))
+
+	// bytes
+	l = newRTMPAMFDataLimiter()
+	require.Equal(t, true, l.take(20000, now))
+	require.Equal(t, false, l.take(10, now.Add(time.Second)))
+	require.Equal(t, true, l.take(10, now.Add(3*time.Second)))
+}
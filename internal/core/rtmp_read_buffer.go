@@ -0,0 +1,230 @@
+package core
+
+import (
+	"sync"
+	"time"
+)
+
+// percentage of the buffer size above which the buffer is considered full.
+const rtmpReadBufferHighWatermark = 90
+
+// rtmpReadBufferPolicy is what happens when an item is pushed into a full buffer.
+type rtmpReadBufferPolicy int
+
+// read buffer policies.
+const (
+	// the oldest item is dropped, in order to keep latency low.
+	rtmpReadBufferDropOldest rtmpReadBufferPolicy = iota
+
+	// the item is kept beyond the buffer size, in order not to lose data,
+	// and the reader is closed if it doesn't catch up in time.
+	rtmpReadBufferBlock
+)
+
+// String implements fmt.Stringer.
+func (p rtmpReadBufferPolicy) String() string {
+	if p == rtmpReadBufferBlock {
+		return "block"
+	}
+	return "drop-oldest"
+}
+
+func rtmpReadBufferPolicyFromConf(v string) rtmpReadBufferPolicy {
+	if v == "block" {
+		return rtmpReadBufferBlock
+	}
+	return rtmpReadBufferDropOldest
+}
+
+// rtmpReadBuffer is the buffer of a reader, that keeps track of the items
+// that have not been pulled yet, in order to detect readers that are too slow.
+// Producers are never blocked, since they are shared by all the readers of a path.
+type rtmpReadBuffer struct {
+	size         int
+	policy       rtmpReadBufferPolicy
+	blockTimeout time.Duration
+
+	mutex     sync.Mutex
+	cond      *sync.Cond
+	items     []interface{}
+	start     int
+	count     int
+	control   []interface{}
+	closed    bool
+	paused    bool
+	dropped   bool
+	fullSince time.Time
+	overSince time.Time
+}
+
+// newRTMPReadBuffer allocates a buffer. When the policy is rtmpReadBufferBlock,
+// the buffer can hold up to twice its size, for at most blockTimeout.
+func newRTMPReadBuffer(size uint64, policy rtmpReadBufferPolicy, blockTimeout time.Duration) *rtmpReadBuffer {
+	capacity := size
+	if policy == rtmpReadBufferBlock {
+		capacity *= 2
+	}
+
+	b := &rtmpReadBuffer{
+		size:         int(size),
+		policy:       policy,
+		blockTimeout: blockTimeout,
+		items:        make([]interface{}, capacity),
+	}
+	b.cond = sync.NewCond(&b.mutex)
+	return b
+}
+
+// close makes pull() return false once the remaining items have been pulled.
+func (b *rtmpReadBuffer) close() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.closed = true
+	b.cond.Broadcast()
+}
+
+// setPaused sets whether the reader is paused. While the reader is paused,
+// pending items are discarded, pushed items are ignored and the buffer
+// is never reported as full.
+func (b *rtmpReadBuffer) setPaused(paused bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.paused = paused
+	b.fullSince = time.Time{}
+	b.overSince = time.Time{}
+
+	if paused {
+		for i := range b.items {
+			b.items[i] = nil
+		}
+		b.start = 0
+		b.count = 0
+	}
+}
+
+// push pushes an item and returns how long the buffer has been full,
+// whether the buffer overflowed, and whether the reader must be closed
+// because it didn't catch up within blockTimeout.
+func (b *rtmpReadBuffer) push(item interface{}, now time.Time) (time.Duration, bool, bool) {
+	return b.pushInner(item, now, b.policy == rtmpReadBufferDropOldest)
+}
+
+// pushNoWait pushes an item, dropping the oldest one when the buffer is full,
+// regardless of the policy.
+func (b *rtmpReadBuffer) pushNoWait(item interface{}, now time.Time) (time.Duration, bool, bool) {
+	return b.pushInner(item, now, true)
+}
+
+func (b *rtmpReadBuffer) pushInner(item interface{}, now time.Time, dropOldest bool) (time.Duration, bool, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.closed || b.paused {
+		return 0, false, false
+	}
+
+	overflowed := false
+
+	if b.count >= b.size {
+		overflowed = true
+
+		if dropOldest {
+			b.items[b.start] = nil
+			b.start = (b.start + 1) % len(b.items)
+			b.count--
+			b.dropped = true
+		} else {
+			if b.overSince.IsZero() {
+				b.overSince = now
+			}
+
+			if b.count == len(b.items) || now.Sub(b.overSince) >= b.blockTimeout {
+				return 0, true, true
+			}
+		}
+	}
+
+	b.items[(b.start+b.count)%len(b.items)] = item
+	b.count++
+	b.cond.Broadcast()
+
+	if b.count < (b.size*rtmpReadBufferHighWatermark+99)/100 {
+		b.fullSince = time.Time{}
+		return 0, overflowed, false
+	}
+
+	if b.fullSince.IsZero() {
+		b.fullSince = now
+		return 0, overflowed, false
+	}
+	return now.Sub(b.fullSince), overflowed, false
+}
+
+// pushControl pushes an item that is not part of the stream, like a ping.
+// It is pulled before the other items, it doesn't count toward the buffer size,
+// it is not discarded when the reader is paused, and it is ignored when
+// the same item is already pending.
+func (b *rtmpReadBuffer) pushControl(item interface{}) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.closed {
+		return
+	}
+
+	for _, cur := range b.control {
+		if cur == item {
+			return
+		}
+	}
+
+	b.control = append(b.control, item)
+	b.cond.Broadcast()
+}
+
+// pull pulls an item. It returns whether items have been dropped
+// since the last pull, and false when the buffer is closed and empty.
+func (b *rtmpReadBuffer) pull() (interface{}, bool, bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for {
+		if len(b.control) != 0 {
+			item := b.control[0]
+			b.control = b.control[1:]
+			return item, false, true
+		}
+
+		if b.count != 0 {
+			break
+		}
+
+		if b.closed {
+			return nil, false, false
+		}
+		b.cond.Wait()
+	}
+
+	item := b.items[b.start]
+	b.items[b.start] = nil
+	b.start = (b.start + 1) % len(b.items)
+	b.count--
+
+	if b.count < b.size {
+		b.overSince = time.Time{}
+	}
+
+	dropped := b.dropped
+	b.dropped = false
+
+	return item, dropped, true
+}
+
+// fill returns the number of items that have not been pulled yet.
+func (b *rtmpReadBuffer) fill() uint64 {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return uint64(b.count)
+}
@@ -0,0 +1,187 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRTMPReadBuffer(t *testing.T) {
+	b := newRTMPReadBuffer(10, rtmpReadBufferDropOldest, 0)
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	push := func(item interface{}, now time.Time) time.Duration {
+		fullFor, _, _ := b.push(item, now)
+		return fullFor
+	}
+
+	for i := 0; i < 8; i++ {
+		require.Equal(t, time.Duration(0), push(i, now))
+	}
+	require.Equal(t, uint64(8), b.fill())
+
+	// the high watermark is reached
+	require.Equal(t, time.Duration(0), push(8, now))
+	require.Equal(t, 2*time.Second, push(9, now.Add(2*time.Second)))
+
+	// items are overwritten
+	fullFor, overflowed, tooSlow := b.push(10, now.Add(3*time.Second))
+	require.Equal(t, 3*time.Second, fullFor)
+	require.Equal(t, true, overflowed)
+	require.Equal(t, false, tooSlow)
+	require.Equal(t, uint64(10), b.fill())
+
+	// the reader catches up, starting from the oldest item that was not dropped
+	for i := 0; i < 5; i++ {
+		item, dropped, ok := b.pull()
+		require.Equal(t, true, ok)
+		require.Equal(t, i+1, item)
+		require.Equal(t, i == 0, dropped)
+	}
+	require.Equal(t, uint64(5), b.fill())
+	require.Equal(t, time.Duration(0), push(11, now.Add(4*time.Second)))
+}
+
+func TestRTMPReadBufferBlock(t *testing.T) {
+	b := newRTMPReadBuffer(2, rtmpReadBufferBlock, time.Second)
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	b.push(0, now)
+	b.push(1, now)
+
+	// the producer is not blocked and the item is kept beyond the buffer size
+	_, overflowed, tooSlow := b.push(2, now)
+	require.Equal(t, true, overflowed)
+	require.Equal(t, false, tooSlow)
+	require.Equal(t, uint64(3), b.fill())
+
+	// nothing is lost
+	for i := 0; i < 3; i++ {
+		item, dropped, ok := b.pull()
+		require.Equal(t, true, ok)
+		require.Equal(t, i, item)
+		require.Equal(t, false, dropped)
+	}
+
+	// remaining items are pulled before the buffer is reported as closed
+	b.push(3, now)
+	b.close()
+	item, _, ok := b.pull()
+	require.Equal(t, true, ok)
+	require.Equal(t, 3, item)
+	_, _, ok = b.pull()
+	require.Equal(t, false, ok)
+}
+
+func TestRTMPReadBufferBlockTimeout(t *testing.T) {
+	b := newRTMPReadBuffer(2, rtmpReadBufferBlock, time.Second)
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	b.push(0, now)
+	b.push(1, now)
+	b.push(2, now)
+
+	// the reader catches up in time
+	b.pull()
+	b.pull()
+	_, _, tooSlow := b.push(3, now.Add(2*time.Second))
+	require.Equal(t, false, tooSlow)
+
+	// the reader doesn't catch up in time
+	b.push(4, now.Add(2*time.Second))
+	_, overflowed, tooSlow := b.push(5, now.Add(3*time.Second))
+	require.Equal(t, true, overflowed)
+	require.Equal(t, true, tooSlow)
+	require.Equal(t, uint64(3), b.fill())
+}
+
+func TestRTMPReadBufferBlockMaxSize(t *testing.T) {
+	b := newRTMPReadBuffer(2, rtmpReadBufferBlock, time.Second)
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 4; i++ {
+		_, _, tooSlow := b.push(i, now)
+		require.Equal(t, false, tooSlow)
+	}
+
+	// the buffer can't hold more than twice its size
+	_, _, tooSlow := b.push(4, now)
+	require.Equal(t, true, tooSlow)
+	require.Equal(t, uint64(4), b.fill())
+}
+
+func TestRTMPReadBufferPushNoWait(t *testing.T) {
+	b := newRTMPReadBuffer(2, rtmpReadBufferBlock, time.Second)
+	now := time.Now()
+
+	b.push(0, now)
+	b.push(1, now)
+
+	// the oldest item is dropped instead of being kept
+	_, overflowed, _ := b.pushNoWait(2, now)
+	require.Equal(t, true, overflowed)
+
+	item, dropped, ok := b.pull()
+	require.Equal(t, true, ok)
+	require.Equal(t, 1, item)
+	require.Equal(t, true, dropped)
+}
+
+func TestRTMPReadBufferPaused(t *testing.T) {
+	b := newRTMPReadBuffer(2, rtmpReadBufferBlock, time.Second)
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	b.push(0, now)
+	b.push(1, now)
+
+	// pending items are discarded and pushed items are ignored
+	b.setPaused(true)
+	require.Equal(t, uint64(0), b.fill())
+
+	for i := 0; i < 10; i++ {
+		fullFor, overflowed, tooSlow := b.push(i, now.Add(time.Duration(i)*time.Second))
+		require.Equal(t, time.Duration(0), fullFor)
+		require.Equal(t, false, overflowed)
+		require.Equal(t, false, tooSlow)
+	}
+	require.Equal(t, uint64(0), b.fill())
+
+	b.setPaused(false)
+	b.push(10, now.Add(10*time.Second))
+
+	item, dropped, ok := b.pull()
+	require.Equal(t, true, ok)
+	require.Equal(t, 10, item)
+	require.Equal(t, false, dropped)
+}
+
+func TestRTMPReadBufferControl(t *testing.T) {
+	b := newRTMPReadBuffer(2, rtmpReadBufferDropOldest, 0)
+	now := time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	b.push(0, now)
+	b.push(1, now)
+
+	// control items don't evict other items, are deduplicated
+	// and are pulled first
+	b.pushControl("ping")
+	b.pushControl("ping")
+	require.Equal(t, uint64(2), b.fill())
+
+	for _, expected := range []interface{}{"ping", 0, 1} {
+		item, dropped, ok := b.pull()
+		require.Equal(t, true, ok)
+		require.Equal(t, expected, item)
+		require.Equal(t, false, dropped)
+	}
+
+	// control items are not discarded when the reader is paused
+	b.setPaused(true)
+	b.pushControl("tick")
+	b.setPaused(false)
+
+	item, _, ok := b.pull()
+	require.Equal(t, true, ok)
+	require.Equal(t, "tick", item)
+}
@@ -0,0 +1,63 @@
+package core
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// maximum duration of a call to the redirect service, that is performed
+// during the handshake of clients.
+const rtmpRedirectTimeout = 5 * time.Second
+
+// rtmpRedirect queries the redirect service and returns the URL
+// the client has to be redirected to, or an empty string.
+func rtmpRedirect(
+	ur string,
+	ip string,
+	app string,
+	query string,
+) (string, error) {
+	enc, _ := json.Marshal(struct {
+		IP    string `json:"ip"`
+		App   string `json:"app"`
+		Query string `json:"query"`
+	}{
+		IP:    ip,
+		App:   app,
+		Query: query,
+	})
+
+	client := &http.Client{Timeout: rtmpRedirectTimeout}
+	res, err := client.Post(ur, "application/json", bytes.NewReader(enc))
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return "", fmt.Errorf("bad status code: %d", res.StatusCode)
+	}
+
+	byts, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+
+	if len(bytes.TrimSpace(byts)) == 0 {
+		return "", nil
+	}
+
+	var out struct {
+		Redirect string `json:"redirect"`
+	}
+	err = json.Unmarshal(byts, &out)
+	if err != nil {
+		return "", fmt.Errorf("invalid response: %s", err)
+	}
+
+	return out.Redirect, nil
+}
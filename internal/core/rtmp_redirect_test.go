@@ -0,0 +1,45 @@
+package core
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRTMPRedirect(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:9122")
+	require.NoError(t, err)
+
+	s := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var in struct {
+				IP    string `json:"ip"`
+				App   string `json:"app"`
+				Query string `json:"query"`
+			}
+			err := json.NewDecoder(r.Body).Decode(&in)
+			require.NoError(t, err)
+			require.Equal(t, "127.0.0.1", in.IP)
+			require.Equal(t, "key=val", in.Query)
+
+			if in.App == "redirected" {
+				w.Write([]byte(`{"redirect":"rtmp://otherhost/redirected"}`))
+			}
+		}),
+	}
+	go s.Serve(ln)
+	defer s.Close()
+
+	target, err := rtmpRedirect("http://127.0.0.1:9122/redirect",
+		"127.0.0.1", "redirected", "key=val")
+	require.NoError(t, err)
+	require.Equal(t, "rtmp://otherhost/redirected", target)
+
+	target, err = rtmpRedirect("http://127.0.0.1:9122/redirect",
+		"127.0.0.1", "myapp", "key=val")
+	require.NoError(t, err)
+	require.Equal(t, "", target)
+}
@@ -0,0 +1,306 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/aler9/gortsplib/pkg/aac"
+	"github.com/aler9/gortsplib/pkg/h264"
+	"github.com/notedit/rtmp/av"
+	"github.com/notedit/rtmp/format/flv/flvio"
+	nrtmp "github.com/notedit/rtmp/format/rtmp"
+)
+
+const (
+	rtmpSelfTestFramePeriod = 20 * time.Millisecond
+	rtmpSelfTestRetryPeriod = 100 * time.Millisecond
+)
+
+var (
+	rtmpSelfTestSPS = []byte{
+		0x67, 0x64, 0x00, 0x0c, 0xac, 0x3b, 0x50, 0xb0,
+		0x4b, 0x42, 0x00, 0x00, 0x03, 0x00, 0x02, 0x00,
+		0x00, 0x03, 0x00, 0x3d, 0x08,
+	}
+	rtmpSelfTestPPS = []byte{0x68, 0xee, 0x3c, 0x80}
+)
+
+// rtmpSelfTestMarker returns the payload of the i-th synthetic frame,
+// that allows to recognize it when it is read back.
+func rtmpSelfTestMarker(i uint32) []byte {
+	buf := []byte{0x53, 0x54, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(buf[2:], i)
+	return buf
+}
+
+// rtmpSelfTestParseMarker returns the index of a synthetic frame.
+func rtmpSelfTestParseMarker(buf []byte) (uint32, bool) {
+	if len(buf) < 6 || buf[len(buf)-6] != 0x53 || buf[len(buf)-5] != 0x54 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(buf[len(buf)-4:]), true
+}
+
+type rtmpSelfTestClient struct {
+	nconn net.Conn
+	conn  *nrtmp.Conn
+}
+
+func newRTMPSelfTestClient(
+	ctx context.Context,
+	address string,
+	tlsConfig *tls.Config,
+	pathName string,
+	stage int,
+) (*rtmpSelfTestClient, error) {
+	var d net.Dialer
+	nconn, err := d.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	// the certificate of the server is not checked, since the server is this one.
+	if tlsConfig != nil {
+		nconn = tls.Client(nconn, &tls.Config{InsecureSkipVerify: true})
+	}
+
+	// the connection is closed when the test ends, that also
+	// unblocks the handshake.
+	go func() {
+		<-ctx.Done()
+		nconn.Close()
+	}()
+
+	conn := nrtmp.NewConn(&bufio.ReadWriter{
+		Reader: bufio.NewReader(nconn),
+		Writer: bufio.NewWriter(nconn),
+	})
+
+	conn.URL, err = url.Parse("rtmp://" + address + "/" + pathName)
+	if err != nil {
+		nconn.Close()
+		return nil, err
+	}
+
+	err = conn.Prepare(nrtmp.StageGotPublishOrPlayCommand, stage)
+	if err != nil {
+		nconn.Close()
+		return nil, err
+	}
+
+	return &rtmpSelfTestClient{
+		nconn: nconn,
+		conn:  conn,
+	}, nil
+}
+
+func (c *rtmpSelfTestClient) close() {
+	c.nconn.Close()
+}
+
+func (c *rtmpSelfTestClient) writeTracks() error {
+	err := c.conn.WritePacket(av.Packet{
+		Type: av.Metadata,
+		Data: flvio.FillAMF0ValsMalloc([]interface{}{flvio.AMFMap{
+			{K: "videocodecid", V: float64(7)},
+			{K: "audiocodecid", V: float64(10)},
+		}}),
+	})
+	if err != nil {
+		return err
+	}
+
+	err = c.conn.WritePacket(av.Packet{
+		Type: av.H264DecoderConfig,
+		Data: rtmpConnH264DecoderConfig(rtmpSelfTestSPS, rtmpSelfTestPPS),
+	})
+	if err != nil {
+		return err
+	}
+
+	enc, err := aac.MPEG4AudioConfig{
+		Type:         2,
+		SampleRate:   44100,
+		ChannelCount: 2,
+	}.Encode()
+	if err != nil {
+		return err
+	}
+
+	err = c.conn.WritePacket(av.Packet{
+		Type: av.AACDecoderConfig,
+		Data: enc,
+	})
+	if err != nil {
+		return err
+	}
+
+	return c.conn.FlushWrite()
+}
+
+func (c *rtmpSelfTestClient) writeFrames(i uint32) error {
+	marker := rtmpSelfTestMarker(i)
+	dts := time.Duration(i) * rtmpSelfTestFramePeriod
+
+	avcc, err := h264.EncodeAVCC([][]byte{append([]byte{0x65, 0x88}, marker...)})
+	if err != nil {
+		return err
+	}
+
+	err = c.conn.WritePacket(av.Packet{
+		Type: av.H264,
+		Data: avcc,
+		Time: dts,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = c.conn.WritePacket(av.Packet{
+		Type: av.AAC,
+		Data: append([]byte{0x21, 0x10}, marker...),
+		Time: dts,
+	})
+	if err != nil {
+		return err
+	}
+
+	return c.conn.FlushWrite()
+}
+
+// rtmpSelfTest publishes a synthetic H264 and AAC stream to a RTMP server,
+// reads it back and checks that frames are received, through real
+// connections, in order to check that the RTMP subsystem is working.
+// It returns the time needed by video frames to reach the reader.
+func rtmpSelfTest(
+	ctx context.Context,
+	address string,
+	tlsConfig *tls.Config,
+	pathName string,
+) (time.Duration, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	source, err := newRTMPSelfTestClient(ctx, address, tlsConfig, pathName, nrtmp.PrepareWriting)
+	if err != nil {
+		return 0, fmt.Errorf("unable to publish: %v", err)
+	}
+	defer source.close()
+
+	err = source.writeTracks()
+	if err != nil {
+		return 0, fmt.Errorf("unable to publish: %v", err)
+	}
+
+	var mutex sync.Mutex
+	var sent []time.Time
+	sourceErr := make(chan error, 1)
+
+	// frames are sent until the test ends, since the
+	// reader may not have been added to the path yet.
+	go func() {
+		t := time.NewTicker(rtmpSelfTestFramePeriod)
+		defer t.Stop()
+
+		for i := uint32(0); ; i++ {
+			mutex.Lock()
+			sent = append(sent, time.Now())
+			mutex.Unlock()
+
+			err := source.writeFrames(i)
+			if err != nil {
+				sourceErr <- err
+				return
+			}
+
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	// the reader is connected again until the stream is ready.
+	var reader *rtmpSelfTestClient
+	var firstPkt av.Packet
+	for {
+		reader, err = newRTMPSelfTestClient(ctx, address, tlsConfig, pathName, nrtmp.PrepareReading)
+		if err == nil {
+			firstPkt, err = reader.conn.ReadPacket()
+			if err == nil {
+				break
+			}
+			reader.close()
+		}
+
+		select {
+		case err := <-sourceErr:
+			return 0, fmt.Errorf("unable to publish: %v", err)
+		case <-time.After(rtmpSelfTestRetryPeriod):
+		case <-ctx.Done():
+			return 0, fmt.Errorf("unable to read: %v", err)
+		}
+	}
+	defer reader.close()
+
+	var latency time.Duration
+	videoReceived := false
+	audioReceived := false
+	pkt := firstPkt
+
+	for {
+		switch pkt.Type {
+		case av.H264:
+			nalus, err := h264.DecodeAVCC(pkt.Data)
+			if err != nil {
+				return 0, fmt.Errorf("invalid video frame: %v", err)
+			}
+
+			for _, nalu := range nalus {
+				if h264.NALUType(nalu[0]&0x1F) != h264.NALUTypeIDR {
+					continue
+				}
+
+				i, ok := rtmpSelfTestParseMarker(nalu)
+				if !ok {
+					return 0, fmt.Errorf("video frame has been corrupted")
+				}
+
+				mutex.Lock()
+				if !videoReceived && int(i) < len(sent) {
+					latency = time.Since(sent[i])
+				}
+				mutex.Unlock()
+				videoReceived = true
+			}
+
+		case av.AAC:
+			if _, ok := rtmpSelfTestParseMarker(pkt.Data); !ok {
+				return 0, fmt.Errorf("audio frame has been corrupted")
+			}
+			audioReceived = true
+		}
+
+		if videoReceived && audioReceived {
+			return latency, nil
+		}
+
+		pkt, err = reader.conn.ReadPacket()
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return 0, fmt.Errorf("frames have not been received in time")
+			default:
+				return 0, fmt.Errorf("unable to read: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,17 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRTMPSelfTestMarker(t *testing.T) {
+	// markers are recognized at the end of frames
+	i, ok := rtmpSelfTestParseMarker(append([]byte{0x65, 0x88}, rtmpSelfTestMarker(123456)...))
+	require.Equal(t, true, ok)
+	require.Equal(t, uint32(123456), i)
+
+	_, ok = rtmpSelfTestParseMarker([]byte{0x65, 0x88, 0x84})
+	require.Equal(t, false, ok)
+}
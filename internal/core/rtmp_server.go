@@ -3,24 +3,60 @@ package core
 import (
 	"context"
 	"crypto/rand"
+	"crypto/tls"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
 
 	"github.com/aler9/rtsp-simple-server/internal/conf"
 	"github.com/aler9/rtsp-simple-server/internal/externalcmd"
 	"github.com/aler9/rtsp-simple-server/internal/logger"
 )
 
+// maximum number of connections that are being rejected because
+// the server is at capacity. Additional connections are closed immediately.
+const rtmpServerMaxRejectingConns = 16
+
+// rtmpServerConnErrorKey identifies a category of connection errors.
+type rtmpServerConnErrorKey struct {
+	direction string
+	kind      string
+}
+
+// rtmpServerConnErrorKind returns a coarse classification of a connection error.
+func rtmpServerConnErrorKind(err error) string {
+	var netErr net.Error
+	switch {
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		return "reset"
+
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "eof"
+
+	default:
+		return "other"
+	}
+}
+
 type rtmpServerAPIConnsListItem struct {
 	RemoteAddr string `json:"remoteAddr"`
 	State      string `json:"state"`
 }
 
 type rtmpServerAPIConnsListData struct {
-	Items map[string]rtmpServerAPIConnsListItem `json:"items"`
+	Count    int                                   `json:"count"`
+	MaxConns int                                   `json:"maxConns"`
+	Items    map[string]rtmpServerAPIConnsListItem `json:"items"`
 }
 
 type rtmpServerAPIConnsListRes struct {
@@ -41,51 +77,102 @@ type rtmpServerAPIConnsKickReq struct {
 	res chan rtmpServerAPIConnsKickRes
 }
 
+type rtmpServerAPISelfTestData struct {
+	OK      bool   `json:"ok"`
+	Latency string `json:"latency"`
+	Error   string `json:"error"`
+
+	latency time.Duration
+}
+
+type rtmpServerAPISelfTestRes struct {
+	data *rtmpServerAPISelfTestData
+	err  error
+}
+
 type rtmpServerParent interface {
 	Log(logger.Level, string, ...interface{})
+	LogFields(logger.Level, logger.Fields, string, ...interface{})
+}
+
+// rtmpServerConf contains the configuration of a rtmpServer.
+type rtmpServerConf struct {
+	rtmpConnConf
+	address           string
+	serverCert        string
+	serverKey         string
+	authMaxBackoff    conf.StringDuration
+	authBackoffWindow conf.StringDuration
+	maxConns          int
+	stateWebhookURL   string
+	selfTestPath      string
 }
 
 type rtmpServer struct {
-	externalAuthenticationURL string
-	readTimeout               conf.StringDuration
-	writeTimeout              conf.StringDuration
-	readBufferCount           int
-	rtspAddress               string
-	runOnConnect              string
-	runOnConnectRestart       bool
-	externalCmdPool           *externalcmd.Pool
-	metrics                   *metrics
-	pathManager               *pathManager
-	parent                    rtmpServerParent
+	rtmpServerConf
+	authBackoff     *rtmpAuthBackoff
+	adobeAuth       *rtmpAdobeAuth
+	stateWebhook    *rtmpStateWebhook
+	externalCmdPool *externalcmd.Pool
+	metrics         *metrics
+	pathManager     *pathManager
+	parent          rtmpServerParent
+
+	tlsConfig *tls.Config
 
 	ctx       context.Context
 	ctxCancel func()
 	wg        sync.WaitGroup
 	l         net.Listener
 	conns     map[*rtmpConn]struct{}
+	rejecting map[*rtmpConn]struct{}
 
 	// in
 	connClose    chan *rtmpConn
 	apiConnsList chan rtmpServerAPIConnsListReq
 	apiConnsKick chan rtmpServerAPIConnsKickReq
+
+	connErrorsMutex sync.Mutex
+	connErrors      map[rtmpServerConnErrorKey]uint64
+	connClosesMutex sync.Mutex
+	connCloses      map[rtmpConnCloseCause]uint64
+	framesDropped   *uint64
+
+	// keys are set when the server is created and values are accessed atomically.
+	readBufferOverflows map[rtmpReadBufferPolicy]*uint64
+
+	audioJitterBufferFill *int64
+
+	// self tests are performed one at a time, since they use the same path.
+	selfTestMutex       sync.Mutex
+	selfTestResultMutex sync.Mutex
+	selfTestResult      *rtmpServerAPISelfTestData
 }
 
 func newRTMPServer(
 	parentCtx context.Context,
-	externalAuthenticationURL string,
-	address string,
-	readTimeout conf.StringDuration,
-	writeTimeout conf.StringDuration,
-	readBufferCount int,
-	rtspAddress string,
-	runOnConnect string,
-	runOnConnectRestart bool,
+	cnf rtmpServerConf,
 	externalCmdPool *externalcmd.Pool,
 	metrics *metrics,
 	pathManager *pathManager,
 	parent rtmpServerParent,
 ) (*rtmpServer, error) {
-	l, err := net.Listen("tcp", address)
+	var tlsConfig *tls.Config
+	if cnf.serverCert != "" {
+		cert, err := tls.LoadX509KeyPair(cnf.serverCert, cnf.serverKey)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	adobeAuth, err := newRTMPAdobeAuth()
+	if err != nil {
+		return nil, err
+	}
+
+	l, err := net.Listen("tcp", cnf.address)
 	if err != nil {
 		return nil, err
 	}
@@ -93,27 +180,49 @@ func newRTMPServer(
 	ctx, ctxCancel := context.WithCancel(parentCtx)
 
 	s := &rtmpServer{
-		externalAuthenticationURL: externalAuthenticationURL,
-		readTimeout:               readTimeout,
-		writeTimeout:              writeTimeout,
-		readBufferCount:           readBufferCount,
-		rtspAddress:               rtspAddress,
-		runOnConnect:              runOnConnect,
-		runOnConnectRestart:       runOnConnectRestart,
-		externalCmdPool:           externalCmdPool,
-		metrics:                   metrics,
-		pathManager:               pathManager,
-		parent:                    parent,
-		ctx:                       ctx,
-		ctxCancel:                 ctxCancel,
-		l:                         l,
-		conns:                     make(map[*rtmpConn]struct{}),
-		connClose:                 make(chan *rtmpConn),
-		apiConnsList:              make(chan rtmpServerAPIConnsListReq),
-		apiConnsKick:              make(chan rtmpServerAPIConnsKickReq),
+		rtmpServerConf:        cnf,
+		authBackoff:           newRTMPAuthBackoff(time.Duration(cnf.authMaxBackoff), time.Duration(cnf.authBackoffWindow)),
+		adobeAuth:             adobeAuth,
+		externalCmdPool:       externalCmdPool,
+		metrics:               metrics,
+		pathManager:           pathManager,
+		parent:                parent,
+		tlsConfig:             tlsConfig,
+		ctx:                   ctx,
+		ctxCancel:             ctxCancel,
+		l:                     l,
+		conns:                 make(map[*rtmpConn]struct{}),
+		rejecting:             make(map[*rtmpConn]struct{}),
+		connClose:             make(chan *rtmpConn),
+		apiConnsList:          make(chan rtmpServerAPIConnsListReq),
+		apiConnsKick:          make(chan rtmpServerAPIConnsKickReq),
+		connErrors:            make(map[rtmpServerConnErrorKey]uint64),
+		connCloses:            make(map[rtmpConnCloseCause]uint64),
+		framesDropped:         new(uint64),
+		audioJitterBufferFill: new(int64),
+		readBufferOverflows: map[rtmpReadBufferPolicy]*uint64{
+			rtmpReadBufferDropOldest: new(uint64),
+			rtmpReadBufferBlock:      new(uint64),
+		},
+	}
+
+	if cnf.stateWebhookURL != "" {
+		s.stateWebhook = newRTMPStateWebhook(cnf.stateWebhookURL)
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.stateWebhook.run(s.ctx, func(err error) {
+				s.log(logger.Warn, "unable to send state change: %s", err)
+			})
+		}()
 	}
 
-	s.log(logger.Info, "listener opened on %s", address)
+	if s.tlsConfig != nil {
+		s.log(logger.Info, "listener opened on %s (TLS)", cnf.address)
+	} else {
+		s.log(logger.Info, "listener opened on %s", cnf.address)
+	}
 
 	if s.metrics != nil {
 		s.metrics.onRTMPServerSet(s)
@@ -129,6 +238,10 @@ func (s *rtmpServer) log(level logger.Level, format string, args ...interface{})
 	s.parent.Log(level, "[RTMP] "+format, append([]interface{}{}, args...)...)
 }
 
+func (s *rtmpServer) logFields(level logger.Level, fields logger.Fields, format string, args ...interface{}) {
+	s.parent.LogFields(level, fields, "[RTMP] "+format, append([]interface{}{}, args...)...)
+}
+
 func (s *rtmpServer) close() {
 	s.log(logger.Info, "listener is closing")
 	s.ctxCancel()
@@ -174,47 +287,55 @@ outer:
 		case nconn := <-connNew:
 			id, _ := s.newConnID()
 
+			// connections are accepted, in order to reject them
+			// with a RTMP message that can be understood by clients.
+			// Rejected connections are not counted and are closed by the
+			// handshake timeout at the latest. When there are too many of them,
+			// connections are closed immediately.
+			overCapacity := s.maxConns != 0 && len(s.conns) >= s.maxConns
+
+			if overCapacity && len(s.rejecting) >= rtmpServerMaxRejectingConns {
+				nconn.Close()
+				s.connClosesMutex.Lock()
+				s.connCloses[rtmpConnCloseCauseCapacity]++
+				s.connClosesMutex.Unlock()
+				continue
+			}
+
 			c := newRTMPConn(
 				s.ctx,
 				id,
-				s.externalAuthenticationURL,
-				s.rtspAddress,
-				s.readTimeout,
-				s.writeTimeout,
-				s.readBufferCount,
-				s.runOnConnect,
-				s.runOnConnectRestart,
+				s.rtmpConnConf,
+				s.authBackoff,
+				s.adobeAuth,
+				overCapacity,
 				&s.wg,
 				nconn,
+				s.tlsConfig,
 				s.externalCmdPool,
 				s.pathManager,
 				s)
-			s.conns[c] = struct{}{}
+			if overCapacity {
+				s.rejecting[c] = struct{}{}
+			} else {
+				s.conns[c] = struct{}{}
+			}
 
 		case c := <-s.connClose:
-			if _, ok := s.conns[c]; !ok {
-				continue
-			}
+			delete(s.rejecting, c)
 			delete(s.conns, c)
 
 		case req := <-s.apiConnsList:
 			data := &rtmpServerAPIConnsListData{
-				Items: make(map[string]rtmpServerAPIConnsListItem),
+				Count:    len(s.conns),
+				MaxConns: s.maxConns,
+				Items:    make(map[string]rtmpServerAPIConnsListItem),
 			}
 
 			for c := range s.conns {
 				data.Items[c.ID()] = rtmpServerAPIConnsListItem{
 					RemoteAddr: c.RemoteAddr().String(),
-					State: func() string {
-						switch c.safeState() {
-						case rtmpConnStateRead:
-							return "read"
-
-						case rtmpConnStatePublish:
-							return "publish"
-						}
-						return "idle"
-					}(),
+					State:      c.safeState().String(),
 				}
 			}
 
@@ -225,7 +346,7 @@ outer:
 				for c := range s.conns {
 					if c.ID() == req.id {
 						delete(s.conns, c)
-						c.close()
+						c.kick()
 						return true
 					}
 				}
@@ -280,13 +401,159 @@ func (s *rtmpServer) newConnID() (string, error) {
 }
 
 // onConnClose is called by rtmpConn.
-func (s *rtmpServer) onConnClose(c *rtmpConn) {
+func (s *rtmpServer) onConnClose(c *rtmpConn, cause rtmpConnCloseCause) {
+	s.connClosesMutex.Lock()
+	s.connCloses[cause]++
+	s.connClosesMutex.Unlock()
+
 	select {
 	case s.connClose <- c:
 	case <-s.ctx.Done():
 	}
 }
 
+// onConnError is called by rtmpConn.
+func (s *rtmpServer) onConnError(direction string, err error) {
+	s.connErrorsMutex.Lock()
+	defer s.connErrorsMutex.Unlock()
+	s.connErrors[rtmpServerConnErrorKey{
+		direction: direction,
+		kind:      rtmpServerConnErrorKind(err),
+	}]++
+}
+
+// onConnStateChange is called by rtmpConn.
+func (s *rtmpServer) onConnStateChange(c *rtmpConn, oldState rtmpConnState, newState rtmpConnState) {
+	if s.stateWebhook == nil {
+		return
+	}
+
+	ok := s.stateWebhook.push(rtmpStateWebhookEvent{
+		ID:         c.ID(),
+		RemoteAddr: c.RemoteAddr().String(),
+		Path:       c.app,
+		OldState:   oldState.String(),
+		NewState:   newState.String(),
+	})
+	if !ok {
+		s.log(logger.Warn, "state change of conn %s discarded, since the webhook is too slow", c.ID())
+	}
+}
+
+// onFramesDropped is called by rtmpConn.
+func (s *rtmpServer) onFramesDropped(n uint64) {
+	atomic.AddUint64(s.framesDropped, n)
+}
+
+// onReadBufferOverflow is called by rtmpConn.
+func (s *rtmpServer) onReadBufferOverflow(policy rtmpReadBufferPolicy) {
+	atomic.AddUint64(s.readBufferOverflows[policy], 1)
+}
+
+// onAudioJitterBufferFill is called by rtmpConn.
+func (s *rtmpServer) onAudioJitterBufferFill(delta int64) {
+	atomic.AddInt64(s.audioJitterBufferFill, delta)
+}
+
+// onMetricsConnErrors is called by metrics.
+func (s *rtmpServer) onMetricsConnErrors() map[rtmpServerConnErrorKey]uint64 {
+	s.connErrorsMutex.Lock()
+	defer s.connErrorsMutex.Unlock()
+
+	ret := make(map[rtmpServerConnErrorKey]uint64, len(s.connErrors))
+	for k, v := range s.connErrors {
+		ret[k] = v
+	}
+	return ret
+}
+
+// onMetricsConnCloses is called by metrics.
+func (s *rtmpServer) onMetricsConnCloses() map[rtmpConnCloseCause]uint64 {
+	s.connClosesMutex.Lock()
+	defer s.connClosesMutex.Unlock()
+
+	ret := make(map[rtmpConnCloseCause]uint64, len(s.connCloses))
+	for k, v := range s.connCloses {
+		ret[k] = v
+	}
+	return ret
+}
+
+// onMetricsFramesDropped is called by metrics.
+func (s *rtmpServer) onMetricsFramesDropped() uint64 {
+	return atomic.LoadUint64(s.framesDropped)
+}
+
+// onMetricsReadBufferOverflows is called by metrics.
+func (s *rtmpServer) onMetricsReadBufferOverflows() map[rtmpReadBufferPolicy]uint64 {
+	ret := make(map[rtmpReadBufferPolicy]uint64, len(s.readBufferOverflows))
+	for k, v := range s.readBufferOverflows {
+		ret[k] = atomic.LoadUint64(v)
+	}
+	return ret
+}
+
+// onMetricsAudioJitterBufferFill is called by metrics.
+func (s *rtmpServer) onMetricsAudioJitterBufferFill() int64 {
+	return atomic.LoadInt64(s.audioJitterBufferFill)
+}
+
+// onMetricsSelfTest is called by metrics.
+// It returns nil when no self test has been performed.
+func (s *rtmpServer) onMetricsSelfTest() *rtmpServerAPISelfTestData {
+	s.selfTestResultMutex.Lock()
+	defer s.selfTestResultMutex.Unlock()
+	return s.selfTestResult
+}
+
+// onAPISelfTest is called by api.
+func (s *rtmpServer) onAPISelfTest() rtmpServerAPISelfTestRes {
+	if s.selfTestPath == "" {
+		return rtmpServerAPISelfTestRes{err: fmt.Errorf("self test is disabled")}
+	}
+
+	s.selfTestMutex.Lock()
+	defer s.selfTestMutex.Unlock()
+
+	ctx, cancel := context.WithTimeout(s.ctx, time.Duration(s.readTimeout))
+	defer cancel()
+
+	latency, err := rtmpSelfTest(ctx, rtmpServerLoopbackAddress(s.l.Addr()), s.tlsConfig, s.selfTestPath)
+
+	data := &rtmpServerAPISelfTestData{}
+	if err != nil {
+		s.log(logger.Warn, "self test failed: %v", err)
+		data.Error = err.Error()
+	} else {
+		s.log(logger.Info, "self test succeeded, latency: %v", latency)
+		data.OK = true
+		data.Latency = latency.String()
+		data.latency = latency
+	}
+
+	s.selfTestResultMutex.Lock()
+	s.selfTestResult = data
+	s.selfTestResultMutex.Unlock()
+
+	return rtmpServerAPISelfTestRes{data: data}
+}
+
+// rtmpServerLoopbackAddress returns the address that allows to connect
+// to a listener from the same host.
+func rtmpServerLoopbackAddress(addr net.Addr) string {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return addr.String()
+	}
+
+	ip := tcpAddr.IP
+	if ip == nil || ip.IsUnspecified() {
+		ip = net.IPv4(127, 0, 0, 1)
+	}
+
+	return net.JoinHostPort(ip.String(), strconv.Itoa(tcpAddr.Port))
+}
+
 // onAPIConnsList is called by api.
 func (s *rtmpServer) onAPIConnsList(req rtmpServerAPIConnsListReq) rtmpServerAPIConnsListRes {
 	req.res = make(chan rtmpServerAPIConnsListRes)
@@ -1,11 +1,26 @@
 package core
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"fmt"
 	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"syscall"
 	"testing"
 	"time"
 
+	"github.com/aler9/gortsplib"
+	"github.com/aler9/gortsplib/pkg/aac"
+	"github.com/notedit/rtmp/av"
+	"github.com/notedit/rtmp/format/flv/flvio"
+	nrtmp "github.com/notedit/rtmp/format/rtmp"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
 	"github.com/stretchr/testify/require"
 
 	"github.com/aler9/rtsp-simple-server/internal/rtmp"
@@ -223,7 +238,830 @@ func TestRTMPServerAuthFail(t *testing.T) {
 		require.NoError(t, err)
 		defer conn.Close()
 
+		// the server sends a NetStream.Play.Failed status, then closes the connection
 		err = conn.ClientHandshake()
+		require.NoError(t, err)
+
+		_, err = conn.ReadPacket()
 		require.Equal(t, err, io.EOF)
 	})
 }
+
+func TestRTMPServerIPsByAction(t *testing.T) {
+	for _, ca := range []struct {
+		name       string
+		publishIPs string
+		readIPs    string
+		ok         bool
+	}{
+		{"publish denied", "[10.0.0.0/8]", "", false},
+		{"publish allowed, read from anywhere", "[127.0.0.0/8]", "", true},
+		{"publish allowed, read denied", "[127.0.0.0/8]", "[10.0.0.0/8]", false},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			conf := "rtspDisable: yes\n" +
+				"hlsDisable: yes\n" +
+				"paths:\n" +
+				"  all:\n" +
+				"    publishIPs: " + ca.publishIPs + "\n"
+			if ca.readIPs != "" {
+				conf += "    readIPs: " + ca.readIPs + "\n"
+			}
+
+			p, ok := newInstance(conf)
+			require.Equal(t, true, ok)
+			defer p.close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+			defer cancel()
+
+			_, err := rtmpSelfTest(ctx, "127.0.0.1:1935", nil, "teststream")
+			if ca.ok {
+				require.NoError(t, err)
+			} else {
+				require.Error(t, err)
+			}
+		})
+	}
+}
+
+func TestRTMPServerConnErrorKind(t *testing.T) {
+	require.Equal(t, "timeout", rtmpServerConnErrorKind(
+		&net.OpError{Op: "write", Err: os.ErrDeadlineExceeded}))
+	require.Equal(t, "reset", rtmpServerConnErrorKind(
+		&net.OpError{Op: "write", Err: &os.SyscallError{Syscall: "write", Err: syscall.ECONNRESET}}))
+	require.Equal(t, "eof", rtmpServerConnErrorKind(io.EOF))
+	require.Equal(t, "other", rtmpServerConnErrorKind(fmt.Errorf("invalid packet")))
+}
+
+func TestRTMPServerAudioOnly(t *testing.T) {
+	p, ok := newInstance("hlsDisable: yes\n" +
+		"paths:\n" +
+		"  all:\n")
+	require.Equal(t, true, ok)
+	defer p.close()
+
+	nconn, err := net.Dial("tcp", "127.0.0.1:1935")
+	require.NoError(t, err)
+	defer nconn.Close()
+
+	source := nrtmp.NewConn(&bufio.ReadWriter{
+		Reader: bufio.NewReader(nconn),
+		Writer: bufio.NewWriter(nconn),
+	})
+	source.URL, err = url.Parse("rtmp://127.0.0.1:1935/mystream")
+	require.NoError(t, err)
+
+	err = source.Prepare(nrtmp.StageGotPublishOrPlayCommand, nrtmp.PrepareWriting)
+	require.NoError(t, err)
+
+	enc, err := aac.MPEG4AudioConfig{
+		Type:         2,
+		SampleRate:   44100,
+		ChannelCount: 2,
+	}.Encode()
+	require.NoError(t, err)
+
+	// the publisher doesn't send metadata, like some radio encoders
+	err = source.WritePacket(av.Packet{
+		Type: av.AACDecoderConfig,
+		Data: enc,
+	})
+	require.NoError(t, err)
+	err = source.FlushWrite()
+	require.NoError(t, err)
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case <-time.After(20 * time.Millisecond):
+			case <-done:
+				return
+			}
+
+			err := source.WritePacket(av.Packet{
+				Type: av.AAC,
+				Data: []byte{0x01, 0x02, 0x03, 0x04},
+				Time: time.Duration(i) * 1024 * time.Second / 44100,
+			})
+			if err != nil {
+				return
+			}
+			source.FlushWrite()
+		}
+	}()
+
+	time.Sleep(500 * time.Millisecond)
+
+	conn, err := rtmp.DialContext(context.Background(), "rtmp://127.0.0.1:1935/mystream")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	err = conn.ClientHandshake()
+	require.NoError(t, err)
+
+	videoTrack, audioTrack, err := conn.ReadTracks()
+	require.NoError(t, err)
+	require.Equal(t, (*gortsplib.TrackH264)(nil), videoTrack)
+
+	audioTrack2, err := gortsplib.NewTrackAAC(96, 2, 44100, 2, nil)
+	require.NoError(t, err)
+	require.Equal(t, audioTrack2, audioTrack)
+
+	for {
+		pkt, err := conn.ReadPacket()
+		require.NoError(t, err)
+
+		if pkt.Type == av.AAC {
+			require.Equal(t, []byte{0x01, 0x02, 0x03, 0x04}, pkt.Data)
+			break
+		}
+	}
+}
+
+func TestRTMPServerPublishRevalidate(t *testing.T) {
+	for _, ca := range []string{
+		"kept",
+		"revoked",
+	} {
+		t.Run(ca, func(t *testing.T) {
+			p, ok := newInstance("hlsDisable: yes\n" +
+				"api: yes\n" +
+				"paths:\n" +
+				"  teststream:\n" +
+				"    publishUser: myuser\n" +
+				"    publishPass: mypass\n" +
+				"    publishRevalidateOnReload: " + map[string]string{"kept": "no", "revoked": "yes"}[ca] + "\n")
+			require.Equal(t, true, ok)
+			defer p.close()
+
+			nconn, err := net.Dial("tcp", "127.0.0.1:1935")
+			require.NoError(t, err)
+			defer nconn.Close()
+
+			source := nrtmp.NewConn(&bufio.ReadWriter{
+				Reader: bufio.NewReader(nconn),
+				Writer: bufio.NewWriter(nconn),
+			})
+			source.URL, err = url.Parse("rtmp://127.0.0.1:1935/teststream?user=myuser&pass=mypass")
+			require.NoError(t, err)
+
+			err = source.Prepare(nrtmp.StageGotPublishOrPlayCommand, nrtmp.PrepareWriting)
+			require.NoError(t, err)
+
+			enc, err := aac.MPEG4AudioConfig{
+				Type:         2,
+				SampleRate:   44100,
+				ChannelCount: 2,
+			}.Encode()
+			require.NoError(t, err)
+
+			err = source.WritePacket(av.Packet{
+				Type: av.AACDecoderConfig,
+				Data: enc,
+			})
+			require.NoError(t, err)
+			err = source.FlushWrite()
+			require.NoError(t, err)
+
+			done := make(chan struct{})
+			defer close(done)
+
+			go func() {
+				for i := 0; ; i++ {
+					select {
+					case <-time.After(20 * time.Millisecond):
+					case <-done:
+						return
+					}
+
+					err := source.WritePacket(av.Packet{
+						Type: av.AAC,
+						Data: []byte{0x01, 0x02, 0x03, 0x04},
+						Time: time.Duration(i) * 1024 * time.Second / 44100,
+					})
+					if err != nil {
+						return
+					}
+					source.FlushWrite()
+				}
+			}()
+
+			publishers := func() int {
+				var out struct {
+					Items map[string]struct {
+						State string `json:"state"`
+					} `json:"items"`
+				}
+				err := httpRequest(http.MethodGet, "http://localhost:9997/v1/rtmpconns/list", nil, &out)
+				require.NoError(t, err)
+
+				n := 0
+				for _, i := range out.Items {
+					if i.State == "publish" {
+						n++
+					}
+				}
+				return n
+			}
+
+			time.Sleep(500 * time.Millisecond)
+			require.Equal(t, 1, publishers())
+
+			err = httpRequest(http.MethodPost, "http://localhost:9997/v1/config/paths/edit/teststream",
+				map[string]interface{}{
+					"publishPass": "newpass",
+				}, nil)
+			require.NoError(t, err)
+
+			time.Sleep(500 * time.Millisecond)
+
+			if ca == "kept" {
+				require.Equal(t, 1, publishers())
+			} else {
+				require.Equal(t, 0, publishers())
+			}
+		})
+	}
+}
+
+func TestRTMPServerPublishUnpublish(t *testing.T) {
+	p, ok := newInstance("hlsDisable: yes\n" +
+		"api: yes\n" +
+		"paths:\n" +
+		"  all:\n")
+	require.Equal(t, true, ok)
+	defer p.close()
+
+	nconn, err := net.Dial("tcp", "127.0.0.1:1935")
+	require.NoError(t, err)
+	defer nconn.Close()
+
+	source := nrtmp.NewConn(&bufio.ReadWriter{
+		Reader: bufio.NewReader(nconn),
+		Writer: bufio.NewWriter(nconn),
+	})
+	source.URL, err = url.Parse("rtmp://127.0.0.1:1935/teststream")
+	require.NoError(t, err)
+
+	err = source.Prepare(nrtmp.StageGotPublishOrPlayCommand, nrtmp.PrepareWriting)
+	require.NoError(t, err)
+
+	enc, err := aac.MPEG4AudioConfig{
+		Type:         2,
+		SampleRate:   44100,
+		ChannelCount: 2,
+	}.Encode()
+	require.NoError(t, err)
+
+	err = source.WritePacket(av.Packet{
+		Type: av.AACDecoderConfig,
+		Data: enc,
+	})
+	require.NoError(t, err)
+	err = source.WritePacket(av.Packet{
+		Type: av.AAC,
+		Data: []byte{0x01, 0x02, 0x03, 0x04},
+	})
+	require.NoError(t, err)
+	err = source.FlushWrite()
+	require.NoError(t, err)
+
+	sourceType := func() string {
+		var out struct {
+			Items map[string]struct {
+				Source *struct {
+					Type string `json:"type"`
+				} `json:"source"`
+			} `json:"items"`
+		}
+		err := httpRequest(http.MethodGet, "http://localhost:9997/v1/paths/list", nil, &out)
+		require.NoError(t, err)
+
+		if out.Items["teststream"].Source == nil {
+			return ""
+		}
+		return out.Items["teststream"].Source.Type
+	}
+
+	time.Sleep(500 * time.Millisecond)
+	require.Equal(t, "rtmpConn", sourceType())
+
+	// command sequence sent by OBS when streaming is stopped,
+	// before the connection is closed.
+	for _, vals := range [][]interface{}{
+		{"FCUnpublish", float64(6), nil, "teststream"},
+		{"deleteStream", float64(7), nil, float64(1)},
+	} {
+		byts := flvio.FillAMF0ValsMalloc(vals)
+		_, err = nconn.Write(append([]byte{
+			0x03, 0x00, 0x00, 0x00,
+			byte(len(byts) >> 16), byte(len(byts) >> 8), byte(len(byts)),
+			0x14, 0x00, 0x00, 0x00, 0x00,
+		}, byts...))
+		require.NoError(t, err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, "", sourceType())
+}
+
+func TestRTMPServerPublishStalled(t *testing.T) {
+	p, ok := newInstance("hlsDisable: yes\n" +
+		"api: yes\n" +
+		"rtmpStalledPublisherTimeout: 1s\n" +
+		"paths:\n" +
+		"  all:\n")
+	require.Equal(t, true, ok)
+	defer p.close()
+
+	nconn, err := net.Dial("tcp", "127.0.0.1:1935")
+	require.NoError(t, err)
+	defer nconn.Close()
+
+	source := nrtmp.NewConn(&bufio.ReadWriter{
+		Reader: bufio.NewReader(nconn),
+		Writer: bufio.NewWriter(nconn),
+	})
+	source.URL, err = url.Parse("rtmp://127.0.0.1:1935/teststream")
+	require.NoError(t, err)
+
+	err = source.Prepare(nrtmp.StageGotPublishOrPlayCommand, nrtmp.PrepareWriting)
+	require.NoError(t, err)
+
+	enc, err := aac.MPEG4AudioConfig{
+		Type:         2,
+		SampleRate:   44100,
+		ChannelCount: 2,
+	}.Encode()
+	require.NoError(t, err)
+
+	err = source.WritePacket(av.Packet{
+		Type: av.AACDecoderConfig,
+		Data: enc,
+	})
+	require.NoError(t, err)
+	err = source.WritePacket(av.Packet{
+		Type: av.AAC,
+		Data: []byte{0x01, 0x02, 0x03, 0x04},
+	})
+	require.NoError(t, err)
+	err = source.FlushWrite()
+	require.NoError(t, err)
+
+	sourceReady := func() bool {
+		var out struct {
+			Items map[string]struct {
+				SourceReady bool `json:"sourceReady"`
+			} `json:"items"`
+		}
+		err := httpRequest(http.MethodGet, "http://localhost:9997/v1/paths/list", nil, &out)
+		require.NoError(t, err)
+		return out.Items["teststream"].SourceReady
+	}
+
+	time.Sleep(500 * time.Millisecond)
+	require.Equal(t, true, sourceReady())
+
+	// metadata keeps the connection alive, but it's not media.
+	// Writes fail when the server closes the connection.
+	for i := 0; i < 10; i++ {
+		err = source.WritePacket(av.Packet{
+			Type: av.Metadata,
+			Data: flvio.FillAMF0ValsMalloc([]interface{}{flvio.AMFMap{
+				{K: "encoder", V: "stuck"},
+			}}),
+		})
+		if err == nil {
+			err = source.FlushWrite()
+		}
+		if err != nil {
+			break
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+
+	require.Equal(t, false, sourceReady())
+}
+
+func TestRTMPServerPublishPacketTooLarge(t *testing.T) {
+	p, ok := newInstance("hlsDisable: yes\n" +
+		"api: yes\n" +
+		"rtmpMaxPacketSize: 1K\n" +
+		"paths:\n" +
+		"  all:\n")
+	require.Equal(t, true, ok)
+	defer p.close()
+
+	nconn, err := net.Dial("tcp", "127.0.0.1:1935")
+	require.NoError(t, err)
+	defer nconn.Close()
+
+	source := nrtmp.NewConn(&bufio.ReadWriter{
+		Reader: bufio.NewReader(nconn),
+		Writer: bufio.NewWriter(nconn),
+	})
+	source.URL, err = url.Parse("rtmp://127.0.0.1:1935/teststream")
+	require.NoError(t, err)
+
+	err = source.Prepare(nrtmp.StageGotPublishOrPlayCommand, nrtmp.PrepareWriting)
+	require.NoError(t, err)
+
+	enc, err := aac.MPEG4AudioConfig{
+		Type:         2,
+		SampleRate:   44100,
+		ChannelCount: 2,
+	}.Encode()
+	require.NoError(t, err)
+
+	err = source.WritePacket(av.Packet{
+		Type: av.AACDecoderConfig,
+		Data: enc,
+	})
+	require.NoError(t, err)
+	err = source.WritePacket(av.Packet{
+		Type: av.AAC,
+		Data: []byte{0x01, 0x02, 0x03, 0x04},
+	})
+	require.NoError(t, err)
+	err = source.FlushWrite()
+	require.NoError(t, err)
+
+	sourceReady := func() bool {
+		var out struct {
+			Items map[string]struct {
+				SourceReady bool `json:"sourceReady"`
+			} `json:"items"`
+		}
+		err := httpRequest(http.MethodGet, "http://localhost:9997/v1/paths/list", nil, &out)
+		require.NoError(t, err)
+		return out.Items["teststream"].SourceReady
+	}
+
+	time.Sleep(500 * time.Millisecond)
+	require.Equal(t, true, sourceReady())
+
+	err = source.WritePacket(av.Packet{
+		Type: av.AAC,
+		Data: bytes.Repeat([]byte{0x01}, 2048),
+	})
+	require.NoError(t, err)
+	err = source.FlushWrite()
+	require.NoError(t, err)
+
+	time.Sleep(500 * time.Millisecond)
+	require.Equal(t, false, sourceReady())
+}
+
+func TestRTMPServerPublishBadName(t *testing.T) {
+	p, ok := newInstance("hlsDisable: yes\n" +
+		"paths:\n" +
+		"  all:\n" +
+		"    disablePublisherOverride: yes\n")
+	require.Equal(t, true, ok)
+	defer p.close()
+
+	publish := func(u string) error {
+		nconn, err := net.Dial("tcp", "127.0.0.1:1935")
+		require.NoError(t, err)
+		t.Cleanup(func() { nconn.Close() })
+
+		conn := nrtmp.NewConn(&bufio.ReadWriter{
+			Reader: bufio.NewReader(nconn),
+			Writer: bufio.NewWriter(nconn),
+		})
+		conn.URL, err = url.Parse(u)
+		require.NoError(t, err)
+
+		return conn.Prepare(nrtmp.StageGotPublishOrPlayCommand, nrtmp.PrepareWriting)
+	}
+
+	t.Run("invalid name", func(t *testing.T) {
+		err := publish("rtmp://127.0.0.1:1935/test%20stream")
+		require.EqualError(t, err, "PublishFailed: CodeInvalid(NetStream.Publish.BadName)")
+	})
+
+	t.Run("race", func(t *testing.T) {
+		errs := make(chan error)
+		for i := 0; i < 2; i++ {
+			go func() {
+				errs <- publish("rtmp://127.0.0.1:1935/teststream")
+			}()
+		}
+
+		// exactly one of the publishers is accepted
+		var failed []error
+		for i := 0; i < 2; i++ {
+			if err := <-errs; err != nil {
+				failed = append(failed, err)
+			}
+		}
+		require.Equal(t, 1, len(failed))
+		require.EqualError(t, failed[0], "PublishFailed: CodeInvalid(NetStream.Publish.BadName)")
+	})
+}
+
+func TestRTMPServerMaxConns(t *testing.T) {
+	p, ok := newInstance("hlsDisable: yes\n" +
+		"api: yes\n" +
+		"rtmpMaxConns: 1\n" +
+		"paths:\n" +
+		"  all:\n")
+	require.Equal(t, true, ok)
+	defer p.close()
+
+	nconn1, err := net.Dial("tcp", "127.0.0.1:1935")
+	require.NoError(t, err)
+	defer nconn1.Close()
+
+	conn1 := nrtmp.NewConn(&bufio.ReadWriter{
+		Reader: bufio.NewReader(nconn1),
+		Writer: bufio.NewWriter(nconn1),
+	})
+	conn1.URL, err = url.Parse("rtmp://127.0.0.1:1935/teststream")
+	require.NoError(t, err)
+
+	err = conn1.Prepare(nrtmp.StageGotPublishOrPlayCommand, nrtmp.PrepareWriting)
+	require.NoError(t, err)
+
+	nconn2, err := net.Dial("tcp", "127.0.0.1:1935")
+	require.NoError(t, err)
+	defer nconn2.Close()
+
+	conn2 := nrtmp.NewConn(&bufio.ReadWriter{
+		Reader: bufio.NewReader(nconn2),
+		Writer: bufio.NewWriter(nconn2),
+	})
+	conn2.URL, err = url.Parse("rtmp://127.0.0.1:1935/teststream2")
+	require.NoError(t, err)
+
+	start := time.Now()
+	err = conn2.Prepare(nrtmp.StageGotPublishOrPlayCommand, nrtmp.PrepareWriting)
+	require.Error(t, err)
+
+	// the rejection is not delayed
+	require.Less(t, time.Since(start), time.Second)
+
+	// connections that are being rejected are not counted
+	nconn3, err := net.Dial("tcp", "127.0.0.1:1935")
+	require.NoError(t, err)
+	defer nconn3.Close()
+
+	time.Sleep(500 * time.Millisecond)
+
+	var conns struct {
+		Count    int                    `json:"count"`
+		MaxConns int                    `json:"maxConns"`
+		Items    map[string]interface{} `json:"items"`
+	}
+	err = httpRequest(http.MethodGet, "http://localhost:9997/v1/rtmpconns/list", nil, &conns)
+	require.NoError(t, err)
+	require.Equal(t, 1, conns.Count)
+	require.Equal(t, 1, conns.MaxConns)
+	require.Equal(t, 1, len(conns.Items))
+
+	require.Equal(t, uint64(1), p.rtmpServer.onMetricsConnCloses()[rtmpConnCloseCauseCapacity])
+
+	// when too many connections are being rejected,
+	// connections are closed immediately.
+	for i := 1; i < rtmpServerMaxRejectingConns; i++ {
+		nconn, err := net.Dial("tcp", "127.0.0.1:1935")
+		require.NoError(t, err)
+		defer nconn.Close()
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	nconn4, err := net.Dial("tcp", "127.0.0.1:1935")
+	require.NoError(t, err)
+	defer nconn4.Close()
+
+	nconn4.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = nconn4.Read(make([]byte, 1))
+	require.Equal(t, io.EOF, err)
+
+	require.Equal(t, uint64(2), p.rtmpServer.onMetricsConnCloses()[rtmpConnCloseCauseCapacity])
+}
+
+func TestRTMPServerReadDisconnect(t *testing.T) {
+	p, ok := newInstance("hlsDisable: yes\n" +
+		"api: yes\n" +
+		"rtmpPingPeriod: 200ms\n" +
+		"paths:\n" +
+		"  all:\n")
+	require.Equal(t, true, ok)
+	defer p.close()
+
+	nconn, err := net.Dial("tcp", "127.0.0.1:1935")
+	require.NoError(t, err)
+	defer nconn.Close()
+
+	source := nrtmp.NewConn(&bufio.ReadWriter{
+		Reader: bufio.NewReader(nconn),
+		Writer: bufio.NewWriter(nconn),
+	})
+	source.URL, err = url.Parse("rtmp://127.0.0.1:1935/teststream")
+	require.NoError(t, err)
+
+	err = source.Prepare(nrtmp.StageGotPublishOrPlayCommand, nrtmp.PrepareWriting)
+	require.NoError(t, err)
+
+	enc, err := aac.MPEG4AudioConfig{
+		Type:         2,
+		SampleRate:   44100,
+		ChannelCount: 2,
+	}.Encode()
+	require.NoError(t, err)
+
+	err = source.WritePacket(av.Packet{
+		Type: av.AACDecoderConfig,
+		Data: enc,
+	})
+	require.NoError(t, err)
+	err = source.FlushWrite()
+	require.NoError(t, err)
+
+	time.Sleep(500 * time.Millisecond)
+
+	for i := 0; i < 3; i++ {
+		rconn, err := net.Dial("tcp", "127.0.0.1:1935")
+		require.NoError(t, err)
+
+		reader := nrtmp.NewConn(&bufio.ReadWriter{
+			Reader: bufio.NewReader(rconn),
+			Writer: bufio.NewWriter(rconn),
+		})
+		reader.URL, err = url.Parse("rtmp://127.0.0.1:1935/teststream")
+		require.NoError(t, err)
+
+		err = reader.Prepare(nrtmp.StageGotPublishOrPlayCommand, nrtmp.PrepareReading)
+		require.NoError(t, err)
+
+		// disconnect abruptly, while tracks are being sent
+		rconn.(*net.TCPConn).SetLinger(0)
+		rconn.Close()
+	}
+
+	// readers that have received the tracks are detected by pings
+	time.Sleep(1 * time.Second)
+
+	var paths struct {
+		Items map[string]struct {
+			SourceReady bool          `json:"sourceReady"`
+			Readers     []interface{} `json:"readers"`
+		} `json:"items"`
+	}
+	err = httpRequest(http.MethodGet, "http://localhost:9997/v1/paths/list", nil, &paths)
+	require.NoError(t, err)
+	require.Equal(t, true, paths.Items["teststream"].SourceReady)
+	require.Equal(t, 0, len(paths.Items["teststream"].Readers))
+
+	var conns struct {
+		Items map[string]struct {
+			State string `json:"state"`
+		} `json:"items"`
+	}
+	err = httpRequest(http.MethodGet, "http://localhost:9997/v1/rtmpconns/list", nil, &conns)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(conns.Items))
+	for _, item := range conns.Items {
+		require.Equal(t, "publish", item.State)
+	}
+}
+
+func TestRTMPServerSelfTest(t *testing.T) {
+	p, ok := newInstance("hlsDisable: yes\n" +
+		"api: yes\n" +
+		"metrics: yes\n" +
+		"rtmpSelfTestPath: selftest\n" +
+		"paths:\n" +
+		"  all:\n")
+	require.Equal(t, true, ok)
+	defer p.close()
+
+	// POST requests are not retried on connections to previous instances
+	http.DefaultClient.CloseIdleConnections()
+
+	var out struct {
+		OK      bool   `json:"ok"`
+		Latency string `json:"latency"`
+		Error   string `json:"error"`
+	}
+	err := httpRequest(http.MethodPost, "http://localhost:9997/v1/rtmpconns/selftest", nil, &out)
+	require.NoError(t, err)
+	require.Equal(t, "", out.Error)
+	require.Equal(t, true, out.OK)
+
+	_, err = time.ParseDuration(out.Latency)
+	require.NoError(t, err)
+
+	res, err := http.Get("http://localhost:9998/metrics")
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	byts, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.Contains(t, string(byts), "rtmp_self_test_ok 1\n")
+}
+
+func TestRTMPServerSelfTestDisabled(t *testing.T) {
+	p, ok := newInstance("hlsDisable: yes\n" +
+		"api: yes\n" +
+		"paths:\n" +
+		"  all:\n")
+	require.Equal(t, true, ok)
+	defer p.close()
+
+	// POST requests are not retried on connections to previous instances
+	http.DefaultClient.CloseIdleConnections()
+
+	err := httpRequest(http.MethodPost, "http://localhost:9997/v1/rtmpconns/selftest", nil, nil)
+	require.EqualError(t, err, "bad status code: 400")
+}
+
+func TestRTMPServerLoopbackAddress(t *testing.T) {
+	require.Equal(t, "127.0.0.1:1935",
+		rtmpServerLoopbackAddress(&net.TCPAddr{IP: net.IPv6unspecified, Port: 1935}))
+	require.Equal(t, "192.168.1.2:1935",
+		rtmpServerLoopbackAddress(&net.TCPAddr{IP: net.IPv4(192, 168, 1, 2), Port: 1935}))
+}
+
+func TestRTMPServerReadRequestKeyFrame(t *testing.T) {
+	p, ok := newInstance("hlsDisable: yes\n" +
+		"paths:\n" +
+		"  all:\n" +
+		"    rtmpRequestKeyFrame: yes\n")
+	require.Equal(t, true, ok)
+	defer p.close()
+
+	track, err := gortsplib.NewTrackH264(96,
+		[]byte{
+			0x67, 0x64, 0x00, 0x0c, 0xac, 0x3b, 0x50, 0xb0,
+			0x4b, 0x42, 0x00, 0x00, 0x03, 0x00, 0x02, 0x00,
+			0x00, 0x03, 0x00, 0x3d, 0x08,
+		},
+		[]byte{0x68, 0xee, 0x3c, 0x80},
+		nil)
+	require.NoError(t, err)
+
+	pli := make(chan uint32, 1)
+
+	transport := gortsplib.TransportTCP
+	source := gortsplib.Client{
+		Transport: &transport,
+		OnPacketRTCP: func(ctx *gortsplib.ClientOnPacketRTCPCtx) {
+			if pkt, ok := ctx.Packet.(*rtcp.PictureLossIndication); ok {
+				select {
+				case pli <- pkt.MediaSSRC:
+				default:
+				}
+			}
+		},
+	}
+
+	err = source.StartPublishing("rtsp://localhost:8554/teststream", gortsplib.Tracks{track})
+	require.NoError(t, err)
+	defer source.Close()
+
+	err = source.WritePacketRTP(0, &rtp.Packet{
+		Header: rtp.Header{
+			Version:     2,
+			PayloadType: 96,
+			SSRC:        0x12345678,
+		},
+		Payload: []byte{0x01},
+	}, true)
+	require.NoError(t, err)
+
+	time.Sleep(500 * time.Millisecond)
+
+	select {
+	case <-pli:
+		t.Errorf("keyframe requested before a reader is connected")
+	default:
+	}
+
+	nconn, err := net.Dial("tcp", "127.0.0.1:1935")
+	require.NoError(t, err)
+	defer nconn.Close()
+
+	reader := nrtmp.NewConn(&bufio.ReadWriter{
+		Reader: bufio.NewReader(nconn),
+		Writer: bufio.NewWriter(nconn),
+	})
+	reader.URL, err = url.Parse("rtmp://127.0.0.1:1935/teststream")
+	require.NoError(t, err)
+
+	err = reader.Prepare(nrtmp.StageGotPublishOrPlayCommand, nrtmp.PrepareReading)
+	require.NoError(t, err)
+
+	select {
+	case ssrc := <-pli:
+		require.Equal(t, uint32(0x12345678), ssrc)
+	case <-time.After(2 * time.Second):
+		t.Errorf("keyframe not requested")
+	}
+}
@@ -15,6 +15,7 @@ import (
 	"github.com/aler9/rtsp-simple-server/internal/conf"
 	"github.com/aler9/rtsp-simple-server/internal/logger"
 	"github.com/aler9/rtsp-simple-server/internal/rtmp"
+	"github.com/aler9/rtsp-simple-server/internal/rtpopus"
 )
 
 const (
@@ -28,11 +29,12 @@ type rtmpSourceParent interface {
 }
 
 type rtmpSource struct {
-	ur           string
-	readTimeout  conf.StringDuration
-	writeTimeout conf.StringDuration
-	wg           *sync.WaitGroup
-	parent       rtmpSourceParent
+	ur            string
+	readTimeout   conf.StringDuration
+	writeTimeout  conf.StringDuration
+	maxPacketSize conf.StringSize
+	wg            *sync.WaitGroup
+	parent        rtmpSourceParent
 
 	ctx       context.Context
 	ctxCancel func()
@@ -43,19 +45,21 @@ func newRTMPSource(
 	ur string,
 	readTimeout conf.StringDuration,
 	writeTimeout conf.StringDuration,
+	maxPacketSize conf.StringSize,
 	wg *sync.WaitGroup,
 	parent rtmpSourceParent,
 ) *rtmpSource {
 	ctx, ctxCancel := context.WithCancel(parentCtx)
 
 	s := &rtmpSource{
-		ur:           ur,
-		readTimeout:  readTimeout,
-		writeTimeout: writeTimeout,
-		wg:           wg,
-		parent:       parent,
-		ctx:          ctx,
-		ctxCancel:    ctxCancel,
+		ur:            ur,
+		readTimeout:   readTimeout,
+		writeTimeout:  writeTimeout,
+		maxPacketSize: maxPacketSize,
+		wg:            wg,
+		parent:        parent,
+		ctx:           ctx,
+		ctxCancel:     ctxCancel,
 	}
 
 	s.log(logger.Info, "started")
@@ -111,6 +115,7 @@ func (s *rtmpSource) runInner() bool {
 			if err != nil {
 				return err
 			}
+			conn.SetMaxMessageSize(uint32(s.maxPacketSize))
 
 			readDone := make(chan error)
 			go func() {
@@ -142,7 +147,9 @@ func (s *rtmpSource) runInner() bool {
 					}
 
 					var aacEncoder *rtpaac.Encoder
-					if audioTrack != nil {
+					var opusEncoder *rtpopus.Encoder
+					switch audioTrack.(type) {
+					case *gortsplib.TrackAAC:
 						aacEncoder = &rtpaac.Encoder{
 							PayloadType: 97,
 							SampleRate:  audioTrack.ClockRate(),
@@ -150,6 +157,15 @@ func (s *rtmpSource) runInner() bool {
 						aacEncoder.Init()
 						audioTrackID = len(tracks)
 						tracks = append(tracks, audioTrack)
+
+					case *gortsplib.TrackOpus:
+						opusEncoder = &rtpopus.Encoder{
+							PayloadType: 97,
+							SampleRate:  audioTrack.ClockRate(),
+						}
+						opusEncoder.Init()
+						audioTrackID = len(tracks)
+						tracks = append(tracks, audioTrack)
 					}
 
 					res := s.parent.onSourceStaticSetReady(pathSourceStaticSetReadyReq{
@@ -166,6 +182,9 @@ func (s *rtmpSource) runInner() bool {
 						s.parent.onSourceStaticSetNotReady(pathSourceStaticSetNotReadyReq{source: s})
 					}()
 
+					var timestampUnwrapper rtmpTimestampUnwrapper
+					amfDataLimiter := newRTMPAMFDataLimiter()
+
 					for {
 						conn.SetReadDeadline(time.Now().Add(time.Duration(s.readTimeout)))
 						pkt, err := conn.ReadPacket()
@@ -173,6 +192,8 @@ func (s *rtmpSource) runInner() bool {
 							return err
 						}
 
+						pkt.Time = timestampUnwrapper.unwrap(pkt.Time)
+
 						switch pkt.Type {
 						case av.H264:
 							if videoTrack == nil {
@@ -184,9 +205,10 @@ func (s *rtmpSource) runInner() bool {
 								return err
 							}
 
-							pts := pkt.Time + pkt.CTime
+							dts := pkt.Time
+							pts := dts + pkt.CTime
 
-							pkts, err := h264Encoder.Encode(nalus, pts)
+							pkts, err := h264Encoder.Encode(nalus, pts+rtmpConnRTPPTSOffset)
 							if err != nil {
 								return fmt.Errorf("error while encoding H264: %v", err)
 							}
@@ -206,12 +228,13 @@ func (s *rtmpSource) runInner() bool {
 										ptsEqualsDTS: h264.IDRPresent(nalus),
 										h264NALUs:    nalus,
 										h264PTS:      pts,
+										h264DTS:      &dts,
 									})
 								}
 							}
 
 						case av.AAC:
-							if audioTrack == nil {
+							if aacEncoder == nil {
 								return fmt.Errorf("received an AAC packet, but track is not set up")
 							}
 
@@ -227,6 +250,31 @@ func (s *rtmpSource) runInner() bool {
 									ptsEqualsDTS: true,
 								})
 							}
+
+						case av.OPUS:
+							if opusEncoder == nil {
+								return fmt.Errorf("received an Opus packet, but track is not set up")
+							}
+
+							pkt, err := opusEncoder.Encode(pkt.Data, pkt.Time)
+							if err != nil {
+								return fmt.Errorf("error while encoding Opus: %v", err)
+							}
+
+							res.stream.writeData(&data{
+								trackID:      audioTrackID,
+								rtp:          pkt,
+								ptsEqualsDTS: true,
+							})
+
+						case rtmp.PacketData:
+							if !amfDataLimiter.take(len(pkt.Data), time.Now()) {
+								continue
+							}
+
+							res.stream.writeAMFData(&data{
+								amfData: pkt.Data,
+							})
 						}
 					}
 				}()
@@ -0,0 +1,88 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	rtmpStateWebhookQueueSize = 64
+	rtmpStateWebhookTimeout   = 10 * time.Second
+)
+
+type rtmpStateWebhookEvent struct {
+	ID         string `json:"id"`
+	RemoteAddr string `json:"remoteAddr"`
+	Path       string `json:"path"`
+	OldState   string `json:"oldState"`
+	NewState   string `json:"newState"`
+}
+
+// rtmpStateWebhook sends the state changes of RTMP connections to an external URL.
+// Events are sent in order by a dedicated routine; when the URL doesn't keep up
+// and the queue is full, they are discarded, in order not to stall connections.
+type rtmpStateWebhook struct {
+	ur     string
+	client *http.Client
+	queue  chan rtmpStateWebhookEvent
+}
+
+func newRTMPStateWebhook(ur string) *rtmpStateWebhook {
+	return &rtmpStateWebhook{
+		ur:     ur,
+		client: &http.Client{Timeout: rtmpStateWebhookTimeout},
+		queue:  make(chan rtmpStateWebhookEvent, rtmpStateWebhookQueueSize),
+	}
+}
+
+// push enqueues an event without blocking. It returns false if the queue is full.
+func (w *rtmpStateWebhook) push(ev rtmpStateWebhookEvent) bool {
+	select {
+	case w.queue <- ev:
+		return true
+	default:
+		return false
+	}
+}
+
+// run sends the enqueued events until the context is canceled.
+func (w *rtmpStateWebhook) run(ctx context.Context, onError func(error)) {
+	for {
+		select {
+		case ev := <-w.queue:
+			err := w.send(ctx, ev)
+			if err != nil {
+				onError(err)
+			}
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (w *rtmpStateWebhook) send(ctx context.Context, ev rtmpStateWebhookEvent) error {
+	enc, _ := json.Marshal(ev)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.ur, bytes.NewReader(enc))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("bad status code: %d", res.StatusCode)
+	}
+
+	return nil
+}
@@ -0,0 +1,64 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRTMPStateWebhook(t *testing.T) {
+	received := make(chan []byte)
+	unblock := make(chan struct{})
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		byts, _ := ioutil.ReadAll(r.Body)
+		received <- byts
+		<-unblock
+	}))
+	defer srv.Close()
+	defer close(unblock)
+
+	w := newRTMPStateWebhook(srv.URL)
+
+	ctx, ctxCancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w.run(ctx, func(error) {})
+	}()
+	defer func() {
+		ctxCancel()
+		<-done
+	}()
+
+	ev := rtmpStateWebhookEvent{
+		ID:         "123456789",
+		RemoteAddr: "127.0.0.1:5000",
+		Path:       "teststream",
+		OldState:   "idle",
+		NewState:   "publish",
+	}
+	require.Equal(t, true, w.push(ev))
+
+	select {
+	case byts := <-received:
+		var got rtmpStateWebhookEvent
+		err := json.Unmarshal(byts, &got)
+		require.NoError(t, err)
+		require.Equal(t, ev, got)
+	case <-time.After(2 * time.Second):
+		t.Fatal("event not received")
+	}
+
+	// the URL is stuck: events are discarded when the queue is full
+	for i := 0; i < rtmpStateWebhookQueueSize; i++ {
+		require.Equal(t, true, w.push(ev))
+	}
+	require.Equal(t, false, w.push(ev))
+}
@@ -0,0 +1,46 @@
+package core
+
+import (
+	"time"
+)
+
+// rtmpTimestampUnwrapper converts the timestamps of RTMP packets, that are
+// 32-bit values in milliseconds and wrap around after about 49.7 days,
+// into monotonic 64-bit timestamps.
+//
+// A timestamp that is lower than the previous one by more than half the range
+// is considered a wraparound. A timestamp that is greater than the previous one
+// by more than half the range is considered a packet that was sent
+// before the last wraparound, like an audio packet that is slightly late
+// with respect to video.
+type rtmpTimestampUnwrapper struct {
+	initialized bool
+	prev        uint32
+	overflows   int64
+}
+
+// unwrap converts the timestamp of a packet, that is decoded by the underlying
+// library as a duration that can't exceed 32 bits of milliseconds.
+func (u *rtmpTimestampUnwrapper) unwrap(t time.Duration) time.Duration {
+	ts := uint32(t / time.Millisecond)
+	overflows := u.overflows
+
+	switch {
+	case !u.initialized:
+		u.initialized = true
+		u.prev = ts
+
+	case ts < u.prev && u.prev-ts > 1<<31:
+		u.overflows++
+		overflows = u.overflows
+		u.prev = ts
+
+	case ts > u.prev && ts-u.prev > 1<<31:
+		overflows--
+
+	case ts > u.prev:
+		u.prev = ts
+	}
+
+	return time.Duration(overflows<<32+int64(ts))*time.Millisecond + t%time.Millisecond
+}
@@ -0,0 +1,46 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRTMPTimestampUnwrapper(t *testing.T) {
+	var u rtmpTimestampUnwrapper
+
+	ms := func(v int64) time.Duration {
+		return time.Duration(v) * time.Millisecond
+	}
+
+	const wrap = int64(1) << 32
+
+	for _, ca := range []struct {
+		in  int64
+		out int64
+	}{
+		{wrap - 2000, wrap - 2000},
+		{wrap - 1000, wrap - 1000},
+		// wraparound
+		{500, wrap + 500},
+		// late packet, sent before the wraparound
+		{wrap - 100, wrap - 100},
+		{1500, wrap + 1500},
+		// small reorderings are preserved
+		{1400, wrap + 1400},
+		{2500, wrap + 2500},
+	} {
+		require.Equal(t, ms(ca.out), u.unwrap(ms(ca.in)))
+	}
+
+	// timestamps are continuous across multiple wraparounds
+	var u2 rtmpTimestampUnwrapper
+	prev := time.Duration(-1)
+	for v := int64(0); v < 3*wrap; v += wrap / 10 {
+		out := u2.unwrap(ms(v % wrap))
+		require.Equal(t, ms(v), out)
+		require.Greater(t, out, prev)
+		prev = out
+	}
+}
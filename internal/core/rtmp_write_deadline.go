@@ -0,0 +1,55 @@
+package core
+
+import (
+	"time"
+)
+
+// rtmpWriteDeadline computes the write timeout of a RTMP reader,
+// adapting it to the speed of the link.
+//
+// The timeout starts from the maximum. When a write takes more than half
+// of the current timeout, the link is considered degraded and the timeout
+// is halved, in order to detect a dead reader sooner. When a write takes
+// less than a tenth of the current timeout, the timeout is increased
+// by a tenth of the maximum, in order to relax it slowly when the link recovers.
+// The timeout is always between the minimum and the maximum.
+type rtmpWriteDeadline struct {
+	min     time.Duration
+	max     time.Duration
+	current time.Duration
+}
+
+func newRTMPWriteDeadline(min time.Duration, max time.Duration) *rtmpWriteDeadline {
+	// the timeout is fixed
+	if min == 0 || min > max {
+		min = max
+	}
+
+	return &rtmpWriteDeadline{
+		min:     min,
+		max:     max,
+		current: max,
+	}
+}
+
+// timeout returns the timeout of the next write.
+func (d *rtmpWriteDeadline) timeout() time.Duration {
+	return d.current
+}
+
+// onWrite updates the timeout with the duration of a successful write.
+func (d *rtmpWriteDeadline) onWrite(elapsed time.Duration) {
+	switch {
+	case elapsed > d.current/2:
+		d.current /= 2
+		if d.current < d.min {
+			d.current = d.min
+		}
+
+	case elapsed < d.current/10:
+		d.current += d.max / 10
+		if d.current > d.max {
+			d.current = d.max
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRTMPWriteDeadline(t *testing.T) {
+	d := newRTMPWriteDeadline(2*time.Second, 10*time.Second)
+	require.Equal(t, 10*time.Second, d.timeout())
+
+	// near timeouts shrink the timeout, down to the minimum
+	d.onWrite(6 * time.Second)
+	require.Equal(t, 5*time.Second, d.timeout())
+	d.onWrite(3 * time.Second)
+	require.Equal(t, 2500*time.Millisecond, d.timeout())
+	d.onWrite(2 * time.Second)
+	require.Equal(t, 2*time.Second, d.timeout())
+
+	// writes that are neither slow nor fast don't change the timeout
+	d.onWrite(500 * time.Millisecond)
+	require.Equal(t, 2*time.Second, d.timeout())
+
+	// fast writes relax the timeout, up to the maximum
+	d.onWrite(10 * time.Millisecond)
+	require.Equal(t, 3*time.Second, d.timeout())
+	for i := 0; i < 20; i++ {
+		d.onWrite(10 * time.Millisecond)
+	}
+	require.Equal(t, 10*time.Second, d.timeout())
+}
+
+func TestRTMPWriteDeadlineFixed(t *testing.T) {
+	d := newRTMPWriteDeadline(0, 10*time.Second)
+	d.onWrite(9 * time.Second)
+	require.Equal(t, 10*time.Second, d.timeout())
+}
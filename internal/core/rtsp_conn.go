@@ -31,6 +31,7 @@ type rtspConn struct {
 	readTimeout               conf.StringDuration
 	runOnConnect              string
 	runOnConnectRestart       bool
+	runOnConnectCleanEnv      bool
 	externalCmdPool           *externalcmd.Pool
 	pathManager               *pathManager
 	conn                      *gortsplib.ServerConn
@@ -50,6 +51,7 @@ func newRTSPConn(
 	readTimeout conf.StringDuration,
 	runOnConnect string,
 	runOnConnectRestart bool,
+	runOnConnectCleanEnv bool,
 	externalCmdPool *externalcmd.Pool,
 	pathManager *pathManager,
 	conn *gortsplib.ServerConn,
@@ -62,6 +64,7 @@ func newRTSPConn(
 		readTimeout:               readTimeout,
 		runOnConnect:              runOnConnect,
 		runOnConnectRestart:       runOnConnectRestart,
+		runOnConnectCleanEnv:      runOnConnectCleanEnv,
 		externalCmdPool:           externalCmdPool,
 		pathManager:               pathManager,
 		conn:                      conn,
@@ -77,6 +80,7 @@ func newRTSPConn(
 			c.externalCmdPool,
 			c.runOnConnect,
 			c.runOnConnectRestart,
+			c.runOnConnectCleanEnv,
 			externalcmd.Environment{
 				"RTSP_PATH": "",
 				"RTSP_PORT": port,
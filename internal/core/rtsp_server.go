@@ -58,6 +58,7 @@ type rtspServer struct {
 	protocols                 map[conf.Protocol]struct{}
 	runOnConnect              string
 	runOnConnectRestart       bool
+	runOnConnectCleanEnv      bool
 	externalCmdPool           *externalcmd.Pool
 	metrics                   *metrics
 	pathManager               *pathManager
@@ -94,6 +95,7 @@ func newRTSPServer(
 	protocols map[conf.Protocol]struct{},
 	runOnConnect string,
 	runOnConnectRestart bool,
+	runOnConnectCleanEnv bool,
 	externalCmdPool *externalcmd.Pool,
 	metrics *metrics,
 	pathManager *pathManager,
@@ -108,6 +110,9 @@ func newRTSPServer(
 		isTLS:                     isTLS,
 		rtspAddress:               rtspAddress,
 		protocols:                 protocols,
+		runOnConnect:              runOnConnect,
+		runOnConnectRestart:       runOnConnectRestart,
+		runOnConnectCleanEnv:      runOnConnectCleanEnv,
 		externalCmdPool:           externalCmdPool,
 		metrics:                   metrics,
 		pathManager:               pathManager,
@@ -264,6 +269,7 @@ func (s *rtspServer) OnConnOpen(ctx *gortsplib.ServerHandlerOnConnOpenCtx) {
 		s.readTimeout,
 		s.runOnConnect,
 		s.runOnConnectRestart,
+		s.runOnConnectCleanEnv,
 		s.externalCmdPool,
 		s.pathManager,
 		ctx.Conn,
@@ -38,12 +38,13 @@ type rtspSession struct {
 	pathManager     rtspSessionPathManager
 	parent          rtspSessionParent
 
-	path            *path
-	state           gortsplib.ServerSessionState
-	stateMutex      sync.Mutex
-	onReadCmd       *externalcmd.Cmd // read
-	announcedTracks gortsplib.Tracks // publish
-	stream          *stream          // publish
+	path              *path
+	state             gortsplib.ServerSessionState
+	stateMutex        sync.Mutex
+	onReadCmd         *externalcmd.Cmd       // read
+	announcedTracks   gortsplib.Tracks       // publish
+	keyFrameRequester *rtcpKeyFrameRequester // publish
+	stream            *stream                // publish
 }
 
 func newRTSPSession(
@@ -158,6 +159,7 @@ func (s *rtspSession) onAnnounce(c *rtspConn, ctx *gortsplib.ServerHandlerOnAnno
 
 	s.path = res.path
 	s.announcedTracks = ctx.Tracks
+	s.keyFrameRequester = newRTCPKeyFrameRequester(ctx.Tracks, s.ss.WritePacketRTCP)
 
 	s.stateMutex.Lock()
 	s.state = gortsplib.ServerSessionStatePreRecord
@@ -257,6 +259,7 @@ func (s *rtspSession) onPlay(ctx *gortsplib.ServerHandlerOnPlayCtx) (*base.Respo
 				s.externalCmdPool,
 				s.path.Conf().RunOnRead,
 				s.path.Conf().RunOnReadRestart,
+				s.path.Conf().RunOnReadCleanEnv,
 				s.path.externalCmdEnv(),
 				func(co int) {
 					s.log(logger.Info, "runOnRead command exited with code %d", co)
@@ -361,6 +364,11 @@ func (s *rtspSession) onReaderAPIDescribe() interface{} {
 	}{typ, s.id}
 }
 
+// onSourceRequestKeyFrame implements sourceKeyFrameRequester.
+func (s *rtspSession) onSourceRequestKeyFrame() {
+	s.keyFrameRequester.request()
+}
+
 // onSourceAPIDescribe implements source.
 func (s *rtspSession) onSourceAPIDescribe() interface{} {
 	var typ string
@@ -392,6 +400,8 @@ func (s *rtspSession) onPublisherAccepted(tracksLen int) {
 
 // onPacketRTP is called by rtspServer.
 func (s *rtspSession) onPacketRTP(ctx *gortsplib.ServerHandlerOnPacketRTPCtx) {
+	s.keyFrameRequester.onPacketRTP(ctx.TrackID, ctx.Packet)
+
 	if ctx.H264NALUs != nil {
 		s.stream.writeData(&data{
 			trackID:      ctx.TrackID,
@@ -12,6 +12,7 @@ import (
 
 	"github.com/aler9/gortsplib"
 	"github.com/aler9/gortsplib/pkg/base"
+	"github.com/pion/rtcp"
 
 	"github.com/aler9/rtsp-simple-server/internal/conf"
 	"github.com/aler9/rtsp-simple-server/internal/logger"
@@ -40,6 +41,9 @@ type rtspSource struct {
 
 	ctx       context.Context
 	ctxCancel func()
+
+	keyFrameRequesterMutex sync.Mutex
+	keyFrameRequester      *rtcpKeyFrameRequester
 }
 
 func newRTSPSource(
@@ -189,11 +193,24 @@ func (s *rtspSource) runInner() bool {
 
 			s.log(logger.Info, "ready")
 
+			keyFrameRequester := newRTCPKeyFrameRequester(c.Tracks(), func(trackID int, pkt rtcp.Packet) {
+				c.WritePacketRTCP(trackID, pkt)
+			})
+			s.keyFrameRequesterMutex.Lock()
+			s.keyFrameRequester = keyFrameRequester
+			s.keyFrameRequesterMutex.Unlock()
+
 			defer func() {
+				s.keyFrameRequesterMutex.Lock()
+				s.keyFrameRequester = nil
+				s.keyFrameRequesterMutex.Unlock()
+
 				s.parent.onSourceStaticSetNotReady(pathSourceStaticSetNotReadyReq{source: s})
 			}()
 
 			c.OnPacketRTP = func(ctx *gortsplib.ClientOnPacketRTPCtx) {
+				keyFrameRequester.onPacketRTP(ctx.TrackID, ctx.Packet)
+
 				if ctx.H264NALUs != nil {
 					res.stream.writeData(&data{
 						trackID:      ctx.TrackID,
@@ -232,6 +249,16 @@ func (s *rtspSource) runInner() bool {
 	}
 }
 
+// onSourceRequestKeyFrame implements sourceKeyFrameRequester.
+func (s *rtspSource) onSourceRequestKeyFrame() {
+	s.keyFrameRequesterMutex.Lock()
+	defer s.keyFrameRequesterMutex.Unlock()
+
+	if s.keyFrameRequester != nil {
+		s.keyFrameRequester.request()
+	}
+}
+
 // onSourceAPIDescribe implements source.
 func (*rtspSource) onSourceAPIDescribe() interface{} {
 	return struct {
@@ -5,6 +5,13 @@ type source interface {
 	onSourceAPIDescribe() interface{}
 }
 
+// sourceKeyFrameRequester is a source that is able to ask the publisher
+// to send a keyframe.
+type sourceKeyFrameRequester interface {
+	source
+	onSourceRequestKeyFrame()
+}
+
 // sourceStatic is an entity that can provide a static stream.
 type sourceStatic interface {
 	source
@@ -3,11 +3,20 @@ package core
 import (
 	"bytes"
 	"sync"
+	"time"
 
 	"github.com/aler9/gortsplib"
 	"github.com/aler9/gortsplib/pkg/h264"
 )
 
+// streamReplayReader is implemented by readers whose onReaderData() can close
+// the reader when its buffer is full. Data of the GOP cache is sent to them
+// through onReaderReplayData(), that drops the oldest data instead, since
+// the whole cache is sent at once.
+type streamReplayReader interface {
+	onReaderReplayData(*data)
+}
+
 type streamNonRTSPReadersMap struct {
 	mutex sync.RWMutex
 	ma    map[reader]struct{}
@@ -49,13 +58,31 @@ func (m *streamNonRTSPReadersMap) forwardPacketRTP(data *data) {
 type stream struct {
 	nonRTSPReaders *streamNonRTSPReadersMap
 	rtspStream     *gortsplib.ServerStream
+
+	// data received since the last H264 IDR, that is sent to
+	// non-RTSP readers when they're added, in order to allow them
+	// to start from a keyframe without waiting for the next one.
+	gopCacheSize    int
+	gopCacheTrackID int
+	gopCacheMutex   sync.Mutex
+	gopCache        []*data
 }
 
-func newStream(tracks gortsplib.Tracks) *stream {
+func newStream(tracks gortsplib.Tracks, gopCacheSize int) *stream {
 	s := &stream{
-		nonRTSPReaders: newStreamNonRTSPReadersMap(),
-		rtspStream:     gortsplib.NewServerStream(tracks),
+		nonRTSPReaders:  newStreamNonRTSPReadersMap(),
+		rtspStream:      gortsplib.NewServerStream(tracks),
+		gopCacheTrackID: -1,
+	}
+
+	for i, track := range tracks {
+		if _, ok := track.(*gortsplib.TrackH264); ok {
+			s.gopCacheSize = gopCacheSize
+			s.gopCacheTrackID = i
+			break
+		}
 	}
+
 	return s
 }
 
@@ -70,6 +97,26 @@ func (s *stream) tracks() gortsplib.Tracks {
 
 func (s *stream) readerAdd(r reader) {
 	if _, ok := r.(pathRTSPSession); !ok {
+		if s.gopCacheSize != 0 {
+			s.gopCacheMutex.Lock()
+			defer s.gopCacheMutex.Unlock()
+
+			rr, canReplay := r.(streamReplayReader)
+
+			for _, data := range s.gopCache {
+				// cached data is marked, in order to prevent readers from
+				// discarding it because it's old.
+				replayed := *data
+				replayed.replayed = true
+
+				if canReplay {
+					rr.onReaderReplayData(&replayed)
+				} else {
+					r.onReaderData(&replayed)
+				}
+			}
+		}
+
 		s.nonRTSPReaders.add(r)
 	}
 }
@@ -127,6 +174,8 @@ func (s *stream) remuxH264NALUs(h264track *gortsplib.TrackH264, data *data) {
 }
 
 func (s *stream) writeData(data *data) {
+	data.received = time.Now()
+
 	track := s.rtspStream.Tracks()[data.trackID]
 	if h264track, ok := track.(*gortsplib.TrackH264); ok {
 		s.updateH264TrackParameters(h264track, data.h264NALUs)
@@ -137,5 +186,38 @@ func (s *stream) writeData(data *data) {
 	s.rtspStream.WritePacketRTP(data.trackID, data.rtp, data.ptsEqualsDTS)
 
 	// forward to non-RTSP readers
+	if s.gopCacheSize != 0 {
+		s.gopCacheMutex.Lock()
+		defer s.gopCacheMutex.Unlock()
+		s.updateGOPCache(data)
+	}
 	s.nonRTSPReaders.forwardPacketRTP(data)
 }
+
+// writeAMFData forwards an AMF data message to non-RTSP readers.
+// The message is not stored into the GOP cache, since it's not needed
+// to decode frames.
+func (s *stream) writeAMFData(data *data) {
+	data.trackID = -1
+	data.received = time.Now()
+	s.nonRTSPReaders.forwardPacketRTP(data)
+}
+
+func (s *stream) updateGOPCache(data *data) {
+	switch {
+	case data.trackID == s.gopCacheTrackID && h264.IDRPresent(data.h264NALUs):
+		s.gopCache = nil
+
+	case s.gopCache == nil:
+		// the cache is empty until an IDR is received
+		return
+
+	case len(s.gopCache) >= s.gopCacheSize:
+		// the GOP is too long: discard it, since a partial GOP
+		// without its IDR can't be decoded.
+		s.gopCache = nil
+		return
+	}
+
+	s.gopCache = append(s.gopCache, data)
+}
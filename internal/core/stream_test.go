@@ -0,0 +1,108 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/aler9/gortsplib"
+	"github.com/pion/rtp"
+	"github.com/stretchr/testify/require"
+)
+
+type testStreamReader struct {
+	received []*data
+}
+
+func (r *testStreamReader) close() {}
+
+func (r *testStreamReader) onReaderAccepted() {}
+
+func (r *testStreamReader) onReaderData(data *data) {
+	r.received = append(r.received, data)
+}
+
+func (r *testStreamReader) onReaderAPIDescribe() interface{} {
+	return nil
+}
+
+type testStreamReplayReader struct {
+	testStreamReader
+	replayed []*data
+}
+
+func (r *testStreamReplayReader) onReaderReplayData(data *data) {
+	r.replayed = append(r.replayed, data)
+}
+
+func TestStreamGOPCache(t *testing.T) {
+	videoTrack, err := gortsplib.NewTrackH264(96,
+		[]byte{
+			0x67, 0x64, 0x00, 0x0c, 0xac, 0x3b, 0x50, 0xb0,
+			0x4b, 0x42, 0x00, 0x00, 0x03, 0x00, 0x02, 0x00,
+			0x00, 0x03, 0x00, 0x3d, 0x08,
+		},
+		[]byte{
+			0x68, 0xee, 0x3c, 0x80,
+		},
+		nil)
+	require.NoError(t, err)
+
+	audioTrack, err := gortsplib.NewTrackAAC(97, 2, 44100, 2, nil)
+	require.NoError(t, err)
+
+	s := newStream(gortsplib.Tracks{videoTrack, audioTrack}, 4)
+	defer s.close()
+
+	newVideo := func(nalu []byte) *data {
+		return &data{
+			trackID:   0,
+			rtp:       &rtp.Packet{Header: rtp.Header{Version: 2, PayloadType: 96}},
+			h264NALUs: [][]byte{nalu},
+		}
+	}
+	newAudio := func() *data {
+		return &data{
+			trackID: 1,
+			rtp:     &rtp.Packet{Header: rtp.Header{Version: 2, PayloadType: 97}},
+		}
+	}
+
+	// data preceding the first IDR is not cached
+	s.writeData(newVideo([]byte{0x41, 0x01}))
+	s.writeData(newAudio())
+
+	idr := newVideo([]byte{0x65, 0x01})
+	s.writeData(idr)
+	audio := newAudio()
+	s.writeData(audio)
+	nonIDR := newVideo([]byte{0x41, 0x02})
+	s.writeData(nonIDR)
+
+	// cached data is sent as a copy, marked as replayed
+	replayed := func(d *data) *data {
+		c := *d
+		c.replayed = true
+		return &c
+	}
+
+	r := &testStreamReader{}
+	s.readerAdd(r)
+	require.Equal(t, []*data{replayed(idr), replayed(audio), replayed(nonIDR)}, r.received)
+	require.Equal(t, false, idr.replayed)
+
+	// data received after the reader has been added is forwarded once
+	audio2 := newAudio()
+	s.writeData(audio2)
+	require.Equal(t, []*data{replayed(idr), replayed(audio), replayed(nonIDR), audio2}, r.received)
+
+	// readers that can block receive cached data through a dedicated method
+	rr := &testStreamReplayReader{}
+	s.readerAdd(rr)
+	require.Equal(t, []*data{replayed(idr), replayed(audio), replayed(nonIDR), replayed(audio2)}, rr.replayed)
+	require.Equal(t, []*data(nil), rr.received)
+
+	// a GOP longer than the cache size is discarded
+	s.writeData(newVideo([]byte{0x41, 0x03}))
+	r2 := &testStreamReader{}
+	s.readerAdd(r2)
+	require.Equal(t, []*data(nil), r2.received)
+}
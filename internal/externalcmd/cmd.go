@@ -1,6 +1,7 @@
 package externalcmd
 
 import (
+	"os"
 	"strings"
 	"time"
 )
@@ -14,21 +15,25 @@ type Environment map[string]string
 
 // Cmd is an external command.
 type Cmd struct {
-	pool    *Pool
-	cmdstr  string
-	restart bool
-	env     Environment
-	onExit  func(int)
+	pool     *Pool
+	cmdstr   string
+	restart  bool
+	cleanEnv bool
+	env      Environment
+	onExit   func(int)
 
 	// in
 	terminate chan struct{}
 }
 
 // NewCmd allocates a Cmd.
+// When cleanEnv is true, the command doesn't inherit the environment
+// of the server, except for a minimal set of variables.
 func NewCmd(
 	pool *Pool,
 	cmdstr string,
 	restart bool,
+	cleanEnv bool,
 	env Environment,
 	onExit func(int),
 ) *Cmd {
@@ -40,6 +45,7 @@ func NewCmd(
 		pool:      pool,
 		cmdstr:    cmdstr,
 		restart:   restart,
+		cleanEnv:  cleanEnv,
 		env:       env,
 		onExit:    onExit,
 		terminate: make(chan struct{}),
@@ -52,6 +58,27 @@ func NewCmd(
 	return e
 }
 
+// environ returns the environment of the command.
+func (e *Cmd) environ() []string {
+	var ret []string
+
+	if e.cleanEnv {
+		for _, key := range safeEnvironment {
+			if val, ok := os.LookupEnv(key); ok {
+				ret = append(ret, key+"="+val)
+			}
+		}
+	} else {
+		ret = append(ret, os.Environ()...)
+	}
+
+	for key, val := range e.env {
+		ret = append(ret, key+"="+val)
+	}
+
+	return ret
+}
+
 // Close closes the command. It doesn't wait for the command to exit.
 func (e *Cmd) Close() {
 	close(e.terminate)
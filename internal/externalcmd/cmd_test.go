@@ -0,0 +1,37 @@
+package externalcmd
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCmdEnviron(t *testing.T) {
+	os.Setenv("EXTERNALCMD_TEST_SECRET", "secret")
+	defer os.Unsetenv("EXTERNALCMD_TEST_SECRET")
+
+	for _, ca := range []string{
+		"inherited",
+		"clean",
+	} {
+		t.Run(ca, func(t *testing.T) {
+			e := &Cmd{
+				cleanEnv: (ca == "clean"),
+				env: Environment{
+					"RTSP_PATH": "mypath",
+				},
+			}
+
+			env := e.environ()
+			require.Contains(t, env, "RTSP_PATH=mypath")
+			require.Contains(t, env, "PATH="+os.Getenv("PATH"))
+
+			if ca == "clean" {
+				require.NotContains(t, env, "EXTERNALCMD_TEST_SECRET=secret")
+			} else {
+				require.Contains(t, env, "EXTERNALCMD_TEST_SECRET=secret")
+			}
+		})
+	}
+}
@@ -11,6 +11,16 @@ import (
 	"github.com/kballard/go-shellquote"
 )
 
+// variables that are passed to commands that don't inherit the environment.
+var safeEnvironment = []string{
+	"PATH",
+	"HOME",
+	"USER",
+	"LANG",
+	"TZ",
+	"TMPDIR",
+}
+
 func (e *Cmd) runInner() (int, bool) {
 	cmdparts, err := shellquote.Split(e.cmdstr)
 	if err != nil {
@@ -19,10 +29,7 @@ func (e *Cmd) runInner() (int, bool) {
 
 	cmd := exec.Command(cmdparts[0], cmdparts[1:]...)
 
-	cmd.Env = append([]string(nil), os.Environ()...)
-	for key, val := range e.env {
-		cmd.Env = append(cmd.Env, key+"="+val)
-	}
+	cmd.Env = e.environ()
 
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
@@ -10,6 +10,17 @@ import (
 	"github.com/kballard/go-shellquote"
 )
 
+// variables that are passed to commands that don't inherit the environment.
+var safeEnvironment = []string{
+	"PATH",
+	"PATHEXT",
+	"SYSTEMROOT",
+	"WINDIR",
+	"COMSPEC",
+	"TEMP",
+	"TMP",
+}
+
 func (e *Cmd) runInner() (int, bool) {
 	cmdparts, err := shellquote.Split(e.cmdstr)
 	if err != nil {
@@ -18,10 +29,7 @@ func (e *Cmd) runInner() (int, bool) {
 
 	cmd := exec.Command(cmdparts[0], cmdparts[1:]...)
 
-	cmd.Env = append([]string(nil), os.Environ()...)
-	for key, val := range e.env {
-		cmd.Env = append(cmd.Env, key+"="+val)
-	}
+	cmd.Env = e.environ()
 
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
@@ -2,6 +2,7 @@ package logger
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
@@ -16,7 +17,8 @@ type Level int
 
 // Log levels.
 const (
-	Debug Level = iota + 1
+	Trace Level = iota + 1
+	Debug
 	Info
 	Warn
 	Error
@@ -36,9 +38,25 @@ const (
 	DestinationSyslog
 )
 
+// Format is a log format.
+type Format int
+
+const (
+	// FormatText writes logs in human-readable format.
+	FormatText Format = iota
+
+	// FormatJSON writes logs as JSON objects, one per line.
+	FormatJSON
+)
+
+// Fields are additional fields of a log entry.
+// They're written only when the format is FormatJSON.
+type Fields map[string]interface{}
+
 // Logger is a log handler.
 type Logger struct {
 	level        Level
+	format       Format
 	destinations map[Destination]struct{}
 
 	mutex        sync.Mutex
@@ -50,9 +68,10 @@ type Logger struct {
 }
 
 // New allocates a log handler.
-func New(level Level, destinations map[Destination]struct{}, filePath string) (*Logger, error) {
+func New(level Level, format Format, destinations map[Destination]struct{}, filePath string) (*Logger, error) {
 	lh := &Logger{
 		level:        level,
+		format:       format,
 		destinations: destinations,
 	}
 
@@ -136,6 +155,13 @@ func writeTime(buf *bytes.Buffer, doColor bool) {
 
 func writeLevel(buf *bytes.Buffer, level Level, doColor bool) {
 	switch level {
+	case Trace:
+		if doColor {
+			buf.WriteString(color.RenderString(color.Gray.Code(), "TRA"))
+		} else {
+			buf.WriteString("TRA")
+		}
+
 	case Debug:
 		if doColor {
 			buf.WriteString(color.RenderString(color.Debug.Code(), "DEB"))
@@ -172,8 +198,59 @@ func writeContent(buf *bytes.Buffer, format string, args []interface{}) {
 	buf.WriteByte('\n')
 }
 
+func levelString(level Level) string {
+	switch level {
+	case Trace:
+		return "trace"
+
+	case Debug:
+		return "debug"
+
+	case Info:
+		return "info"
+
+	case Warn:
+		return "warn"
+	}
+	return "error"
+}
+
+func writeJSON(buf *bytes.Buffer, level Level, fields Fields, format string, args []interface{}) {
+	entry := make(map[string]interface{}, len(fields)+3)
+	for k, v := range fields {
+		entry[k] = v
+	}
+	entry["time"] = time.Now().Format(time.RFC3339)
+	entry["level"] = levelString(level)
+	entry["msg"] = fmt.Sprintf(format, args...)
+
+	byts, _ := json.Marshal(entry)
+	buf.Write(byts)
+	buf.WriteByte('\n')
+}
+
+func (lh *Logger) writeEntry(buf *bytes.Buffer, doColor bool,
+	level Level, fields Fields, format string, args []interface{},
+) {
+	buf.Reset()
+
+	if lh.format == FormatJSON {
+		writeJSON(buf, level, fields, format, args)
+		return
+	}
+
+	writeTime(buf, doColor)
+	writeLevel(buf, level, doColor)
+	writeContent(buf, format, args)
+}
+
 // Log writes a log entry.
 func (lh *Logger) Log(level Level, format string, args ...interface{}) {
+	lh.LogFields(level, nil, format, args...)
+}
+
+// LogFields writes a log entry with additional fields.
+func (lh *Logger) LogFields(level Level, fields Fields, format string, args ...interface{}) {
 	if level < lh.level {
 		return
 	}
@@ -182,26 +259,17 @@ func (lh *Logger) Log(level Level, format string, args ...interface{}) {
 	defer lh.mutex.Unlock()
 
 	if _, ok := lh.destinations[DestinationStdout]; ok {
-		lh.stdoutBuffer.Reset()
-		writeTime(&lh.stdoutBuffer, true)
-		writeLevel(&lh.stdoutBuffer, level, true)
-		writeContent(&lh.stdoutBuffer, format, args)
+		lh.writeEntry(&lh.stdoutBuffer, true, level, fields, format, args)
 		print(lh.stdoutBuffer.String())
 	}
 
 	if _, ok := lh.destinations[DestinationFile]; ok {
-		lh.fileBuffer.Reset()
-		writeTime(&lh.fileBuffer, false)
-		writeLevel(&lh.fileBuffer, level, false)
-		writeContent(&lh.fileBuffer, format, args)
+		lh.writeEntry(&lh.fileBuffer, false, level, fields, format, args)
 		lh.file.Write(lh.fileBuffer.Bytes())
 	}
 
 	if _, ok := lh.destinations[DestinationSyslog]; ok {
-		lh.syslogBuffer.Reset()
-		writeTime(&lh.syslogBuffer, false)
-		writeLevel(&lh.syslogBuffer, level, false)
-		writeContent(&lh.syslogBuffer, format, args)
+		lh.writeEntry(&lh.syslogBuffer, false, level, fields, format, args)
 		lh.syslog.Write(lh.syslogBuffer.Bytes())
 	}
 }
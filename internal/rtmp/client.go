@@ -25,14 +25,18 @@ func DialContext(ctx context.Context, address string) (*Conn, error) {
 		return nil, err
 	}
 
+	lc := &sizeLimitConn{Conn: nconn}
+
 	rconn := rtmp.NewConn(&bufio.ReadWriter{
-		Reader: bufio.NewReaderSize(nconn, readBufferSize),
+		Reader: bufio.NewReaderSize(lc, readBufferSize),
 		Writer: bufio.NewWriterSize(nconn, writeBufferSize),
 	})
 	rconn.URL = u
 
 	return &Conn{
-		rconn: rconn,
-		nconn: nconn,
+		rconn:         rconn,
+		nconn:         nconn,
+		lc:            lc,
+		ackWindowSize: defaultAckWindowSize,
 	}, nil
 }
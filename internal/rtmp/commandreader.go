@@ -0,0 +1,505 @@
+package rtmp
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+
+	"github.com/notedit/rtmp/format/flv/flvio"
+)
+
+const (
+	// C0 + C1 + C2
+	handshakeLength = 1 + 1536 + 1536
+
+	defaultChunkSize = 128
+	maxMessageSize   = 1 * 1024 * 1024
+
+	msgTypeSetChunkSize  = 1
+	msgTypeWindowAckSize = 5
+	msgTypeCommandAMF3   = 17
+)
+
+// tee stores the bytes received by a connection, in order to allow
+// to parse them in a separate routine.
+type tee struct {
+	mutex    sync.Mutex
+	cond     *sync.Cond
+	buf      bytes.Buffer
+	disabled bool
+	err      error
+}
+
+func newTee() *tee {
+	t := &tee{}
+	t.cond = sync.NewCond(&t.mutex)
+	return t
+}
+
+func (t *tee) write(p []byte) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.disabled {
+		return
+	}
+
+	t.buf.Write(p)
+	t.cond.Broadcast()
+}
+
+func (t *tee) close(err error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.err == nil {
+		t.err = err
+	}
+	t.cond.Broadcast()
+}
+
+// bytes returns a copy of the stored bytes.
+func (t *tee) bytes() []byte {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return append([]byte(nil), t.buf.Bytes()...)
+}
+
+// disable stops storing received bytes, and frees the stored ones.
+func (t *tee) disable() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.disabled = true
+	t.buf = bytes.Buffer{}
+	t.cond.Broadcast()
+}
+
+// wake wakes up the routines that are waiting in waitBytes().
+func (t *tee) wake() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.cond.Broadcast()
+}
+
+// waitBytes waits until more than n bytes are stored, and returns a copy of them.
+// It returns an error when the tee is closed or disabled, or when stop()
+// returns true after a call to wake().
+func (t *tee) waitBytes(n int, stop func() bool) ([]byte, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for t.buf.Len() <= n {
+		switch {
+		case t.err != nil:
+			return nil, t.err
+
+		case t.disabled || stop():
+			return nil, fmt.Errorf("terminated")
+		}
+		t.cond.Wait()
+	}
+
+	return append([]byte(nil), t.buf.Bytes()...), nil
+}
+
+// Read implements io.Reader.
+func (t *tee) Read(p []byte) (int, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	for t.buf.Len() == 0 {
+		if t.err != nil {
+			return 0, t.err
+		}
+		t.cond.Wait()
+	}
+
+	return t.buf.Read(p)
+}
+
+// teeConn is a net.Conn that copies received bytes into a tee,
+// and into another one when tracing is enabled.
+type teeConn struct {
+	net.Conn
+	tee   *tee
+	trace *tee
+}
+
+// Read implements net.Conn.
+func (c *teeConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.tee.write(p[:n])
+		if c.trace != nil {
+			c.trace.write(p[:n])
+		}
+	}
+	if err != nil {
+		c.tee.close(err)
+		if c.trace != nil {
+			c.trace.close(err)
+		}
+	}
+	return n, err
+}
+
+// ErrMessageTooLarge is returned when the remote peer sends a message
+// that exceeds the maximum size.
+type ErrMessageTooLarge struct {
+	Size uint32
+	Max  uint32
+}
+
+// Error implements error.
+func (e ErrMessageTooLarge) Error() string {
+	return fmt.Sprintf("message too large (%d bytes, maximum is %d bytes)", e.Size, e.Max)
+}
+
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+type chunkStream struct {
+	extended bool
+	msgLen   uint32
+	msgType  uint8
+	received uint32
+	buf      []byte
+}
+
+// commandReader reads the messages sent by a client.
+// It is needed since the underlying library discards them
+// once the play command has been received.
+type commandReader struct {
+	r                byteReader
+	handshakeSkipped bool
+	chunkSize        uint32
+	maxMessageSize   uint32
+	streams          map[uint32]*chunkStream
+
+	// skip tells whether the payload of a message can be discarded
+	// instead of being stored. Set Chunk Size messages are always stored.
+	skip func(msgType uint8) bool
+}
+
+// newCommandReader allocates a commandReader. When r is a byteReader,
+// it's not buffered, in order not to read more bytes than the parsed ones.
+func newCommandReader(r io.Reader) *commandReader {
+	br, ok := r.(byteReader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+
+	return &commandReader{
+		r:              br,
+		chunkSize:      defaultChunkSize,
+		maxMessageSize: maxMessageSize,
+		streams:        make(map[uint32]*chunkStream),
+	}
+}
+
+// readMessage reads a message. The message is nil when its payload is skipped.
+func (r *commandReader) readMessage() (uint8, []byte, error) {
+	if !r.handshakeSkipped {
+		_, err := io.CopyN(ioutil.Discard, r.r, handshakeLength)
+		if err != nil {
+			return 0, nil, err
+		}
+		r.handshakeSkipped = true
+	}
+
+	for {
+		msgType, msg, complete, err := r.readChunk()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		if complete {
+			return msgType, msg, nil
+		}
+	}
+}
+
+// readChunk reads a chunk, and returns the type of the message it belongs to,
+// the message and whether the message is complete.
+func (r *commandReader) readChunk() (uint8, []byte, bool, error) {
+	b0, err := r.r.ReadByte()
+	if err != nil {
+		return 0, nil, false, err
+	}
+
+	typ := b0 >> 6
+	csid := uint32(b0 & 0x3F)
+
+	switch csid {
+	case 0:
+		b1, err := r.r.ReadByte()
+		if err != nil {
+			return 0, nil, false, err
+		}
+		csid = 64 + uint32(b1)
+
+	case 1:
+		var buf [2]byte
+		_, err := io.ReadFull(r.r, buf[:])
+		if err != nil {
+			return 0, nil, false, err
+		}
+		csid = 64 + uint32(buf[0]) + uint32(buf[1])*256
+	}
+
+	st, ok := r.streams[csid]
+	if !ok {
+		st = &chunkStream{}
+		r.streams[csid] = st
+	}
+
+	var header []byte
+	switch typ {
+	case 0:
+		header = make([]byte, 11)
+	case 1:
+		header = make([]byte, 7)
+	case 2:
+		header = make([]byte, 3)
+	}
+
+	if len(header) > 0 {
+		_, err := io.ReadFull(r.r, header)
+		if err != nil {
+			return 0, nil, false, err
+		}
+
+		st.extended = (uint32(header[0])<<16 | uint32(header[1])<<8 | uint32(header[2])) == 0xFFFFFF
+
+		if typ <= 1 {
+			st.msgLen = uint32(header[3])<<16 | uint32(header[4])<<8 | uint32(header[5])
+			st.msgType = header[6]
+			st.received = 0
+			st.buf = nil
+
+			if st.msgLen > r.maxMessageSize {
+				return 0, nil, false, ErrMessageTooLarge{Size: st.msgLen, Max: r.maxMessageSize}
+			}
+		}
+	}
+
+	if st.extended {
+		_, err := io.CopyN(ioutil.Discard, r.r, 4)
+		if err != nil {
+			return 0, nil, false, err
+		}
+	}
+
+	n := st.msgLen - st.received
+	if n > r.chunkSize {
+		n = r.chunkSize
+	}
+
+	if r.skip != nil && st.msgType != msgTypeSetChunkSize && r.skip(st.msgType) {
+		_, err = io.CopyN(ioutil.Discard, r.r, int64(n))
+		if err != nil {
+			return 0, nil, false, err
+		}
+	} else {
+		payload := make([]byte, n)
+		_, err = io.ReadFull(r.r, payload)
+		if err != nil {
+			return 0, nil, false, err
+		}
+		st.buf = append(st.buf, payload...)
+	}
+	st.received += n
+
+	if st.received != st.msgLen {
+		return st.msgType, nil, false, nil
+	}
+
+	msg := st.buf
+	st.received = 0
+	st.buf = nil
+
+	if st.msgType == msgTypeSetChunkSize && len(msg) >= 4 {
+		r.chunkSize = binary.BigEndian.Uint32(msg) & 0x7FFFFFFF
+		if r.chunkSize == 0 {
+			return 0, nil, false, fmt.Errorf("invalid chunk size")
+		}
+	}
+
+	return st.msgType, msg, true, nil
+}
+
+// parseCommand parses a command message, and returns its name and values.
+func parseCommand(msgType uint8, msg []byte) (string, []interface{}, bool) {
+	switch msgType {
+	case msgTypeCommandAMF0:
+
+	case msgTypeCommandAMF3:
+		// AMF3 commands are AMF0 commands with a leading byte
+		if len(msg) == 0 {
+			return "", nil, false
+		}
+		msg = msg[1:]
+
+	default:
+		return "", nil, false
+	}
+
+	vals, err := flvio.ParseAMFVals(msg, false)
+	if err != nil || len(vals) == 0 {
+		return "", nil, false
+	}
+
+	name, ok := vals[0].(string)
+	if !ok {
+		return "", nil, false
+	}
+
+	return name, vals, true
+}
+
+// readCommand reads messages until a command is received,
+// and returns its name and values.
+func (r *commandReader) readCommand() (string, []interface{}, error) {
+	for {
+		msgType, msg, err := r.readMessage()
+		if err != nil {
+			return "", nil, err
+		}
+
+		name, vals, ok := parseCommand(msgType, msg)
+		if !ok {
+			continue
+		}
+
+		return name, vals, nil
+	}
+}
+
+// readConnect reads messages until a connect command is received,
+// and returns its transaction ID and the requested app.
+func (r *commandReader) readConnect() (float64, string, error) {
+	name, vals, err := r.readCommand()
+	if err != nil {
+		return 0, "", err
+	}
+
+	if name != "connect" || len(vals) < 3 {
+		return 0, "", fmt.Errorf("first command is not connect")
+	}
+
+	transID, _ := vals[1].(float64)
+
+	obj, ok := vals[2].(flvio.AMFMap)
+	if !ok {
+		return 0, "", fmt.Errorf("invalid connect command")
+	}
+
+	app, ok := obj.GetString("app")
+	if !ok {
+		return 0, "", fmt.Errorf("connect command doesn't contain app")
+	}
+
+	return transID, app, nil
+}
+
+// readStreamName reads messages until a publish or play command is received,
+// and returns the requested stream name.
+func (r *commandReader) readStreamName() (string, error) {
+	for {
+		name, vals, err := r.readCommand()
+		if err != nil {
+			return "", err
+		}
+
+		if (name != "publish" && name != "play") || len(vals) < 4 {
+			continue
+		}
+
+		streamName, _ := vals[3].(string)
+		return streamName, nil
+	}
+}
+
+// readPlayRequest reads messages until a play command is received,
+// and returns its start and duration arguments, that are optional.
+func (r *commandReader) readPlayRequest() (PlayRequest, error) {
+	for {
+		name, vals, err := r.readCommand()
+		if err != nil {
+			return PlayRequest{}, err
+		}
+
+		if name != "play" || len(vals) < 4 {
+			continue
+		}
+
+		req := PlayRequest{
+			Start:    playStartLiveOrRecorded,
+			Duration: playDurationUntilEnd,
+		}
+
+		if len(vals) >= 5 {
+			if v, ok := vals[4].(float64); ok {
+				req.Start = v
+			}
+		}
+
+		if len(vals) >= 6 {
+			if v, ok := vals[5].(float64); ok {
+				req.Duration = v
+			}
+		}
+
+		return req, nil
+	}
+}
+
+// readAckWindowSize reads messages until the end of the stream, and returns
+// the last acknowledgement window size set by the remote peer, or def if
+// the window size has not been set.
+func (r *commandReader) readAckWindowSize(def uint32) uint32 {
+	size := def
+
+	for {
+		msgType, msg, err := r.readMessage()
+		if err != nil {
+			return size
+		}
+
+		if msgType == msgTypeWindowAckSize && len(msg) >= 4 {
+			size = binary.BigEndian.Uint32(msg)
+		}
+	}
+}
+
+// readPause reads messages until a pause command is received,
+// and returns whether the client requested to pause or to resume.
+func (r *commandReader) readPause() (bool, error) {
+	for {
+		name, vals, err := r.readCommand()
+		if err != nil {
+			return false, err
+		}
+
+		if name != "pause" || len(vals) < 4 {
+			continue
+		}
+
+		paused, ok := vals[3].(bool)
+		if !ok {
+			continue
+		}
+
+		return paused, nil
+	}
+}
@@ -0,0 +1,125 @@
+package rtmp
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/notedit/rtmp/format/flv/flvio"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTestMessage(buf *bytes.Buffer, chunkSize int, csid byte, msgType byte, payload []byte) {
+	buf.Write([]byte{
+		csid,
+		0x00, 0x00, 0x00,
+		byte(len(payload) >> 16), byte(len(payload) >> 8), byte(len(payload)),
+		msgType,
+		0x01, 0x00, 0x00, 0x00,
+	})
+
+	for {
+		n := len(payload)
+		if n > chunkSize {
+			n = chunkSize
+		}
+		buf.Write(payload[:n])
+		payload = payload[n:]
+
+		if len(payload) == 0 {
+			break
+		}
+
+		buf.WriteByte(0xC0 | csid)
+	}
+}
+
+func TestCommandReaderReadPause(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write(make([]byte, handshakeLength))
+
+	// message split into multiple chunks
+	writeTestMessage(&buf, defaultChunkSize, 8, msgTypeCommandAMF0,
+		flvio.FillAMF0ValsMalloc([]interface{}{"releaseStream", float64(2), nil, strings.Repeat("a", 300)}))
+
+	writeTestMessage(&buf, defaultChunkSize, 2, msgTypeSetChunkSize,
+		[]byte{0x00, 0x00, 0x10, 0x00})
+
+	writeTestMessage(&buf, 4096, 8, msgTypeCommandAMF0,
+		flvio.FillAMF0ValsMalloc([]interface{}{"pause", float64(0), nil, true, float64(1000)}))
+
+	writeTestMessage(&buf, 4096, 8, msgTypeCommandAMF0,
+		flvio.FillAMF0ValsMalloc([]interface{}{"pause", float64(0), nil, false, float64(1000)}))
+
+	r := newCommandReader(&buf)
+
+	paused, err := r.readPause()
+	require.NoError(t, err)
+	require.Equal(t, true, paused)
+
+	paused, err = r.readPause()
+	require.NoError(t, err)
+	require.Equal(t, false, paused)
+}
+
+func TestCommandReaderReadStreamName(t *testing.T) {
+	var buf bytes.Buffer
+	buf.Write(make([]byte, handshakeLength))
+
+	writeTestMessage(&buf, defaultChunkSize, 3, msgTypeCommandAMF0,
+		flvio.FillAMF0ValsMalloc([]interface{}{"createStream", float64(2), nil}))
+
+	writeTestMessage(&buf, defaultChunkSize, 8, msgTypeCommandAMF0,
+		flvio.FillAMF0ValsMalloc([]interface{}{"publish", float64(5), nil, "mystream?key=val", "live"}))
+
+	streamName, err := newCommandReader(&buf).readStreamName()
+	require.NoError(t, err)
+	require.Equal(t, "mystream?key=val", streamName)
+}
+
+func TestCommandReaderReadPlayRequest(t *testing.T) {
+	for _, ca := range []struct {
+		name    string
+		args    []interface{}
+		req     PlayRequest
+		seeking bool
+	}{
+		{
+			"default",
+			[]interface{}{"play", float64(4), nil, "mystream"},
+			PlayRequest{Start: -2, Duration: -1},
+			false,
+		},
+		{
+			"live",
+			[]interface{}{"play", float64(4), nil, "mystream", float64(-1000)},
+			PlayRequest{Start: -1000, Duration: -1},
+			false,
+		},
+		{
+			"seek",
+			[]interface{}{"play", float64(4), nil, "mystream", float64(30), float64(-1), true},
+			PlayRequest{Start: 30, Duration: -1},
+			true,
+		},
+		{
+			"duration",
+			[]interface{}{"play", float64(4), nil, "mystream", float64(0), float64(10)},
+			PlayRequest{Start: 0, Duration: 10},
+			true,
+		},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			buf.Write(make([]byte, handshakeLength))
+
+			writeTestMessage(&buf, defaultChunkSize, 8, msgTypeCommandAMF0,
+				flvio.FillAMF0ValsMalloc(ca.args))
+
+			req, err := newCommandReader(&buf).readPlayRequest()
+			require.NoError(t, err)
+			require.Equal(t, ca.req, req)
+			require.Equal(t, ca.seeking, req.SeekRequested())
+		})
+	}
+}
@@ -1,16 +1,24 @@
 package rtmp
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/aler9/gortsplib"
 	"github.com/aler9/gortsplib/pkg/aac"
 	"github.com/notedit/rtmp/av"
 	nh264 "github.com/notedit/rtmp/codec/h264"
+	"github.com/notedit/rtmp/format/flv"
 	"github.com/notedit/rtmp/format/flv/flvio"
 	"github.com/notedit/rtmp/format/rtmp"
 )
@@ -19,28 +27,411 @@ const (
 	readBufferSize  = 4096
 	writeBufferSize = 4096
 	codecH264       = 7
+	codecH265       = 12
 	codecAAC        = 10
+	codecOpus       = 13
+	codecPCMA       = 7
+	codecPCMU       = 8
+
+	// chunk size of outgoing messages, that is set by the underlying library
+	// with a Set Chunk Size message while the connect command is processed.
+	// It's much larger than the default one (128), and the library doesn't allow
+	// to change it afterwards, therefore it's not configurable.
+	writeChunkSize = 65536
+
+	// acknowledgement window size that is sent to the remote peer, and that is
+	// used by the underlying library until the remote peer sets another one.
+	// Every time this amount of bytes is received, the library sends
+	// an Acknowledgement message, that allows publishers to keep sending data.
+	defaultAckWindowSize = 2500000
+
+	msgTypeUserControl   = 4
+	msgTypeCommandAMF0   = 20
+	eventTypePingRequest = 6
 )
 
+// ErrUnpublished is returned by ReadPacket when a publishing client
+// stops publishing without closing the connection.
+var ErrUnpublished = errors.New("unpublished")
+
 // Conn is a RTMP connection.
 type Conn struct {
 	rconn *rtmp.Conn
 	nconn net.Conn
+	lc    *sizeLimitConn
+
+	// server-side only
+	br             *bufio.Reader
+	tee            *tee
+	tc             *teeConn
+	tw             *traceWriter
+	traceWG        sync.WaitGroup
+	commandReader  *commandReader
+	connectTransID float64
+	connectApp     string
+	streamName     string
+	playRequest    PlayRequest
+
+	encoderInfo   *EncoderInfo
+	ackWindowSize uint32
+
+	replyBandwidthChecks bool
 }
 
 // Close closes the connection.
 func (c *Conn) Close() error {
+	if c.tee != nil {
+		c.tee.close(errors.New("terminated"))
+	}
+	c.closeTrace()
 	return c.nconn.Close()
 }
 
+// SetMaxMessageSize sets the maximum size of the messages received from
+// the remote peer. Reads of bigger messages fail with ErrMessageTooLarge
+// before the messages are allocated. It must be called before the handshake.
+func (c *Conn) SetMaxMessageSize(size uint32) {
+	c.lc.maxMessageSize = size
+}
+
 // ClientHandshake performs the handshake of a client-side connection.
 func (c *Conn) ClientHandshake() error {
 	return c.rconn.Prepare(rtmp.StageGotPublishOrPlayCommand, rtmp.PrepareReading)
 }
 
+// ReadConnect performs the handshake of a server-side connection and returns
+// the app requested by the connect command, without replying to it,
+// in order to allow to reject the connection with WriteConnectError().
+// The connection can then be accepted with ServerHandshake().
+func (c *Conn) ReadConnect() (string, error) {
+	err := c.rconn.Prepare(rtmp.StageHandshakeDone, 0)
+	if err != nil {
+		return "", err
+	}
+
+	// the command is read from a copy of the received bytes,
+	// since it has to be read again by the underlying library.
+	for {
+		transID, app, err := newCommandReader(bytes.NewReader(c.tee.bytes())).readConnect()
+		if err == nil {
+			c.connectTransID = transID
+			c.connectApp = app
+			return app, nil
+		}
+
+		if err != io.EOF && err != io.ErrUnexpectedEOF {
+			return "", err
+		}
+
+		// receive more bytes, without consuming them
+		_, err = c.br.Peek(c.br.Buffered() + 1)
+		if err != nil {
+			return "", err
+		}
+	}
+}
+
+// WriteConnectError rejects the connect command read by ReadConnect()
+// with the given description.
+func (c *Conn) WriteConnectError(description string) error {
+	return c.writeCommand("_error", c.connectTransID, nil, flvio.AMFMap{
+		{K: "level", V: "error"},
+		{K: "code", V: "NetConnection.Connect.Rejected"},
+		{K: "description", V: description},
+	})
+}
+
+// ReplyBandwidthChecks enables the replies to the bandwidth check commands
+// (checkBandwidth, _checkbw) that some encoders send after the connect command,
+// and without which they never start publishing.
+// It must be called before ServerHandshake().
+func (c *Conn) ReplyBandwidthChecks() {
+	c.replyBandwidthChecks = true
+}
+
 // ServerHandshake performs the handshake of a server-side connection.
 func (c *Conn) ServerHandshake() error {
-	return c.rconn.Prepare(rtmp.StageGotPublishOrPlayCommand, 0)
+	stopReplies := c.startCommandReplies()
+	err := c.rconn.Prepare(rtmp.StageGotPublishOrPlayCommand, 0)
+	stopReplies()
+	if err != nil {
+		return err
+	}
+
+	// the window size is usually set by clients before the connect command.
+	buf := c.tee.bytes()
+	c.ackWindowSize = newCommandReader(bytes.NewReader(buf)).readAckWindowSize(defaultAckWindowSize)
+
+	if c.connectApp != "" {
+		c.rconn.URL = urlWithAppQuery(c.rconn.URL, c.connectApp)
+	}
+
+	c.streamName, _ = newCommandReader(bytes.NewReader(buf)).readStreamName()
+
+	// commands are read only from clients that are reading.
+	if c.rconn.Publishing {
+		c.tee.disable()
+
+		// commands sent by publishers are returned by the underlying library
+		// together with packets, in order to detect when they stop publishing.
+		c.rconn.BypassMsgtypeid = []uint8{msgTypeCommandAMF0, msgTypeCommandAMF3}
+
+		return nil
+	}
+
+	req, err := newCommandReader(bytes.NewReader(buf)).readPlayRequest()
+	if err == nil {
+		c.playRequest = req
+	}
+
+	return nil
+}
+
+// default values of the arguments of the play command.
+const (
+	playStartLiveOrRecorded = -2
+	playDurationUntilEnd    = -1
+)
+
+// PlayRequest contains the arguments of the play command sent by a reading client.
+// Start is the position from which the stream has to be played, in seconds,
+// or a negative value to play the live stream; Duration is the amount of time
+// to play, in seconds, or a negative value to play until the end.
+type PlayRequest struct {
+	Start    float64
+	Duration float64
+}
+
+// SeekRequested checks whether the client asked to play from a recorded position,
+// or for a limited amount of time, as it would do with a VOD stream.
+func (r PlayRequest) SeekRequested() bool {
+	return r.Start > 0 || r.Duration > 0
+}
+
+// PlayRequest returns the arguments of the play command.
+// It must be called after ServerHandshake() by reading connections.
+func (c *Conn) PlayRequest() PlayRequest {
+	return c.playRequest
+}
+
+// ConnectInfo contains the parameters sent by a client in the connect command,
+// and the stream name sent in the publish or play command, that allow
+// to connect to another server in the same way.
+type ConnectInfo struct {
+	App        string
+	TcURL      string
+	PageURL    string
+	FlashVer   string
+	StreamName string
+}
+
+// ConnectInfo returns the parameters sent by a client to connect.
+// It must be called after ServerHandshake().
+func (c *Conn) ConnectInfo() ConnectInfo {
+	return ConnectInfo{
+		App:        c.connectApp,
+		TcURL:      c.rconn.TcUrl,
+		PageURL:    c.rconn.PageUrl,
+		FlashVer:   c.rconn.FlashVer,
+		StreamName: c.streamName,
+	}
+}
+
+// urlWithAppQuery fixes the URL built by the underlying library when the app
+// contains a query, like the one added by clients that use the Adobe authentication.
+// Since the URL is built by joining the app and the stream name with a slash,
+// the stream name ends up inside the query.
+func urlWithAppQuery(u *url.URL, app string) *url.URL {
+	i := strings.Index(app, "?")
+	if i < 0 {
+		return u
+	}
+	appPath, appQuery := app[:i], app[i+1:]
+
+	if !strings.HasPrefix(u.RawQuery, appQuery+"/") {
+		return u
+	}
+	stream := u.RawQuery[len(appQuery)+1:]
+
+	nu, err := url.ParseRequestURI("/" + appPath + "/" + stream)
+	if err != nil {
+		return u
+	}
+
+	nu.Scheme = u.Scheme
+	nu.Host = u.Host
+	if nu.RawQuery != "" {
+		nu.RawQuery = appQuery + "&" + nu.RawQuery
+	} else {
+		nu.RawQuery = appQuery
+	}
+	return nu
+}
+
+// startCommandReplies starts replying to the commands that are discarded
+// by the underlying library while it waits for the publish or play command,
+// and returns a function that stops it.
+// Commands are read from a copy of the received bytes, in a separate routine,
+// and are replied as soon as they are received, since some clients wait for
+// a reply before sending the next command.
+func (c *Conn) startCommandReplies() func() {
+	if c.tee == nil {
+		return func() {}
+	}
+
+	var stopped int32
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+		c.runCommandReplies(func() bool {
+			return atomic.LoadInt32(&stopped) != 0
+		})
+	}()
+
+	// the commands that have been received before stopping are replied
+	// before returning, since the routine processes all the stored bytes.
+	return func() {
+		atomic.StoreInt32(&stopped, 1)
+		c.tee.wake()
+		<-done
+	}
+}
+
+func (c *Conn) runCommandReplies(stop func() bool) {
+	n := 0
+	replied := 0
+
+	for {
+		buf, err := c.tee.waitBytes(n, stop)
+		if err != nil {
+			return
+		}
+		n = len(buf)
+
+		// commands are parsed again from the beginning, since
+		// the last one may have been received partially.
+		r := newCommandReader(bytes.NewReader(buf))
+		count := 0
+
+		for {
+			name, vals, err := r.readCommand()
+			if err != nil {
+				break
+			}
+
+			replies := c.commandReplies(name, vals)
+			if replies == nil {
+				continue
+			}
+
+			count++
+			if count <= replied {
+				continue
+			}
+			replied = count
+
+			// the replies are written directly into the connection, in a single write,
+			// since the underlying library may be writing at the same time.
+			_, err = c.tw.Write(commandMessages(replies))
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// commandReplies returns the replies to a command, or nil if the command
+// is handled by the underlying library.
+// releaseStream and FCPublish are sent by some clients (Wirecast,
+// Adobe tools) before the publish command; checkBandwidth and _checkbw are
+// sent by some encoders after the connect command, and they never start
+// publishing without a reply. Replies are matched by the client through
+// their transaction ID.
+func (c *Conn) commandReplies(name string, vals []interface{}) [][]interface{} {
+	if len(vals) < 2 {
+		return nil
+	}
+
+	transID, ok := vals[1].(float64)
+	if !ok {
+		return nil
+	}
+
+	switch name {
+	case "releaseStream":
+		return [][]interface{}{
+			{"_result", transID, nil},
+		}
+
+	case "FCPublish":
+		streamName := ""
+		if len(vals) >= 4 {
+			streamName, _ = vals[3].(string)
+		}
+
+		return [][]interface{}{
+			{"onFCPublish", float64(0), nil, flvio.AMFMap{
+				{K: "code", V: "NetStream.Publish.Start"},
+				{K: "description", V: streamName},
+			}},
+			{"_result", transID, nil},
+		}
+
+	case "checkBandwidth", "_checkbw":
+		if !c.replyBandwidthChecks {
+			return nil
+		}
+
+		// the bandwidth is not measured: the result of the command is sent,
+		// followed by an onBWDone command that notifies the client that the check
+		// is over.
+		return [][]interface{}{
+			{"_result", transID, nil},
+			{"onBWDone", float64(0), nil},
+		}
+	}
+
+	return nil
+}
+
+// commandMessages encodes the given commands into AMF0 command messages.
+// Messages are split with the chunk size used by the underlying library,
+// that is sent to the client before the result of the connect command,
+// and therefore before the client sends the commands that are replied.
+func commandMessages(cmds [][]interface{}) []byte {
+	var buf []byte
+
+	for _, vals := range cmds {
+		body := flvio.FillAMF0ValsMalloc(vals)
+
+		// type 0 header
+		header := make([]byte, 12)
+		header[0] = 3 // chunk stream ID
+		header[4] = byte(len(body) >> 16)
+		header[5] = byte(len(body) >> 8)
+		header[6] = byte(len(body))
+		header[7] = msgTypeCommandAMF0
+		buf = append(buf, header...)
+
+		for {
+			n := len(body)
+			if n > writeChunkSize {
+				n = writeChunkSize
+			}
+			buf = append(buf, body[:n]...)
+			body = body[n:]
+
+			if len(body) == 0 {
+				break
+			}
+
+			// type 3 header
+			buf = append(buf, 0xC0|3)
+		}
+	}
+
+	return buf
 }
 
 // SetReadDeadline sets the read deadline.
@@ -58,6 +449,109 @@ func (c *Conn) RemoteAddr() net.Addr {
 	return c.nconn.RemoteAddr()
 }
 
+// ReadChunkSize returns the chunk size used by the remote peer.
+func (c *Conn) ReadChunkSize() int {
+	return c.rconn.ReadMaxChunkSize
+}
+
+// WriteChunkSize returns the chunk size used to send messages to the remote peer.
+func (c *Conn) WriteChunkSize() int {
+	return writeChunkSize
+}
+
+// AckWindowSize returns the acknowledgement window size set by the remote peer
+// during the handshake. An Acknowledgement message is sent to the remote peer
+// every time this amount of bytes is received.
+func (c *Conn) AckWindowSize() uint32 {
+	return c.ackWindowSize
+}
+
+// WriteError rejects the publish or play request of the client with the
+// given error, that is sent to the client as an onStatus command.
+func (c *Conn) WriteError(err error) error {
+	c.rconn.PubPlayErr = err
+	err = c.rconn.Prepare(rtmp.StageCommandDone, 0)
+	if err != nil {
+		return err
+	}
+	return c.rconn.FlushWrite()
+}
+
+// WritePing writes a ping request (user control message).
+func (c *Conn) WritePing() error {
+	buf := make([]byte, 6)
+	binary.BigEndian.PutUint16(buf[0:2], eventTypePingRequest)
+	binary.BigEndian.PutUint32(buf[2:6], uint32(time.Now().Unix()))
+
+	err := c.rconn.WriteEvent(msgTypeUserControl, buf)
+	if err != nil {
+		return err
+	}
+	return c.rconn.FlushWrite()
+}
+
+// WriteStatus writes an onStatus command with the given code and description.
+func (c *Conn) WriteStatus(code string, description string) error {
+	return c.writeStatus("status", code, description)
+}
+
+// WriteStatusError writes an onStatus command with the error level,
+// that can be used to reject a publish or play command with a specific code.
+func (c *Conn) WriteStatusError(code string, description string) error {
+	return c.writeStatus("error", code, description)
+}
+
+// WriteConnectRedirect rejects the connect command read by ReadConnect()
+// and asks the client to connect to another URL, in the same format
+// used by other servers.
+func (c *Conn) WriteConnectRedirect(u string) error {
+	return c.writeCommand(
+		"_error",
+		c.connectTransID,
+		nil,
+		flvio.AMFMap{
+			{K: "level", V: "error"},
+			{K: "code", V: "NetConnection.Connect.Rejected"},
+			{K: "description", V: "redirect"},
+			{K: "ex", V: flvio.AMFMap{
+				{K: "code", V: float64(302)},
+				{K: "redirect", V: u},
+			}},
+		})
+}
+
+func (c *Conn) writeStatus(level string, code string, description string) error {
+	return c.writeCommand(
+		"onStatus",
+		float64(0),
+		nil,
+		flvio.AMFMap{
+			{K: "level", V: level},
+			{K: "code", V: code},
+			{K: "description", V: description},
+		})
+}
+
+func (c *Conn) writeCommand(vals ...interface{}) error {
+	err := c.rconn.WriteTag(flvio.Tag{
+		Type: msgTypeCommandAMF0,
+		Data: flvio.FillAMF0ValsMalloc(vals),
+	})
+	if err != nil {
+		return err
+	}
+	return c.rconn.FlushWrite()
+}
+
+// ReadPause waits until a reading client requests to pause or to resume,
+// and returns whether the client is paused.
+func (c *Conn) ReadPause() (bool, error) {
+	if c.commandReader == nil {
+		return false, fmt.Errorf("pause requests can be read only by server-side connections")
+	}
+	return c.commandReader.readPause()
+}
+
 // IsPublishing returns whether the connection is publishing.
 func (c *Conn) IsPublishing() bool {
 	return c.rconn.Publishing
@@ -69,13 +563,185 @@ func (c *Conn) URL() *url.URL {
 }
 
 // ReadPacket reads a packet.
+// It returns ErrUnpublished when a publishing client stops publishing.
 func (c *Conn) ReadPacket() (av.Packet, error) {
-	return c.rconn.ReadPacket()
+	err := c.rconn.Prepare(rtmp.StageCommandDone, rtmp.PrepareReading)
+	if err != nil {
+		return av.Packet{}, err
+	}
+
+	var interceptedPkt *av.Packet
+
+	pkt, err := flv.ReadPacket(func() (flvio.Tag, error) {
+		tag, err := c.readTag()
+		if err != nil {
+			return tag, err
+		}
+
+		// data messages and enhanced RTMP tags are discarded
+		// by the underlying library, therefore they are intercepted here.
+		if data, ok := parseDataMessage(tag); ok {
+			interceptedPkt = &av.Packet{
+				Type: PacketData,
+				Data: data,
+				Time: flvio.TsToTime(int64(tag.Time)),
+			}
+			return flvio.Tag{}, errInterceptedPacket
+		}
+
+		if pkt, ok := parseExAudio(tag); ok {
+			interceptedPkt = &pkt
+			return flvio.Tag{}, errInterceptedPacket
+		}
+
+		err = checkExVideo(tag)
+		if err != nil {
+			return flvio.Tag{}, err
+		}
+
+		return tag, nil
+	})
+	if interceptedPkt != nil {
+		return *interceptedPkt, nil
+	}
+	return pkt, err
+}
+
+// readTrackPacket reads a packet, skipping data messages, that are not needed
+// to read tracks.
+func (c *Conn) readTrackPacket() (av.Packet, error) {
+	for {
+		pkt, err := c.ReadPacket()
+		if err != nil || pkt.Type != PacketData {
+			return pkt, err
+		}
+	}
+}
+
+// PacketData is the packet type of the AMF data messages (onCuePoint, onTextData)
+// sent by publishers, that are returned by ReadPacket and can be written with
+// WritePacket. The data of the packet contains the AMF0 values of the message,
+// starting with its name.
+const PacketData = 200
+
+var errInterceptedPacket = errors.New("intercepted packet")
+
+// names of the AMF data messages that are returned by ReadPacket.
+var dataMessageNames = map[string]struct{}{
+	"onCuePoint": {},
+	"onTextData": {},
+}
+
+// parseDataMessage parses a data message with one of the names in dataMessageNames,
+// and returns its values encoded in AMF0.
+func parseDataMessage(tag flvio.Tag) ([]byte, bool) {
+	if tag.Type != flvio.TAG_AMF0 && tag.Type != flvio.TAG_AMF3 {
+		return nil, false
+	}
+
+	vals, err := flvio.ParseAMFVals(tag.Data, tag.Type == flvio.TAG_AMF3)
+	if err != nil {
+		return nil, false
+	}
+
+	// the name can be preceded by @setDataFrame, that asks the server
+	// to store the message.
+	if len(vals) != 0 {
+		if s, _ := vals[0].(string); s == flv.SetDataFrame {
+			vals = vals[1:]
+		}
+	}
+
+	if len(vals) == 0 {
+		return nil, false
+	}
+
+	name, _ := vals[0].(string)
+	if _, ok := dataMessageNames[name]; !ok {
+		return nil, false
+	}
+
+	return flvio.FillAMF0ValsMalloc(vals), true
+}
+
+// readTag reads a tag, and handles the commands that are returned
+// by the underlying library when they are bypassed.
+func (c *Conn) readTag() (flvio.Tag, error) {
+	for {
+		tag, err := c.rconn.ReadTag()
+		if err != nil {
+			return tag, err
+		}
+
+		if tag.Type != msgTypeCommandAMF0 && tag.Type != msgTypeCommandAMF3 {
+			return tag, nil
+		}
+
+		// OBS sends FCUnpublish and deleteStream when streaming is stopped,
+		// other clients send closeStream.
+		name, _, ok := parseCommand(tag.Type, tag.Data)
+		if ok && (name == "FCUnpublish" || name == "deleteStream" || name == "closeStream") {
+			return flvio.Tag{}, ErrUnpublished
+		}
+	}
+}
+
+// packet types of G.711 frames, that are not supported by the underlying
+// library and are written as raw FLV audio tags.
+const (
+	PacketPCMA = 100 + iota
+	PacketPCMU
+)
+
+// TrackIsPCMA checks whether a track is a G.711 A-law track.
+// These tracks are not parsed by gortsplib and are exposed as generic tracks
+// with the static payload type 8.
+func TrackIsPCMA(track gortsplib.Track) bool {
+	tt, ok := track.(*gortsplib.TrackGeneric)
+	if !ok {
+		return false
+	}
+
+	md := tt.MediaDescription()
+	return md.MediaName.Media == "audio" &&
+		len(md.MediaName.Formats) == 1 &&
+		md.MediaName.Formats[0] == "8"
 }
 
 // WritePacket writes a packet.
+// G.711 frames can be written with the PacketPCMA and PacketPCMU types,
+// data messages with the PacketData type.
 func (c *Conn) WritePacket(pkt av.Packet) error {
-	err := c.rconn.WritePacket(pkt)
+	var err error
+	switch pkt.Type {
+	case PacketData:
+		err = c.rconn.WriteTag(flvio.Tag{
+			Type: flvio.TAG_AMF0,
+			Time: uint32(flvio.TimeToTs(pkt.Time)),
+			Data: pkt.Data,
+		})
+
+	case PacketPCMA, PacketPCMU:
+		soundFormat := uint8(flvio.SOUND_ALAW)
+		if pkt.Type == PacketPCMU {
+			soundFormat = flvio.SOUND_MULAW
+		}
+
+		// G.711 is always 8kHz, that doesn't have a dedicated sound rate;
+		// the same flags of FFmpeg are used.
+		err = c.rconn.WriteTag(flvio.Tag{
+			Type:        flvio.TAG_AUDIO,
+			SoundFormat: soundFormat,
+			SoundRate:   flvio.SOUND_5_5Khz,
+			SoundSize:   flvio.SOUND_16BIT,
+			SoundType:   flvio.SOUND_MONO,
+			Time:        uint32(flvio.TimeToTs(pkt.Time)),
+			Data:        pkt.Data,
+		})
+
+	default:
+		err = c.rconn.WritePacket(pkt)
+	}
 	if err != nil {
 		return err
 	}
@@ -91,9 +757,74 @@ func trackFromH264DecoderConfig(data []byte) (*gortsplib.TrackH264, error) {
 	return gortsplib.NewTrackH264(96, codec.SPS[0], codec.PPS[0], nil)
 }
 
+func trackFromAACDecoderConfig(data []byte) (*gortsplib.TrackAAC, error) {
+	var mpegConf aac.MPEG4AudioConfig
+	err := mpegConf.Decode(data)
+	if err != nil {
+		return nil, err
+	}
+
+	return gortsplib.NewTrackAAC(96, int(mpegConf.Type), mpegConf.SampleRate,
+		mpegConf.ChannelCount, mpegConf.AOTSpecificConfig)
+}
+
 var errEmptyMetadata = errors.New("metadata is empty")
 
-func (c *Conn) readTracksFromMetadata(pkt av.Packet) (*gortsplib.TrackH264, *gortsplib.TrackAAC, error) {
+// EncoderInfo contains informations about the encoder of a publisher,
+// sent inside onMetaData.
+type EncoderInfo struct {
+	Encoder       string
+	VideoDataRate float64
+	AudioDataRate float64
+	FrameRate     float64
+	Width         float64
+	Height        float64
+}
+
+func encoderInfoFromAMF(md flvio.AMFMap) *EncoderInfo {
+	var info EncoderInfo
+	info.Encoder, _ = md.GetString("encoder")
+	info.VideoDataRate, _ = md.GetFloat64("videodatarate")
+	info.AudioDataRate, _ = md.GetFloat64("audiodatarate")
+	info.FrameRate, _ = md.GetFloat64("framerate")
+	info.Width, _ = md.GetFloat64("width")
+	info.Height, _ = md.GetFloat64("height")
+	return &info
+}
+
+// ParseEncoderInfo parses the encoder informations contained in a metadata packet.
+func ParseEncoderInfo(data []byte) (*EncoderInfo, error) {
+	arr, err := flvio.ParseAMFVals(data, false)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(arr) != 1 {
+		return nil, fmt.Errorf("invalid metadata")
+	}
+
+	md, ok := arr[0].(flvio.AMFMap)
+	if !ok {
+		return nil, fmt.Errorf("invalid metadata")
+	}
+
+	return encoderInfoFromAMF(md), nil
+}
+
+// EncoderInfo returns the encoder informations sent by the publisher
+// before the tracks, or nil if they were not sent.
+func (c *Conn) EncoderInfo() *EncoderInfo {
+	return c.encoderInfo
+}
+
+// H265 and AV1 can't be routed until the RTSP library provides tracks and
+// RTP encoders / decoders for them; until then, reject them with a clear message.
+var (
+	errH265NotSupported = errors.New("H265 is not supported yet, only H264 can be published with RTMP")
+	errAV1NotSupported  = errors.New("AV1 is not supported yet, only H264 can be published with RTMP")
+)
+
+func (c *Conn) readTracksFromMetadata(pkt av.Packet) (*gortsplib.TrackH264, gortsplib.Track, error) {
 	arr, err := flvio.ParseAMFVals(pkt.Data, false)
 	if err != nil {
 		return nil, nil, err
@@ -108,6 +839,8 @@ func (c *Conn) readTracksFromMetadata(pkt av.Packet) (*gortsplib.TrackH264, *gor
 		return nil, nil, fmt.Errorf("invalid metadata")
 	}
 
+	c.encoderInfo = encoderInfoFromAMF(md)
+
 	hasVideo, err := func() (bool, error) {
 		v, ok := md.GetV("videocodecid")
 		if !ok {
@@ -122,11 +855,24 @@ func (c *Conn) readTracksFromMetadata(pkt av.Packet) (*gortsplib.TrackH264, *gor
 
 			case codecH264:
 				return true, nil
+
+			case codecH265, fourCCValue(fourCCHEVC):
+				return false, errH265NotSupported
+
+			case fourCCValue(fourCCAV1):
+				return false, errAV1NotSupported
 			}
 
 		case string:
-			if vt == "avc1" {
+			switch vt {
+			case "avc1":
 				return true, nil
+
+			case "hvc1", "hev1":
+				return false, errH265NotSupported
+
+			case "av01":
+				return false, errAV1NotSupported
 			}
 		}
 
@@ -136,29 +882,36 @@ func (c *Conn) readTracksFromMetadata(pkt av.Packet) (*gortsplib.TrackH264, *gor
 		return nil, nil, err
 	}
 
-	hasAudio, err := func() (bool, error) {
+	hasAudio, isOpus, err := func() (bool, bool, error) {
 		v, ok := md.GetV("audiocodecid")
 		if !ok {
-			return false, nil
+			return false, false, nil
 		}
 
 		switch vt := v.(type) {
 		case float64:
 			switch vt {
 			case 0:
-				return false, nil
+				return false, false, nil
 
 			case codecAAC:
-				return true, nil
+				return true, false, nil
+
+			case codecOpus, fourCCValue(fourCCOpus):
+				return true, true, nil
 			}
 
 		case string:
-			if vt == "mp4a" {
-				return true, nil
+			switch vt {
+			case "mp4a":
+				return true, false, nil
+
+			case "Opus", "opus":
+				return true, true, nil
 			}
 		}
 
-		return false, fmt.Errorf("unsupported audio codec %v", v)
+		return false, false, fmt.Errorf("unsupported audio codec %v", v)
 	}()
 	if err != nil {
 		return nil, nil, err
@@ -169,7 +922,23 @@ func (c *Conn) readTracksFromMetadata(pkt av.Packet) (*gortsplib.TrackH264, *gor
 	}
 
 	var videoTrack *gortsplib.TrackH264
-	var audioTrack *gortsplib.TrackAAC
+	var audioTrack gortsplib.Track
+
+	// Opus doesn't have a decoder config, therefore the track
+	// is filled with the informations provided by metadata.
+	if isOpus {
+		channelCount := 2
+		if v, ok := md.GetFloat64("audiochannels"); ok && v == 1 {
+			channelCount = 1
+		} else if v, ok := md.GetBool("stereo"); ok && !v {
+			channelCount = 1
+		}
+
+		audioTrack, err = gortsplib.NewTrackOpus(97, 48000, channelCount)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
 
 	for {
 		var pkt av.Packet
@@ -193,8 +962,20 @@ func (c *Conn) readTracksFromMetadata(pkt av.Packet) (*gortsplib.TrackH264, *gor
 				return nil, nil, err
 			}
 
+		case PacketOpusHead:
+			if !isOpus {
+				return nil, nil, fmt.Errorf("unexpected audio packet")
+			}
+
+			// the track filled with metadata is replaced, since
+			// the header is more reliable.
+			audioTrack, err = trackFromOpusHead(pkt.Data)
+			if err != nil {
+				return nil, nil, err
+			}
+
 		case av.AACDecoderConfig:
-			if !hasAudio {
+			if !hasAudio || isOpus {
 				return nil, nil, fmt.Errorf("unexpected audio packet")
 			}
 
@@ -202,14 +983,7 @@ func (c *Conn) readTracksFromMetadata(pkt av.Packet) (*gortsplib.TrackH264, *gor
 				return nil, nil, fmt.Errorf("audio track setupped twice")
 			}
 
-			var mpegConf aac.MPEG4AudioConfig
-			err := mpegConf.Decode(pkt.Data)
-			if err != nil {
-				return nil, nil, err
-			}
-
-			audioTrack, err = gortsplib.NewTrackAAC(96, int(mpegConf.Type), mpegConf.SampleRate,
-				mpegConf.ChannelCount, mpegConf.AOTSpecificConfig)
+			audioTrack, err = trackFromAACDecoderConfig(pkt.Data)
 			if err != nil {
 				return nil, nil, err
 			}
@@ -223,8 +997,12 @@ func (c *Conn) readTracksFromMetadata(pkt av.Packet) (*gortsplib.TrackH264, *gor
 }
 
 // ReadTracks reads track informations.
-func (c *Conn) ReadTracks() (*gortsplib.TrackH264, *gortsplib.TrackAAC, error) {
-	pkt, err := c.ReadPacket()
+// The audio track can be a *gortsplib.TrackAAC or a *gortsplib.TrackOpus.
+// G.711 (sound formats 7 and 8) can only be written, and publishers
+// that declare it in metadata are rejected.
+// Both tracks are nil when the publisher doesn't provide any codec data.
+func (c *Conn) ReadTracks() (*gortsplib.TrackH264, gortsplib.Track, error) {
+	pkt, err := c.readTrackPacket()
 	if err != nil {
 		return nil, nil, err
 	}
@@ -234,21 +1012,12 @@ func (c *Conn) ReadTracks() (*gortsplib.TrackH264, *gortsplib.TrackAAC, error) {
 		videoTrack, audioTrack, err := c.readTracksFromMetadata(pkt)
 		if err != nil {
 			if err == errEmptyMetadata {
-				pkt, err := c.ReadPacket()
-				if err != nil {
-					return nil, nil, err
-				}
-
-				if pkt.Type != av.H264DecoderConfig {
-					return nil, nil, fmt.Errorf("unexpected packet (%v)", pkt.Type)
-				}
-
-				videoTrack, err := trackFromH264DecoderConfig(pkt.Data)
+				pkt, err := c.readTrackPacket()
 				if err != nil {
 					return nil, nil, err
 				}
 
-				return videoTrack, nil, nil
+				return tracksFromDecoderConfig(pkt)
 			}
 
 			return nil, nil, err
@@ -256,6 +1025,16 @@ func (c *Conn) ReadTracks() (*gortsplib.TrackH264, *gortsplib.TrackAAC, error) {
 
 		return videoTrack, audioTrack, nil
 
+	default:
+		return tracksFromDecoderConfig(pkt)
+	}
+}
+
+// tracksFromDecoderConfig fills the tracks of a publisher that didn't send
+// metadata, in which case the first packet is the decoder config of the only track.
+// Publishers that send frames without a decoder config don't provide any track.
+func tracksFromDecoderConfig(pkt av.Packet) (*gortsplib.TrackH264, gortsplib.Track, error) {
+	switch pkt.Type {
 	case av.H264DecoderConfig:
 		videoTrack, err := trackFromH264DecoderConfig(pkt.Data)
 		if err != nil {
@@ -264,43 +1043,116 @@ func (c *Conn) ReadTracks() (*gortsplib.TrackH264, *gortsplib.TrackAAC, error) {
 
 		return videoTrack, nil, nil
 
+	case av.AACDecoderConfig:
+		audioTrack, err := trackFromAACDecoderConfig(pkt.Data)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return nil, audioTrack, nil
+
+	case PacketOpusHead:
+		audioTrack, err := trackFromOpusHead(pkt.Data)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return nil, audioTrack, nil
+
 	default:
-		return nil, nil, fmt.Errorf("unexpected packet (%v)", pkt.Type)
+		return nil, nil, nil
+	}
+}
+
+func metadata(videoTrack *gortsplib.TrackH264, audioTrack gortsplib.Track) flvio.AMFMap {
+	md := flvio.AMFMap{
+		{
+			K: "videodatarate",
+			V: float64(0),
+		},
+		{
+			K: "videocodecid",
+			V: func() float64 {
+				if videoTrack != nil {
+					return codecH264
+				}
+				return 0
+			}(),
+		},
 	}
+
+	// resolution and framerate are available only if the SPS is known.
+	if videoTrack != nil && videoTrack.SPS() != nil {
+		info, err := nh264.ParseSPS(videoTrack.SPS())
+		if err == nil {
+			md = append(md,
+				flvio.AMFKv{K: "width", V: float64(info.Width)},
+				flvio.AMFKv{K: "height", V: float64(info.Height)})
+
+			if info.FPS != 0 {
+				md = append(md, flvio.AMFKv{K: "framerate", V: float64(info.FPS)})
+			}
+		}
+	}
+
+	md = append(md,
+		flvio.AMFKv{
+			K: "audiodatarate",
+			V: float64(0),
+		},
+		flvio.AMFKv{
+			K: "audiocodecid",
+			V: func() float64 {
+				switch audioTrack.(type) {
+				case *gortsplib.TrackAAC:
+					return codecAAC
+
+				case *gortsplib.TrackOpus:
+					return codecOpus
+
+				case *gortsplib.TrackPCMU:
+					return codecPCMU
+				}
+				if TrackIsPCMA(audioTrack) {
+					return codecPCMA
+				}
+				return 0
+			}(),
+		})
+
+	switch tt := audioTrack.(type) {
+	case *gortsplib.TrackAAC:
+		md = append(md,
+			flvio.AMFKv{K: "audiosamplerate", V: float64(tt.ClockRate())},
+			flvio.AMFKv{K: "audiochannels", V: float64(tt.ChannelCount())})
+
+	case *gortsplib.TrackOpus:
+		md = append(md,
+			flvio.AMFKv{K: "audiosamplerate", V: float64(tt.ClockRate())},
+			flvio.AMFKv{K: "audiochannels", V: float64(tt.ChannelCount())})
+	}
+
+	// G.711 is always 8kHz mono.
+	if _, ok := audioTrack.(*gortsplib.TrackPCMU); ok || TrackIsPCMA(audioTrack) {
+		md = append(md,
+			flvio.AMFKv{K: "audiosamplerate", V: float64(8000)},
+			flvio.AMFKv{K: "audiochannels", V: float64(1)})
+	}
+
+	return md
 }
 
 // WriteTracks writes track informations.
-func (c *Conn) WriteTracks(videoTrack *gortsplib.TrackH264, audioTrack *gortsplib.TrackAAC) error {
+// The audio track can be a *gortsplib.TrackAAC or a *gortsplib.TrackOpus.
+// Since this is the first write of a reading connection, it also causes
+// the NetStream.Play.Reset and NetStream.Play.Start status messages
+// to be sent before any frame, as some players wait for them.
+// The AAC sequence header (AudioSpecificConfig) is sent here too, before
+// the first AAC frame, as required by FLV players.
+func (c *Conn) WriteTracks(videoTrack *gortsplib.TrackH264, audioTrack gortsplib.Track) error {
 	err := c.WritePacket(av.Packet{
 		Type: av.Metadata,
-		Data: flvio.FillAMF0ValMalloc(flvio.AMFMap{
-			{
-				K: "videodatarate",
-				V: float64(0),
-			},
-			{
-				K: "videocodecid",
-				V: func() float64 {
-					if videoTrack != nil {
-						return codecH264
-					}
-					return 0
-				}(),
-			},
-			{
-				K: "audiodatarate",
-				V: float64(0),
-			},
-			{
-				K: "audiocodecid",
-				V: func() float64 {
-					if audioTrack != nil {
-						return codecAAC
-					}
-					return 0
-				}(),
-			},
-		}),
+		Data: flvio.FillAMF0ValMalloc(metadata(videoTrack, audioTrack)),
 	})
 	if err != nil {
 		return err
@@ -331,7 +1183,8 @@ func (c *Conn) WriteTracks(videoTrack *gortsplib.TrackH264, audioTrack *gortspli
 		}
 	}
 
-	if audioTrack != nil {
+	// Opus doesn't have a decoder config.
+	if audioTrack, ok := audioTrack.(*gortsplib.TrackAAC); ok {
 		enc, err := aac.MPEG4AudioConfig{
 			Type:              aac.MPEG4AudioType(audioTrack.Type()),
 			SampleRate:        audioTrack.ClockRate(),
@@ -1,10 +1,12 @@
 package rtmp
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/binary"
 	"fmt"
 	"io"
 	"net"
@@ -14,8 +16,10 @@ import (
 
 	"github.com/aler9/gortsplib"
 	"github.com/aler9/gortsplib/pkg/aac"
+	"github.com/notedit/rtmp/av"
 	nh264 "github.com/notedit/rtmp/codec/h264"
 	"github.com/notedit/rtmp/format/flv/flvio"
+	"github.com/notedit/rtmp/format/rtmp"
 	"github.com/stretchr/testify/require"
 )
 
@@ -242,6 +246,8 @@ func TestReadTracks(t *testing.T) {
 		"standard",
 		"empty metadata",
 		"no metadata",
+		"audio only",
+		"audio only no metadata",
 	} {
 		t.Run(ca, func(t *testing.T) {
 			ln, err := net.Listen("tcp", "127.0.0.1:9121")
@@ -296,7 +302,7 @@ func TestReadTracks(t *testing.T) {
 					require.NoError(t, err)
 					require.Equal(t, videoTrack2, videoTrack)
 
-					require.Equal(t, (*gortsplib.TrackAAC)(nil), audioTrack)
+					require.Equal(t, nil, audioTrack)
 
 				case "no metadata":
 					videoTrack2, err := gortsplib.NewTrackH264(96,
@@ -312,7 +318,14 @@ func TestReadTracks(t *testing.T) {
 					require.NoError(t, err)
 					require.Equal(t, videoTrack2, videoTrack)
 
-					require.Equal(t, (*gortsplib.TrackAAC)(nil), audioTrack)
+					require.Equal(t, nil, audioTrack)
+
+				case "audio only", "audio only no metadata":
+					require.Equal(t, (*gortsplib.TrackH264)(nil), videoTrack)
+
+					audioTrack2, err := gortsplib.NewTrackAAC(96, 2, 44100, 2, nil)
+					require.NoError(t, err)
+					require.Equal(t, audioTrack2, audioTrack)
 				}
 
 				close(done)
@@ -438,6 +451,19 @@ func TestReadTracks(t *testing.T) {
 			}.write(conn)
 			require.NoError(t, err)
 
+			// S->C releaseStream result
+			err = c0.read(conn, 65536)
+			require.NoError(t, err)
+			require.Equal(t, uint8(3), c0.chunkStreamID)
+			require.Equal(t, uint8(0x14), c0.typ)
+			arr, err = flvio.ParseAMFVals(c0.body, false)
+			require.NoError(t, err)
+			require.Equal(t, []interface{}{
+				"_result",
+				float64(2),
+				nil,
+			}, arr)
+
 			// C->S FCPublish
 			err = chunk1{
 				chunkStreamID: 3,
@@ -451,6 +477,32 @@ func TestReadTracks(t *testing.T) {
 			}.write(conn)
 			require.NoError(t, err)
 
+			// S->C onFCPublish
+			err = c0.read(conn, 65536)
+			require.NoError(t, err)
+			arr, err = flvio.ParseAMFVals(c0.body, false)
+			require.NoError(t, err)
+			require.Equal(t, []interface{}{
+				"onFCPublish",
+				float64(0),
+				nil,
+				flvio.AMFMap{
+					{K: "code", V: "NetStream.Publish.Start"},
+					{K: "description", V: ""},
+				},
+			}, arr)
+
+			// S->C FCPublish result
+			err = c0.read(conn, 65536)
+			require.NoError(t, err)
+			arr, err = flvio.ParseAMFVals(c0.body, false)
+			require.NoError(t, err)
+			require.Equal(t, []interface{}{
+				"_result",
+				float64(3),
+				nil,
+			}, arr)
+
 			// C->S createStream
 			err = chunk3{
 				chunkStreamID: 3,
@@ -657,6 +709,271 @@ func TestReadTracks(t *testing.T) {
 					body:          byts,
 				}.write(conn)
 				require.NoError(t, err)
+
+			case "audio only", "audio only no metadata":
+				if ca == "audio only" {
+					// C->S metadata
+					byts = flvio.FillAMF0ValsMalloc([]interface{}{
+						"@setDataFrame",
+						"onMetaData",
+						flvio.AMFMap{
+							{
+								K: "audiodatarate",
+								V: float64(0),
+							},
+							{
+								K: "audiocodecid",
+								V: float64(codecAAC),
+							},
+						},
+					})
+					err = chunk0{
+						chunkStreamID: 4,
+						typ:           0x12,
+						streamID:      1,
+						bodyLen:       uint32(len(byts)),
+						body:          byts,
+					}.write(conn)
+					require.NoError(t, err)
+				}
+
+				// C->S AAC decoder config
+				enc, err := aac.MPEG4AudioConfig{
+					Type:         2,
+					SampleRate:   44100,
+					ChannelCount: 2,
+				}.Encode()
+				require.NoError(t, err)
+				err = chunk0{
+					chunkStreamID: 4,
+					typ:           flvio.TAG_AUDIO,
+					streamID:      1,
+					bodyLen:       uint32(len(enc) + 2),
+					body: append([]byte{
+						flvio.SOUND_AAC<<4 | flvio.SOUND_44Khz<<2 | flvio.SOUND_16BIT<<1 | flvio.SOUND_STEREO,
+						flvio.AAC_SEQHDR,
+					}, enc...),
+				}.write(conn)
+				require.NoError(t, err)
+			}
+
+			<-done
+		})
+	}
+}
+
+func TestPublishResults(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:9121")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		conn, err := ln.Accept()
+		require.NoError(t, err)
+		defer conn.Close()
+
+		rconn := NewServerConn(conn)
+
+		_, err = rconn.ReadConnect()
+		require.NoError(t, err)
+
+		err = rconn.ServerHandshake()
+		require.NoError(t, err)
+		require.Equal(t, true, rconn.IsPublishing())
+	}()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:9121")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// C->S handshake C0+C1
+	err = writeHandshakeC0C1(conn)
+	require.NoError(t, err)
+
+	// S->C handshake S0+S1+S2
+	s0s1s2 := make([]byte, 1536*2+1)
+	_, err = io.ReadFull(conn, s0s1s2)
+	require.NoError(t, err)
+
+	// C->S handshake C2
+	err = writeHandshakeC2(conn, s0s1s2)
+	require.NoError(t, err)
+
+	writeCommand := func(vals ...interface{}) {
+		byts := flvio.FillAMF0ValsMalloc(vals)
+		err := chunk0{
+			chunkStreamID: 3,
+			typ:           0x14,
+			bodyLen:       uint32(len(byts)),
+			body:          byts,
+		}.write(conn)
+		require.NoError(t, err)
+	}
+
+	r := newCommandReader(conn)
+	r.handshakeSkipped = true
+
+	readCommand := func() []interface{} {
+		_, vals, err := r.readCommand()
+		require.NoError(t, err)
+		return vals
+	}
+
+	// command sequence sent by Wirecast after the connect command:
+	// each command is sent after the reply to the previous one.
+	writeCommand("connect", float64(1), flvio.AMFMap{
+		{K: "app", V: "stream"},
+		{K: "tcUrl", V: "rtmp://127.0.0.1:9121/stream"},
+	})
+	require.Equal(t, "_result", readCommand()[0])
+
+	writeCommand("releaseStream", float64(2), nil, "mystream")
+	require.Equal(t, []interface{}{"_result", float64(2), nil}, readCommand())
+
+	writeCommand("FCPublish", float64(3), nil, "mystream")
+	require.Equal(t, []interface{}{
+		"onFCPublish",
+		float64(0),
+		nil,
+		flvio.AMFMap{
+			{K: "code", V: "NetStream.Publish.Start"},
+			{K: "description", V: "mystream"},
+		},
+	}, readCommand())
+	require.Equal(t, []interface{}{"_result", float64(3), nil}, readCommand())
+
+	writeCommand("createStream", float64(4), nil)
+	require.Equal(t, []interface{}{"_result", float64(4), nil, float64(1)}, readCommand())
+
+	writeCommand("publish", float64(5), nil, "mystream", "live")
+
+	<-done
+}
+
+func TestCommandMessages(t *testing.T) {
+	// a command longer than the chunk size is split into multiple chunks
+	streamName := strings.Repeat("a", writeChunkSize)
+
+	r := newCommandReader(bytes.NewReader(commandMessages([][]interface{}{
+		{"_result", float64(2), nil},
+		{"onFCPublish", float64(0), nil, streamName},
+	})))
+	r.handshakeSkipped = true
+	r.chunkSize = writeChunkSize
+
+	_, vals, err := r.readCommand()
+	require.NoError(t, err)
+	require.Equal(t, []interface{}{"_result", float64(2), nil}, vals)
+
+	_, vals, err = r.readCommand()
+	require.NoError(t, err)
+	require.Equal(t, []interface{}{"onFCPublish", float64(0), nil, streamName}, vals)
+}
+
+func TestReadConnect(t *testing.T) {
+	for _, ca := range []string{"error", "redirect"} {
+		t.Run(ca, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:9121")
+			require.NoError(t, err)
+			defer ln.Close()
+
+			done := make(chan struct{})
+
+			go func() {
+				defer close(done)
+
+				conn, err := ln.Accept()
+				require.NoError(t, err)
+				defer conn.Close()
+
+				rconn := NewServerConn(conn)
+				app, err := rconn.ReadConnect()
+				require.NoError(t, err)
+				require.Equal(t, "stream?authmod=adobe", app)
+
+				if ca == "error" {
+					err = rconn.WriteConnectError("code=403 need auth")
+				} else {
+					err = rconn.WriteConnectRedirect("rtmp://otherhost/stream")
+				}
+				require.NoError(t, err)
+			}()
+
+			conn, err := net.Dial("tcp", "127.0.0.1:9121")
+			require.NoError(t, err)
+			defer conn.Close()
+
+			// C->S handshake C0+C1
+			err = writeHandshakeC0C1(conn)
+			require.NoError(t, err)
+
+			// S->C handshake S0+S1+S2
+			s0s1s2 := make([]byte, 1536*2+1)
+			_, err = io.ReadFull(conn, s0s1s2)
+			require.NoError(t, err)
+
+			// C->S handshake C2
+			err = writeHandshakeC2(conn, s0s1s2)
+			require.NoError(t, err)
+
+			// C->S connect
+			byts := flvio.FillAMF0ValsMalloc([]interface{}{
+				"connect",
+				1,
+				flvio.AMFMap{
+					{K: "app", V: "stream?authmod=adobe"},
+					{K: "flashVer", V: "LNX 9,0,124,2"},
+					{K: "tcUrl", V: "rtmp://127.0.0.1:9121/stream?authmod=adobe"},
+				},
+			})
+			err = chunk0{
+				chunkStreamID: 3,
+				typ:           0x14,
+				bodyLen:       uint32(len(byts)),
+				body:          byts[:128],
+			}.write(conn)
+			require.NoError(t, err)
+			err = chunk3{
+				chunkStreamID: 3,
+				body:          byts[128:],
+			}.write(conn)
+			require.NoError(t, err)
+
+			// S->C error
+			r := newCommandReader(conn)
+			r.handshakeSkipped = true
+			_, arr, err := r.readCommand()
+			require.NoError(t, err)
+			if ca == "error" {
+				require.Equal(t, []interface{}{
+					"_error",
+					float64(1),
+					nil,
+					flvio.AMFMap{
+						{K: "level", V: "error"},
+						{K: "code", V: "NetConnection.Connect.Rejected"},
+						{K: "description", V: "code=403 need auth"},
+					},
+				}, arr)
+			} else {
+				require.Equal(t, []interface{}{
+					"_error",
+					float64(1),
+					nil,
+					flvio.AMFMap{
+						{K: "level", V: "error"},
+						{K: "code", V: "NetConnection.Connect.Rejected"},
+						{K: "description", V: "redirect"},
+						{K: "ex", V: flvio.AMFMap{
+							{K: "code", V: float64(302)},
+							{K: "redirect", V: "rtmp://otherhost/stream"},
+						}},
+					},
+				}, arr)
 			}
 
 			<-done
@@ -664,6 +981,307 @@ func TestReadTracks(t *testing.T) {
 	}
 }
 
+func TestBandwidthCheck(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:9121")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		conn, err := ln.Accept()
+		require.NoError(t, err)
+		defer conn.Close()
+
+		rconn := NewServerConn(conn)
+		rconn.ReplyBandwidthChecks()
+
+		_, err = rconn.ReadConnect()
+		require.NoError(t, err)
+
+		err = rconn.ServerHandshake()
+		require.NoError(t, err)
+		require.Equal(t, true, rconn.IsPublishing())
+	}()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:9121")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// C->S handshake C0+C1
+	err = writeHandshakeC0C1(conn)
+	require.NoError(t, err)
+
+	// S->C handshake S0+S1+S2
+	s0s1s2 := make([]byte, 1536*2+1)
+	_, err = io.ReadFull(conn, s0s1s2)
+	require.NoError(t, err)
+
+	// C->S handshake C2
+	err = writeHandshakeC2(conn, s0s1s2)
+	require.NoError(t, err)
+
+	writeCommand := func(vals ...interface{}) {
+		byts := flvio.FillAMF0ValsMalloc(vals)
+		err := chunk0{
+			chunkStreamID: 3,
+			typ:           0x14,
+			bodyLen:       uint32(len(byts)),
+			body:          byts,
+		}.write(conn)
+		require.NoError(t, err)
+	}
+
+	r := newCommandReader(conn)
+	r.handshakeSkipped = true
+
+	readCommand := func() []interface{} {
+		_, vals, err := r.readCommand()
+		require.NoError(t, err)
+		return vals
+	}
+
+	// command sequence sent by encoders that perform a bandwidth check:
+	// the encoder waits for the replies before creating the stream.
+	writeCommand("connect", float64(1), flvio.AMFMap{
+		{K: "app", V: "stream"},
+		{K: "tcUrl", V: "rtmp://127.0.0.1:9121/stream"},
+	})
+	require.Equal(t, "_result", readCommand()[0])
+
+	for i, name := range []string{"checkBandwidth", "_checkbw"} {
+		transID := float64(2 + i)
+		writeCommand(name, transID, nil)
+		require.Equal(t, []interface{}{"_result", transID, nil}, readCommand())
+		require.Equal(t, []interface{}{"onBWDone", float64(0), nil}, readCommand())
+	}
+
+	writeCommand("createStream", float64(4), nil)
+	require.Equal(t, []interface{}{"_result", float64(4), nil, float64(1)}, readCommand())
+
+	writeCommand("publish", float64(5), nil, "mystream", "live")
+
+	<-done
+}
+
+func TestURLWithAppQuery(t *testing.T) {
+	for _, ca := range []struct {
+		name string
+		app  string
+		play string
+		out  string
+	}{
+		{
+			"no app query",
+			"live",
+			"mystream?key=val",
+			"rtmp://127.0.0.1/live/mystream?key=val",
+		},
+		{
+			"app query",
+			"live?authmod=adobe&user=myuser",
+			"mystream",
+			"rtmp://127.0.0.1/live/mystream?authmod=adobe&user=myuser",
+		},
+		{
+			"app and stream query",
+			"live?authmod=adobe&response=ab+c/d==",
+			"mystream?key=val",
+			"rtmp://127.0.0.1/live/mystream?authmod=adobe&response=ab+c/d==&key=val",
+		},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			// URL built by the underlying library
+			u, err := url.ParseRequestURI("/" + ca.app + "/" + ca.play)
+			require.NoError(t, err)
+			u.Scheme = "rtmp"
+			u.Host = "127.0.0.1"
+
+			require.Equal(t, ca.out, urlWithAppQuery(u, ca.app).String())
+		})
+	}
+}
+
+type testWriteRecorder struct {
+	net.Conn
+	written bytes.Buffer
+}
+
+func (r *testWriteRecorder) Write(p []byte) (int, error) {
+	r.written.Write(p)
+	return r.Conn.Write(p)
+}
+
+func TestAcknowledgement(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:9121")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	const (
+		packetCount = 48
+		packetSize  = 64 * 1024
+	)
+
+	recorder := make(chan *testWriteRecorder)
+
+	go func() {
+		conn, err := ln.Accept()
+		require.NoError(t, err)
+		defer conn.Close()
+
+		rec := &testWriteRecorder{Conn: conn}
+
+		rconn := NewServerConn(rec)
+		err = rconn.ServerHandshake()
+		require.NoError(t, err)
+
+		// the client sets the window size before the connect command
+		require.Equal(t, uint32(2500000), rconn.AckWindowSize())
+
+		for i := 0; i < packetCount; i++ {
+			_, err := rconn.ReadPacket()
+			require.NoError(t, err)
+		}
+
+		recorder <- rec
+	}()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:9121")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	rconn := rtmp.NewConn(&bufio.ReadWriter{
+		Reader: bufio.NewReader(conn),
+		Writer: bufio.NewWriter(conn),
+	})
+	rconn.URL, err = url.Parse("rtmp://127.0.0.1:9121/stream")
+	require.NoError(t, err)
+
+	err = rconn.Prepare(rtmp.StageGotPublishOrPlayCommand, rtmp.PrepareWriting)
+	require.NoError(t, err)
+
+	// publish a burst larger than the window size
+	for i := 0; i < packetCount; i++ {
+		err = rconn.WritePacket(av.Packet{
+			Type: av.H264,
+			Data: make([]byte, packetSize),
+		})
+		require.NoError(t, err)
+	}
+	err = rconn.FlushWrite()
+	require.NoError(t, err)
+
+	rec := <-recorder
+
+	r := newCommandReader(&rec.written)
+
+	var acks []uint32
+	for {
+		msgType, msg, err := r.readMessage()
+		if err != nil {
+			break
+		}
+
+		if msgType == 3 {
+			require.Equal(t, 4, len(msg))
+			acks = append(acks, binary.BigEndian.Uint32(msg))
+		}
+	}
+
+	require.Equal(t, 1, len(acks))
+	require.Greater(t, acks[0], uint32(2500000))
+	require.Less(t, acks[0], uint32(packetCount*packetSize))
+}
+
+func TestMaxMessageSize(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:9121")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		conn, err := ln.Accept()
+		require.NoError(t, err)
+		defer conn.Close()
+
+		rconn := NewServerConn(conn)
+		rconn.SetMaxMessageSize(128 * 1024)
+		err = rconn.ServerHandshake()
+		require.NoError(t, err)
+
+		// messages split into multiple chunks are received
+		for i := 0; i < 4; i++ {
+			pkt, err := rconn.ReadPacket()
+			require.NoError(t, err)
+			require.Equal(t, 64*1024, len(pkt.Data))
+		}
+
+		_, err = rconn.ReadPacket()
+		require.Equal(t, ErrMessageTooLarge{Size: 256*1024 + 5, Max: 128 * 1024}, err)
+	}()
+
+	conn, err := net.Dial("tcp", "127.0.0.1:9121")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	rconn := rtmp.NewConn(&bufio.ReadWriter{
+		Reader: bufio.NewReader(conn),
+		Writer: bufio.NewWriter(conn),
+	})
+	rconn.URL, err = url.Parse("rtmp://127.0.0.1:9121/stream")
+	require.NoError(t, err)
+
+	err = rconn.Prepare(rtmp.StageGotPublishOrPlayCommand, rtmp.PrepareWriting)
+	require.NoError(t, err)
+
+	for i := 0; i < 4; i++ {
+		err = rconn.WritePacket(av.Packet{
+			Type: av.H264,
+			Data: make([]byte, 64*1024),
+		})
+		require.NoError(t, err)
+	}
+	err = rconn.FlushWrite()
+	require.NoError(t, err)
+
+	// the connection may be closed by the server while the message is written
+	rconn.WritePacket(av.Packet{
+		Type: av.H264,
+		Data: make([]byte, 256*1024),
+	})
+	rconn.FlushWrite()
+
+	<-done
+}
+
+func TestParseEncoderInfo(t *testing.T) {
+	info, err := ParseEncoderInfo(flvio.FillAMF0ValsMalloc([]interface{}{
+		flvio.AMFMap{
+			{K: "encoder", V: "obs-output module (libobs version 27.2.4)"},
+			{K: "videodatarate", V: float64(2500)},
+			{K: "audiodatarate", V: float64(160)},
+			{K: "framerate", V: float64(30)},
+			{K: "width", V: float64(1920)},
+			{K: "height", V: float64(1080)},
+			{K: "videocodecid", V: float64(codecH264)},
+		},
+	}))
+	require.NoError(t, err)
+	require.Equal(t, &EncoderInfo{
+		Encoder:       "obs-output module (libobs version 27.2.4)",
+		VideoDataRate: 2500,
+		AudioDataRate: 160,
+		FrameRate:     30,
+		Width:         1920,
+		Height:        1080,
+	}, info)
+}
+
 func TestWriteTracks(t *testing.T) {
 	ln, err := net.Listen("tcp", "127.0.0.1:9121")
 	require.NoError(t, err)
@@ -973,8 +1591,13 @@ func TestWriteTracks(t *testing.T) {
 		flvio.AMFMap{
 			{K: "videodatarate", V: float64(0)},
 			{K: "videocodecid", V: float64(7)},
+			{K: "width", V: float64(352)},
+			{K: "height", V: float64(288)},
+			{K: "framerate", V: float64(15)},
 			{K: "audiodatarate", V: float64(0)},
 			{K: "audiocodecid", V: float64(10)},
+			{K: "audiosamplerate", V: float64(44100)},
+			{K: "audiochannels", V: float64(2)},
 		},
 	}, arr)
 
@@ -999,3 +1622,142 @@ func TestWriteTracks(t *testing.T) {
 	require.Equal(t, uint8(0x08), c0.typ)
 	require.Equal(t, []byte{0xae, 0x0, 0x12, 0x10}, c0.body)
 }
+
+func TestMetadataG711(t *testing.T) {
+	pcmaTrack, err := gortsplib.NewTrackGeneric("audio", []string{"8"}, "8 PCMA/8000", "")
+	require.NoError(t, err)
+
+	for _, ca := range []struct {
+		name    string
+		track   gortsplib.Track
+		codecID float64
+	}{
+		{"pcma", pcmaTrack, codecPCMA},
+		{"pcmu", gortsplib.NewTrackPCMU(), codecPCMU},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			md := metadata(nil, ca.track)
+			require.Equal(t, ca.codecID, md.Get("audiocodecid").V)
+			require.Equal(t, float64(8000), md.Get("audiosamplerate").V)
+			require.Equal(t, float64(1), md.Get("audiochannels").V)
+		})
+	}
+}
+
+func TestReadTracksG711(t *testing.T) {
+	for _, ca := range []struct {
+		name    string
+		codecID float64
+	}{
+		{"pcma", codecPCMA},
+		{"pcmu", codecPCMU},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			c := &Conn{}
+			_, _, err := c.readTracksFromMetadata(av.Packet{
+				Type: av.Metadata,
+				Data: flvio.FillAMF0ValsMalloc([]interface{}{flvio.AMFMap{
+					{K: "audiocodecid", V: ca.codecID},
+				}}),
+			})
+			require.EqualError(t, err, fmt.Sprintf("unsupported audio codec %v", ca.codecID))
+		})
+	}
+}
+
+func TestReadTracksH265(t *testing.T) {
+	for _, ca := range []struct {
+		name    string
+		codecID interface{}
+	}{
+		{"codec id", float64(codecH265)},
+		{"fourcc", "hvc1"},
+		{"fourcc hev1", "hev1"},
+		{"fourcc value", fourCCValue(fourCCHEVC)},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			c := &Conn{}
+			_, _, err := c.readTracksFromMetadata(av.Packet{
+				Type: av.Metadata,
+				Data: flvio.FillAMF0ValsMalloc([]interface{}{flvio.AMFMap{
+					{K: "videocodecid", V: ca.codecID},
+				}}),
+			})
+			require.Equal(t, errH265NotSupported, err)
+		})
+	}
+}
+
+func TestReadTracksAV1(t *testing.T) {
+	for _, ca := range []struct {
+		name    string
+		codecID interface{}
+	}{
+		{"fourcc", "av01"},
+		{"fourcc value", fourCCValue(fourCCAV1)},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			c := &Conn{}
+			_, _, err := c.readTracksFromMetadata(av.Packet{
+				Type: av.Metadata,
+				Data: flvio.FillAMF0ValsMalloc([]interface{}{flvio.AMFMap{
+					{K: "videocodecid", V: ca.codecID},
+				}}),
+			})
+			require.Equal(t, errAV1NotSupported, err)
+		})
+	}
+}
+
+func TestParseDataMessage(t *testing.T) {
+	cuePoint := flvio.AMFMap{
+		{K: "name", V: "ad"},
+		{K: "time", V: float64(10)},
+	}
+
+	for _, ca := range []struct {
+		name string
+		tag  flvio.Tag
+		ok   bool
+	}{
+		{
+			"cue point",
+			flvio.Tag{
+				Type: flvio.TAG_AMF0,
+				Data: flvio.FillAMF0ValsMalloc([]interface{}{"onCuePoint", cuePoint}),
+			},
+			true,
+		},
+		{
+			"set data frame",
+			flvio.Tag{
+				Type: flvio.TAG_AMF0,
+				Data: flvio.FillAMF0ValsMalloc([]interface{}{"@setDataFrame", "onCuePoint", cuePoint}),
+			},
+			true,
+		},
+		{
+			"metadata",
+			flvio.Tag{
+				Type: flvio.TAG_AMF0,
+				Data: flvio.FillAMF0ValsMalloc([]interface{}{"@setDataFrame", "onMetaData", flvio.AMFMap{}}),
+			},
+			false,
+		},
+		{
+			"video",
+			flvio.Tag{
+				Type: flvio.TAG_VIDEO,
+			},
+			false,
+		},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			data, ok := parseDataMessage(ca.tag)
+			require.Equal(t, ca.ok, ok)
+			if ok {
+				require.Equal(t, flvio.FillAMF0ValsMalloc([]interface{}{"onCuePoint", cuePoint}), data)
+			}
+		})
+	}
+}
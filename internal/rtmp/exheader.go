@@ -0,0 +1,113 @@
+package rtmp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/aler9/gortsplib"
+	"github.com/notedit/rtmp/av"
+	"github.com/notedit/rtmp/format/flv/flvio"
+)
+
+// enhanced RTMP (https://github.com/veovera/enhanced-rtmp) allows to send
+// codecs that are not supported by the legacy FLV format, by replacing
+// the codec ID of tags with a FourCC.
+const (
+	// sound format of the audio tags that contain an ExAudioHeader.
+	soundFormatExHeader = 9
+
+	audioPacketTypeSequenceStart = 0
+	audioPacketTypeCodedFrames   = 1
+
+	// bit of the frame type of the video tags that contain an ExVideoHeader.
+	frameTypeExHeader = 0x08
+)
+
+var (
+	fourCCOpus = [4]byte{'O', 'p', 'u', 's'}
+	fourCCHEVC = [4]byte{'h', 'v', 'c', '1'}
+	fourCCAV1  = [4]byte{'a', 'v', '0', '1'}
+)
+
+// fourCCValue returns the numeric value of a FourCC, that is used
+// in metadata by some publishers instead of the string.
+func fourCCValue(fourCC [4]byte) float64 {
+	return float64(binary.BigEndian.Uint32(fourCC[:]))
+}
+
+// PacketOpusHead is the packet type of the Opus sequence start sent by
+// publishers that use enhanced RTMP, that is returned by ReadPacket.
+// The data of the packet contains the Opus identification header (OpusHead).
+const PacketOpusHead = 201
+
+// parseExAudio converts an audio tag that contains an ExAudioHeader into a packet.
+// It returns false when the tag doesn't contain an ExAudioHeader, or when
+// its codec or its packet type is not supported.
+func parseExAudio(tag flvio.Tag) (av.Packet, bool) {
+	if tag.Type != flvio.TAG_AUDIO || tag.SoundFormat != soundFormatExHeader || len(tag.Data) < 4 {
+		return av.Packet{}, false
+	}
+
+	// the packet type replaces the sound rate, size and type.
+	packetType := tag.SoundRate<<2 | tag.SoundSize<<1 | tag.SoundType
+
+	var fourCC [4]byte
+	copy(fourCC[:], tag.Data)
+	if fourCC != fourCCOpus {
+		return av.Packet{}, false
+	}
+
+	switch packetType {
+	case audioPacketTypeSequenceStart:
+		return av.Packet{
+			Type: PacketOpusHead,
+			Data: tag.Data[4:],
+		}, true
+
+	case audioPacketTypeCodedFrames:
+		return av.Packet{
+			Type: av.OPUS,
+			Data: tag.Data[4:],
+			Time: flvio.TsToTime(int64(tag.Time)),
+		}, true
+	}
+
+	return av.Packet{}, false
+}
+
+// checkExVideo returns an error when a video tag contains an ExVideoHeader,
+// since none of the video codecs that can be sent with it is supported yet.
+func checkExVideo(tag flvio.Tag) error {
+	if tag.Type != flvio.TAG_VIDEO || tag.FrameType&frameTypeExHeader == 0 || len(tag.Data) < 4 {
+		return nil
+	}
+
+	var fourCC [4]byte
+	copy(fourCC[:], tag.Data)
+
+	switch fourCC {
+	case fourCCHEVC:
+		return errH265NotSupported
+
+	case fourCCAV1:
+		return errAV1NotSupported
+	}
+
+	return fmt.Errorf("unsupported video codec %q", fourCC[:])
+}
+
+// trackFromOpusHead creates an Opus track from an Opus identification header.
+func trackFromOpusHead(byts []byte) (*gortsplib.TrackOpus, error) {
+	if len(byts) < 19 || !bytes.Equal(byts[:8], []byte("OpusHead")) {
+		return nil, fmt.Errorf("invalid Opus identification header")
+	}
+
+	channelCount := int(byts[9])
+	if channelCount != 1 && channelCount != 2 {
+		return nil, fmt.Errorf("unsupported Opus channel count: %d", channelCount)
+	}
+
+	// the RTP clock rate of Opus is always 48kHz.
+	return gortsplib.NewTrackOpus(97, 48000, channelCount)
+}
@@ -0,0 +1,161 @@
+package rtmp
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aler9/gortsplib"
+	"github.com/notedit/rtmp/av"
+	"github.com/notedit/rtmp/format/flv/flvio"
+	"github.com/stretchr/testify/require"
+)
+
+var testOpusHead = []byte{
+	'O', 'p', 'u', 's', 'H', 'e', 'a', 'd',
+	0x01, 0x01, 0x38, 0x01, 0x80, 0xbb, 0x00, 0x00,
+	0x00, 0x00, 0x00,
+}
+
+func TestParseExAudio(t *testing.T) {
+	for _, ca := range []struct {
+		name string
+		tag  flvio.Tag
+		pkt  av.Packet
+		ok   bool
+	}{
+		{
+			"opus sequence start",
+			flvio.Tag{
+				Type:        flvio.TAG_AUDIO,
+				SoundFormat: soundFormatExHeader,
+				Data:        append([]byte("Opus"), testOpusHead...),
+			},
+			av.Packet{
+				Type: PacketOpusHead,
+				Data: testOpusHead,
+			},
+			true,
+		},
+		{
+			"opus coded frames",
+			flvio.Tag{
+				Type:        flvio.TAG_AUDIO,
+				SoundFormat: soundFormatExHeader,
+				SoundType:   audioPacketTypeCodedFrames,
+				Time:        40,
+				Data:        []byte{'O', 'p', 'u', 's', 0x01, 0x02},
+			},
+			av.Packet{
+				Type: av.OPUS,
+				Data: []byte{0x01, 0x02},
+				Time: 40 * time.Millisecond,
+			},
+			true,
+		},
+		{
+			"unsupported codec",
+			flvio.Tag{
+				Type:        flvio.TAG_AUDIO,
+				SoundFormat: soundFormatExHeader,
+				SoundType:   audioPacketTypeCodedFrames,
+				Data:        []byte{'f', 'L', 'a', 'C', 0x01, 0x02},
+			},
+			av.Packet{},
+			false,
+		},
+		{
+			"unsupported packet type",
+			flvio.Tag{
+				Type:        flvio.TAG_AUDIO,
+				SoundFormat: soundFormatExHeader,
+				SoundSize:   1, // sequence end
+				Data:        []byte("Opus"),
+			},
+			av.Packet{},
+			false,
+		},
+		{
+			"legacy",
+			flvio.Tag{
+				Type:        flvio.TAG_AUDIO,
+				SoundFormat: codecOpus,
+				Data:        []byte{0x01, 0x02},
+			},
+			av.Packet{},
+			false,
+		},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			pkt, ok := parseExAudio(ca.tag)
+			require.Equal(t, ca.ok, ok)
+			require.Equal(t, ca.pkt, pkt)
+		})
+	}
+}
+
+func TestTrackFromOpusHead(t *testing.T) {
+	track, err := trackFromOpusHead(testOpusHead)
+	require.NoError(t, err)
+
+	track2, err := gortsplib.NewTrackOpus(97, 48000, 1)
+	require.NoError(t, err)
+	require.Equal(t, track2, track)
+
+	_, err = trackFromOpusHead([]byte("OpusTags"))
+	require.Error(t, err)
+}
+
+func TestFourCCValue(t *testing.T) {
+	require.Equal(t, float64(0x4F707573), fourCCValue(fourCCOpus))
+}
+
+func TestCheckExVideo(t *testing.T) {
+	for _, ca := range []struct {
+		name string
+		tag  flvio.Tag
+		err  error
+	}{
+		{
+			"hevc",
+			flvio.Tag{
+				Type:      flvio.TAG_VIDEO,
+				FrameType: frameTypeExHeader | flvio.FRAME_KEY,
+				Data:      []byte{'h', 'v', 'c', '1', 0x01, 0x02},
+			},
+			errH265NotSupported,
+		},
+		{
+			"av1",
+			flvio.Tag{
+				Type:      flvio.TAG_VIDEO,
+				FrameType: frameTypeExHeader | flvio.FRAME_KEY,
+				Data:      []byte{'a', 'v', '0', '1', 0x01, 0x02},
+			},
+			errAV1NotSupported,
+		},
+		{
+			"unsupported codec",
+			flvio.Tag{
+				Type:      flvio.TAG_VIDEO,
+				FrameType: frameTypeExHeader | flvio.FRAME_KEY,
+				Data:      []byte{'v', 'p', '0', '9', 0x01, 0x02},
+			},
+			fmt.Errorf("unsupported video codec \"vp09\""),
+		},
+		{
+			"legacy",
+			flvio.Tag{
+				Type:        flvio.TAG_VIDEO,
+				FrameType:   flvio.FRAME_KEY,
+				VideoFormat: flvio.VIDEO_H264,
+				Data:        []byte{'h', 'v', 'c', '1', 0x01, 0x02},
+			},
+			nil,
+		},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			require.Equal(t, ca.err, checkExVideo(ca.tag))
+		})
+	}
+}
@@ -9,15 +9,28 @@ import (
 
 // NewServerConn initializes a server-side connection.
 func NewServerConn(nconn net.Conn) *Conn {
+	t := newTee()
+
+	lc := &sizeLimitConn{Conn: nconn}
+	tc := &teeConn{Conn: lc, tee: t}
+	tw := &traceWriter{w: nconn}
+
 	// https://github.com/aler9/rtmp/blob/master/format/rtmp/server.go#L46
+	br := bufio.NewReaderSize(tc, readBufferSize)
 	c := rtmp.NewConn(&bufio.ReadWriter{
-		Reader: bufio.NewReaderSize(nconn, readBufferSize),
-		Writer: bufio.NewWriterSize(nconn, writeBufferSize),
+		Reader: br,
+		Writer: bufio.NewWriterSize(tw, writeBufferSize),
 	})
 	c.IsServer = true
 
 	return &Conn{
-		rconn: c,
-		nconn: nconn,
+		rconn:         c,
+		nconn:         nconn,
+		lc:            lc,
+		br:            br,
+		tee:           t,
+		tc:            tc,
+		tw:            tw,
+		commandReader: newCommandReader(t),
 	}
 }
@@ -0,0 +1,109 @@
+package rtmp
+
+import (
+	"bufio"
+	"net"
+)
+
+// recordingReader is a byteReader that stores the bytes that have been read.
+type recordingReader struct {
+	r   *bufio.Reader
+	buf []byte
+}
+
+// Read implements io.Reader.
+func (r *recordingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.buf = append(r.buf, p[:n]...)
+	return n, err
+}
+
+// ReadByte implements io.ByteReader.
+func (r *recordingReader) ReadByte() (byte, error) {
+	b, err := r.r.ReadByte()
+	if err == nil {
+		r.buf = append(r.buf, b)
+	}
+	return b, err
+}
+
+// take returns the stored bytes and stops storing them.
+func (r *recordingReader) take() []byte {
+	buf := r.buf
+	r.buf = nil
+	return buf
+}
+
+// sizeLimitConn is a net.Conn that checks the size of the messages received
+// from the remote peer before passing them to the underlying library,
+// that allocates a message as soon as its header is received.
+// Bytes are passed to the library one chunk at a time, after the chunk
+// header has been checked.
+type sizeLimitConn struct {
+	net.Conn
+
+	// it must be set before the first read; 0 means that messages
+	// are not checked.
+	maxMessageSize uint32
+
+	initialized   bool
+	br            *bufio.Reader
+	rec           *recordingReader
+	cr            *commandReader
+	handshakeLeft int
+	pending       []byte
+	err           error
+}
+
+// Read implements net.Conn.
+func (c *sizeLimitConn) Read(p []byte) (int, error) {
+	if !c.initialized {
+		c.initialized = true
+
+		if c.maxMessageSize != 0 {
+			c.br = bufio.NewReaderSize(c.Conn, readBufferSize)
+			c.rec = &recordingReader{r: c.br}
+			c.cr = newCommandReader(c.rec)
+			c.cr.maxMessageSize = c.maxMessageSize
+			c.cr.skip = func(uint8) bool { return true }
+			c.handshakeLeft = handshakeLength
+		}
+	}
+
+	if c.cr == nil {
+		return c.Conn.Read(p)
+	}
+
+	if len(c.pending) == 0 {
+		if c.err != nil {
+			return 0, c.err
+		}
+
+		// the handshake is passed through as it is received,
+		// since the remote peer waits for a reply before completing it.
+		if c.handshakeLeft > 0 {
+			if len(p) > c.handshakeLeft {
+				p = p[:c.handshakeLeft]
+			}
+			n, err := c.br.Read(p)
+			c.handshakeLeft -= n
+			return n, err
+		}
+
+		_, _, _, err := c.cr.readChunk()
+		c.pending = c.rec.take()
+
+		// bytes of the chunk are discarded, since they may contain the header
+		// of a message that is too large. The parser state can't be recovered,
+		// therefore the error is returned by all following reads.
+		if err != nil {
+			c.pending = nil
+			c.err = err
+			return 0, err
+		}
+	}
+
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
@@ -0,0 +1,232 @@
+package rtmp
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/notedit/rtmp/format/flv/flvio"
+)
+
+const (
+	msgTypeAbort            = 2
+	msgTypeAcknowledgement  = 3
+	msgTypeSetPeerBandwidth = 6
+	msgTypeAudio            = 8
+	msgTypeVideo            = 9
+	msgTypeDataAMF3         = 15
+	msgTypeDataAMF0         = 18
+)
+
+// maximum size of traced messages, that is the one of the underlying library,
+// since audio and video messages, that are the biggest ones, are not stored.
+const traceMaxMessageSize = 4 * 1024 * 1024
+
+// passwords are removed from traced messages.
+var tracePassRegexp = regexp.MustCompile(`pass=[^&"\s]*`)
+
+// traceWriter is a io.Writer that copies written bytes into a tee,
+// when tracing is enabled.
+// Writes are serialized, since replies to some commands are written
+// by a separate routine while the underlying library is writing.
+type traceWriter struct {
+	w     io.Writer
+	trace *tee
+	mutex sync.Mutex
+}
+
+// Write implements io.Writer.
+func (w *traceWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	n, err := w.w.Write(p)
+	if w.trace != nil {
+		if n > 0 {
+			w.trace.write(p[:n])
+		}
+		if err != nil {
+			w.trace.close(err)
+		}
+	}
+	return n, err
+}
+
+// Trace enables the tracing of the control and command messages exchanged
+// with the remote peer. It must be called before the handshake.
+// cb is called from separate routines, with the direction of the message
+// and its description, until the connection is closed.
+func (c *Conn) Trace(cb func(received bool, description string)) {
+	if c.tc == nil {
+		return
+	}
+
+	c.tc.trace = newTee()
+	c.tw.trace = newTee()
+
+	c.traceWG.Add(2)
+	go traceMessages(&c.traceWG, c.tc.trace, func(description string) {
+		cb(true, description)
+	})
+	go traceMessages(&c.traceWG, c.tw.trace, func(description string) {
+		cb(false, description)
+	})
+}
+
+func (c *Conn) closeTrace() {
+	if c.tc != nil && c.tc.trace != nil {
+		c.tc.trace.close(errors.New("terminated"))
+		c.tw.trace.close(errors.New("terminated"))
+		c.traceWG.Wait()
+	}
+}
+
+func traceMessages(wg *sync.WaitGroup, t *tee, cb func(string)) {
+	defer wg.Done()
+
+	// when the parser exits, received bytes must not be stored anymore.
+	defer t.disable()
+
+	// audio and video messages are not described, therefore
+	// they are not stored.
+	r := newCommandReader(t)
+	r.maxMessageSize = traceMaxMessageSize
+	r.skip = func(msgType uint8) bool {
+		return msgType == msgTypeAudio || msgType == msgTypeVideo
+	}
+
+	for {
+		msgType, msg, err := r.readMessage()
+		if err != nil {
+			return
+		}
+
+		description, ok := describeMessage(msgType, msg)
+		if ok {
+			cb(tracePassRegexp.ReplaceAllString(description, "pass=***"))
+		}
+	}
+}
+
+func userControlEventName(typ uint16) string {
+	switch typ {
+	case 0:
+		return "stream begin"
+	case 1:
+		return "stream EOF"
+	case 2:
+		return "stream dry"
+	case 3:
+		return "set buffer length"
+	case 4:
+		return "stream is recorded"
+	case 6:
+		return "ping request"
+	case 7:
+		return "ping response"
+	}
+	return "event " + strconv.FormatUint(uint64(typ), 10)
+}
+
+// describeMessage returns a description of a control, command or data message.
+// Audio and video messages are not described.
+func describeMessage(msgType uint8, msg []byte) (string, bool) {
+	switch msgType {
+	case msgTypeAudio, msgTypeVideo:
+		return "", false
+
+	case msgTypeSetChunkSize, msgTypeAbort, msgTypeAcknowledgement, msgTypeWindowAckSize, msgTypeSetPeerBandwidth:
+		if len(msg) < 4 {
+			break
+		}
+		v := binary.BigEndian.Uint32(msg)
+
+		switch msgType {
+		case msgTypeSetChunkSize:
+			return fmt.Sprintf("set chunk size %d", v&0x7FFFFFFF), true
+		case msgTypeAbort:
+			return fmt.Sprintf("abort (chunk stream %d)", v), true
+		case msgTypeAcknowledgement:
+			return fmt.Sprintf("acknowledgement %d", v), true
+		case msgTypeWindowAckSize:
+			return fmt.Sprintf("window acknowledgement size %d", v), true
+		default:
+			return fmt.Sprintf("set peer bandwidth %d", v), true
+		}
+
+	case msgTypeUserControl:
+		if len(msg) < 2 {
+			break
+		}
+		return "user control (" + userControlEventName(binary.BigEndian.Uint16(msg)) + ")", true
+
+	case msgTypeCommandAMF0, msgTypeCommandAMF3, msgTypeDataAMF0, msgTypeDataAMF3:
+		kind := "command"
+		if msgType == msgTypeDataAMF0 || msgType == msgTypeDataAMF3 {
+			kind = "data"
+		}
+
+		// AMF3 messages are AMF0 messages with a leading byte
+		if msgType == msgTypeCommandAMF3 || msgType == msgTypeDataAMF3 {
+			if len(msg) == 0 {
+				break
+			}
+			msg = msg[1:]
+		}
+
+		vals, err := flvio.ParseAMFVals(msg, false)
+		if err != nil || len(vals) == 0 {
+			break
+		}
+
+		parts := make([]string, len(vals))
+		for i, v := range vals {
+			parts[i] = formatAMF(v)
+		}
+		return kind + " " + strings.Join(parts, " "), true
+	}
+
+	return fmt.Sprintf("message type %d (%d bytes)", msgType, len(msg)), true
+}
+
+// formatAMF returns a compact description of an AMF value.
+func formatAMF(v interface{}) string {
+	switch tv := v.(type) {
+	case nil:
+		return "null"
+
+	case string:
+		return strconv.Quote(tv)
+
+	case float64:
+		return strconv.FormatFloat(tv, 'f', -1, 64)
+
+	case flvio.AMFMap:
+		return formatAMFMap(tv)
+
+	case flvio.AMFECMAArray:
+		return formatAMFMap(flvio.AMFMap(tv))
+
+	case flvio.AMFArray:
+		parts := make([]string, len(tv))
+		for i, e := range tv {
+			parts[i] = formatAMF(e)
+		}
+		return "[" + strings.Join(parts, ", ") + "]"
+	}
+
+	return fmt.Sprintf("%v", v)
+}
+
+func formatAMFMap(m flvio.AMFMap) string {
+	parts := make([]string, len(m))
+	for i, kv := range m {
+		parts[i] = kv.K + ": " + formatAMF(kv.V)
+	}
+	return "{" + strings.Join(parts, ", ") + "}"
+}
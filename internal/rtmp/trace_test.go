@@ -0,0 +1,141 @@
+package rtmp
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+
+	"github.com/notedit/rtmp/format/flv/flvio"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDescribeMessage(t *testing.T) {
+	for _, ca := range []struct {
+		name        string
+		msgType     uint8
+		msg         []byte
+		description string
+	}{
+		{
+			"set chunk size",
+			msgTypeSetChunkSize,
+			[]byte{0x00, 0x01, 0x00, 0x00},
+			"set chunk size 65536",
+		},
+		{
+			"window acknowledgement size",
+			msgTypeWindowAckSize,
+			[]byte{0x00, 0x26, 0x25, 0xa0},
+			"window acknowledgement size 2500000",
+		},
+		{
+			"user control",
+			msgTypeUserControl,
+			[]byte{0x00, 0x03, 0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x0b, 0xb8},
+			"user control (set buffer length)",
+		},
+		{
+			"command",
+			msgTypeCommandAMF0,
+			flvio.FillAMF0ValsMalloc([]interface{}{
+				"connect",
+				float64(1),
+				flvio.AMFMap{
+					{K: "app", V: "live"},
+					{K: "tcUrl", V: "rtmp://127.0.0.1/live"},
+				},
+			}),
+			`command "connect" 1 {app: "live", tcUrl: "rtmp://127.0.0.1/live"}`,
+		},
+		{
+			"command with null",
+			msgTypeCommandAMF0,
+			flvio.FillAMF0ValsMalloc([]interface{}{
+				"publish",
+				float64(5),
+				nil,
+				"mystream",
+				"live",
+			}),
+			`command "publish" 5 null "mystream" "live"`,
+		},
+		{
+			"unknown",
+			22,
+			[]byte{0x01, 0x02},
+			"message type 22 (2 bytes)",
+		},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			description, ok := describeMessage(ca.msgType, ca.msg)
+			require.Equal(t, true, ok)
+			require.Equal(t, ca.description, description)
+		})
+	}
+
+	_, ok := describeMessage(msgTypeVideo, []byte{0x17, 0x01})
+	require.Equal(t, false, ok)
+}
+
+func TestTraceMessages(t *testing.T) {
+	chunk := func(msgType uint8, payload []byte) []byte {
+		buf := []byte{
+			0x03,
+			0x00, 0x00, 0x00,
+			byte(len(payload) >> 16), byte(len(payload) >> 8), byte(len(payload)),
+			msgType,
+			0x00, 0x00, 0x00, 0x00,
+		}
+		return append(buf, payload...)
+	}
+
+	tr := newTee()
+	tr.write(make([]byte, handshakeLength))
+	tr.write(chunk(msgTypeSetChunkSize, []byte{0x00, 0x40, 0x00, 0x00}))
+
+	// media messages are skipped
+	tr.write(chunk(msgTypeVideo, make([]byte, 2*1024*1024)))
+	tr.write(chunk(msgTypeCommandAMF0, flvio.FillAMF0ValsMalloc([]interface{}{"deleteStream", float64(4)})))
+
+	var wg sync.WaitGroup
+	descriptions := make(chan string, 10)
+	wg.Add(1)
+	go traceMessages(&wg, tr, func(description string) {
+		descriptions <- description
+	})
+
+	require.Equal(t, "set chunk size 4194304", <-descriptions)
+	require.Equal(t, `command "deleteStream" 4`, <-descriptions)
+
+	// the parser exits when a message can't be parsed, and bytes are not stored anymore
+	tr.write(chunk(msgTypeDataAMF0, make([]byte, traceMaxMessageSize+1)))
+	wg.Wait()
+
+	tr.write([]byte{0x01, 0x02})
+	require.Equal(t, 0, len(tr.bytes()))
+}
+
+func TestTraceWriterConcurrentWrites(t *testing.T) {
+	var buf bytes.Buffer
+	w := &traceWriter{w: &buf}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func(b byte) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				_, err := w.Write(bytes.Repeat([]byte{b}, 10))
+				require.NoError(t, err)
+			}
+		}(byte(i))
+	}
+	wg.Wait()
+
+	// writes are not interleaved
+	out := buf.Bytes()
+	require.Equal(t, 2*100*10, len(out))
+	for i := 0; i < len(out); i += 10 {
+		require.Equal(t, bytes.Repeat(out[i:i+1], 10), out[i:i+10])
+	}
+}
@@ -0,0 +1,32 @@
+package rtpopus
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aler9/gortsplib/pkg/rtptimedec"
+	"github.com/pion/rtp"
+)
+
+// Decoder is a RTP/Opus decoder.
+type Decoder struct {
+	// sample rate of input packets.
+	SampleRate int
+
+	timeDecoder *rtptimedec.Decoder
+}
+
+// Init initializes the decoder.
+func (d *Decoder) Init() {
+	d.timeDecoder = rtptimedec.New(d.SampleRate)
+}
+
+// Decode decodes an Opus packet from a RTP/Opus packet.
+// It returns the Opus packet and its PTS.
+func (d *Decoder) Decode(pkt *rtp.Packet) ([]byte, time.Duration, error) {
+	if len(pkt.Payload) == 0 {
+		return nil, 0, fmt.Errorf("payload is empty")
+	}
+
+	return pkt.Payload, d.timeDecoder.Decode(pkt.Timestamp), nil
+}
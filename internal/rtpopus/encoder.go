@@ -0,0 +1,76 @@
+package rtpopus
+
+import (
+	"crypto/rand"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+func randUint32() uint32 {
+	var b [4]byte
+	rand.Read(b[:])
+	return uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+}
+
+// Encoder is a RTP/Opus encoder.
+// Each Opus packet is put into a dedicated RTP packet, as described in RFC7587.
+type Encoder struct {
+	// payload type of packets.
+	PayloadType uint8
+
+	// sample rate of packets.
+	SampleRate int
+
+	// SSRC of packets (optional).
+	SSRC *uint32
+
+	// initial sequence number of packets (optional).
+	InitialSequenceNumber *uint16
+
+	// initial timestamp of packets (optional).
+	InitialTimestamp *uint32
+
+	sequenceNumber uint16
+}
+
+// Init initializes the encoder.
+func (e *Encoder) Init() {
+	if e.SSRC == nil {
+		v := randUint32()
+		e.SSRC = &v
+	}
+	if e.InitialSequenceNumber == nil {
+		v := uint16(randUint32())
+		e.InitialSequenceNumber = &v
+	}
+	if e.InitialTimestamp == nil {
+		v := randUint32()
+		e.InitialTimestamp = &v
+	}
+
+	e.sequenceNumber = *e.InitialSequenceNumber
+}
+
+func (e *Encoder) encodeTimestamp(ts time.Duration) uint32 {
+	return *e.InitialTimestamp + uint32(ts.Seconds()*float64(e.SampleRate))
+}
+
+// Encode encodes an Opus packet into a RTP/Opus packet.
+func (e *Encoder) Encode(frame []byte, pts time.Duration) (*rtp.Packet, error) {
+	pkt := &rtp.Packet{
+		Header: rtp.Header{
+			Version:        rtpVersion,
+			PayloadType:    e.PayloadType,
+			SequenceNumber: e.sequenceNumber,
+			Timestamp:      e.encodeTimestamp(pts),
+			SSRC:           *e.SSRC,
+			Marker:         true,
+		},
+		Payload: frame,
+	}
+
+	e.sequenceNumber++
+
+	return pkt, nil
+}
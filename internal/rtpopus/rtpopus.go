@@ -0,0 +1,6 @@
+// Package rtpopus contains a RTP/Opus decoder and encoder.
+package rtpopus
+
+const (
+	rtpVersion = 0x02
+)
@@ -0,0 +1,80 @@
+package rtpopus
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncode(t *testing.T) {
+	e := &Encoder{
+		PayloadType: 96,
+		SampleRate:  48000,
+		SSRC: func() *uint32 {
+			v := uint32(0x9dbb7812)
+			return &v
+		}(),
+		InitialSequenceNumber: func() *uint16 {
+			v := uint16(0x44ed)
+			return &v
+		}(),
+		InitialTimestamp: func() *uint32 {
+			v := uint32(0x88776655)
+			return &v
+		}(),
+	}
+	e.Init()
+
+	pkt, err := e.Encode([]byte{0x01, 0x02, 0x03, 0x04}, 20*time.Millisecond)
+	require.NoError(t, err)
+	require.Equal(t, &rtp.Packet{
+		Header: rtp.Header{
+			Version:        2,
+			Marker:         true,
+			PayloadType:    96,
+			SequenceNumber: 0x44ed,
+			Timestamp:      0x88776655 + 960,
+			SSRC:           0x9dbb7812,
+		},
+		Payload: []byte{0x01, 0x02, 0x03, 0x04},
+	}, pkt)
+
+	pkt, err = e.Encode([]byte{0x05, 0x06}, 40*time.Millisecond)
+	require.NoError(t, err)
+	require.Equal(t, uint16(0x44ee), pkt.SequenceNumber)
+	require.Equal(t, uint32(0x88776655+1920), pkt.Timestamp)
+}
+
+func TestDecode(t *testing.T) {
+	d := &Decoder{SampleRate: 48000}
+	d.Init()
+
+	frame, pts, err := d.Decode(&rtp.Packet{
+		Header: rtp.Header{
+			Version:   2,
+			Marker:    true,
+			Timestamp: 0x88776655,
+		},
+		Payload: []byte{0x01, 0x02, 0x03, 0x04},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x01, 0x02, 0x03, 0x04}, frame)
+	require.Equal(t, time.Duration(0), pts)
+
+	frame, pts, err = d.Decode(&rtp.Packet{
+		Header: rtp.Header{
+			Version:   2,
+			Marker:    true,
+			Timestamp: 0x88776655 + 960,
+		},
+		Payload: []byte{0x05, 0x06},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x05, 0x06}, frame)
+	require.Equal(t, 20*time.Millisecond, pts)
+
+	_, _, err = d.Decode(&rtp.Packet{})
+	require.Error(t, err)
+}